@@ -0,0 +1,59 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFdsStart is SD_LISTEN_FDS_START, the first fd passed by
+// systemd.
+const listenFdsStart = 3
+
+// ErrNotActivated is returned by ActivationListener if the process
+// was not started through systemd socket activation.
+var ErrNotActivated = errors.New("sshctl: not socket activated")
+
+// ActivationListener returns the control socket passed by systemd
+// socket activation, see sd_listen_fds(3), so a MasterServer can be
+// started on demand when the first client connects. The socket unit
+// must have a single ListenStream= on a unix socket path. The
+// LISTEN_* variables are removed from the environment, so children
+// do not take the socket as well. Closing the listener leaves the
+// socket file in place, as it belongs to systemd.
+func ActivationListener() (*net.UnixListener, error) {
+	return activationListener(listenFdsStart)
+}
+
+func activationListener(start int) (*net.UnixListener, error) {
+	pid, nfds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || nfds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, ErrNotActivated
+	}
+	if n, err := strconv.Atoi(nfds); err != nil || n != 1 {
+		return nil, fmt.Errorf("sshctl: expected one activation socket, got LISTEN_FDS=%s", nfds)
+	}
+	syscall.CloseOnExec(start)
+	f := os.NewFile(uintptr(start), "LISTEN_FD_"+strconv.Itoa(start))
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("sshctl: activation socket: %w", err)
+	}
+	ul, ok := l.(*net.UnixListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("sshctl: activation socket is not a unix socket but %s", l.Addr().Network())
+	}
+	return ul, nil
+}
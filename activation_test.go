@@ -0,0 +1,68 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestActivationListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctrl.sock")
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+	f, err := ul.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a bare fd, like the one systemd passes, owned by the listener
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := activationListener(fd); err != ErrNotActivated {
+		t.Fatalf("expected ErrNotActivated for another pid, got %v", err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "ctrl")
+	l, err := activationListener(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(v); ok {
+			t.Fatalf("expected %s to be unset", v)
+		}
+	}
+
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	m := NewMasterServer(g.client)
+	defer m.Close()
+	go m.Serve(l)
+	if out, err := NewClient(path).NewSession().Output("echo hi"); err != nil || string(out) != "hi\n" {
+		t.Fatalf("expected hi, got %q (%v)", out, err)
+	}
+	m.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the socket to stay, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FileTransfer is one file of a TransferBatch.
+type FileTransfer struct {
+	// Download copies Remote to Local; otherwise Local is uploaded
+	// to Remote.
+	Download bool
+
+	Local  string
+	Remote string
+}
+
+// FileTransferResult reports the outcome of one FileTransfer.
+type FileTransferResult struct {
+	FileTransfer
+	Err      error
+	Duration time.Duration
+}
+
+// BatchOptions control TransferBatch. Options is passed to each
+// UploadFile or DownloadFile and may be nil; its Progress, if set,
+// receives the updates of concurrent transfers.
+type BatchOptions struct {
+	Options *TransferOptions
+
+	// Workers is the number of files transferred at once. If zero,
+	// 8 is used.
+	Workers int
+
+	// Clients, if non-empty, are used in turn by the workers
+	// instead of the Client of TransferBatch, e.g. several masters
+	// to the same host, to spread the transfers over more than one
+	// connection.
+	Clients []*Client
+}
+
+// TransferBatch copies many files through a pool of workers, each
+// running one UploadFile or DownloadFile at a time as its own
+// session on the master. This hides the latency of the per-file
+// round trips, which dominates transfers of many small files. opts
+// may be nil.
+//
+// The results are in the order of transfers; a file failed if its Err
+// is non-nil. Once ctx is done, no further files are started and
+// those left report ctx.Err(); transfers already running complete.
+func (c *Client) TransferBatch(ctx context.Context, transfers []FileTransfer, opts *BatchOptions) []FileTransferResult {
+	if opts == nil {
+		opts = &BatchOptions{}
+	}
+	clients := opts.Clients
+	if len(clients) == 0 {
+		clients = []*Client{c}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 8
+	}
+
+	results := make([]FileTransferResult, len(transfers))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(transfers); w++ {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			for i := range next {
+				res := &results[i]
+				start := time.Now()
+				if res.Download {
+					res.Err = client.DownloadFile(res.Remote, res.Local, opts.Options)
+				} else {
+					res.Err = client.UploadFile(res.Local, res.Remote, opts.Options)
+				}
+				res.Duration = time.Since(start)
+			}
+		}(clients[w%len(clients)])
+	}
+	i := 0
+feed:
+	for ; i < len(transfers) && ctx.Err() == nil; i++ {
+		results[i].FileTransfer = transfers[i]
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	for ; i < len(transfers); i++ {
+		results[i].FileTransfer = transfers[i]
+		results[i].Err = ctx.Err()
+	}
+	wg.Wait()
+	return results
+}
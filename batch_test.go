@@ -0,0 +1,64 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransferBatch(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	dir := t.TempDir()
+	var ups, downs []FileTransfer
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%d", i)
+		local := filepath.Join(dir, name)
+		if err := os.WriteFile(local, []byte(TestString+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		remote := filepath.Join(dir, "remote-"+name)
+		ups = append(ups, FileTransfer{Local: local, Remote: remote})
+		downs = append(downs, FileTransfer{Download: true, Local: local + ".back", Remote: remote})
+	}
+	ups = append(ups, FileTransfer{Local: filepath.Join(dir, "missing"), Remote: filepath.Join(dir, "x")})
+
+	res := c.TransferBatch(context.Background(), ups, &BatchOptions{Workers: 4, Clients: []*Client{c, NewClient(g.ctrlSock)}})
+	for i, r := range res[:20] {
+		if r.FileTransfer != ups[i] || r.Err != nil {
+			t.Fatalf("upload %d: %+v", i, r)
+		}
+	}
+	if !errors.Is(res[20].Err, os.ErrNotExist) {
+		t.Fatalf("expected upload of a missing file to fail, got %v", res[20].Err)
+	}
+
+	for i, r := range c.TransferBatch(context.Background(), downs, nil) {
+		if r.Err != nil {
+			t.Fatalf("download %d: %v", i, r.Err)
+		}
+		got, err := os.ReadFile(r.Local)
+		if want := TestString + fmt.Sprintf("f%d", i); err != nil || string(got) != want {
+			t.Fatalf("download %d: got %q, %v", i, got, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range c.TransferBatch(ctx, ups, nil) {
+		if r.Err != context.Canceled {
+			t.Fatalf("expected canceled transfers, got %v", r.Err)
+		}
+	}
+}
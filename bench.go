@@ -0,0 +1,175 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// BenchOptions control Bench and BenchEcho. Zero values select the
+// defaults.
+type BenchOptions struct {
+	Size      int64 // bytes sent, default 16 MiB
+	ChunkSize int   // default 32 KiB
+	Window    int   // chunks in flight at once, default 8
+}
+
+// BenchResult reports a benchmark run.
+type BenchResult struct {
+	Bytes      int64 // sent, and received back
+	Duration   time.Duration
+	Throughput float64 // bytes per second, in each direction
+
+	// Latency is the time from sending a chunk to receiving all of
+	// it back, across the chunks. With more than one chunk in
+	// flight, it includes the time spent queued behind the others.
+	Latency LatencyStats
+}
+
+// LatencyStats summarizes durations by percentiles.
+type LatencyStats struct {
+	Min, P50, P90, P99, Max time.Duration
+}
+
+func (l LatencyStats) String() string {
+	return fmt.Sprintf("min %v p50 %v p90 %v p99 %v max %v", l.Min, l.P50, l.P90, l.P99, l.Max)
+}
+
+func (r *BenchResult) String() string {
+	return fmt.Sprintf("%d bytes in %v, %.1f MB/s, latency %v",
+		r.Bytes, r.Duration, r.Throughput/1e6, r.Latency)
+}
+
+// Bench measures the link to the master's remote host by echoing
+// random data through a remote cat(1). opts may be nil.
+func (c *Client) Bench(opts *BenchOptions) (*BenchResult, error) {
+	s := c.NewSession()
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Start("cat"); err != nil {
+		return nil, err
+	}
+	res, err := BenchEcho(struct {
+		io.Reader
+		io.Writer
+	}{stdout, stdin}, opts)
+	stdin.Close()
+	go io.Copy(io.Discard, stdout)
+	if err1 := s.Wait(); err == nil && err1 != nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// BenchEcho measures a stream, such as a forwarded connection to an
+// echo service, that sends back whatever is written to it. It writes
+// random data and checks that it comes back unchanged. opts may be
+// nil.
+func BenchEcho(rw io.ReadWriter, opts *BenchOptions) (*BenchResult, error) {
+	var o BenchOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Size <= 0 {
+		o.Size = 16 << 20
+	}
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = 32 << 10
+	}
+	if o.Window <= 0 {
+		o.Window = 8
+	}
+	// cycle through more random data than a zlib window, so
+	// compression of the link cannot help
+	pattern := make([]byte, 2*o.ChunkSize+64<<10)
+	if _, err := rand.Read(pattern); err != nil {
+		return nil, err
+	}
+	chunks := int((o.Size + int64(o.ChunkSize) - 1) / int64(o.ChunkSize))
+	chunk := func(i int) []byte {
+		off := (i * o.ChunkSize) % (len(pattern) - o.ChunkSize)
+		n := o.ChunkSize
+		if i == chunks-1 && o.Size%int64(o.ChunkSize) != 0 {
+			n = int(o.Size % int64(o.ChunkSize))
+		}
+		return pattern[off : off+n]
+	}
+
+	sent := make(chan time.Time, o.Window)
+	werr := make(chan error, 1)
+	// stops the writer when the reader gives up
+	quit := make(chan struct{})
+	defer close(quit)
+	start := time.Now()
+	go func() {
+		for i := 0; i < chunks; i++ {
+			// blocks while Window chunks are in flight
+			select {
+			case sent <- time.Now():
+			case <-quit:
+				werr <- nil
+				return
+			}
+			if _, err := rw.Write(chunk(i)); err != nil {
+				werr <- err
+				return
+			}
+		}
+		werr <- nil
+	}()
+
+	latencies := make([]time.Duration, chunks)
+	buf := make([]byte, o.ChunkSize)
+	for i := 0; i < chunks; i++ {
+		want := chunk(i)
+		if _, err := io.ReadFull(rw, buf[:len(want)]); err != nil {
+			select {
+			case err1 := <-werr:
+				if err1 != nil {
+					err = err1
+				}
+			default:
+			}
+			return nil, err
+		}
+		latencies[i] = time.Since(<-sent)
+		if !bytes.Equal(buf[:len(want)], want) {
+			return nil, errors.New("sshctl: bench: data came back corrupted")
+		}
+	}
+	d := time.Since(start)
+	if err := <-werr; err != nil {
+		return nil, err
+	}
+	return &BenchResult{
+		Bytes:      o.Size,
+		Duration:   d,
+		Throughput: float64(o.Size) / d.Seconds(),
+		Latency:    latencyStats(latencies),
+	}, nil
+}
+
+func latencyStats(d []time.Duration) LatencyStats {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	p := func(q float64) time.Duration {
+		return d[int(q*float64(len(d)-1)+0.5)]
+	}
+	return LatencyStats{Min: d[0], P50: p(0.5), P90: p(0.9), P99: p(0.99), Max: d[len(d)-1]}
+}
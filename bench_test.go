@@ -0,0 +1,94 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	res, err := c.Bench(&BenchOptions{Size: 1<<20 + 123, ChunkSize: 16 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bytes != 1<<20+123 || res.Throughput <= 0 {
+		t.Fatalf("unexpected result %v", res)
+	}
+	l := res.Latency
+	if l.Min <= 0 || l.Min > l.P50 || l.P50 > l.P90 || l.P90 > l.P99 || l.P99 > l.Max {
+		t.Fatalf("unordered latencies %v", l)
+	}
+
+	echo := serveOnce(t, func(conn net.Conn) {
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	})
+	defer echo.Close()
+	conn, err := c.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if res, err := BenchEcho(conn, &BenchOptions{Size: 100 << 10}); err != nil || res.Bytes != 100<<10 {
+		t.Fatalf("unexpected result %v (%v)", res, err)
+	}
+
+	// a stream that does not echo
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		buf := make([]byte, 100)
+		b.Read(buf)
+		buf[0]++
+		b.Write(buf)
+		b.Close()
+	}()
+	if _, err := BenchEcho(a, &BenchOptions{Size: 100}); err == nil {
+		t.Fatal("expected corrupted data to be detected")
+	}
+}
+
+// failingEcho accepts all writes and fails all reads.
+type failingEcho struct{}
+
+func (failingEcho) Read(p []byte) (int, error)  { return 0, io.ErrUnexpectedEOF }
+func (failingEcho) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestBenchEchoWriterExits(t *testing.T) {
+	before := runtime.NumGoroutine()
+	if _, err := BenchEcho(failingEcho{}, &BenchOptions{Size: 1 << 20, ChunkSize: 1024, Window: 2}); err == nil {
+		t.Fatal("expected the read error")
+	}
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 200 {
+			t.Fatalf("writer goroutine left behind, %d goroutines, %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	var d []time.Duration
+	for i := 100; i > 0; i-- {
+		d = append(d, time.Duration(i)*time.Millisecond)
+	}
+	want := LatencyStats{Min: time.Millisecond, P50: 51 * time.Millisecond, P90: 90 * time.Millisecond,
+		P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}
+	if l := latencyStats(d); l != want {
+		t.Fatalf("expected %v, got %v", want, l)
+	}
+}
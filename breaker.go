@@ -0,0 +1,102 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker keeps track of hosts whose masters keep failing, so
+// Executor runs skip them for a while instead of waiting for their
+// timeouts and retries every time. After Threshold consecutive
+// failures the breaker of a host opens: its attempts fail at once
+// with a *CircuitOpenError until Cooldown has passed. The next
+// attempt then goes through; a success closes the breaker, a failure
+// opens it for another Cooldown.
+//
+// Only failures other than a remote exit status count, as for
+// Executor.Retries, except for cancelled runs. Share a CircuitBreaker
+// among runs and Executors to have it remember the hosts.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures opening the
+	// breaker of a host. If zero, 3 is used.
+	Threshold int
+
+	// Cooldown is how long an open breaker fails attempts. If zero,
+	// 1 minute is used.
+	Cooldown time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breakerState // by host Alias
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// CircuitOpenError is the error of an attempt on a host whose
+// breaker is open.
+type CircuitOpenError struct {
+	Host     string
+	Failures int       // consecutive failures so far
+	Until    time.Time // end of the cooldown
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("sshctl: host %s skipped after %d consecutive failures until %s",
+		e.Host, e.Failures, e.Until.Format(time.RFC3339))
+}
+
+// Allow returns a *CircuitOpenError if the breaker of host is open,
+// and nil otherwise.
+func (b *CircuitBreaker) Allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.hosts[host]
+	if st == nil || st.failures < b.threshold() || !time.Now().Before(st.openUntil) {
+		return nil
+	}
+	return &CircuitOpenError{Host: host, Failures: st.failures, Until: st.openUntil}
+}
+
+// Record counts an attempt on host that failed with err, or
+// succeeded if err is nil.
+func (b *CircuitBreaker) Record(host string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.hosts, host)
+		return
+	}
+	if b.hosts == nil {
+		b.hosts = make(map[string]*breakerState)
+	}
+	st := b.hosts[host]
+	if st == nil {
+		st = &breakerState{}
+		b.hosts[host] = st
+	}
+	if st.failures++; st.failures >= b.threshold() {
+		st.openUntil = time.Now().Add(durationOr(b.Cooldown, time.Minute))
+	}
+}
+
+// Reset closes the breaker of host, e.g. after its master was
+// restarted.
+func (b *CircuitBreaker) Reset(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.hosts, host)
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.Threshold > 0 {
+		return b.Threshold
+	}
+	return 3
+}
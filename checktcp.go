@@ -0,0 +1,109 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// TCPCheckError reports an address the remote host could not
+// connect to. Err is os.ErrDeadlineExceeded if it is unknown whether
+// it can, see CheckTCP.
+type TCPCheckError struct {
+	Addr string
+	Err  error
+}
+
+func (e *TCPCheckError) Error() string {
+	if e.Err == os.ErrDeadlineExceeded {
+		return "sshctl: no answer from " + e.Addr + " within the timeout, it is unreachable or waits for its client"
+	}
+	return "sshctl: remote host cannot reach " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *TCPCheckError) Unwrap() error {
+	return e.Err
+}
+
+// CheckTCP tells whether the remote host can connect to the TCP
+// address addr, by opening a stdio forward to it, without running
+// anything remotely. It returns nil if it can, a *TCPCheckError if
+// it cannot, or the error of talking to the master.
+//
+// An OpenSSH master connects asynchronously and closes the forward
+// if the connection fails, so CheckTCP waits up to timeout for the
+// address to either send data or have the forward closed. If neither
+// happens, the result is unknown, and the *TCPCheckError wraps
+// os.ErrDeadlineExceeded: a server waiting for its client to speak
+// cannot be told from a connection attempt still pending, e.g. one
+// dropped by a firewall. Use a timeout longer than a refusal takes to
+// travel back.
+func (c *Client) CheckTCP(addr string, timeout time.Duration) error {
+	conn, err := c.Dial("tcp", addr)
+	if err != nil {
+		var fe *stdioFwdError
+		if errors.As(err, &fe) {
+			return &TCPCheckError{addr, errors.New(fe.reason)}
+		}
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var b [1]byte
+	_, err = conn.Read(b[:])
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return &TCPCheckError{addr, os.ErrDeadlineExceeded}
+	case err == io.EOF:
+		return &TCPCheckError{addr, errors.New("connection closed by the master")}
+	}
+	return &TCPCheckError{addr, err}
+}
+
+// waitServiceInterval is the delay between the attempts of
+// WaitForRemoteService, and how long each waits for a refusal.
+var waitServiceInterval = 500 * time.Millisecond
+
+// WaitForRemoteService waits until the remote host can connect to
+// the TCP address addr, e.g. a service that a deploy just started,
+// by repeating CheckTCP. It returns nil once the address accepts
+// connections, or the error of talking to the master. If ctx is
+// done first, it returns ctx.Err() joined with the last
+// *TCPCheckError.
+//
+// As most services wait for their client to speak first, an address
+// whose check is neither answered nor closed counts as accepting
+// connections.
+func (c *Client) WaitForRemoteService(ctx context.Context, addr string) error {
+	for {
+		err := c.CheckTCP(addr, waitServiceInterval)
+		if tcpOpen(err) {
+			return nil
+		}
+		var te *TCPCheckError
+		if !errors.As(err, &te) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), err)
+		case <-time.After(waitServiceInterval):
+		}
+	}
+}
+
+// tcpOpen tells whether err from CheckTCP leaves the address open:
+// it answered, or it neither answered nor was closed, as with a
+// silent server, which cannot be told from a dropped connection.
+func tcpOpen(err error) bool {
+	var te *TCPCheckError
+	return err == nil || errors.As(err, &te) && te.Err == os.ErrDeadlineExceeded
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// serveOnce accepts connections on a new listener and hands them to
+// fn.
+func serveOnce(t *testing.T, fn func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fn(conn)
+		}
+	}()
+	return l
+}
+
+func TestCheckTCP(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	silent := echoServer(t)
+	defer silent.Close()
+	greeter := serveOnce(t, func(conn net.Conn) {
+		conn.Write([]byte("220 hello\r\n"))
+		time.Sleep(time.Second)
+		conn.Close()
+	})
+	defer greeter.Close()
+	closer := serveOnce(t, func(conn net.Conn) { conn.Close() })
+	defer closer.Close()
+
+	start := time.Now()
+	if err := c.CheckTCP(greeter.Addr().String(), 5*time.Second); err != nil {
+		t.Fatalf("greeter: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("expected the greeting to end the check, took %v", d)
+	}
+	var te *TCPCheckError
+	err := c.CheckTCP(silent.Addr().String(), 100*time.Millisecond)
+	if !errors.As(err, &te) || te.Err != os.ErrDeadlineExceeded || !tcpOpen(err) {
+		t.Fatalf("expected an unanswered check for a silent server, got %v", err)
+	}
+
+	refused := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	if err := c.CheckTCP(refused, time.Second); !errors.As(err, &te) || te.Addr != refused {
+		t.Fatalf("expected *TCPCheckError for a refused port, got %v", err)
+	}
+	if err := c.CheckTCP(closer.Addr().String(), time.Second); !errors.As(err, &te) {
+		t.Fatalf("expected *TCPCheckError for a closed forward, got %v", err)
+	}
+
+	var me *MasterError
+	if err := NewClient(g.ctrlSock+".missing").CheckTCP(refused, time.Second); !errors.As(err, &me) {
+		t.Fatalf("expected *MasterError, got %v", err)
+	}
+}
+
+func TestWaitForRemoteService(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+	old := waitServiceInterval
+	waitServiceInterval = 50 * time.Millisecond
+	defer func() { waitServiceInterval = old }()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var te *TCPCheckError
+	if err := c.WaitForRemoteService(ctx, addr); !errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &te) {
+		t.Fatalf("expected the deadline and a *TCPCheckError, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.WaitForRemoteService(context.Background(), addr) }()
+	time.Sleep(200 * time.Millisecond)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the service to be found")
+	}
+}
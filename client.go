@@ -0,0 +1,474 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Client is a handle to an ssh(1) "ControlMaster" process.
+// It creates Sessions and answers queries about the master.
+type Client struct {
+	// Quoting selects the quoting rules for commands built with
+	// Command, according to the shell of the remote host.
+	Quoting Quoting
+
+	// Events, if non-nil, is the Events channel of the sessions
+	// created by the Client, see Session.Events.
+	Events chan<- SessionEvent
+
+	sshctlpath string          // the ssh control unix socket path
+	ctx        context.Context // set by NewClientContext
+	stopCtx    func() bool     // unregisters the cleanup of ctx
+
+	// dials instead of sshctlpath, set by NewClientDialer
+	dial func() (*net.UnixConn, error)
+
+	mu       sync.Mutex
+	forwards map[Forward]*ForwardStatus // opened through this client
+	sessions map[*Session]bool          // started and not yet waited for
+	closed   bool                       // set by Shutdown
+	idle     chan struct{}              // closed when the last session is done after Shutdown
+}
+
+// NewClient returns a Client for the master listening on the
+// given ssh "ControlPath". It does not connect: the master is first
+// contacted when a session or forward needs it, or by Connect. An
+// empty path is taken from the SSHCTL_CONTROL_PATH environment
+// variable.
+func NewClient(path string) *Client {
+	return &Client{sshctlpath: defaultControlPath(path)}
+}
+
+// Connect makes sure the master answers, by doing the hello
+// handshake that later sessions would otherwise do first. Concurrent
+// first contacts with a master share a single handshake. Connect
+// returns ctx.Err() if ctx is done before the master answered. For a
+// Client from NewClientFromConn it uses up the connection.
+func (c *Client) Connect(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		if c.dial == nil {
+			done <- masterProbes.do(c.sshctlpath, probeMaster)
+			return
+		}
+		s := c.NewSession()
+		if err := s.dialCtrlConn(); err != nil {
+			done <- err
+			return
+		}
+		defer s.ctrlconn.Close()
+		done <- s.sshMuxHello(time.Time{})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return &MasterError{c.sshctlpath, "connect", err}
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NewClientContext returns a Client bound to ctx: once ctx is done,
+// its sessions are closed, its forwards are cancelled, and starting
+// further sessions or opening forwards fails with ctx.Err(). Shutdown
+// unbinds the Client from ctx.
+func NewClientContext(ctx context.Context, path string) *Client {
+	c := &Client{sshctlpath: defaultControlPath(path), ctx: ctx}
+	c.stopCtx = context.AfterFunc(ctx, func() {
+		c.closeSessions()
+		c.CloseAllForwards()
+	})
+	return c
+}
+
+// NewClientDialer returns a Client that gets its control connections
+// from dial instead of connecting to a socket path, e.g. to reach a
+// master through another tunnel or a socket in another namespace.
+// The mux protocol takes one connection per session, forward and
+// query, so dial is called for each; the connections must be unix
+// sockets since the stdio fds are passed over them. name stands in
+// for the control path in errors, traces and labels.
+func NewClientDialer(name string, dial func() (*net.UnixConn, error)) *Client {
+	return &Client{sshctlpath: name, dial: dial}
+}
+
+// ErrConnUsed is returned when a Client from NewClientFromConn needs
+// a second control connection.
+var ErrConnUsed = errors.New("sshctl: injected connection already used")
+
+// NewClientFromConn returns a Client on a control connection that is
+// already established, e.g. received from another process through fd
+// passing. As the master serves a single session or query per
+// connection, the Client can only run one; further ones fail with
+// ErrConnUsed. The Client takes ownership of conn.
+func NewClientFromConn(conn *net.UnixConn) *Client {
+	name := "injected connection"
+	if a := conn.RemoteAddr(); a != nil && a.String() != "" {
+		name = a.String()
+	}
+	var once sync.Once
+	return NewClientDialer(name, func() (*net.UnixConn, error) {
+		err := ErrConnUsed
+		once.Do(func() { err = nil })
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// NewSession prepares a new Session on top of the client's master.
+func (c *Client) NewSession() *Session {
+	s := NewSession(c.sshctlpath)
+	s.client = c
+	s.dial = c.dial
+	s.Events = c.Events
+	return s
+}
+
+// ErrClientShutdown is returned when starting a session of a Client
+// that was shut down.
+var ErrClientShutdown = errors.New("sshctl: client is shut down")
+
+// Shutdown gracefully tears down everything c set up on the master:
+// it stops starting new sessions, waits for started ones to be
+// waited for, detached or closed, and then cancels the forwards
+// opened through c. Once ctx is done, remaining sessions are closed
+// instead and ctx.Err() is returned, joined with errors from
+// cancelling the forwards. The master itself keeps running.
+func (c *Client) Shutdown(ctx context.Context) error {
+	if c.stopCtx != nil {
+		c.stopCtx()
+	}
+	c.mu.Lock()
+	c.closed = true
+	if len(c.sessions) > 0 && c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+	idle := c.idle
+	c.mu.Unlock()
+
+	var errs []error
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+			c.closeSessions()
+		}
+	}
+	if err := c.CloseAllForwards(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// closeSessions closes all started sessions of c.
+func (c *Client) closeSessions() {
+	c.mu.Lock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.mu.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+// acquire registers a session being started. c may be nil.
+func (c *Client) acquire(s *Session) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientShutdown
+	}
+	if err := c.ctxErr(); err != nil {
+		return err
+	}
+	if c.sessions == nil {
+		c.sessions = make(map[*Session]bool)
+	}
+	c.sessions[s] = true
+	return nil
+}
+
+// ctxErr returns the error of the context of a Client from
+// NewClientContext, once it is done.
+func (c *Client) ctxErr() error {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
+// release unregisters a session that is done. c may be nil.
+func (c *Client) release(s *Session) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, s)
+	if len(c.sessions) == 0 && c.idle != nil {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// Dial connects to addr from the remote host through a stdio forward
+// of the master, like "ssh -W". The network must be "tcp" or "unix".
+// The connection holds a control connection of its own, which is
+// closed together with it.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	var host string
+	var port int
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("sshctl: invalid port %q", p)
+		}
+		host = h
+	case "unix":
+		host, port = addr, muxPortStreamLocal
+	default:
+		return nil, fmt.Errorf("sshctl: unsupported network %q", network)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "stdio-fwd")
+	remote := os.NewFile(uintptr(fds[1]), "stdio-fwd")
+	defer local.Close()
+	defer remote.Close()
+
+	s, err := c.handshake()
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sshMuxNewStdioFwd(host, port, remote); err != nil {
+		s.ctrlconn.Close()
+		return nil, err
+	}
+	conn, err := net.FileConn(local)
+	if err != nil {
+		s.ctrlconn.Close()
+		return nil, err
+	}
+	return &stdioConn{Conn: conn, ctrl: s.ctrlconn}, nil
+}
+
+// stdioConn is the local end of a stdio forward.
+type stdioConn struct {
+	net.Conn
+	ctrl net.Conn
+}
+
+// CloseWrite shuts down the writing side of the forward, so the
+// remote end reads EOF while its response can still be read.
+func (c *stdioConn) CloseWrite() error {
+	return c.Conn.(*net.UnixConn).CloseWrite()
+}
+
+func (c *stdioConn) Close() error {
+	err := c.Conn.Close()
+	c.ctrl.Close()
+	return err
+}
+
+// MasterInfo describes the master process behind a control socket.
+type MasterInfo struct {
+	// PID is the process id of the master, as reported by the
+	// mux alive check.
+	PID int
+
+	// Protocol is the highest mux protocol version sshctl speaks.
+	Protocol int
+
+	// Version is the negotiated mux protocol version.
+	Version int
+
+	// Extensions holds the name/value pairs the master advertised
+	// in its hello message.
+	Extensions map[string]string
+
+	// OpenSSHVersion is the version string of the master's ssh
+	// binary, e.g. "OpenSSH_7.6p1". The detection is best-effort;
+	// the field is empty if the version could not be determined.
+	OpenSSHVersion string
+}
+
+// String formats m on a single line, with the extensions sorted by
+// name, e.g. "mux protocol 4, negotiated 4, master pid 1234,
+// extensions [a@example.com=1]", followed by the OpenSSHVersion if
+// it is known.
+func (m *MasterInfo) String() string {
+	names := make([]string, 0, len(m.Extensions))
+	for name := range m.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if value := m.Extensions[name]; value != "" {
+			names[i] += "=" + value
+		}
+	}
+	str := fmt.Sprintf("mux protocol %d, negotiated %d, master pid %d, extensions [%s]",
+		m.Protocol, m.Version, m.PID, strings.Join(names, " "))
+	if m.OpenSSHVersion != "" {
+		str += ", " + m.OpenSSHVersion
+	}
+	return str
+}
+
+// MasterInfo connects to the master, performs the mux handshake
+// and returns what was learned about it, see Version, together with
+// the OpenSSHVersion. No session is opened.
+func (c *Client) MasterInfo() (*MasterInfo, error) {
+	info, err := c.Version()
+	if err != nil {
+		return nil, err
+	}
+	info.OpenSSHVersion = openSSHVersion(info.PID)
+	return info, nil
+}
+
+// Version connects to the master and reports the mux protocol
+// details of the client and the master, for support bundles and
+// startup logs: the negotiated mux version, the master's hello
+// extensions and its pid. Unlike MasterInfo, it does not run the ssh
+// binary, so OpenSSHVersion is empty.
+func (c *Client) Version() (*MasterInfo, error) {
+	s, err := c.handshake()
+	if err != nil {
+		return nil, err
+	}
+	s.ctrlconn.Close()
+	return &MasterInfo{
+		PID:        s.masterPid,
+		Protocol:   muxVersion,
+		Version:    s.masterVersion,
+		Extensions: s.masterExtensions,
+	}, nil
+}
+
+// Check verifies that the master is up, like "ssh -O check": it
+// dials the control socket, performs the mux hello and an alive
+// check and returns the master's pid. On failure the error is a
+// *MasterError telling which step failed.
+func (c *Client) Check() (int, error) {
+	s, err := c.handshake()
+	if err != nil {
+		return 0, err
+	}
+	s.ctrlconn.Close()
+	return s.masterPid, nil
+}
+
+// MasterError reports a master that cannot be used.
+type MasterError struct {
+	Path string // the control socket
+	Op   string // the failed step: "connect", "dial", "hello" or "alive"
+	Err  error
+}
+
+func (e *MasterError) Error() string {
+	return "sshctl: master " + e.Path + ": " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *MasterError) Unwrap() error {
+	return e.Err
+}
+
+// handshake dials the master and runs hello and alive check on a
+// fresh control connection, which is left open for further requests.
+func (c *Client) handshake() (*Session, error) {
+	s := c.NewSession()
+	if err := s.openCtrlConn(); err != nil {
+		var he *helloError
+		if errors.As(err, &he) {
+			return nil, &MasterError{c.sshctlpath, "hello", he.err}
+		}
+		return nil, &MasterError{c.sshctlpath, "dial", err}
+	}
+	if err := s.sshMuxHello(time.Time{}); err != nil {
+		masterProbes.forget(s.sshctlpath)
+		s.ctrlconn.Close()
+		return nil, &MasterError{c.sshctlpath, "hello", err}
+	}
+	if err := s.sshMuxAliveCheck(); err != nil {
+		s.ctrlconn.Close()
+		return nil, &MasterError{c.sshctlpath, "alive", err}
+	}
+	return s, nil
+}
+
+// openSSHVersion runs "ssh -V" on the binary of the given process,
+// falling back to the ssh found in $PATH.
+func openSSHVersion(pid int) string {
+	bin := fmt.Sprintf("/proc/%d/exe", pid)
+	if _, err := os.Stat(bin); err != nil {
+		if bin, err = exec.LookPath("ssh"); err != nil {
+			return ""
+		}
+	}
+	out, err := exec.Command(bin, "-V").CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	// e.g. "OpenSSH_7.6p1 Ubuntu-4, OpenSSL 1.0.2n  7 Dec 2017"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "OpenSSH") {
+		return ""
+	}
+	return strings.TrimSuffix(fields[0], ",")
+}
+
+// WaitForMaster waits for a master to come up at path, e.g. after
+// starting ssh(1), and returns its pid. It polls with Check, starting
+// at 10 milliseconds and backing off to one second between attempts,
+// until the master answers or ctx is done; in the latter case the
+// error wraps ctx.Err() and tells the last failure.
+func WaitForMaster(ctx context.Context, path string) (int, error) {
+	c := NewClient(path)
+	delay := 10 * time.Millisecond
+	for {
+		pid, err := c.Check()
+		if err == nil {
+			return pid, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("sshctl: waiting for master at %s: %w (%v)", path, ctx.Err(), err)
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
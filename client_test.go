@@ -0,0 +1,153 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/mpfz0r/sshctl/mux"
+)
+
+func TestMasterInfo(t *testing.T) {
+	server := newServer(t)
+	defer server.Shutdown()
+	sshmux := server.Run()
+
+	info, err := NewClient(sshmux).MasterInfo()
+	if err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if info.PID != server.sshcmd.Process.Pid {
+		t.Fatalf("expected master pid %d but got %d", server.sshcmd.Process.Pid, info.PID)
+	}
+	if info.Version != muxVersion {
+		t.Fatalf("expected mux version %d but got %d", muxVersion, info.Version)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	pid, err := NewClient(g.ctrlSock).Check()
+	if err != nil || pid != os.Getpid() {
+		t.Fatalf("expected pid %d, got %d (%v)", os.Getpid(), pid, err)
+	}
+
+	_, err = NewClient(g.ctrlSock + ".missing").Check()
+	var me *MasterError
+	if !errors.As(err, &me) || me.Op != "dial" {
+		t.Fatalf("expected *MasterError from dial, got %v", err)
+	}
+
+	// a hello failure of the shared probe is told as such
+	_, err = NewClient(fakeMaster(t, mux.Marshal(&mux.Hello{Version: 3}))).Check()
+	var ve *VersionError
+	if !errors.As(err, &me) || me.Op != "hello" || !errors.As(err, &ve) {
+		t.Fatalf("expected *MasterError from hello, got %v", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	v, err := NewClient(g.ctrlSock).Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Protocol != muxVersion || v.Version != muxVersion || v.PID != os.Getpid() {
+		t.Fatalf("unexpected version info %+v", v)
+	}
+
+	v.Extensions = map[string]string{"b@example.com": "", "a@example.com": "1"}
+	want := fmt.Sprintf("mux protocol %d, negotiated %d, master pid %d, extensions [a@example.com=1 b@example.com]",
+		muxVersion, muxVersion, os.Getpid())
+	if s := v.String(); s != want {
+		t.Fatalf("expected %q, got %q", want, s)
+	}
+	v.OpenSSHVersion = "OpenSSH_7.6p1"
+	if s := v.String(); s != want+", OpenSSH_7.6p1" {
+		t.Fatalf("expected the ssh version, got %q", s)
+	}
+}
+
+func TestEnvControlPath(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	t.Setenv(EnvControlPath, g.ctrlSock)
+
+	if pid, err := NewClient("").Check(); err != nil || pid != os.Getpid() {
+		t.Fatalf("expected pid %d, got %d (%v)", os.Getpid(), pid, err)
+	}
+	out, err := NewSession("").Output("echo hi")
+	if err != nil || string(out) != "hi\n" {
+		t.Fatalf("expected hi, got %q (%v)", out, err)
+	}
+	if s := NewSession("/other"); s.sshctlpath != "/other" {
+		t.Fatalf("explicit path replaced by %s", s.sshctlpath)
+	}
+}
+
+func TestControlPathFor(t *testing.T) {
+	t.Setenv(EnvControlPath, "/run/ssh/%h.sock")
+	t.Setenv(EnvControlPaths, "web=/tmp/web, db=/tmp/db")
+	for host, want := range map[string]string{
+		"web":   "/tmp/web",
+		"db":    "/tmp/db",
+		"cache": "/run/ssh/cache.sock",
+	} {
+		if got := ControlPathFor(host); got != want {
+			t.Errorf("%s: expected %s, got %s", host, want, got)
+		}
+	}
+	t.Setenv(EnvControlPath, "")
+	if got := ControlPathFor("cache"); got != "" {
+		t.Errorf("expected no path, got %s", got)
+	}
+}
+
+func TestNewClientFromConn(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	dial := func() (*net.UnixConn, error) {
+		return net.DialUnix("unix", nil, &net.UnixAddr{Name: g.ctrlSock, Net: "unix"})
+	}
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClientFromConn(conn)
+	if out, err := c.NewSession().Output("echo hi"); err != nil || string(out) != "hi\n" {
+		t.Fatalf("expected hi, got %q (%v)", out, err)
+	}
+	if err := c.NewSession().Run("true"); !errors.Is(err, ErrConnUsed) {
+		t.Fatalf("expected ErrConnUsed, got %v", err)
+	}
+
+	var dials int
+	c = NewClientDialer("tunnel", func() (*net.UnixConn, error) {
+		dials++
+		return dial()
+	})
+	for i := 0; i < 2; i++ {
+		if err := c.NewSession().Run("true"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.MasterInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 3 {
+		t.Fatalf("expected 3 dials, got %d", dials)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"io"
+)
+
+// Cmd is a remote command built from a program name and arguments,
+// in the spirit of os/exec. Unlike strings passed to Session.Run, the
+// arguments are quoted for the remote shell, so they reach the
+// program unchanged.
+type Cmd struct {
+	// Path is the program to run, looked up in the remote $PATH
+	// unless it contains a slash.
+	Path string
+
+	// Args holds the command line arguments, including the program
+	// name as Args[0].
+	Args []string
+
+	// Dir is the working directory of the command. If empty, the
+	// command runs in the remote user's login directory.
+	Dir string
+
+	// Shell is the shell interpreting the command line on the remote
+	// host, e.g. "sh" or "/bin/bash". The line is passed to it with
+	// -c. If empty, the remote user's login shell interprets it,
+	// which works for Command's quoted arguments as long as the
+	// login shell follows POSIX quoting rules. Shell is ignored
+	// unless Quoting is POSIXQuoting.
+	Shell string
+
+	// Quoting selects the quoting rules of the remote shell.
+	// Command takes it from the Client.
+	Quoting Quoting
+
+	// Stdin, Stdout and Stderr are handed to Session on Start.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Session runs the command. It may be configured, e.g. with
+	// Setenv or RequestPty, before Start.
+	Session *Session
+
+	script string // set by ShellCommand
+}
+
+// Command returns a Cmd running the named program with the given
+// arguments over the client's master.
+func (c *Client) Command(name string, arg ...string) *Cmd {
+	return &Cmd{
+		Path:    name,
+		Args:    append([]string{name}, arg...),
+		Quoting: c.Quoting,
+		Session: c.NewSession(),
+	}
+}
+
+// ShellCommand returns a Cmd running script, which is not quoted,
+// with the given shell, e.g. "bash" for a script using pipefail. An
+// empty shell leaves the script to the remote user's login shell,
+// like Session.Run.
+func (c *Client) ShellCommand(shell, script string) *Cmd {
+	return &Cmd{
+		Shell:   shell,
+		Quoting: c.Quoting,
+		Session: c.NewSession(),
+		script:  script,
+	}
+}
+
+// String returns the command line sent to the remote host.
+func (c *Cmd) String() string {
+	var line string
+	if c.script != "" {
+		line = c.script
+		if c.Dir != "" {
+			line = c.Quoting.chdir(c.Dir, line, false)
+		}
+	} else {
+		args := []string{c.Path}
+		if len(c.Args) > 1 {
+			args = append(args, c.Args[1:]...)
+		}
+		line = c.Quoting.argv(args)
+		if c.Dir != "" {
+			line = c.Quoting.chdir(c.Dir, line, true)
+		}
+	}
+	if c.Shell != "" && c.Quoting == POSIXQuoting {
+		line = "exec " + shellQuote(c.Shell) + " -c " + shellQuote(line)
+	}
+	return line
+}
+
+// Start starts the command but does not wait for it to complete.
+func (c *Cmd) Start() error {
+	c.Session.Stdin = c.Stdin
+	c.Session.Stdout = c.Stdout
+	c.Session.Stderr = c.Stderr
+	return c.Session.Start(c.String())
+}
+
+// Wait waits for the command started by Start to exit.
+func (c *Cmd) Wait() error {
+	return c.Session.Wait()
+}
+
+// Run starts the command and waits for it to complete.
+func (c *Cmd) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Output runs the command and returns its standard output.
+func (c *Cmd) Output() ([]byte, error) {
+	c.Session.Stdin = c.Stdin
+	c.Session.Stderr = c.Stderr
+	return c.Session.Output(c.String())
+}
+
+// CombinedOutput runs the command and returns its combined standard
+// output and standard error.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	c.Session.Stdin = c.Stdin
+	return c.Session.CombinedOutput(c.String())
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCmdString(t *testing.T) {
+	c := NewClient("").Command("ls", "-l", "it's here")
+	if want := `'ls' '-l' 'it'\''s here'`; c.String() != want {
+		t.Fatalf("expected %s, got %s", want, c.String())
+	}
+	c.Dir = "/tmp/a dir"
+	if want := `cd -- '/tmp/a dir' && exec 'ls' '-l' 'it'\''s here'`; c.String() != want {
+		t.Fatalf("expected %s, got %s", want, c.String())
+	}
+}
+
+func TestCmdDir(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	dir := filepath.Join(t.TempDir(), "$(touch pwned) dir")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(g.ctrlSock).Command("pwd")
+	c.Dir = dir
+	out, err := c.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != dir+"\n" {
+		t.Fatalf("expected %q, got %q", dir+"\n", out)
+	}
+
+	c = NewClient(g.ctrlSock).Command("pwd")
+	c.Dir = filepath.Join(dir, "missing")
+	if err := c.Run(); err == nil {
+		t.Fatalf("expected failure for missing directory")
+	}
+}
+
+func TestCmdShell(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	client := NewClient(g.ctrlSock)
+
+	c := client.Command("echo", "$HOME", "a  b")
+	c.Shell = "sh"
+	if want := `exec 'sh' -c ''\''echo'\'' '\''$HOME'\'' '\''a  b'\'''`; c.String() != want {
+		t.Fatalf("expected %s, got %s", want, c.String())
+	}
+	out, err := c.Output()
+	if err != nil || string(out) != "$HOME a  b\n" {
+		t.Fatalf("unexpected output %q, %v", out, err)
+	}
+
+	dir := t.TempDir()
+	c = client.ShellCommand("sh", `echo "$(pwd)" | tr a-z A-Z`)
+	c.Dir = dir
+	out, err = c.Output()
+	if want := strings.ToUpper(dir) + "\n"; err != nil || string(out) != want {
+		t.Fatalf("expected %q, got %q, %v", want, out, err)
+	}
+}
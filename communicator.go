@@ -0,0 +1,118 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// RemoteCmd is a command started by a Communicator, shaped after the
+// RemoteCmd of Packer and the remote.Cmd of Terraform.
+type RemoteCmd struct {
+	// Command is the command line run by the remote user's shell.
+	Command string
+
+	// Stdin, Stdout and Stderr are handed to the Session on Start.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	once   sync.Once
+	exited chan struct{}
+	status int
+	err    error
+}
+
+func (r *RemoteCmd) init() {
+	r.once.Do(func() { r.exited = make(chan struct{}) })
+}
+
+// setExited records the result of the command and wakes up Wait.
+func (r *RemoteCmd) setExited(err error) {
+	r.init()
+	r.status, r.err = ExitCode(err), err
+	close(r.exited)
+}
+
+// Wait blocks until the command started by Communicator.Start
+// completed and returns its error, as returned by Session.Wait.
+func (r *RemoteCmd) Wait() error {
+	r.init()
+	<-r.exited
+	return r.err
+}
+
+// ExitStatus waits for the command like Wait and returns its exit
+// code, as computed by ExitCode.
+func (r *RemoteCmd) ExitStatus() int {
+	r.Wait()
+	return r.status
+}
+
+// Communicator adapts a Client to the "communicator" interface that
+// provisioning tools such as Packer and Terraform use to run
+// commands and copy files, so their steps share the connection of an
+// existing master instead of each opening one of their own. Tools
+// declare the interface on their side; a thin wrapper translates
+// their command type to RemoteCmd.
+type Communicator struct {
+	client *Client
+}
+
+// NewCommunicator returns a Communicator working through c.
+func NewCommunicator(c *Client) *Communicator {
+	return &Communicator{client: c}
+}
+
+// Connect makes sure the master answers, see Client.Connect.
+func (c *Communicator) Connect(ctx context.Context) error {
+	return c.client.Connect(ctx)
+}
+
+// Disconnect waits for the started commands and cancels the forwards
+// opened through the Client, see Client.Shutdown. The master keeps
+// running, and the Communicator cannot start commands afterwards.
+func (c *Communicator) Disconnect() error {
+	return c.client.Shutdown(context.Background())
+}
+
+// Start starts cmd and returns without waiting for it; use
+// cmd.Wait or cmd.ExitStatus for its result. If ctx is done before
+// the command completes, its session is closed and cmd.Wait returns
+// ctx.Err(). A RemoteCmd must not be started twice.
+func (c *Communicator) Start(ctx context.Context, cmd *RemoteCmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cmd.init()
+	s := c.client.NewSession()
+	s.Stdin, s.Stdout, s.Stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+	if err := s.Start(cmd.Command); err != nil {
+		return err
+	}
+	go func() {
+		cmd.setExited(s.waitContext(ctx))
+	}()
+	return nil
+}
+
+// Upload copies r to the remote path dst. The file gets the mode of
+// fi if non-nil and 0644 otherwise; Packer passes the FileInfo of
+// the local file being uploaded.
+func (c *Communicator) Upload(dst string, r io.Reader, fi *os.FileInfo) error {
+	mode := os.FileMode(0644)
+	if fi != nil && *fi != nil {
+		mode = (*fi).Mode()
+	}
+	return c.client.NewSession().Upload(r, dst, mode)
+}
+
+// Download copies the remote path src to w.
+func (c *Communicator) Download(src string, w io.Writer) error {
+	return c.client.NewSession().Download(w, src)
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommunicator(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	comm := NewCommunicator(NewClient(g.ctrlSock))
+	ctx := context.Background()
+	if err := comm.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	cmd := &RemoteCmd{
+		Command: "cat; exit 3",
+		Stdin:   strings.NewReader(TestString),
+		Stdout:  &stdout,
+	}
+	if err := comm.Start(ctx, cmd); err != nil {
+		t.Fatal(err)
+	}
+	if st := cmd.ExitStatus(); st != 3 {
+		t.Fatalf("expected exit status 3, got %d, %v", st, cmd.Wait())
+	}
+	if stdout.String() != TestString {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+
+	remote := filepath.Join(t.TempDir(), "file")
+	fi := os.FileInfo(nil)
+	if err := comm.Upload(remote, strings.NewReader(TestString), &fi); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(remote); err != nil || fi.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected mode %v, %v", fi.Mode(), err)
+	}
+	var got bytes.Buffer
+	if err := comm.Download(remote, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != TestString {
+		t.Fatalf("unexpected download %q", got.String())
+	}
+
+	if err := comm.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := comm.Start(ctx, &RemoteCmd{Command: "true"}); err == nil {
+		t.Fatalf("expected Start after Disconnect to fail")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how transfer helpers compress data in transit.
+// The remote host needs the matching command line tool.
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	Gzip                      // needs gzip(1) on the remote host
+	Zstd                      // needs zstd(1) on the remote host
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+// compressCmd returns the remote filter compressing stdin.
+func (c Compression) compressCmd() string {
+	switch c {
+	case Gzip:
+		return "gzip -c"
+	case Zstd:
+		return "zstd -q -c"
+	}
+	return "cat"
+}
+
+// decompressCmd returns the remote filter decompressing stdin.
+func (c Compression) decompressCmd() string {
+	switch c {
+	case Gzip:
+		return "gzip -dc"
+	case Zstd:
+		return "zstd -q -dc"
+	}
+	return "cat"
+}
+
+// compress writes r to w compressed with c.
+func (c Compression) compress(w io.Writer, r io.Reader) error {
+	var cw io.WriteCloser
+	var err error
+	switch c {
+	case Gzip:
+		cw = gzip.NewWriter(w)
+	case Zstd:
+		if cw, err = zstd.NewWriter(w); err != nil {
+			return err
+		}
+	default:
+		_, err = io.Copy(w, r)
+		return err
+	}
+	if _, err = io.Copy(cw, r); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// decompress writes r, compressed with c, to w.
+func (c Compression) decompress(w io.Writer, r io.Reader) error {
+	switch c {
+	case Gzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Config describes hosts and defaults for programs working on many
+// hosts, so they share one file format. It is read from JSON by
+// LoadConfig, which needs no third-party parser as YAML or TOML
+// would:
+//
+//	{
+//		"concurrency": 10,
+//		"timeouts": {"command": "5m", "control": "10s", "drain": "2s"},
+//		"env": {"LC_ALL": "C"},
+//		"hosts": {
+//			"web": {"hostname": "web.example.com", "user": "deploy",
+//				"control_path": "/run/ssh/web.sock"},
+//			"win": {"quoting": "powershell", "env": {"DEBUG": "1"}}
+//		}
+//	}
+//
+// All entries are optional.
+type Config struct {
+	Hosts map[string]HostConfig
+
+	// Env is set on every session, before the host's Env.
+	Env map[string]string
+
+	// CommandTimeout bounds each command run by fan-out helpers.
+	// ControlTimeout and DrainTimeout become the sessions' fields of
+	// the same name.
+	CommandTimeout time.Duration
+	ControlTimeout time.Duration
+	DrainTimeout   time.Duration
+
+	// Concurrency limits the number of hosts worked on at once by
+	// fan-out helpers. Zero means no limit.
+	Concurrency int
+}
+
+// HostConfig is a host entry of a Config.
+type HostConfig struct {
+	HostName string // defaults to the entry's name
+	Port     int
+	User     string
+
+	// ControlPath defaults to ControlPathFor the entry's name.
+	ControlPath string
+
+	Quoting Quoting
+	Env     map[string]string
+}
+
+// configFile is the JSON form of a Config.
+type configFile struct {
+	Concurrency int `json:"concurrency"`
+	Timeouts    struct {
+		Command string `json:"command"`
+		Control string `json:"control"`
+		Drain   string `json:"drain"`
+	} `json:"timeouts"`
+	Env   map[string]string `json:"env"`
+	Hosts map[string]struct {
+		HostName    string            `json:"hostname"`
+		Port        int               `json:"port"`
+		User        string            `json:"user"`
+		ControlPath string            `json:"control_path"`
+		Quoting     string            `json:"quoting"`
+		Env         map[string]string `json:"env"`
+	} `json:"hosts"`
+}
+
+// LoadConfig reads a Config from the JSON file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ParseConfig parses a Config in the format described there. Unknown
+// keys are an error, to catch misspellings.
+func ParseConfig(data []byte) (*Config, error) {
+	var f configFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("sshctl: config: %w", err)
+	}
+	c := &Config{
+		Hosts:       make(map[string]HostConfig),
+		Env:         f.Env,
+		Concurrency: f.Concurrency,
+	}
+	for _, d := range []struct {
+		name, value string
+		dst         *time.Duration
+	}{
+		{"command", f.Timeouts.Command, &c.CommandTimeout},
+		{"control", f.Timeouts.Control, &c.ControlTimeout},
+		{"drain", f.Timeouts.Drain, &c.DrainTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("sshctl: config: %s timeout: %w", d.name, err)
+		}
+		*d.dst = v
+	}
+	for name, h := range f.Hosts {
+		q, err := parseQuoting(h.Quoting)
+		if err != nil {
+			return nil, fmt.Errorf("sshctl: config: host %s: %w", name, err)
+		}
+		c.Hosts[name] = HostConfig{
+			HostName:    h.HostName,
+			Port:        h.Port,
+			User:        h.User,
+			ControlPath: h.ControlPath,
+			Quoting:     q,
+			Env:         h.Env,
+		}
+	}
+	return c, nil
+}
+
+func parseQuoting(s string) (Quoting, error) {
+	for _, q := range []Quoting{POSIXQuoting, CmdQuoting, PowerShellQuoting} {
+		if s == q.String() {
+			return q, nil
+		}
+	}
+	if s == "" {
+		return POSIXQuoting, nil
+	}
+	return 0, fmt.Errorf("unknown quoting %q", s)
+}
+
+// HostNames returns the names of the configured hosts, sorted.
+func (c *Config) HostNames() []string {
+	names := make([]string, 0, len(c.Hosts))
+	for name := range c.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Host returns the configured host called name. Hosts missing from
+// the config are returned with their defaults, so a ControlPath from
+// the environment still applies.
+func (c *Config) Host(name string) *Host {
+	hc := c.Hosts[name]
+	h := &Host{
+		Alias:       name,
+		HostName:    hc.HostName,
+		Port:        hc.Port,
+		User:        hc.User,
+		ControlPath: hc.ControlPath,
+		Quoting:     hc.Quoting,
+	}
+	if h.HostName == "" {
+		h.HostName = name
+	}
+	if h.Port == 0 {
+		h.Port = 22
+	}
+	if h.ControlPath == "" {
+		h.ControlPath = ControlPathFor(name)
+	}
+	return h
+}
+
+// Client returns a Client for the master of the host called name.
+func (c *Config) Client(name string) (*Client, error) {
+	return c.Host(name).Client()
+}
+
+// NewSession returns a Session on the master of the host called
+// name, with the configured environment and timeouts.
+func (c *Config) NewSession(name string) (*Session, error) {
+	client, err := c.Client(name)
+	if err != nil {
+		return nil, err
+	}
+	s := client.NewSession()
+	s.ControlTimeout = c.ControlTimeout
+	s.DrainTimeout = c.DrainTimeout
+	for _, env := range []map[string]string{c.Env, c.Hosts[name].Env} {
+		for _, k := range sortedKeys(env) {
+			if err := s.Setenv(k, env[k]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Executor returns an Executor for the named hosts, with the
+// configured Concurrency and CommandTimeout. Its sessions are made
+// by NewSession, so they get the configured environment and
+// timeouts.
+func (c *Config) Executor(names ...string) *Executor {
+	hosts := make([]Host, len(names))
+	for i, name := range names {
+		hosts[i] = *c.Host(name)
+	}
+	e := NewExecutor(hosts)
+	e.Concurrency = c.Concurrency
+	e.Timeout = c.CommandTimeout
+	e.NewSession = func(h Host) (*Session, error) {
+		return c.NewSession(h.Alias)
+	}
+	return e
+}
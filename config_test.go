@@ -0,0 +1,89 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	path := filepath.Join(t.TempDir(), "sshctl.json")
+	data := `{
+		"concurrency": 4,
+		"timeouts": {"command": "5m", "control": "10s"},
+		"env": {"LC_ALL": "C", "A": "1"},
+		"hosts": {
+			"web": {"hostname": "web.example.com", "user": "deploy",
+				"control_path": "` + g.ctrlSock + `", "env": {"DEBUG": "1"}},
+			"win": {"port": 2222, "quoting": "powershell"}
+		}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Concurrency != 4 || c.CommandTimeout != 5*time.Minute || c.ControlTimeout != 10*time.Second || c.DrainTimeout != 0 {
+		t.Fatalf("unexpected settings %+v", c)
+	}
+	if names := c.HostNames(); !reflect.DeepEqual(names, []string{"web", "win"}) {
+		t.Fatalf("unexpected hosts %q", names)
+	}
+
+	t.Setenv(EnvControlPath, "/run/ssh/%h")
+	want := &Host{Alias: "win", HostName: "win", Port: 2222, ControlPath: "/run/ssh/win", Quoting: PowerShellQuoting}
+	if h := c.Host("win"); !reflect.DeepEqual(h, want) {
+		t.Fatalf("expected %+v, got %+v", want, h)
+	}
+
+	s, err := c.NewSession("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := []string{"A=1", "LC_ALL=C", "DEBUG=1"}; !reflect.DeepEqual(s.env, env) {
+		t.Fatalf("expected env %q, got %q", env, s.env)
+	}
+	if s.ControlTimeout != 10*time.Second {
+		t.Fatalf("expected ControlTimeout 10s, got %v", s.ControlTimeout)
+	}
+	if e := c.Executor("web", "win"); e.Concurrency != 4 || e.Timeout != 5*time.Minute || len(e.Hosts) != 2 {
+		t.Fatalf("unexpected executor %+v", e)
+	}
+	if out, err := s.Output("echo hi"); err != nil || string(out) != "hi\n" {
+		t.Fatalf("expected hi, got %q (%v)", out, err)
+	}
+
+	// executor runs get the configured environment
+	res := c.Executor("web").Run("echo $A$DEBUG")
+	if res[0].Err != nil || string(res[0].Stdout) != "11\n" {
+		t.Fatalf("expected the configured env, got %q (%v)", res[0].Stdout, res[0].Err)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for data, want := range map[string]string{
+		`{"concurency": 4}`:                     "unknown field",
+		`{"timeouts": {"drain": "soon"}}`:       "drain timeout",
+		`{"hosts": {"a": {"quoting": "fish"}}}`: "host a: unknown quoting",
+		`{"hosts": {"a": {"control_path": 1}}}`: "cannot unmarshal",
+	} {
+		_, err := ParseConfig([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected error containing %q, got %v", data, want, err)
+		}
+	}
+}
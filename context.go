@@ -0,0 +1,80 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// RunContext is like Run but closes the session if ctx is done before
+// the command completes, in which case ctx.Err() is returned.
+func (s *Session) RunContext(ctx context.Context, cmd string) error {
+	if err := ctx.Err(); err != nil {
+		return s.labelErr(err)
+	}
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+	return s.waitContext(ctx)
+}
+
+// waitContext is like Wait but closes the session if ctx is done
+// first, in which case ctx.Err() is returned.
+func (s *Session) waitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+	err := s.Wait()
+	if ctxErr := ctx.Err(); ctxErr != nil && err != nil {
+		return s.labelErr(ctxErr)
+	}
+	return err
+}
+
+// OutputContext is like Output but closes the session if ctx is done
+// before the command completes. The output received up to then is
+// returned together with ctx.Err().
+func (s *Session) OutputContext(ctx context.Context, cmd string) ([]byte, error) {
+	if s.Stdout != nil {
+		return nil, errors.New("ssh: Stdout already set")
+	}
+	var b singleWriter
+	s.Stdout = &b
+	err := s.RunContext(ctx, cmd)
+	return b.bytes(), err
+}
+
+// CombinedOutputContext is like CombinedOutput but closes the session
+// if ctx is done before the command completes. The output received up
+// to then is returned together with ctx.Err().
+func (s *Session) CombinedOutputContext(ctx context.Context, cmd string) ([]byte, error) {
+	if s.Stdout != nil {
+		return nil, errors.New("ssh: Stdout already set")
+	}
+	if s.Stderr != nil {
+		return nil, errors.New("ssh: Stderr already set")
+	}
+	var b singleWriter
+	s.Stdout = &b
+	s.Stderr = &b
+	err := s.RunContext(ctx, cmd)
+	return b.bytes(), err
+}
+
+// bytes returns a copy of what was written so far; copy goroutines
+// may still be writing after an aborted Wait.
+func (w *singleWriter) bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return bytes.Clone(w.b.Bytes())
+}
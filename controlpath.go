@@ -0,0 +1,46 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"os"
+	"strings"
+)
+
+// Environment variables consulted for control paths.
+const (
+	// EnvControlPath is the control path used by NewSession and
+	// NewClient when given an empty path. ControlPathFor replaces
+	// "%h" in it by the host name.
+	EnvControlPath = "SSHCTL_CONTROL_PATH"
+
+	// EnvControlPaths maps hosts to control paths for
+	// ControlPathFor, as a comma separated list of host=path pairs,
+	// e.g. "web=/run/ssh/web.sock,db=/run/ssh/db.sock".
+	EnvControlPaths = "SSHCTL_CONTROL_PATHS"
+)
+
+// defaultControlPath returns path, or the one from the environment if
+// path is empty.
+func defaultControlPath(path string) string {
+	if path != "" {
+		return path
+	}
+	return os.Getenv(EnvControlPath)
+}
+
+// ControlPathFor returns the control path configured for host in the
+// environment: its entry in SSHCTL_CONTROL_PATHS, or else
+// SSHCTL_CONTROL_PATH with "%h" expanded to host. It returns "" if
+// neither is set.
+func ControlPathFor(host string) string {
+	for _, pair := range strings.Split(os.Getenv(EnvControlPaths), ",") {
+		h, path, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && h == host {
+			return path
+		}
+	}
+	return strings.Replace(os.Getenv(EnvControlPath), "%h", host, -1)
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DebugHandler is an http.Handler showing what a set of Clients is
+// doing right now, in the spirit of expvar and net/http/pprof: their
+// running sessions with label, command, state and bytes copied so
+// far, and the forwards opened through them. It serves JSON, e.g.
+//
+//	h := sshctl.NewDebugHandler(client)
+//	http.Handle("/debug/sshctl", h)
+//
+// Commands pass through the sessions' Redactor, but the page still
+// tells a lot about the hosts; do not expose it publicly.
+type DebugHandler struct {
+	mu      sync.Mutex
+	clients map[*Client]bool
+}
+
+// NewDebugHandler returns a DebugHandler showing clients.
+func NewDebugHandler(clients ...*Client) *DebugHandler {
+	h := &DebugHandler{clients: make(map[*Client]bool)}
+	for _, c := range clients {
+		h.Add(c)
+	}
+	return h
+}
+
+// Add adds c to the clients shown.
+func (h *DebugHandler) Add(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+}
+
+// Remove stops showing c, e.g. after it was shut down.
+func (h *DebugHandler) Remove(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// DebugClient is the state of a Client as served by DebugHandler.
+type DebugClient struct {
+	ControlPath string         `json:"control_path"`
+	ShutDown    bool           `json:"shut_down"`
+	Sessions    []DebugSession `json:"sessions"`
+	Forwards    []DebugForward `json:"forwards"`
+}
+
+// DebugSession is a running session as served by DebugHandler.
+type DebugSession struct {
+	Label       string    `json:"label,omitempty"`
+	Cmd         string    `json:"cmd"`
+	State       string    `json:"state"`
+	Started     time.Time `json:"started"`
+	StdinBytes  int64     `json:"stdin_bytes"`
+	StdoutBytes int64     `json:"stdout_bytes"`
+	StderrBytes int64     `json:"stderr_bytes"`
+}
+
+// DebugForward is a forward as served by DebugHandler.
+type DebugForward struct {
+	Forward string    `json:"forward"`
+	Up      bool      `json:"up"`
+	Port    int       `json:"port"`
+	Since   time.Time `json:"since"`
+	Reopens int       `json:"reopens"`
+	Err     string    `json:"error,omitempty"`
+}
+
+// Snapshot returns the current state of the clients, sorted by
+// control path, with sessions in the order they were started.
+func (h *DebugHandler) Snapshot() []DebugClient {
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	res := make([]DebugClient, 0, len(clients))
+	for _, c := range clients {
+		res = append(res, c.debugState())
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].ControlPath < res[j].ControlPath })
+	return res
+}
+
+func (c *Client) debugState() DebugClient {
+	c.mu.Lock()
+	d := DebugClient{ControlPath: c.sshctlpath, ShutDown: c.closed, Sessions: []DebugSession{}}
+	for s := range c.sessions {
+		// only what is set before the session is registered, or
+		// accessed atomically, is safe to read here
+		d.Sessions = append(d.Sessions, DebugSession{
+			Label:       s.label,
+			Cmd:         s.Redactor.Redact(s.cmd),
+			State:       s.State().String(),
+			Started:     s.startTime,
+			StdinBytes:  atomic.LoadInt64(&s.stdinBytes),
+			StdoutBytes: atomic.LoadInt64(&s.stdoutBytes),
+			StderrBytes: atomic.LoadInt64(&s.stderrBytes),
+		})
+	}
+	c.mu.Unlock()
+	sort.Slice(d.Sessions, func(i, j int) bool { return d.Sessions[i].Started.Before(d.Sessions[j].Started) })
+
+	d.Forwards = []DebugForward{}
+	for _, st := range c.Forwards() {
+		f := DebugForward{Forward: st.Forward.String(), Up: st.Up, Port: st.Port, Since: st.Since, Reopens: st.Reopens}
+		if st.Err != nil {
+			f.Err = st.Err.Error()
+		}
+		d.Forwards = append(d.Forwards, f)
+	}
+	return d
+}
+
+func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Clients []DebugClient `json:"clients"`
+	}{h.Snapshot()})
+}
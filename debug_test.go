@@ -0,0 +1,80 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugHandler(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	client := NewClient(g.ctrlSock)
+	f := Forward{LocalForward, "127.0.0.1", freePort(t), "127.0.0.1", echo.Addr().(*net.TCPAddr).Port}
+	if _, err := client.OpenForward(f); err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseAllForwards()
+
+	r, w := io.Pipe()
+	s := client.NewSession().WithLabel("job")
+	s.Stdin, s.Stdout = r, ioutil.Discard
+	if err := s.Start("cat"); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(TestString))
+
+	h := NewDebugHandler(client)
+	get := func() []DebugClient {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/sshctl", nil))
+		var page struct{ Clients []DebugClient }
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%v: %s", err, rec.Body)
+		}
+		return page.Clients
+	}
+	var clients []DebugClient
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		clients = get()
+		if len(clients) == 1 && len(clients[0].Sessions) == 1 && clients[0].Sessions[0].StdoutBytes == int64(len(TestString)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected output to show up, got %+v", clients)
+		}
+	}
+	sess := clients[0].Sessions[0]
+	if clients[0].ControlPath != g.ctrlSock || sess.Label != "job" || sess.Cmd != "cat" ||
+		sess.State != "running" || sess.StdinBytes != int64(len(TestString)) {
+		t.Fatalf("unexpected state %+v", clients[0])
+	}
+	if fw := clients[0].Forwards; len(fw) != 1 || fw[0].Forward != f.String() || !fw[0].Up {
+		t.Fatalf("unexpected forwards %+v", fw)
+	}
+
+	w.Close()
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if clients = get(); len(clients[0].Sessions) != 0 {
+		t.Fatalf("expected no sessions after Wait, got %+v", clients[0].Sessions)
+	}
+	h.Remove(client)
+	if clients = get(); len(clients) != 0 {
+		t.Fatalf("expected no clients, got %+v", clients)
+	}
+}
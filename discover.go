@@ -0,0 +1,203 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MasterCandidate is a live master found by DiscoverMasters. User,
+// Host and Port are hints derived from the socket's name, empty or
+// zero if it does not tell.
+type MasterCandidate struct {
+	Path string
+	Pid  int
+	User string
+	Host string
+	Port int
+}
+
+// discoverGlobs are common ControlPath locations relative to ~/.ssh.
+var discoverGlobs = []string{"ctrl-*", "cm-*", "master-*", "sockets/*", "controlmasters/*"}
+
+// ssh_config files searched for ControlPath settings.
+var sshConfigFiles = []string{"~/.ssh/config", "/etc/ssh/ssh_config"}
+
+// DiscoverMasters looks for control sockets in common locations,
+// such as ~/.ssh/ctrl-* and ~/.ssh/sockets/, and at the ControlPath
+// settings of the user's and the system's ssh_config, and returns
+// those with a live master, sorted by path. It is meant for tools
+// offering to pick a connection.
+func DiscoverMasters() ([]MasterCandidate, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	type pattern struct {
+		glob string
+		hint *regexp.Regexp
+	}
+	var patterns []pattern
+	for _, g := range discoverGlobs {
+		patterns = append(patterns, pattern{filepath.Join(home, ".ssh", g), nil})
+	}
+	for _, file := range sshConfigFiles {
+		for _, tmpl := range controlPaths(expandHome(file, home)) {
+			tmpl = expandHome(tmpl, home)
+			patterns = append(patterns, pattern{controlPathGlob(tmpl), controlPathRegexp(tmpl)})
+		}
+	}
+
+	hints := make(map[string]*regexp.Regexp)
+	for _, p := range patterns {
+		matches, _ := filepath.Glob(p.glob)
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err != nil || fi.Mode()&os.ModeSocket == 0 {
+				continue
+			}
+			if _, ok := hints[m]; !ok || hints[m] == nil {
+				hints[m] = p.hint
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var found []MasterCandidate
+	for path, hint := range hints {
+		wg.Add(1)
+		go func(path string, hint *regexp.Regexp) {
+			defer wg.Done()
+			pid, err := NewClient(path).Check()
+			if err != nil {
+				return
+			}
+			c := MasterCandidate{Path: path, Pid: pid}
+			c.hint(hint)
+			mu.Lock()
+			found = append(found, c)
+			mu.Unlock()
+		}(path, hint)
+	}
+	wg.Wait()
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Path < found[j].Path
+	})
+	return found, nil
+}
+
+// socketNameRegexp guesses user, host and port from socket names such
+// as "ctrl-user@host:22" or "user@host-22".
+var socketNameRegexp = regexp.MustCompile(`^(?:[a-z]+-)?(?:(?P<user>[^@/]+)@)?(?P<host>[^@/]+?)(?:[:_-](?P<port>[0-9]+))?$`)
+
+func (c *MasterCandidate) hint(re *regexp.Regexp) {
+	name := c.Path
+	if re == nil {
+		re, name = socketNameRegexp, filepath.Base(c.Path)
+	}
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return
+	}
+	for i, group := range re.SubexpNames() {
+		switch group {
+		case "user":
+			c.User = m[i]
+		case "host":
+			c.Host = m[i]
+		case "port":
+			c.Port, _ = strconv.Atoi(m[i])
+		}
+	}
+}
+
+// controlPaths returns the ControlPath values of an ssh_config file.
+func controlPaths(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var paths []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		kv := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '='
+		})
+		if len(kv) >= 2 && strings.EqualFold(kv[0], "ControlPath") && kv[1] != "none" {
+			paths = append(paths, strings.Trim(kv[1], `"`))
+		}
+	}
+	return paths
+}
+
+func expandHome(path, home string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return home + path[1:]
+	}
+	return strings.Replace(path, "%d", home, -1)
+}
+
+// controlPathGlob turns the %-tokens of a ControlPath into wildcards.
+func controlPathGlob(tmpl string) string {
+	var b strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		switch {
+		case tmpl[i] != '%' || i+1 == len(tmpl):
+			b.WriteByte(tmpl[i])
+		case tmpl[i+1] == '%':
+			b.WriteByte('%')
+			i++
+		default:
+			b.WriteByte('*')
+			i++
+		}
+	}
+	return b.String()
+}
+
+// controlPathRegexp matches paths made from a ControlPath, capturing
+// the remote user, host and port.
+func controlPathRegexp(tmpl string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteByte('^')
+	seen := make(map[string]bool)
+	group := func(name, re string) string {
+		if seen[name] {
+			return re
+		}
+		seen[name] = true
+		return "(?P<" + name + ">" + re + ")"
+	}
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i+1 == len(tmpl) {
+			b.WriteString(regexp.QuoteMeta(tmpl[i : i+1]))
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'r':
+			b.WriteString(group("user", `[^/]+?`))
+		case 'h', 'n':
+			b.WriteString(group("host", `[^/]+?`))
+		case 'p':
+			b.WriteString(group("port", `[0-9]+`))
+		default:
+			b.WriteString(`[^/]*?`)
+		}
+	}
+	b.WriteByte('$')
+	return regexp.MustCompile(b.String())
+}
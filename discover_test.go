@@ -0,0 +1,74 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverMasters(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	defer func(files []string) { sshConfigFiles = files }(sshConfigFiles)
+	sshConfigFiles = []string{"~/.ssh/config"}
+
+	for _, dir := range []string{".ssh/sockets", ".ssh/cp"} {
+		if err := os.MkdirAll(filepath.Join(home, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := "Host *\n  ControlPath ~/.ssh/cp/%r@%h-%p\n"
+	if err := os.WriteFile(filepath.Join(home, ".ssh/config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newGoMasterAt(t, filepath.Join(home, ".ssh/ctrl-root@db01:2222"))
+	defer a.Shutdown()
+	b := newGoMasterAt(t, filepath.Join(home, ".ssh/cp/deploy@web-01-22"))
+	defer b.Shutdown()
+	c := newGoMasterAt(t, filepath.Join(home, ".ssh/sockets/backup"))
+	defer c.Shutdown()
+
+	// a socket without a master and a regular file
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(home, ".ssh/ctrl-stale"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	os.WriteFile(filepath.Join(home, ".ssh/ctrl-file"), nil, 0600)
+
+	found, err := DiscoverMasters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	want := []MasterCandidate{
+		{Path: b.ctrlSock, Pid: pid, User: "deploy", Host: "web-01", Port: 22},
+		{Path: a.ctrlSock, Pid: pid, User: "root", Host: "db01", Port: 2222},
+		{Path: c.ctrlSock, Pid: pid, Host: "backup"},
+	}
+	if !reflect.DeepEqual(found, want) {
+		t.Fatalf("expected %+v, got %+v", want, found)
+	}
+}
+
+func TestControlPathGlob(t *testing.T) {
+	for tmpl, want := range map[string]string{
+		"/tmp/ssh-%r@%h:%p": "/tmp/ssh-*@*:*",
+		"~/.ssh/cm-%C":      "~/.ssh/cm-*",
+		"/tmp/100%%-%h":     "/tmp/100%-*",
+	} {
+		if got := controlPathGlob(tmpl); got != want {
+			t.Errorf("%s: expected %s, got %s", tmpl, want, got)
+		}
+	}
+}
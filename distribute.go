@@ -0,0 +1,44 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"sync"
+	"time"
+)
+
+// DistributeResult reports the outcome of Distribute for one host.
+type DistributeResult struct {
+	Host     Host
+	Err      error
+	Duration time.Duration
+}
+
+// Distribute copies the file at localPath to remotePath on all hosts
+// concurrently, each through the master at its ControlPath, and
+// verifies the remote sha256 checksum. The file mode is preserved.
+// The results are in the order of hosts; a host failed if its Err is
+// non-nil. Errors of the sessions are labeled with the host's Alias,
+// see WithLabel; use errors.As to get at the *ChecksumError of a
+// remote copy that differs.
+func Distribute(localPath, remotePath string, hosts []Host) []DistributeResult {
+	results := make([]DistributeResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		results[i].Host = h
+		wg.Add(1)
+		go func(res *DistributeResult) {
+			defer wg.Done()
+			start := time.Now()
+			c, err := res.Host.Client()
+			if err == nil {
+				err = c.uploadFile(localPath, remotePath, &TransferOptions{Verify: true}, res.Host.Alias)
+			}
+			res.Err, res.Duration = err, time.Since(start)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
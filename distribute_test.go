@@ -0,0 +1,66 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDistribute(t *testing.T) {
+	var hosts []Host
+	for _, name := range []string{"a", "b", "c"} {
+		g := newGoMaster(t)
+		defer g.Shutdown()
+		hosts = append(hosts, Host{Alias: name, ControlPath: g.ctrlSock})
+	}
+	hosts = append(hosts, Host{Alias: "nomaster"})
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "artifact")
+	data := bytes.Repeat([]byte(TestString), 10000)
+	if err := os.WriteFile(src, data, 0750); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	results := Distribute(src, dst, hosts)
+	for i, res := range results {
+		if res.Host.Alias != hosts[i].Alias {
+			t.Fatalf("results out of order: %v", results)
+		}
+		if res.Host.Alias == "nomaster" {
+			if res.Err != ErrNoControlPath {
+				t.Fatalf("expected ErrNoControlPath, got %v", res.Err)
+			}
+			continue
+		}
+		if res.Err != nil {
+			t.Fatalf("%s: %v", res.Host.Alias, res.Err)
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: content differs, %v", res.Host.Alias, err)
+		}
+		if fi, err := os.Stat(dst); err != nil || fi.Mode().Perm() != 0750 {
+			t.Fatalf("%s: unexpected mode %v, %v", res.Host.Alias, fi.Mode(), err)
+		}
+	}
+
+	// per-host errors name the host
+	results = Distribute(src, filepath.Join(dir, "missing", "dst"), hosts[:2])
+	for _, res := range results {
+		var le *LabeledError
+		if !errors.As(res.Err, &le) || le.Label != res.Host.Alias ||
+			!strings.HasPrefix(res.Err.Error(), res.Host.Alias+": ") {
+			t.Fatalf("%s: expected an error labeled with the host, got %v", res.Host.Alias, res.Err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SendEnv passes local environment variables whose names match one
+// of the allow patterns, but none of the deny patterns, to the remote
+// command, like ssh_config's SendEnv. Patterns use path.Match syntax,
+// e.g. "LC_*". The caveats of Setenv apply.
+func (s *Session) SendEnv(allow, deny []string) error {
+	// not append(allow, deny...), which may write to the caller's
+	// array behind allow
+	for _, patterns := range [][]string{allow, deny} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return err
+			}
+		}
+	}
+	env := os.Environ()
+	sort.Strings(env)
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			continue
+		}
+		name := kv[:i]
+		if matchAny(allow, name) && !matchAny(deny, name) {
+			if err := s.Setenv(name, kv[i+1:]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardLocale passes the local LANG and LC_* variables to the
+// remote command, so it formats output like local commands do. The
+// server only sets them if its AcceptEnv allows them, which stock
+// OpenSSH does not; some distributions, e.g. Debian, add them.
+func (s *Session) ForwardLocale() error {
+	return s.SendEnv([]string{"LANG", "LC_*"}, nil)
+}
+
+// ForceLocale sets LC_ALL to locale, e.g. "C.UTF-8", overriding all
+// locale settings of the remote host. Programs parsing the output of
+// remote commands should use it to get predictable number and date
+// formats and messages.
+func (s *Session) ForceLocale(locale string) error {
+	return s.Setenv("LC_ALL", locale)
+}
+
+// remoteEnvCmd prints the environment with NUL separated entries,
+// so values may contain newlines. Perl stands in for an env(1)
+// without -0.
+const remoteEnvCmd = `env -0 2>/dev/null || perl -e 'print "$_=$ENV{$_}\0" for keys %ENV'`
+
+// RemoteEnv returns the environment a command on the remote host
+// runs with, as set up by its login and the server, e.g. to find
+// PATH or HOME before running other commands.
+func (c *Client) RemoteEnv() (map[string]string, error) {
+	out, err := c.NewSession().Output(remoteEnvCmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseEnv(out), nil
+}
+
+// parseEnv splits NUL separated "NAME=value" entries.
+func parseEnv(data []byte) map[string]string {
+	env := make(map[string]string)
+	for _, kv := range strings.Split(string(data), "\x00") {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSendEnv(t *testing.T) {
+	t.Setenv("SSHCTL_TEST_A", "a")
+	t.Setenv("SSHCTL_TEST_B", "b")
+	t.Setenv("SSHCTL_TEST_SECRET", "s")
+	t.Setenv("OTHER_SSHCTL_TEST", "o")
+
+	s := NewSession("")
+	if err := s.SendEnv([]string{"SSHCTL_TEST_*"}, []string{"*SECRET*"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SSHCTL_TEST_A=a", "SSHCTL_TEST_B=b"}
+	if !reflect.DeepEqual(s.env, want) {
+		t.Fatalf("expected %q, got %q", want, s.env)
+	}
+	if err := s.SendEnv([]string{"["}, nil); err == nil {
+		t.Fatalf("expected error for malformed pattern")
+	}
+
+	allow := make([]string, 1, 2)
+	allow[0] = "SSHCTL_TEST_A"
+	if err := NewSession("").SendEnv(allow, []string{"*SECRET*"}); err != nil {
+		t.Fatal(err)
+	}
+	if spare := allow[:2][1]; spare != "" {
+		t.Fatalf("expected the caller's slice to be untouched, got %q", spare)
+	}
+}
+
+func TestLocale(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	t.Setenv("LC_SSHCTL_TEST", TestString)
+	s := NewSession(g.ctrlSock)
+	if err := s.ForwardLocale(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ForceLocale("C"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.Output(`printf "$LC_SSHCTL_TEST $LC_ALL"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := TestString + " C"; string(out) != want {
+		t.Fatalf("expected %q, got %q", want, out)
+	}
+}
+
+func TestRemoteEnv(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	// the test server passes its environment on
+	t.Setenv("SSHCTL_TEST_MULTI", "a\nb=c\n")
+	t.Setenv("SSHCTL_TEST_EMPTY", "")
+	env, err := NewClient(g.ctrlSock).RemoteEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := env["SSHCTL_TEST_MULTI"]; !ok || v != "a\nb=c\n" {
+		t.Fatalf("expected multiline value, got %q", v)
+	}
+	if v, ok := env["SSHCTL_TEST_EMPTY"]; !ok || v != "" {
+		t.Fatalf("expected empty value, got %q (%v)", v, ok)
+	}
+}
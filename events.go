@@ -0,0 +1,99 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SessionEventType tells what a SessionEvent reports.
+type SessionEventType int
+
+const (
+	SessionOpened  SessionEventType = iota // the master opened the session
+	SessionStarted                         // the command runs and its stdio is copied
+	SessionBytes                           // more bytes were copied
+	SessionExited                          // Wait returned or Start failed, Err tells how
+)
+
+var sessionEventNames = []string{
+	SessionOpened:  "opened",
+	SessionStarted: "started",
+	SessionBytes:   "bytes",
+	SessionExited:  "exited",
+}
+
+func (t SessionEventType) String() string {
+	if t < 0 || int(t) >= len(sessionEventNames) {
+		return "unknown"
+	}
+	return sessionEventNames[t]
+}
+
+// SessionEvent is a progress update of a session, see Session.Events.
+type SessionEvent struct {
+	Type  SessionEventType
+	Time  time.Time
+	Path  string // the control socket
+	Label string // set by WithLabel
+	Cmd   string // passed through the session's Redactor
+
+	// bytes copied so far
+	StdinBytes, StdoutBytes, StderrBytes int64
+
+	// Err is what Wait or Start returned, for SessionExited
+	Err error
+}
+
+// event returns a SessionEvent of type t describing s now.
+func (s *Session) event(t SessionEventType, err error) SessionEvent {
+	return SessionEvent{
+		Type:        t,
+		Time:        time.Now(),
+		Path:        s.sshctlpath,
+		Label:       s.label,
+		Cmd:         s.Redactor.Redact(s.cmd),
+		StdinBytes:  atomic.LoadInt64(&s.stdinBytes),
+		StdoutBytes: atomic.LoadInt64(&s.stdoutBytes),
+		StderrBytes: atomic.LoadInt64(&s.stderrBytes),
+		Err:         err,
+	}
+}
+
+// emit sends a lifecycle event to Events, if set.
+func (s *Session) emit(t SessionEventType, err error) {
+	if s.Events != nil {
+		s.Events <- s.event(t, err)
+	}
+}
+
+// reportBytes sends SessionBytes at most every progressInterval while
+// the counts change, until the session is over. Events that do not
+// fit into the channel are dropped.
+func (s *Session) reportBytes() {
+	defer close(s.bytesReported)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	var last SessionEvent
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.exited:
+			return
+		case <-s.aborted:
+			return
+		}
+		ev := s.event(SessionBytes, nil)
+		if ev.StdinBytes == last.StdinBytes && ev.StdoutBytes == last.StdoutBytes && ev.StderrBytes == last.StderrBytes {
+			continue
+		}
+		select {
+		case s.Events <- ev:
+			last = ev
+		default:
+		}
+	}
+}
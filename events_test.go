@@ -0,0 +1,57 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestSessionEvents(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	events := make(chan SessionEvent, 100)
+	client := NewClient(g.ctrlSock)
+	client.Events = events
+	sess := client.NewSession().WithLabel("job")
+	sess.Stdout = ioutil.Discard
+	if err := sess.Run("echo -n " + TestString + "; sleep 0.5"); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	var types []SessionEventType
+	var last SessionEvent
+	for ev := range events {
+		if len(types) == 0 || types[len(types)-1] != ev.Type {
+			types = append(types, ev.Type)
+		}
+		if ev.Label != "job" || ev.Path != g.ctrlSock {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+		last = ev
+	}
+	want := []SessionEventType{SessionOpened, SessionStarted, SessionBytes, SessionExited}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("expected events %v, got %v", want, types)
+	}
+	if last.StdoutBytes != int64(len(TestString)) || last.Err != nil {
+		t.Fatalf("unexpected exit event %+v", last)
+	}
+
+	events = make(chan SessionEvent, 1)
+	sess = NewSession(g.ctrlSock + ".missing")
+	sess.Events = events
+	if err := sess.Start("true"); err == nil {
+		t.Fatal("expected Start to fail")
+	}
+	if ev := <-events; ev.Type != SessionExited || ev.Err == nil {
+		t.Fatalf("expected an exit event with the error, got %+v", ev)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Executor runs a command on many hosts in parallel, each through the
+// master at its ControlPath.
+type Executor struct {
+	Hosts []Host
+
+	// Vars holds variables for RunTemplate by host Alias.
+	Vars map[string]map[string]string
+
+	// Concurrency limits the number of hosts running the command at
+	// once. Zero means no limit.
+	Concurrency int
+
+	// Timeout, if non-zero, bounds each attempt of the command on a
+	// host; HostTimeouts overrides it for hosts by Alias. An attempt
+	// running out of time fails with ErrExecTimeout.
+	Timeout      time.Duration
+	HostTimeouts map[string]time.Duration
+
+	// Retries is the number of times a failed host is retried. Only
+	// failures other than a remote exit status are retried, e.g. a
+	// master that is not up or an attempt that timed out.
+	Retries int
+
+	// MinBackoff and MaxBackoff bound the delay between attempts,
+	// which doubles with every retry. If zero, 1 second and 1 minute
+	// are used.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// NewSession, if non-nil, creates the sessions run on a host
+	// instead of the host's Client, e.g. to set their environment
+	// and timeouts. Config.Executor sets it to Config.NewSession.
+	NewSession func(h Host) (*Session, error)
+
+	// Breaker, if non-nil, skips hosts that failed repeatedly: their
+	// attempts fail with a *CircuitOpenError while the breaker is
+	// open, without being retried.
+	Breaker *CircuitBreaker
+
+	// RunTimeout, if non-zero, bounds the whole run. Hosts not done
+	// by then are cancelled as if the run's context was.
+	RunTimeout time.Duration
+
+	// DryRun makes runs only check that each host's master is
+	// alive, with the hello and alive check of Client.Check, instead
+	// of starting sessions. The results report the commands that
+	// would have been run, and Err if the master is not usable.
+	DryRun bool
+
+	// Events, if non-nil, receives an event when a host starts, for
+	// each chunk of its output, and when it finishes. Unlike with
+	// Supervisor, events are never dropped, so the receiver must
+	// keep up. Every run closes Events before it returns, also one
+	// failing early like RunTemplate with a bad template, so a
+	// channel can only be used for one run; set a new one before the
+	// next.
+	Events chan<- ExecEvent
+}
+
+// ExecEventType tells what happened on a host of an Executor run.
+type ExecEventType int
+
+const (
+	ExecStarted  ExecEventType = iota // the host was picked up
+	ExecOutput                        // the command wrote Data
+	ExecRetrying                      // an attempt failed, see Result; retry after Delay
+	ExecFinished                      // the host is done, see Result
+)
+
+var execEventNames = []string{
+	ExecStarted:  "started",
+	ExecOutput:   "output",
+	ExecRetrying: "retrying",
+	ExecFinished: "finished",
+}
+
+func (t ExecEventType) String() string {
+	if t < 0 || int(t) >= len(execEventNames) {
+		return "unknown"
+	}
+	return execEventNames[t]
+}
+
+// ExecEvent reports progress of an Executor run on one host.
+type ExecEvent struct {
+	Type   ExecEventType
+	Time   time.Time
+	Host   Host
+	Stderr bool          // for ExecOutput, whether Data went to stderr
+	Data   []byte        // for ExecOutput
+	Delay  time.Duration // for ExecRetrying
+	Result *HostResult   // for ExecRetrying and ExecFinished
+}
+
+// ErrExecTimeout is the error of an Executor attempt that ran longer
+// than its timeout.
+var ErrExecTimeout = errors.New("sshctl: command timed out")
+
+func (e *Executor) emit(ev ExecEvent) {
+	if e.Events == nil {
+		return
+	}
+	ev.Time = time.Now()
+	e.Events <- ev
+}
+
+// execOutput passes output to a buffer and on to Events.
+type execOutput struct {
+	e      *Executor
+	host   Host
+	stderr bool
+	buf    bytes.Buffer
+}
+
+func (w *execOutput) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	w.e.emit(ExecEvent{Type: ExecOutput, Host: w.host, Stderr: w.stderr, Data: append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+// NewExecutor returns an Executor for hosts.
+func NewExecutor(hosts []Host) *Executor {
+	return &Executor{Hosts: hosts}
+}
+
+// HostResult is the outcome of an Executor run on one host.
+//
+// In JSON, Host is its Alias, Err its message, omitted if nil, and
+// Duration a number of seconds, so results can be stored or handed
+// to other tools. Decoding restores Err as a plain error carrying the
+// message.
+type HostResult struct {
+	Host       Host
+	Cmd        string
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int           // as for ExitCode(Err)
+	Duration   time.Duration // of all attempts, including backoff
+	Err        error
+	Attempts   int
+
+	// Cancelled is set if the run's context was done before the
+	// host finished; Err is then the context's error.
+	Cancelled bool
+
+	// DryRun is set if Cmd was not run, see Executor.DryRun.
+	DryRun bool
+}
+
+type hostResultJSON struct {
+	Host       string  `json:"host"`
+	Cmd        string  `json:"cmd"`
+	Stdout     string  `json:"stdout"`
+	Stderr     string  `json:"stderr"`
+	ExitStatus int     `json:"exit_status"`
+	Duration   float64 `json:"duration"`
+	Err        string  `json:"error,omitempty"`
+	Attempts   int     `json:"attempts"`
+	Cancelled  bool    `json:"cancelled,omitempty"`
+	DryRun     bool    `json:"dry_run,omitempty"`
+}
+
+func (r HostResult) MarshalJSON() ([]byte, error) {
+	j := hostResultJSON{
+		Host:       r.Host.Alias,
+		Cmd:        r.Cmd,
+		Stdout:     string(r.Stdout),
+		Stderr:     string(r.Stderr),
+		ExitStatus: r.ExitStatus,
+		Duration:   r.Duration.Seconds(),
+		Attempts:   r.Attempts,
+		Cancelled:  r.Cancelled,
+		DryRun:     r.DryRun,
+	}
+	if r.Err != nil {
+		j.Err = r.Err.Error()
+	}
+	return json.Marshal(j)
+}
+
+func (r *HostResult) UnmarshalJSON(data []byte) error {
+	var j hostResultJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*r = HostResult{
+		Host:       Host{Alias: j.Host},
+		Cmd:        j.Cmd,
+		Stdout:     []byte(j.Stdout),
+		Stderr:     []byte(j.Stderr),
+		ExitStatus: j.ExitStatus,
+		Duration:   time.Duration(j.Duration * float64(time.Second)),
+		Attempts:   j.Attempts,
+		Cancelled:  j.Cancelled,
+		DryRun:     j.DryRun,
+	}
+	if j.Err != "" {
+		r.Err = errors.New(j.Err)
+	}
+	return nil
+}
+
+// Run runs cmd on all hosts and returns the result of each, in the
+// order of Hosts.
+func (e *Executor) Run(cmd string) []HostResult {
+	return e.RunContext(context.Background(), cmd)
+}
+
+// RunContext is like Run but stops once ctx is done: the sessions
+// still running are closed, hosts not started yet are skipped, and
+// RunContext returns when all goroutines are done, with the results
+// of hosts that did not finish marked Cancelled. Hosts skipped get an
+// ExecFinished event only.
+//
+// Closing a session closes its channel, so the remote command sees
+// EOF on its standard input and SIGPIPE when writing output, which
+// ends most commands. Ones ignoring both keep running.
+func (e *Executor) RunContext(ctx context.Context, cmd string) []HostResult {
+	results := make([]HostResult, len(e.Hosts))
+	for i := range results {
+		results[i].Host, results[i].Cmd = e.Hosts[i], cmd
+	}
+	return e.runAll(ctx, results)
+}
+
+// runAll runs the Cmd of each result on its Host, skipping those
+// that already failed.
+func (e *Executor) runAll(ctx context.Context, results []HostResult) []HostResult {
+	if e.Events != nil {
+		defer close(e.Events)
+	}
+	if e.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.RunTimeout)
+		defer cancel()
+	}
+	var sem chan struct{}
+	if e.Concurrency > 0 {
+		sem = make(chan struct{}, e.Concurrency)
+	}
+	var wg sync.WaitGroup
+	for i := range results {
+		if results[i].Err != nil {
+			e.emit(ExecEvent{Type: ExecFinished, Host: results[i].Host, Result: &results[i]})
+			continue
+		}
+		wg.Add(1)
+		go func(res *HostResult) {
+			defer wg.Done()
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				res.Err, res.ExitStatus, res.Cancelled = err, ExitCode(err), true
+			} else {
+				e.emit(ExecEvent{Type: ExecStarted, Host: res.Host})
+				e.run(ctx, res)
+			}
+			e.emit(ExecEvent{Type: ExecFinished, Host: res.Host, Result: res})
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+func (e *Executor) run(ctx context.Context, res *HostResult) {
+	start := time.Now()
+	if e.DryRun {
+		res.DryRun = true
+		c, err := res.Host.Client()
+		if err == nil {
+			_, err = c.Check()
+		}
+		res.Err, res.ExitStatus, res.Duration = err, ExitCode(err), time.Since(start)
+		return
+	}
+	timeout, ok := e.HostTimeouts[res.Host.Alias]
+	if !ok {
+		timeout = e.Timeout
+	}
+	minDelay := durationOr(e.MinBackoff, time.Second)
+	maxDelay := durationOr(e.MaxBackoff, time.Minute)
+	delay := minDelay
+	for {
+		if e.Breaker != nil {
+			if res.Err = e.Breaker.Allow(res.Host.Alias); res.Err != nil {
+				break
+			}
+		}
+		res.Attempts++
+		e.attempt(ctx, res, timeout)
+		var ee *ExitError
+		if e.Breaker != nil && ctx.Err() == nil {
+			if errors.As(res.Err, &ee) {
+				e.Breaker.Record(res.Host.Alias, nil)
+			} else {
+				e.Breaker.Record(res.Host.Alias, res.Err)
+			}
+		}
+		if res.Err == nil || errors.As(res.Err, &ee) || ctx.Err() != nil || res.Attempts > e.Retries {
+			break
+		}
+		failed := *res
+		e.emit(ExecEvent{Type: ExecRetrying, Host: res.Host, Delay: delay, Result: &failed})
+		select {
+		case <-ctx.Done():
+			res.Err = ctx.Err()
+		case <-time.After(delay):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	res.ExitStatus, res.Duration = ExitCode(res.Err), time.Since(start)
+	res.Cancelled = res.Err != nil && ctx.Err() != nil
+}
+
+// attempt runs the command once, setting the output and Err of res.
+func (e *Executor) attempt(ctx context.Context, res *HostResult, timeout time.Duration) {
+	s, err := e.newSession(res.Host)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	actx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		actx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	stdout := &execOutput{e: e, host: res.Host}
+	stderr := &execOutput{e: e, host: res.Host, stderr: true}
+	s.Stdout, s.Stderr = stdout, stderr
+	err = s.RunContext(actx, res.Cmd)
+	if err != nil && ctx.Err() == nil && actx.Err() != nil {
+		err = fmt.Errorf("%w after %v", ErrExecTimeout, timeout)
+	}
+	res.Stdout, res.Stderr, res.Err = stdout.buf.Bytes(), stderr.buf.Bytes(), err
+}
+
+// newSession returns a session on h, see NewSession.
+func (e *Executor) newSession(h Host) (*Session, error) {
+	if e.NewSession != nil {
+		return e.NewSession(h)
+	}
+	c, err := h.Client()
+	if err != nil {
+		return nil, err
+	}
+	return c.NewSession(), nil
+}
@@ -0,0 +1,301 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHostResult(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	e := NewExecutor([]Host{
+		{Alias: "a", ControlPath: g.ctrlSock},
+		{Alias: "b"},
+	})
+	res := e.Run("echo out; echo err >&2; exit 3")
+	if string(res[0].Stdout) != "out\n" || string(res[0].Stderr) != "err\n" || res[0].ExitStatus != 3 {
+		t.Fatalf("unexpected result %+v", res[0])
+	}
+	if res[0].Duration <= 0 {
+		t.Fatalf("expected a duration, got %v", res[0].Duration)
+	}
+	if res[1].Err != ErrNoControlPath || res[1].ExitStatus != 255 {
+		t.Fatalf("expected ErrNoControlPath, got %+v", res[1])
+	}
+
+	r := HostResult{Host: Host{Alias: "a", Port: 22}, Stdout: []byte("out\n"), ExitStatus: 255,
+		Duration: 1500 * time.Millisecond, Err: ErrNoControlPath, Attempts: 2}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"host":"a","cmd":"","stdout":"out\n","stderr":"","exit_status":255,"duration":1.5,"error":"sshctl: no ControlPath configured","attempts":2}`
+	if string(data) != want {
+		t.Fatalf("expected %s, got %s", want, data)
+	}
+	var back HostResult
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Host.Alias != "a" || string(back.Stdout) != "out\n" || back.Duration != r.Duration || back.Attempts != 2 ||
+		back.Err == nil || back.Err.Error() != r.Err.Error() {
+		t.Fatalf("round trip changed %+v to %+v", r, back)
+	}
+	if data, _ := json.Marshal(HostResult{Host: Host{Alias: "b"}}); string(data) != `{"host":"b","cmd":"","stdout":"","stderr":"","exit_status":0,"duration":0,"attempts":0}` {
+		t.Fatalf("unexpected encoding of a success: %s", data)
+	}
+}
+
+func TestExecutorEvents(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	events := make(chan ExecEvent)
+	e := NewExecutor([]Host{{Alias: "a", ControlPath: g.ctrlSock}, {Alias: "b", ControlPath: g.ctrlSock}})
+	e.Events = events
+	done := make(chan []HostResult)
+	go func() { done <- e.Run("echo out; echo err >&2") }()
+
+	var seen []string
+	output := make(map[string]string)
+	for ev := range events {
+		switch ev.Type {
+		case ExecOutput:
+			if ev.Stderr {
+				output[ev.Host.Alias+"/err"] += string(ev.Data)
+			} else {
+				output[ev.Host.Alias+"/out"] += string(ev.Data)
+			}
+			continue
+		case ExecFinished:
+			if ev.Result == nil || ev.Result.Err != nil {
+				t.Errorf("%s: unexpected result %+v", ev.Host.Alias, ev.Result)
+			}
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("%s: %s event without time", ev.Host.Alias, ev.Type)
+		}
+		seen = append(seen, ev.Host.Alias+" "+ev.Type.String())
+	}
+	res := <-done
+	if len(res) != 2 || len(seen) != 4 {
+		t.Fatalf("expected 2 results and 4 events, got %d and %q", len(res), seen)
+	}
+	for _, h := range []string{"a", "b"} {
+		if output[h+"/out"] != "out\n" || output[h+"/err"] != "err\n" {
+			t.Errorf("%s: unexpected output %q", h, output)
+		}
+	}
+}
+
+func TestExecutorCancel(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	var hosts []Host
+	for _, name := range []string{"a", "b", "c"} {
+		hosts = append(hosts, Host{Alias: name, ControlPath: g.ctrlSock})
+	}
+	events := make(chan ExecEvent, 16)
+	e := NewExecutor(hosts)
+	e.Concurrency = 2
+	e.Events = events
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan []HostResult)
+	go func() { done <- e.RunContext(ctx, "echo up; sleep 10") }()
+
+	for up := 0; up < 2; {
+		if ev := <-events; ev.Type == ExecOutput {
+			up++
+		}
+	}
+	start := time.Now()
+	cancel()
+	var res []HostResult
+	select {
+	case res = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext did not return after cancel")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("cancel took %v", d)
+	}
+	for _, r := range res {
+		if !r.Cancelled || !errors.Is(r.Err, context.Canceled) {
+			t.Errorf("%s: expected cancelled result, got %+v", r.Host.Alias, r)
+		}
+	}
+	var skipped int
+	for _, r := range res {
+		if r.Stdout == nil {
+			skipped++
+		} else if string(r.Stdout) != "up\n" {
+			t.Errorf("%s: unexpected output %q", r.Host.Alias, r.Stdout)
+		}
+	}
+	if skipped != 1 {
+		t.Errorf("expected one host to be skipped, got %d", skipped)
+	}
+	var started int
+	for ev := range events {
+		if ev.Type == ExecStarted {
+			started++
+		}
+	}
+	if started != 0 {
+		t.Errorf("expected no more hosts to be started, got %d", started)
+	}
+}
+
+func TestExecutorRetry(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	late := filepath.Join(t.TempDir(), "late.sock")
+
+	events := make(chan ExecEvent)
+	e := NewExecutor([]Host{
+		{Alias: "fails", ControlPath: g.ctrlSock},
+		{Alias: "down", ControlPath: g.ctrlSock + ".missing"},
+		{Alias: "late", ControlPath: late},
+	})
+	e.Retries = 2
+	e.MinBackoff = 50 * time.Millisecond
+	e.Events = events
+	retries := make(map[string][]time.Duration)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range events {
+			if ev.Type != ExecRetrying {
+				continue
+			}
+			if ev.Host.Alias == "late" && len(retries["late"]) == 0 {
+				// the master comes up during the backoff
+				os.Symlink(g.ctrlSock, late)
+			}
+			retries[ev.Host.Alias] = append(retries[ev.Host.Alias], ev.Delay)
+		}
+	}()
+	res := e.Run("exit 3")
+	<-done
+
+	if res[0].Attempts != 1 || res[0].ExitStatus != 3 {
+		t.Errorf("expected a remote exit status not to be retried, got %+v", res[0])
+	}
+	if res[1].Attempts != 3 || res[1].Err == nil || res[1].Duration < 150*time.Millisecond {
+		t.Errorf("expected 3 attempts with backoff for down, got %+v", res[1])
+	}
+	if res[2].Attempts != 2 || res[2].ExitStatus != 3 {
+		t.Errorf("expected late to succeed on the second attempt, got %+v", res[2])
+	}
+	want := map[string][]time.Duration{
+		"down": {50 * time.Millisecond, 100 * time.Millisecond},
+		"late": {50 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(retries, want) {
+		t.Errorf("expected retries %v, got %v", want, retries)
+	}
+}
+
+func TestExecutorBreaker(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	e := NewExecutor([]Host{
+		{Alias: "up", ControlPath: g.ctrlSock},
+		{Alias: "down", ControlPath: g.ctrlSock + ".missing"},
+	})
+	e.Retries = 5
+	e.MinBackoff = time.Millisecond
+	e.Breaker = &CircuitBreaker{Threshold: 2, Cooldown: 200 * time.Millisecond}
+	var ce *CircuitOpenError
+	res := e.Run("exit 3")
+	if res[0].ExitStatus != 3 || e.Breaker.Allow("up") != nil {
+		t.Errorf("expected up to run, got %+v", res[0])
+	}
+	if res[1].Attempts != 2 || !errors.As(res[1].Err, &ce) || ce.Host != "down" || ce.Failures != 2 {
+		t.Errorf("expected the breaker to stop retrying down, got %+v", res[1])
+	}
+
+	res = e.Run("exit 3")
+	if res[1].Attempts != 0 || !errors.As(res[1].Err, &ce) || res[1].ExitStatus != 255 {
+		t.Errorf("expected down to be skipped, got %+v", res[1])
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	e.Retries = 0
+	res = e.Run("exit 3")
+	if res[1].Attempts != 1 || errors.As(res[1].Err, &ce) {
+		t.Errorf("expected down to be tried after the cooldown, got %+v", res[1])
+	}
+	if err := e.Breaker.Allow("down"); !errors.As(err, &ce) || ce.Failures != 3 {
+		t.Errorf("expected a failure after the cooldown to open the breaker, got %v", err)
+	}
+	e.Breaker.Reset("down")
+	if err := e.Breaker.Allow("down"); err != nil {
+		t.Errorf("expected Reset to close the breaker, got %v", err)
+	}
+}
+
+func TestExecutorTimeouts(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	e := NewExecutor([]Host{{Alias: "fast", ControlPath: g.ctrlSock}, {Alias: "slow", ControlPath: g.ctrlSock}})
+	e.HostTimeouts = map[string]time.Duration{"slow": 50 * time.Millisecond}
+	res := e.Run("sleep 0.3")
+	if res[0].Err != nil {
+		t.Errorf("expected fast to succeed, got %v", res[0].Err)
+	}
+	if !errors.Is(res[1].Err, ErrExecTimeout) || res[1].Cancelled {
+		t.Errorf("expected slow to time out, got %+v", res[1])
+	}
+
+	e.HostTimeouts = nil
+	e.RunTimeout = 50 * time.Millisecond
+	start := time.Now()
+	for _, r := range e.Run("sleep 5") {
+		if !r.Cancelled || !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected the run deadline to cancel, got %+v", r.Host.Alias, r)
+		}
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("run deadline took %v", d)
+	}
+}
+
+func TestExecutorDryRun(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	marker := filepath.Join(t.TempDir(), "marker")
+
+	e := NewExecutor([]Host{{Alias: "up", ControlPath: g.ctrlSock}, {Alias: "down", ControlPath: g.ctrlSock + ".missing"}})
+	e.DryRun = true
+	res, err := e.RunTemplate("touch " + marker + ".{{.Host.Alias}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res[0].DryRun || res[0].Err != nil || res[0].Cmd != "touch "+marker+".up" {
+		t.Errorf("unexpected result for up: %+v", res[0])
+	}
+	var me *MasterError
+	if !res[1].DryRun || !errors.As(res[1].Err, &me) || me.Op != "dial" {
+		t.Errorf("expected a dial error for down, got %+v", res[1])
+	}
+	if _, err := os.Stat(marker + ".up"); !os.IsNotExist(err) {
+		t.Fatalf("dry run ran the command: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// signal numbers by name, as sent in ssh "exit-signal" messages
+var signalNumbers = map[string]int{
+	"HUP": 1, "INT": 2, "QUIT": 3, "ILL": 4, "ABRT": 6, "FPE": 8,
+	"KILL": 9, "USR1": 10, "SEGV": 11, "USR2": 12, "PIPE": 13,
+	"ALRM": 14, "TERM": 15,
+}
+
+// ExitCode converts an error returned by Run, Wait and friends into
+// a process exit code following ssh(1)'s conventions, for programs
+// that wrap a remote command:
+//
+//	nil                          0
+//	*ExitError                   the remote exit status, or
+//	                             128 + signal number if killed by a signal
+//	ErrAborted, context.Canceled 130, as if interrupted by SIGINT
+//	ErrDetached                  0
+//	*TTYAllocError               the code of its Err
+//	anything else                255, like ssh(1) on connection errors
+func ExitCode(err error) int {
+	if err == nil || errors.Is(err, ErrDetached) {
+		return 0
+	}
+	var te *TTYAllocError
+	if errors.As(err, &te) {
+		return ExitCode(te.Err)
+	}
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		if sig := ee.Signal(); sig != "" {
+			if n, ok := signalNumbers[strings.TrimPrefix(sig, "SIG")]; ok {
+				return 128 + n
+			}
+			return 255
+		}
+		if st := ee.ExitStatus(); st >= 0 && st <= 255 {
+			return st
+		}
+		return 255
+	}
+	if errors.Is(err, ErrAborted) || errors.Is(err, context.Canceled) {
+		return 130
+	}
+	return 255
+}
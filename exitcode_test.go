@@ -0,0 +1,35 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{&ExitError{Waitmsg{status: 3}}, 3},
+		{&ExitError{Waitmsg{status: 143, signal: "TERM"}}, 143},
+		{&ExitError{Waitmsg{status: 130, signal: "SIGINT"}}, 130},
+		{&LabeledError{"db01", &ExitError{Waitmsg{status: 7}}}, 7},
+		{&ExitMissingError{}, 255},
+		{ErrAborted, 130},
+		{context.Canceled, 130},
+		{ErrDetached, 0},
+		{&TTYAllocError{}, 0},
+		{&TTYAllocError{&ExitError{Waitmsg{status: 4}}}, 4},
+		{errors.New("Unable to read from control socket"), 255},
+	} {
+		if got := ExitCode(tc.err); got != tc.want {
+			t.Errorf("ExitCode(%v): expected %d, got %d", tc.err, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Extension describes a mux hello extension. Client and master may
+// append name/value pairs to their hello messages to negotiate
+// features beyond the base protocol.
+type Extension struct {
+	// Name of the extension, e.g. "example@openssh.com".
+	Name string
+
+	// Advertise sends the extension with Value in our hello.
+	Advertise bool
+	Value     string
+
+	// Consume, if non-nil, is called during the handshake with the
+	// value the master advertised for Name. Returning an error
+	// aborts the handshake.
+	Consume func(s *Session, value string) error
+}
+
+var extensions = struct {
+	sync.Mutex
+	m map[string]Extension
+}{m: make(map[string]Extension)}
+
+// RegisterExtension makes a hello extension known to all sessions.
+// Registering a name twice replaces the earlier registration.
+func RegisterExtension(ext Extension) {
+	extensions.Lock()
+	defer extensions.Unlock()
+	extensions.m[ext.Name] = ext
+}
+
+func registeredExtension(name string) (Extension, bool) {
+	extensions.Lock()
+	defer extensions.Unlock()
+	ext, ok := extensions.m[name]
+	return ext, ok
+}
+
+// marshalExtensions returns the advertised extensions in the wire
+// format of the hello message, ordered by name.
+func marshalExtensions() []byte {
+	extensions.Lock()
+	defer extensions.Unlock()
+	names := make([]string, 0, len(extensions.m))
+	for name, ext := range extensions.m {
+		if ext.Advertise {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		buf = append(buf, ssh.Marshal(struct {
+			Name  string
+			Value string
+		}{name, extensions.m[name].Value})...)
+	}
+	return buf
+}
+
+// consumeExtensions hands the master's extensions to the registered
+// consumers.
+func (s *Session) consumeExtensions() error {
+	for name, value := range s.masterExtensions {
+		ext, ok := registeredExtension(name)
+		if !ok || ext.Consume == nil {
+			continue
+		}
+		if err := ext.Consume(s, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnknownExtensions returns the extensions advertised by the master
+// that have not been registered with RegisterExtension.
+func (m *MasterInfo) UnknownExtensions() map[string]string {
+	unknown := make(map[string]string)
+	for name, value := range m.Extensions {
+		if _, ok := registeredExtension(name); !ok {
+			unknown[name] = value
+		}
+	}
+	return unknown
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Facts describes a remote host, see GatherFacts.
+type Facts struct {
+	// Kernel, Hostname, KernelRelease, KernelVersion and Machine are
+	// the output of uname -s, -n, -r, -v and -m, e.g. "Linux" and
+	// "x86_64".
+	Kernel        string
+	Hostname      string
+	KernelRelease string
+	KernelVersion string
+	Machine       string
+
+	// OSRelease holds the variables of os-release(5), e.g. ID and
+	// VERSION_ID, with quoting removed. It is empty on systems
+	// without the file.
+	OSRelease map[string]string
+
+	// CPUs is the number of online processors and Memory the size of
+	// the physical memory in bytes. Either is zero if unknown.
+	CPUs   int
+	Memory int64
+
+	// Home is the home directory of the remote user.
+	Home string
+}
+
+// factsSep separates the sections of the facts script's output.
+const factsSep = "--sshctl-facts--"
+
+// factsScript prints, in sections: uname, the number of CPUs, the
+// memory size, $HOME and os-release. It tries the Linux way first
+// and falls back to sysctl(8) for the BSDs and macOS.
+const factsScript = `uname -s; uname -n; uname -r; uname -v; uname -m
+echo ` + factsSep + `
+getconf _NPROCESSORS_ONLN 2>/dev/null || sysctl -n hw.ncpu 2>/dev/null
+echo ` + factsSep + `
+awk '/^MemTotal:/ { printf "%.0f\n", $2 * 1024 }' /proc/meminfo 2>/dev/null ||
+	sysctl -n hw.memsize 2>/dev/null || sysctl -n hw.physmem 2>/dev/null
+echo ` + factsSep + `
+printf '%s\n' "$HOME"
+echo ` + factsSep + `
+cat /etc/os-release 2>/dev/null || cat /usr/lib/os-release 2>/dev/null
+true`
+
+// GatherFacts collects facts about the remote host in a single
+// session, for inventories and for deciding what to run. The remote
+// host needs a POSIX shell; facts that cannot be determined are left
+// at their zero value.
+func (c *Client) GatherFacts() (*Facts, error) {
+	out, err := c.NewSession().Output(factsScript)
+	if err != nil {
+		return nil, err
+	}
+	return parseFacts(out)
+}
+
+func parseFacts(out []byte) (*Facts, error) {
+	sections := strings.Split(string(out), factsSep+"\n")
+	if len(sections) != 5 {
+		return nil, fmt.Errorf("sshctl: facts: expected 5 sections, got %d", len(sections))
+	}
+	f := &Facts{OSRelease: parseOSRelease([]byte(sections[4]))}
+	uname := strings.Split(strings.TrimSuffix(sections[0], "\n"), "\n")
+	for i, p := range []*string{&f.Kernel, &f.Hostname, &f.KernelRelease, &f.KernelVersion, &f.Machine} {
+		if i < len(uname) {
+			*p = uname[i]
+		}
+	}
+	f.CPUs, _ = strconv.Atoi(strings.TrimSpace(sections[1]))
+	f.Memory, _ = strconv.ParseInt(strings.TrimSpace(sections[2]), 10, 64)
+	f.Home = strings.TrimSuffix(sections[3], "\n")
+	return f, nil
+}
+
+// parseOSRelease parses the shell-like assignments of os-release(5).
+func parseOSRelease(data []byte) map[string]string {
+	vars := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		i := strings.Index(line, "=")
+		if line == "" || line[0] == '#' || i <= 0 {
+			continue
+		}
+		vars[line[:i]] = unquoteOSRelease(line[i+1:])
+	}
+	return vars
+}
+
+func unquoteOSRelease(v string) string {
+	if len(v) < 2 || v[0] != v[len(v)-1] {
+		return v
+	}
+	switch v[0] {
+	case '\'':
+		return v[1 : len(v)-1]
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(v)-1; i++ {
+			// backslash escapes ", \, $ and `
+			if v[i] == '\\' && i+1 < len(v)-1 && strings.IndexByte("\"\\$`", v[i+1]) >= 0 {
+				i++
+			}
+			b.WriteByte(v[i])
+		}
+		return b.String()
+	}
+	return v
+}
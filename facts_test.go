@@ -0,0 +1,63 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestGatherFacts(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	t.Setenv("HOME", "/home/sshctl test")
+	f, err := NewClient(g.ctrlSock).GatherFacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	if f.Kernel == "" || f.Hostname != host || f.Machine == "" {
+		t.Fatalf("unexpected uname facts %+v", f)
+	}
+	if f.Home != "/home/sshctl test" {
+		t.Fatalf("expected home, got %q", f.Home)
+	}
+	if runtime.GOOS == "linux" {
+		if f.CPUs <= 0 || f.Memory <= 0 {
+			t.Fatalf("expected CPUs and memory, got %d and %d", f.CPUs, f.Memory)
+		}
+		if _, err := os.Stat("/etc/os-release"); err == nil && f.OSRelease["ID"] == "" {
+			t.Fatalf("expected os-release ID, got %q", f.OSRelease)
+		}
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	data := `# comment
+NAME="Debian GNU/Linux"
+ID=debian
+PRETTY_NAME='Debian 12'
+QUOTED="say \"hi\" for \$5 \n"
+
+BROKEN
+`
+	want := map[string]string{
+		"NAME":        "Debian GNU/Linux",
+		"ID":          "debian",
+		"PRETTY_NAME": "Debian 12",
+		"QUOTED":      `say "hi" for $5 \n`,
+	}
+	if got := parseOSRelease([]byte(data)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if _, err := parseFacts([]byte("Linux\n")); err == nil {
+		t.Fatalf("expected error for truncated output")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/ftrvxmtrx/fd"
+)
+
+// TestDarwinFdPassing checks what the master relies on when it takes
+// the stdio fds: macOS delivers each SCM_RIGHTS message separately
+// and in order to a reader taking one byte at a time, as ssh(1)'s
+// mm_receive_fd does, and the fds stay usable after the sender closed
+// its copies.
+func TestDarwinFdPassing(t *testing.T) {
+	c, s := unixPair(t)
+	defer c.Close()
+	defer s.Close()
+
+	var readers, writers []*os.File
+	for i := 0; i < 3; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		readers, writers = append(readers, r), append(writers, w)
+	}
+	for _, w := range writers {
+		if err := fd.Put(c, w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+
+	for i, r := range readers {
+		buf := make([]byte, 1)
+		oob := make([]byte, syscall.CmsgSpace(4))
+		_, oobn, _, _, err := s.ReadMsgUnix(buf, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(scms) != 1 {
+			t.Fatalf("fd %d: expected one control message, got %d (%v)", i, len(scms), err)
+		}
+		fds, err := syscall.ParseUnixRights(&scms[0])
+		if err != nil || len(fds) != 1 {
+			t.Fatalf("fd %d: expected one fd, got %v (%v)", i, fds, err)
+		}
+		w := os.NewFile(uintptr(fds[0]), "passed")
+		w.Write([]byte{byte('0' + i)})
+		w.Close()
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != string(rune('0'+i)) {
+			t.Fatalf("fd %d: expected it to reach pipe %d, read %q (%v)", i, i, got, err)
+		}
+	}
+}
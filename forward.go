@@ -0,0 +1,587 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ForwardType is the direction of a port forward.
+type ForwardType int
+
+const (
+	LocalForward  ForwardType = muxFwdLocal  // like ssh -L
+	RemoteForward ForwardType = muxFwdRemote // like ssh -R
+)
+
+// PortStreamLocal is the port of a forward side that is a unix
+// socket; the host is the socket path then.
+const PortStreamLocal = -2
+
+// Forward describes a port forward handled by the master.
+//
+// As with ssh(1), an empty ListenHost binds to the loopback address
+// unless GatewayPorts is set, and "*" binds to all addresses. IPv6
+// addresses may be given with or without brackets.
+type Forward struct {
+	Type        ForwardType
+	ListenHost  string // bind address, "" for localhost, "*" for all
+	ListenPort  int    // 0 lets the server pick a remote port
+	ConnectHost string
+	ConnectPort int
+}
+
+// ParseForward parses a forward in the argument syntax of ssh(1)
+// -L or -R, depending on typ:
+//
+//	[bind_address:]port:host:hostport
+//	[bind_address:]port:socket
+//	socket:host:hostport
+//	socket:socket
+//
+// IPv6 addresses are enclosed in square brackets, e.g.
+// "[::1]:8080:[fd00::5]:5432". Sockets are paths containing a slash.
+// Dynamic forwards, -D and -R with only a port, are not supported.
+func ParseForward(typ ForwardType, spec string) (Forward, error) {
+	f := Forward{Type: typ}
+	fields, err := splitForward(spec)
+	if err != nil {
+		return f, err
+	}
+	isSocket := func(i int) bool {
+		return strings.Contains(fields[i], "/")
+	}
+	// the listen side takes what the connect side leaves
+	var listen []string
+	switch {
+	case len(fields) >= 3 && !isSocket(len(fields)-1):
+		f.ConnectHost = fields[len(fields)-2]
+		if f.ConnectPort, err = parsePort(fields[len(fields)-1]); err != nil {
+			return f, fmt.Errorf("sshctl: forward %q: %v", spec, err)
+		}
+		listen = fields[:len(fields)-2]
+	case len(fields) >= 2 && isSocket(len(fields)-1):
+		f.ConnectHost, f.ConnectPort = fields[len(fields)-1], PortStreamLocal
+		listen = fields[:len(fields)-1]
+	}
+	switch {
+	case len(listen) == 1 && strings.Contains(listen[0], "/"):
+		f.ListenHost, f.ListenPort = listen[0], PortStreamLocal
+	case len(listen) == 1:
+		f.ListenPort, err = parsePort(listen[0])
+	case len(listen) == 2:
+		// an explicitly empty bind address means all, like "*"
+		if f.ListenHost = listen[0]; f.ListenHost == "" {
+			f.ListenHost = "*"
+		}
+		f.ListenPort, err = parsePort(listen[1])
+	default:
+		return f, fmt.Errorf("sshctl: invalid forward %q", spec)
+	}
+	if err != nil {
+		return f, fmt.Errorf("sshctl: forward %q: %v", spec, err)
+	}
+	return f, nil
+}
+
+// splitForward splits spec at colons outside of square brackets and
+// removes the brackets.
+func splitForward(spec string) ([]string, error) {
+	var fields []string
+	for spec != "" {
+		var field string
+		if strings.HasPrefix(spec, "[") {
+			end := strings.Index(spec, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("sshctl: missing ] in forward %q", spec)
+			}
+			field, spec = spec[1:end], spec[end+1:]
+			if spec != "" && spec[0] != ':' {
+				return nil, fmt.Errorf("sshctl: invalid forward %q", spec)
+			}
+		} else if i := strings.Index(spec, ":"); i >= 0 {
+			field, spec = spec[:i], spec[i:]
+		} else {
+			field, spec = spec, ""
+		}
+		fields = append(fields, field)
+		if spec != "" {
+			spec = spec[1:]
+			if spec == "" {
+				fields = append(fields, "")
+			}
+		}
+	}
+	return fields, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// unbracket removes the square brackets around an IPv6 address, which
+// the mux protocol does not expect.
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// String returns the forward in ssh(1) command line notation,
+// e.g. "-L localhost:8080:db:5432".
+func (f Forward) String() string {
+	flag := "-L"
+	if f.Type == RemoteForward {
+		flag = "-R"
+	}
+	return flag + " " + forwardSide(f.ListenHost, f.ListenPort) + ":" +
+		forwardSide(f.ConnectHost, f.ConnectPort)
+}
+
+func forwardSide(host string, port int) string {
+	if port == PortStreamLocal {
+		return host
+	}
+	if host == "" {
+		return strconv.Itoa(port)
+	}
+	if host = unbracket(host); strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + strconv.Itoa(port)
+}
+
+func (f Forward) msg(request, rid int) []byte {
+	m := struct {
+		Request     uint32
+		RequestId   uint32
+		Type        uint32
+		ListenHost  string
+		ListenPort  uint32
+		ConnectHost string
+		ConnectPort uint32
+	}{uint32(request), uint32(rid), uint32(f.Type),
+		unbracket(f.ListenHost), uint32(f.ListenPort), unbracket(f.ConnectHost), uint32(f.ConnectPort)}
+	return ssh.Marshal(&m)
+}
+
+// OpenForward asks the master to set up f, like "ssh -O forward".
+// For a remote forward with ListenPort 0 it returns the port
+// allocated by the server, otherwise f.ListenPort.
+func (c *Client) OpenForward(f Forward) (int, error) {
+	if err := c.ctxErr(); err != nil {
+		return 0, err
+	}
+	port, err := c.forwardRequest(muxOpenFwd, f)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.track([]Forward{f}, []int{port}); err != nil {
+		c.forwardRequest(muxCloseFwd, f)
+		return 0, err
+	}
+	return port, nil
+}
+
+// CloseForward asks the master to cancel f, like "ssh -O cancel".
+func (c *Client) CloseForward(f Forward) error {
+	_, err := c.forwardRequest(muxCloseFwd, f)
+	if err == nil {
+		c.untrack(f)
+	}
+	return err
+}
+
+// Forwards returns the forwards opened through c that were not closed
+// since, sorted like ForwardSupervisor.Status. The master may have
+// lost them in the meantime, e.g. by being restarted.
+func (c *Client) Forwards() []ForwardStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make([]ForwardStatus, 0, len(c.forwards))
+	for _, st := range c.forwards {
+		res = append(res, *st)
+	}
+	sortForwards(res)
+	return res
+}
+
+// CloseAllForwards cancels all forwards returned by Forwards. They are
+// forgotten even if cancelling fails, e.g. because the master is gone;
+// the errors are joined.
+func (c *Client) CloseAllForwards() error {
+	c.mu.Lock()
+	forwards := c.forwards
+	c.forwards = nil
+	c.mu.Unlock()
+	var errs []error
+	for f := range forwards {
+		if _, err := c.forwardRequest(muxCloseFwd, f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// track records the forwards fs opened with ports, unless the
+// context of c is done: the forwards would then outlive the cleanup
+// of NewClientContext, so the caller has to cancel them.
+func (c *Client) track(fs []Forward, ports []int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ctxErr(); err != nil {
+		return err
+	}
+	if c.forwards == nil {
+		c.forwards = make(map[Forward]*ForwardStatus)
+	}
+	for i, f := range fs {
+		c.forwards[f] = &ForwardStatus{Forward: f, Up: true, Port: ports[i], Since: time.Now()}
+	}
+	return nil
+}
+
+func (c *Client) untrack(f Forward) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.forwards, f)
+}
+
+// OpenForwards sets up all of fs over a single control connection,
+// for a consistent set of tunnels or none: if one fails, the ones
+// already opened are cancelled again. It returns the listen ports as
+// OpenForward does. The returned error names the failed forward and
+// includes any errors of the rollback.
+func (c *Client) OpenForwards(fs []Forward) ([]int, error) {
+	if err := c.ctxErr(); err != nil {
+		return nil, err
+	}
+	s, err := c.handshake()
+	if err != nil {
+		return nil, err
+	}
+	defer s.ctrlconn.Close()
+	ports := make([]int, 0, len(fs))
+	for _, f := range fs {
+		port, err := s.sshMuxForward(muxOpenFwd, f)
+		if err != nil {
+			errs := []error{err}
+			for i := len(ports) - 1; i >= 0; i-- {
+				if _, err := s.sshMuxForward(muxCloseFwd, fs[i]); err != nil {
+					errs = append(errs, fmt.Errorf("rollback: %w", err))
+				}
+			}
+			return nil, errors.Join(errs...)
+		}
+		ports = append(ports, port)
+	}
+	if err := c.track(fs, ports); err != nil {
+		for _, f := range fs {
+			s.sshMuxForward(muxCloseFwd, f)
+		}
+		return nil, err
+	}
+	return ports, nil
+}
+
+func (c *Client) forwardRequest(request int, f Forward) (int, error) {
+	s, err := c.handshake()
+	if err != nil {
+		return 0, err
+	}
+	defer s.ctrlconn.Close()
+	return s.sshMuxForward(request, f)
+}
+
+func (s *Session) sshMuxForward(request int, f Forward) (int, error) {
+	s.tracef("forward request %d: 0x%x %s", s.ctrlReqid, request, f)
+	if err := s.writePacket(f.msg(request, s.ctrlReqid)); err != nil {
+		return 0, err
+	}
+	packet, err := s.readPacket()
+	if err != nil {
+		return 0, err
+	}
+	var mtype, rid int
+	if mtype, err = packetPopInt(&packet); err != nil {
+		return 0, err
+	}
+	if rid, err = packetPopInt(&packet); err != nil {
+		return 0, err
+	}
+	if rid != s.ctrlReqid {
+		return 0, fmt.Errorf("out of sequence reply: 0x%x", rid)
+	}
+	s.ctrlReqid++
+	switch mtype {
+	case muxOk:
+		return f.ListenPort, nil
+	case muxRemotePort:
+		return packetPopInt(&packet)
+	case muxPermissionDenied, muxFailure:
+		reason, _ := packetPopString(&packet)
+		return 0, &ForwardError{f, reason, forwardCause(mtype, reason)}
+	}
+	return 0, fmt.Errorf("Unexpected forward reply: 0x%x", mtype)
+}
+
+// Causes of failed forwards, see ForwardError.
+var (
+	ErrForwardAddrInUse    = errors.New("address already in use")
+	ErrForwardPrivileged   = errors.New("privileged port")
+	ErrForwardAddrNotAvail = errors.New("bind address not available")
+	ErrForwardRejected     = errors.New("rejected by the server")
+	ErrForwardDenied       = errors.New("denied by the master")
+)
+
+var forwardHints = map[error]string{
+	ErrForwardAddrInUse:    "another process listens on the port; pick a different port or stop it",
+	ErrForwardPrivileged:   "ports below 1024 can only be bound by root; use a higher port",
+	ErrForwardAddrNotAvail: "the bind address is not configured on the listening host",
+	ErrForwardRejected: "the port may be in use or privileged on the server; also check " +
+		"AllowTcpForwarding, and GatewayPorts for bind addresses other than loopback, in sshd_config",
+	ErrForwardDenied: "the master refused the request, e.g. a ControlMaster ask prompt was declined",
+}
+
+// ForwardError reports a forward the master failed to set up. Err
+// classifies the reason and can be tested with errors.Is, e.g.
+// errors.Is(err, ErrForwardAddrInUse).
+type ForwardError struct {
+	Forward Forward
+	Reason  string // as reported by the master
+	Err     error  // one of the ErrForward* causes, nil if unknown
+}
+
+func (e *ForwardError) Error() string {
+	msg := "forward " + e.Forward.String() + ": " + e.Reason
+	if hint := e.Hint(); hint != "" {
+		msg += " (" + hint + ")"
+	}
+	return msg
+}
+
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
+// Hint returns advice on how to fix the failure, or "" if the cause
+// is unknown.
+func (e *ForwardError) Hint() string {
+	return forwardHints[e.Err]
+}
+
+// forwardCause maps the failure reply of the master to a cause. ssh(1)
+// only reports remote forward failures generically, the details are
+// in the server's logs.
+func forwardCause(mtype int, reason string) error {
+	if mtype == muxPermissionDenied {
+		return ErrForwardDenied
+	}
+	reason = strings.ToLower(reason)
+	switch {
+	case strings.Contains(reason, "address already in use"):
+		return ErrForwardAddrInUse
+	case strings.Contains(reason, "permission denied"),
+		strings.Contains(reason, "privileged port"):
+		return ErrForwardPrivileged
+	case strings.Contains(reason, "cannot assign requested address"),
+		strings.Contains(reason, "can't assign requested address"):
+		return ErrForwardAddrNotAvail
+	case strings.Contains(reason, "remote port forwarding failed"),
+		strings.Contains(reason, "denied by peer"),
+		strings.Contains(reason, "administratively prohibited"):
+		return ErrForwardRejected
+	}
+	return nil
+}
+
+// ForwardStatus reports the state of a forward kept by a
+// ForwardSupervisor.
+type ForwardStatus struct {
+	Forward Forward
+	Up      bool
+	Port    int       // listen port, as allocated by the server if requested
+	Since   time.Time // time of the last transition between up and down
+	Reopens int
+	Err     error // why the forward is down, if it is
+}
+
+// ForwardEvent reports a change of a forward's state.
+type ForwardEvent struct {
+	ForwardStatus
+	Time time.Time
+}
+
+// ForwardSupervisor keeps a set of forwards established on a master.
+// Forwards die with the master process, so the master is checked
+// periodically; when it comes back or its pid changes, all forwards
+// are opened again.
+type ForwardSupervisor struct {
+	// CheckInterval is the time between checks of the master.
+	// If zero, 10 seconds are used.
+	CheckInterval time.Duration
+
+	// Events, if non-nil, receives an event whenever a forward goes
+	// up or down or fails to open. Events are dropped if the
+	// channel is not ready.
+	Events chan<- ForwardEvent
+
+	client *Client
+	wake   chan struct{}
+
+	mu        sync.Mutex
+	masterPid int
+	forwards  map[Forward]*forwardState
+}
+
+type forwardState struct {
+	ForwardStatus
+	opened bool // the forward was up before
+}
+
+// NewForwardSupervisor returns a ForwardSupervisor for the master
+// behind c.
+func NewForwardSupervisor(c *Client) *ForwardSupervisor {
+	return &ForwardSupervisor{
+		client:   c,
+		wake:     make(chan struct{}, 1),
+		forwards: make(map[Forward]*forwardState),
+	}
+}
+
+// Add registers f. It is opened by Run as soon as possible.
+func (fs *ForwardSupervisor) Add(f Forward) {
+	fs.mu.Lock()
+	if _, ok := fs.forwards[f]; !ok {
+		fs.forwards[f] = &forwardState{ForwardStatus: ForwardStatus{Forward: f, Since: time.Now()}}
+	}
+	fs.mu.Unlock()
+	fs.poke()
+}
+
+// Remove unregisters f and cancels it on the master if it is up.
+func (fs *ForwardSupervisor) Remove(f Forward) error {
+	fs.mu.Lock()
+	st, ok := fs.forwards[f]
+	delete(fs.forwards, f)
+	fs.mu.Unlock()
+	if !ok || !st.Up {
+		return nil
+	}
+	return fs.client.CloseForward(f)
+}
+
+// Status returns the state of all registered forwards.
+func (fs *ForwardSupervisor) Status() []ForwardStatus {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	res := make([]ForwardStatus, 0, len(fs.forwards))
+	for _, st := range fs.forwards {
+		res = append(res, st.ForwardStatus)
+	}
+	sortForwards(res)
+	return res
+}
+
+func sortForwards(fs []ForwardStatus) {
+	sort.Slice(fs, func(i, j int) bool {
+		return fs[i].Forward.String() < fs[j].Forward.String()
+	})
+}
+
+func (fs *ForwardSupervisor) poke() {
+	select {
+	case fs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks the master and reopens lost forwards until ctx is done.
+// It always returns ctx.Err().
+func (fs *ForwardSupervisor) Run(ctx context.Context) error {
+	interval := durationOr(fs.CheckInterval, 10*time.Second)
+	for {
+		fs.reconcile()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-fs.wake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (fs *ForwardSupervisor) reconcile() {
+	pid, err := fs.client.Check()
+
+	fs.mu.Lock()
+	if err != nil || pid != fs.masterPid {
+		// the master is gone or was replaced, taking its forwards along
+		if err == nil {
+			err = fmt.Errorf("master restarted as pid %d", pid)
+		}
+		for _, st := range fs.forwards {
+			if st.Up {
+				fs.update(st, false, 0, err)
+			}
+		}
+		fs.masterPid = pid
+	}
+	var down []Forward
+	if pid != 0 {
+		for f, st := range fs.forwards {
+			if !st.Up {
+				down = append(down, f)
+			}
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, f := range down {
+		port, err := fs.client.OpenForward(f)
+		fs.mu.Lock()
+		if st, ok := fs.forwards[f]; ok {
+			fs.update(st, err == nil, port, err)
+		}
+		fs.mu.Unlock()
+	}
+}
+
+// update changes the state of st and emits an event if it went up or
+// down, or started failing. fs.mu must be held.
+func (fs *ForwardSupervisor) update(st *forwardState, up bool, port int, err error) {
+	changed := st.Up != up || (st.Err == nil) != (err == nil)
+	if st.Up != up {
+		st.Since = time.Now()
+	}
+	if up {
+		if st.opened {
+			st.Reopens++
+		}
+		st.opened = true
+		st.Port = port
+	}
+	st.Up, st.Err = up, err
+	if changed && fs.Events != nil {
+		select {
+		case fs.Events <- ForwardEvent{st.ForwardStatus, time.Now()}:
+		default:
+		}
+	}
+}
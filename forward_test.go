@@ -0,0 +1,396 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer accepts connections on a local port and echoes lines.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func checkEcho(t *testing.T, addr string) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("expected echo through %s, got %q, %v", addr, line, err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	client := NewClient(g.ctrlSock)
+	f := Forward{
+		Type:        LocalForward,
+		ListenHost:  "127.0.0.1",
+		ListenPort:  freePort(t),
+		ConnectHost: "127.0.0.1",
+		ConnectPort: echo.Addr().(*net.TCPAddr).Port,
+	}
+	port, err := client.OpenForward(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != f.ListenPort {
+		t.Fatalf("expected port %d, got %d", f.ListenPort, port)
+	}
+	checkEcho(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err := client.CloseForward(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseForward(f); err == nil {
+		t.Fatalf("expected closing an unknown forward to fail")
+	}
+}
+
+func TestOpenForwards(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	echo := echoServer(t)
+	defer echo.Close()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	client := NewClient(g.ctrlSock)
+	fs := []Forward{
+		{LocalForward, "127.0.0.1", freePort(t), "127.0.0.1", echoPort},
+		{LocalForward, "127.0.0.1", freePort(t), "127.0.0.1", echoPort},
+	}
+	ports, err := client.OpenForwards(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, port := range ports {
+		if port != fs[i].ListenPort {
+			t.Fatalf("expected port %d, got %d", fs[i].ListenPort, port)
+		}
+		checkEcho(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	}
+
+	// the last forward collides with the first, which is rolled back
+	busy := Forward{LocalForward, "127.0.0.1", fs[0].ListenPort, "localhost", echoPort}
+	next := []Forward{{LocalForward, "127.0.0.1", freePort(t), "127.0.0.1", echoPort}, busy}
+	if _, err := client.OpenForwards(next); err == nil {
+		t.Fatalf("expected a busy listen port to fail")
+	}
+	if err := client.CloseForward(next[0]); err == nil {
+		t.Fatalf("expected %s to be rolled back", next[0])
+	}
+	for _, f := range fs {
+		if err := client.CloseForward(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestForwardBookkeeping(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	echo := echoServer(t)
+	defer echo.Close()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	client := NewClient(g.ctrlSock)
+	a := Forward{LocalForward, "127.0.0.1", freePort(t), "127.0.0.1", echoPort}
+	b := Forward{LocalForward, "localhost", freePort(t), "127.0.0.1", echoPort}
+	if _, err := client.OpenForward(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.OpenForward(b); err != nil {
+		t.Fatal(err)
+	}
+	got := client.Forwards()
+	if len(got) != 2 || got[0].Forward != a || got[1].Forward != b ||
+		got[0].Port != a.ListenPort || got[1].Port != b.ListenPort || !got[1].Up {
+		t.Fatalf("unexpected forwards %+v", got)
+	}
+
+	if err := client.CloseForward(a); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.Forwards(); len(got) != 1 || got[0].Forward != b {
+		t.Fatalf("unexpected forwards %+v", got)
+	}
+	if err := client.CloseAllForwards(); err != nil {
+		t.Fatal(err)
+	}
+	if got := client.Forwards(); len(got) != 0 {
+		t.Fatalf("expected no forwards, got %+v", got)
+	}
+	if err := client.CloseForward(b); err == nil {
+		t.Fatalf("expected %s to be closed", b)
+	}
+}
+
+func TestForwardError(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := NewClient(g.ctrlSock)
+	f := Forward{LocalForward, "127.0.0.1", l.Addr().(*net.TCPAddr).Port, "127.0.0.1", 22}
+	_, err = client.OpenForward(f)
+	var fe *ForwardError
+	if !errors.As(err, &fe) || fe.Forward != f || !errors.Is(err, ErrForwardAddrInUse) {
+		t.Fatalf("expected ErrForwardAddrInUse, got %v", err)
+	}
+	if fe.Hint() == "" || !strings.Contains(err.Error(), fe.Hint()) {
+		t.Fatalf("expected a hint in %q", err)
+	}
+
+	for _, tt := range []struct {
+		mtype  int
+		reason string
+		want   error
+	}{
+		{muxFailure, "port forwarding failed: listen tcp 0.0.0.0:80: bind: permission denied", ErrForwardPrivileged},
+		{muxFailure, "listen tcp 10.9.9.9:8080: bind: cannot assign requested address", ErrForwardAddrNotAvail},
+		{muxFailure, "remote port forwarding failed for listen port 80", ErrForwardRejected},
+		{muxPermissionDenied, "Permission denied", ErrForwardDenied},
+		{muxFailure, "Port forwarding failed", nil},
+	} {
+		if got := forwardCause(tt.mtype, tt.reason); got != tt.want {
+			t.Errorf("%q: expected %v, got %v", tt.reason, tt.want, got)
+		}
+	}
+}
+
+func TestForwardString(t *testing.T) {
+	tests := []struct {
+		f    Forward
+		want string
+	}{
+		{Forward{LocalForward, "", 8080, "db", 5432}, "-L 8080:db:5432"},
+		{Forward{RemoteForward, "*", 0, "localhost", 80}, "-R *:0:localhost:80"},
+		{Forward{LocalForward, "/tmp/l.sock", PortStreamLocal, "/run/r.sock", PortStreamLocal},
+			"-L /tmp/l.sock:/run/r.sock"},
+		{Forward{LocalForward, "::1", 8080, "[fd00::5]", 5432}, "-L [::1]:8080:[fd00::5]:5432"},
+	}
+	for _, tt := range tests {
+		if got := tt.f.String(); got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, got)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		typ  ForwardType
+		spec string
+		want Forward
+	}{
+		{LocalForward, "8080:db:5432", Forward{LocalForward, "", 8080, "db", 5432}},
+		{LocalForward, "*:8080:db:5432", Forward{LocalForward, "*", 8080, "db", 5432}},
+		{LocalForward, ":8080:db:5432", Forward{LocalForward, "*", 8080, "db", 5432}},
+		{RemoteForward, "0:localhost:80", Forward{RemoteForward, "", 0, "localhost", 80}},
+		{LocalForward, "[::1]:8080:[fd00::5]:5432", Forward{LocalForward, "::1", 8080, "fd00::5", 5432}},
+		{LocalForward, "127.0.0.1:8080:/run/r.sock", Forward{LocalForward, "127.0.0.1", 8080, "/run/r.sock", PortStreamLocal}},
+		{RemoteForward, "/tmp/r.sock:db:5432", Forward{RemoteForward, "/tmp/r.sock", PortStreamLocal, "db", 5432}},
+		{LocalForward, "/tmp/l.sock:/run/r.sock", Forward{LocalForward, "/tmp/l.sock", PortStreamLocal, "/run/r.sock", PortStreamLocal}},
+	}
+	for _, tt := range tests {
+		got, err := ParseForward(tt.typ, tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %+v, got %+v", tt.spec, tt.want, got)
+		}
+		// String produces the same syntax
+		again, err := ParseForward(tt.typ, got.String()[3:])
+		if err != nil || again != got {
+			t.Errorf("%q: %q does not parse back: %+v, %v", tt.spec, got, again, err)
+		}
+	}
+	for _, spec := range []string{"", "8080", "8080:db", "[::1:8080:db:22", "x:8080:db:22:1", "8080:db:http", "70000:db:22"} {
+		if f, err := ParseForward(LocalForward, spec); err == nil {
+			t.Errorf("%q: expected an error, got %+v", spec, f)
+		}
+	}
+}
+
+func TestForwardIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	l.Close()
+
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	client := NewClient(g.ctrlSock)
+	f := Forward{LocalForward, "[::1]", freePort(t), "127.0.0.1", echo.Addr().(*net.TCPAddr).Port}
+	if _, err := client.OpenForward(f); err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, net.JoinHostPort("::1", strconv.Itoa(f.ListenPort)))
+	if err := client.CloseForward(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardSupervisor(t *testing.T) {
+	g := newGoMaster(t)
+	echo := echoServer(t)
+	defer echo.Close()
+
+	f := Forward{
+		Type:        LocalForward,
+		ListenHost:  "127.0.0.1",
+		ListenPort:  freePort(t),
+		ConnectHost: "127.0.0.1",
+		ConnectPort: echo.Addr().(*net.TCPAddr).Port,
+	}
+	addr := net.JoinHostPort(f.ListenHost, strconv.Itoa(f.ListenPort))
+	events := make(chan ForwardEvent, 10)
+	fs := NewForwardSupervisor(NewClient(g.ctrlSock))
+	fs.CheckInterval = 10 * time.Millisecond
+	fs.Events = events
+	fs.Add(f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fs.Run(ctx)
+
+	expect := func(up bool) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Up != up || ev.Forward != f {
+				t.Fatalf("expected up=%v for %s, got %+v", up, f, ev)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for up=%v", up)
+		}
+	}
+	expect(true)
+	checkEcho(t, addr)
+
+	// the forward dies with the master and comes back with a new one
+	g.Shutdown()
+	expect(false)
+	g = newGoMasterAt(t, g.ctrlSock)
+	defer g.Shutdown()
+	expect(true)
+	checkEcho(t, addr)
+	if st := fs.Status(); len(st) != 1 || !st[0].Up || st[0].Reopens != 1 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+
+	if err := fs.Remove(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("expected forward to be closed")
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	// answers only once its client is done sending
+	counter := serveOnce(t, func(conn net.Conn) {
+		go func() {
+			defer conn.Close()
+			b, _ := io.ReadAll(conn)
+			fmt.Fprintf(conn, "got %d", len(b))
+		}()
+	})
+	defer counter.Close()
+
+	client := NewClient(g.ctrlSock)
+	f := Forward{
+		Type:        LocalForward,
+		ListenHost:  "127.0.0.1",
+		ListenPort:  freePort(t),
+		ConnectHost: "127.0.0.1",
+		ConnectPort: counter.Addr().(*net.TCPAddr).Port,
+	}
+	if _, err := client.OpenForward(f); err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseForward(f)
+
+	for _, dial := range []func() (net.Conn, error){
+		func() (net.Conn, error) { return client.Dial("tcp", counter.Addr().String()) },
+		func() (net.Conn, error) { return net.Dial("tcp", net.JoinHostPort(f.ListenHost, strconv.Itoa(f.ListenPort))) },
+	} {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(TestString))
+		if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if want := fmt.Sprintf("got %d", len(TestString)); err != nil || string(got) != want {
+			t.Fatalf("expected %q after the half-close, got %q (%v)", want, got, err)
+		}
+	}
+}
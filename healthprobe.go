@@ -0,0 +1,172 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck describes an endpoint probed by a Prober. The address
+// is connected to from the remote host, so it may be reachable only
+// from there, e.g. behind a bastion.
+type HealthCheck struct {
+	Name string
+	Addr string // host:port
+
+	// HTTPPath, if set, makes the check an HTTP GET of this path,
+	// e.g. "/healthz", which is healthy if it answers with a 2xx or
+	// 3xx status. Otherwise the check is CheckTCP's, with an
+	// address that is neither answering nor closing the connection
+	// counted as healthy, as servers waiting for their client are.
+	HTTPPath string
+
+	// Timeout bounds each probe. If zero, 5 seconds are used.
+	Timeout time.Duration
+}
+
+// HealthStatus is the state of a HealthCheck.
+type HealthStatus struct {
+	Name     string
+	Healthy  bool
+	Since    time.Time // of the last change of Healthy
+	Checked  time.Time // of the last probe
+	Failures int       // consecutive failed probes
+	Err      error     // of the last probe
+}
+
+// Prober runs recurring health checks through a master. Each check
+// is probed every Interval; OnChange learns when one turns healthy
+// or unhealthy.
+type Prober struct {
+	// Interval is the delay between two probes of a check. If zero,
+	// 30 seconds are used.
+	Interval time.Duration
+
+	// OnChange, if non-nil, is called with the new status when a
+	// check is probed for the first time and whenever it turns
+	// healthy or unhealthy. It is called from Run's goroutines, one
+	// per check, and should not block.
+	OnChange func(HealthStatus)
+
+	client *Client
+	checks []HealthCheck
+
+	mu     sync.Mutex
+	status map[string]*HealthStatus
+}
+
+// NewProber returns a Prober running checks through c. Checks are
+// told apart by Name.
+func NewProber(c *Client, checks ...HealthCheck) *Prober {
+	return &Prober{client: c, checks: checks, status: make(map[string]*HealthStatus)}
+}
+
+// Status returns the state of the checks probed so far, in the order
+// they were given to NewProber.
+func (p *Prober) Status() []HealthStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var res []HealthStatus
+	for _, hc := range p.checks {
+		if st, ok := p.status[hc.Name]; ok {
+			res = append(res, *st)
+		}
+	}
+	return res
+}
+
+// Run probes the checks until ctx is done and returns ctx.Err().
+func (p *Prober) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, hc := range p.checks {
+		wg.Add(1)
+		go func(hc HealthCheck) {
+			defer wg.Done()
+			p.probeLoop(ctx, hc)
+		}(hc)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (p *Prober) probeLoop(ctx context.Context, hc HealthCheck) {
+	interval := durationOr(p.Interval, 30*time.Second)
+	for {
+		p.record(hc, p.probe(ctx, hc))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probe runs hc once.
+func (p *Prober) probe(ctx context.Context, hc HealthCheck) error {
+	timeout := durationOr(hc.Timeout, 5*time.Second)
+	if hc.HTTPPath == "" {
+		if err := p.client.CheckTCP(hc.Addr, timeout); !tcpOpen(err) {
+			return err
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	hcl := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.client.Dial(network, addr)
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+hc.Addr+hc.HTTPPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hcl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("sshctl: health check %s: HTTP status %s", hc.Name, resp.Status)
+	}
+	return nil
+}
+
+// record updates the status of hc with the result of a probe and
+// calls OnChange if it changed.
+func (p *Prober) record(hc HealthCheck, err error) {
+	now := time.Now()
+	p.mu.Lock()
+	st, seen := p.status[hc.Name]
+	if !seen {
+		st = &HealthStatus{Name: hc.Name, Since: now}
+		p.status[hc.Name] = st
+	}
+	healthy := err == nil
+	changed := !seen || st.Healthy != healthy
+	if changed {
+		st.Since = now
+	}
+	st.Healthy, st.Checked, st.Err = healthy, now, err
+	if healthy {
+		st.Failures = 0
+	} else {
+		st.Failures++
+	}
+	snap := *st
+	p.mu.Unlock()
+	if changed && p.OnChange != nil {
+		p.OnChange(snap)
+	}
+}
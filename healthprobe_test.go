@@ -0,0 +1,72 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProber(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	var failing int32
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+
+	p := NewProber(NewClient(g.ctrlSock),
+		HealthCheck{Name: "web", Addr: strings.TrimPrefix(web.URL, "http://"), HTTPPath: "/healthz"},
+		HealthCheck{Name: "db", Addr: fmt.Sprintf("127.0.0.1:%d", freePort(t)), Timeout: time.Second},
+	)
+	p.Interval = 50 * time.Millisecond
+	changes := make(chan HealthStatus, 10)
+	p.OnChange = func(st HealthStatus) { changes <- st }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	next := func() HealthStatus {
+		select {
+		case st := <-changes:
+			return st
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a status change")
+		}
+		return HealthStatus{}
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		st := next()
+		got[st.Name] = st.Healthy
+	}
+	if !got["web"] || got["db"] {
+		t.Fatalf("expected web up and db down, got %v", got)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	if st := next(); st.Name != "web" || st.Healthy || st.Err == nil {
+		t.Fatalf("expected web to go down, got %+v", st)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if st := p.Status(); len(st) != 2 || st[0].Name != "web" || st[1].Failures == 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ErrNoControlPath is returned for hosts without a ControlPath.
+var ErrNoControlPath = errors.New("sshctl: no ControlPath configured")
+
+// Host is a destination as configured in ssh_config, so programs can
+// refer to hosts by alias just like the ssh command line does.
+type Host struct {
+	Alias       string // the name given to LookupHost
+	HostName    string
+	Port        int
+	User        string
+	ControlPath string     // empty if not configured
+	ProxyJump   []JumpHost // as configured, not resolved
+
+	// Quoting is used by the host's Client. It is not part of
+	// ssh_config; set it for hosts running Windows.
+	Quoting Quoting
+}
+
+// LookupHost returns the configuration of alias as reported by
+// "ssh -G". args are passed to ssh, e.g. "-F", "path/to/config".
+// ControlPath tokens are expanded by OpenSSH 8.0 and newer only.
+func LookupHost(alias string, args ...string) (*Host, error) {
+	config, err := sshConfig(alias, args...)
+	if err != nil {
+		return nil, err
+	}
+	h := &Host{
+		Alias:    alias,
+		HostName: config["hostname"],
+		User:     config["user"],
+	}
+	if h.Port, err = strconv.Atoi(config["port"]); err != nil {
+		return nil, fmt.Errorf("ssh -G %s: invalid port %q", alias, config["port"])
+	}
+	if cp := config["controlpath"]; cp != "none" {
+		h.ControlPath = cp
+	}
+	if h.ProxyJump, err = ParseProxyJump(config["proxyjump"]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Addr returns the host's "hostname:port".
+func (h *Host) Addr() string {
+	return net.JoinHostPort(h.HostName, strconv.Itoa(h.Port))
+}
+
+// JumpHost returns the host as the hop of a ProxyJump chain.
+func (h *Host) JumpHost() JumpHost {
+	return JumpHost{User: h.User, Host: h.HostName, Port: h.Port}
+}
+
+// Client returns a Client for the host's master.
+func (h *Host) Client() (*Client, error) {
+	if h.ControlPath == "" {
+		return nil, ErrNoControlPath
+	}
+	c := NewClient(h.ControlPath)
+	c.Quoting = h.Quoting
+	return c, nil
+}
+
+// MuxdHost returns a MuxdHost keeping a master for the host at its
+// ControlPath, or in the Muxd's directory if it has none.
+func (h *Host) MuxdHost() MuxdHost {
+	return MuxdHost{Name: h.Alias, ControlPath: h.ControlPath}
+}
+
+func (h *Host) String() string {
+	return h.Alias
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLookupHost(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "config")
+	err := os.WriteFile(cfg, []byte(`Host web
+  HostName 10.0.0.7
+  User deploy
+  ControlPath `+dir+`/web.sock
+  ProxyJump bastion
+Host plain
+  ControlPath none
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := LookupHost("web", "-F", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Host{
+		Alias:       "web",
+		HostName:    "10.0.0.7",
+		Port:        22,
+		User:        "deploy",
+		ControlPath: dir + "/web.sock",
+		ProxyJump:   []JumpHost{{Host: "bastion"}},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Fatalf("expected %+v, got %+v", want, h)
+	}
+	if c, err := h.Client(); err != nil || c.sshctlpath != want.ControlPath {
+		t.Fatalf("unexpected client %v, %v", c, err)
+	}
+
+	h, err = LookupHost("plain", "-F", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Client(); err != ErrNoControlPath {
+		t.Fatalf("expected ErrNoControlPath, got %v", err)
+	}
+}
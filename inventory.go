@@ -0,0 +1,402 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Inventory is a list of hosts in groups, with variables, read from
+// a minimal form of Ansible's INI inventory format:
+//
+//	db1 user=postgres
+//
+//	[web]
+//	web1 hostname=10.0.0.1 control_path=/run/ssh/web1
+//	web2
+//
+//	[web:vars]
+//	user=deploy
+//
+//	[prod:children]
+//	web
+//
+//	[all:vars]
+//	env=prod
+//
+// Hosts before the first section belong to no group but "all". The
+// variables hostname, port, user, control_path and quoting configure
+// the Host, and timeout, a duration such as "30s", the host's
+// Executor timeout; all are available as the host's Vars. Host variables
+// override group variables, and those of a group override those of
+// its parents.
+type Inventory struct {
+	hosts  []string // in order of appearance
+	vars   map[string]map[string]string
+	groups map[string]*inventoryGroup
+}
+
+type inventoryGroup struct {
+	hosts    []string
+	children []string
+	vars     map[string]string
+}
+
+// LoadInventory reads the inventory file at path.
+func LoadInventory(path string) (*Inventory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	inv, err := ParseInventory(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return inv, nil
+}
+
+// ParseInventory reads an inventory in the format described at
+// Inventory.
+func ParseInventory(r io.Reader) (*Inventory, error) {
+	inv := &Inventory{
+		vars:   make(map[string]map[string]string),
+		groups: map[string]*inventoryGroup{"all": {}},
+	}
+	group, kind := "all", "hosts"
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("sshctl: inventory line %d: malformed section %q", n, line)
+			}
+			group, kind, _ = strings.Cut(line[1:len(line)-1], ":")
+			switch kind {
+			case "":
+				kind = "hosts"
+			case "vars", "children":
+			default:
+				return nil, fmt.Errorf("sshctl: inventory line %d: unknown section kind %q", n, kind)
+			}
+			inv.group(group)
+			continue
+		}
+		fields, err := splitInventoryLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("sshctl: inventory line %d: %w", n, err)
+		}
+		g := inv.group(group)
+		switch kind {
+		case "hosts":
+			name := fields[0]
+			if _, ok := inv.vars[name]; !ok {
+				inv.hosts = append(inv.hosts, name)
+				inv.vars[name] = make(map[string]string)
+			}
+			if group != "all" {
+				g.hosts = append(g.hosts, name)
+			}
+			if err := parseInventoryVars(fields[1:], inv.vars[name]); err != nil {
+				return nil, fmt.Errorf("sshctl: inventory line %d: %w", n, err)
+			}
+		case "vars":
+			if g.vars == nil {
+				g.vars = make(map[string]string)
+			}
+			if err := parseInventoryVars(fields, g.vars); err != nil {
+				return nil, fmt.Errorf("sshctl: inventory line %d: %w", n, err)
+			}
+		case "children":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("sshctl: inventory line %d: expected a group name", n)
+			}
+			inv.group(fields[0])
+			g.children = append(g.children, fields[0])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for name, g := range inv.groups {
+		if inv.vars[name] != nil {
+			return nil, fmt.Errorf("sshctl: inventory: %s is both a host and a group", name)
+		}
+		if g.contains(inv, name, nil) {
+			return nil, fmt.Errorf("sshctl: inventory: group %s contains itself", name)
+		}
+	}
+	return inv, nil
+}
+
+func (inv *Inventory) group(name string) *inventoryGroup {
+	g := inv.groups[name]
+	if g == nil {
+		g = &inventoryGroup{}
+		inv.groups[name] = g
+	}
+	return g
+}
+
+// contains reports whether name is a child group of g, directly or
+// indirectly. seen guards against cycles.
+func (g *inventoryGroup) contains(inv *Inventory, name string, seen map[string]bool) bool {
+	if seen == nil {
+		seen = make(map[string]bool)
+	}
+	for _, c := range g.children {
+		if c == name {
+			return true
+		}
+		if !seen[c] {
+			seen[c] = true
+			if inv.groups[c].contains(inv, name, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitInventoryLine splits line at blanks, keeping double quoted
+// strings together.
+func splitInventoryLine(line string) ([]string, error) {
+	var fields []string
+	var b strings.Builder
+	quoted, inField := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted, inField = !quoted, true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inField {
+				fields = append(fields, b.String())
+				b.Reset()
+				inField = false
+			}
+		default:
+			b.WriteRune(r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, b.String())
+	}
+	return fields, nil
+}
+
+func parseInventoryVars(fields []string, vars map[string]string) error {
+	for _, f := range fields {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("expected key=value, got %q", f)
+		}
+		vars[k] = v
+	}
+	return nil
+}
+
+// Groups returns the names of the inventory's groups, sorted. It
+// includes "all".
+func (inv *Inventory) Groups() []string {
+	names := make([]string, 0, len(inv.groups))
+	for name := range inv.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// members returns the hosts of group, including those of its child
+// groups.
+func (inv *Inventory) members(group string) []string {
+	if group == "all" {
+		return inv.hosts
+	}
+	seen := make(map[string]bool)
+	var hosts []string
+	var walk func(name string)
+	walk = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		g := inv.groups[name]
+		hosts = append(hosts, g.hosts...)
+		for _, c := range g.children {
+			walk(c)
+		}
+	}
+	walk(group)
+	return hosts
+}
+
+// Hosts returns the hosts matching pattern: a host name, a group
+// name, "all", or several of those separated by commas. Each host is
+// returned once, in the order of the inventory file.
+func (inv *Inventory) Hosts(pattern string) ([]Host, error) {
+	want := make(map[string]bool)
+	for _, name := range strings.Split(pattern, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case inv.groups[name] != nil:
+			for _, h := range inv.members(name) {
+				want[h] = true
+			}
+		case inv.vars[name] != nil:
+			want[name] = true
+		default:
+			return nil, fmt.Errorf("sshctl: inventory has no host or group %q", name)
+		}
+	}
+	var hosts []Host
+	for _, name := range inv.hosts {
+		if want[name] {
+			h, err := inv.host(name)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, *h)
+		}
+	}
+	return hosts, nil
+}
+
+func (inv *Inventory) host(name string) (*Host, error) {
+	vars := inv.Vars(name)
+	h := &Host{
+		Alias:       name,
+		HostName:    vars["hostname"],
+		User:        vars["user"],
+		ControlPath: vars["control_path"],
+		Port:        22,
+	}
+	if h.HostName == "" {
+		h.HostName = name
+	}
+	if h.ControlPath == "" {
+		h.ControlPath = ControlPathFor(name)
+	}
+	if p, ok := vars["port"]; ok {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("sshctl: inventory: host %s: invalid port %q", name, p)
+		}
+		h.Port = port
+	}
+	q, err := parseQuoting(vars["quoting"])
+	if err != nil {
+		return nil, fmt.Errorf("sshctl: inventory: host %s: %w", name, err)
+	}
+	h.Quoting = q
+	return h, nil
+}
+
+// Vars returns the variables of the named host: those of "all", then
+// of its groups, parents before children and otherwise by name, and
+// finally its own. It returns nil for unknown hosts.
+func (inv *Inventory) Vars(host string) map[string]string {
+	if inv.vars[host] == nil {
+		return nil
+	}
+	// the depth of each group containing host
+	depth := make(map[string]int)
+	var walk func(name string, d int)
+	walk = func(name string, d int) {
+		if old, ok := depth[name]; ok && old >= d {
+			return
+		}
+		depth[name] = d
+		for _, c := range inv.groups[name].children {
+			walk(c, d+1)
+		}
+	}
+	for name := range inv.groups {
+		if !inv.isChild(name) {
+			walk(name, 1)
+		}
+	}
+	var groups []string
+	for name := range inv.groups {
+		if name != "all" && contains(inv.members(name), host) {
+			groups = append(groups, name)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if depth[groups[i]] != depth[groups[j]] {
+			return depth[groups[i]] < depth[groups[j]]
+		}
+		return groups[i] < groups[j]
+	})
+	vars := make(map[string]string)
+	for _, name := range append([]string{"all"}, groups...) {
+		for k, v := range inv.groups[name].vars {
+			vars[k] = v
+		}
+	}
+	for k, v := range inv.vars[host] {
+		vars[k] = v
+	}
+	return vars
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isChild reports whether group is the child of another group.
+func (inv *Inventory) isChild(group string) bool {
+	for _, g := range inv.groups {
+		if contains(g.children, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Executor returns an Executor for the hosts matching pattern, as
+// selected by Hosts, with the hosts' timeouts and Vars.
+func (inv *Inventory) Executor(pattern string) (*Executor, error) {
+	hosts, err := inv.Hosts(pattern)
+	if err != nil {
+		return nil, err
+	}
+	e := NewExecutor(hosts)
+	e.Vars = make(map[string]map[string]string)
+	for _, h := range hosts {
+		e.Vars[h.Alias] = inv.Vars(h.Alias)
+		v, ok := e.Vars[h.Alias]["timeout"]
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("sshctl: inventory: host %s: invalid timeout %q", h.Alias, v)
+		}
+		if e.HostTimeouts == nil {
+			e.HostTimeouts = make(map[string]time.Duration)
+		}
+		e.HostTimeouts[h.Alias] = d
+	}
+	return e, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testInventory = `
+# ungrouped
+db1 user=postgres port=2222
+
+[web]
+web1 hostname=10.0.0.1 control_path=/run/ssh/web1
+web2 motd="hello world"
+
+[web:vars]
+user=deploy
+tier=front
+
+[canary]
+web2
+
+[canary:vars]
+tier=canary
+
+[prod:children]
+web
+
+[prod:vars]
+tier=prod
+env=prod
+
+[all:vars]
+env=dev
+`
+
+func TestInventory(t *testing.T) {
+	t.Setenv(EnvControlPath, "/run/ssh/%h.sock")
+	inv, err := ParseInventory(strings.NewReader(testInventory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups := inv.Groups(); !reflect.DeepEqual(groups, []string{"all", "canary", "prod", "web"}) {
+		t.Fatalf("unexpected groups %q", groups)
+	}
+
+	for pattern, want := range map[string][]string{
+		"all":          {"db1", "web1", "web2"},
+		"prod":         {"web1", "web2"},
+		"canary":       {"web2"},
+		"db1, canary":  {"db1", "web2"},
+		"web2,web,web": {"web1", "web2"},
+	} {
+		hosts, err := inv.Hosts(pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		var names []string
+		for _, h := range hosts {
+			names = append(names, h.Alias)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: expected %q, got %q", pattern, want, names)
+		}
+	}
+	if _, err := inv.Hosts("web,nope"); err == nil || !strings.Contains(err.Error(), `"nope"`) {
+		t.Fatalf("expected unknown name error, got %v", err)
+	}
+
+	hosts, _ := inv.Hosts("all")
+	want := []Host{
+		{Alias: "db1", HostName: "db1", Port: 2222, User: "postgres", ControlPath: "/run/ssh/db1.sock"},
+		{Alias: "web1", HostName: "10.0.0.1", Port: 22, User: "deploy", ControlPath: "/run/ssh/web1"},
+		{Alias: "web2", HostName: "web2", Port: 22, User: "deploy", ControlPath: "/run/ssh/web2.sock"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("expected %+v, got %+v", want, hosts)
+	}
+
+	// web is nested deeper than canary, so its tier wins
+	vars := inv.Vars("web2")
+	wantVars := map[string]string{"user": "deploy", "tier": "front", "env": "prod", "motd": "hello world"}
+	if !reflect.DeepEqual(vars, wantVars) {
+		t.Fatalf("expected %v, got %v", wantVars, vars)
+	}
+	if vars := inv.Vars("db1"); vars["env"] != "dev" {
+		t.Fatalf("expected env from all, got %v", vars)
+	}
+	if inv.Vars("nope") != nil {
+		t.Fatal("expected no vars for unknown host")
+	}
+}
+
+func TestParseInventoryErrors(t *testing.T) {
+	for data, want := range map[string]string{
+		"[web":                             "malformed section",
+		"[web:hosts]":                      "unknown section kind",
+		"[web]\nweb1 user":                 "expected key=value",
+		"[web]\nweb1 motd=\"hi":            "unterminated quote",
+		"[a:children]\nb\n[b:children]\na": "contains itself",
+		"web\n[web]\nweb1":                 "both a host and a group",
+		"db1 port=ssh":                     "", // reported by Hosts
+	} {
+		inv, err := ParseInventory(strings.NewReader(data))
+		if want == "" {
+			if _, err = inv.Hosts("all"); err == nil || !strings.Contains(err.Error(), "invalid port") {
+				t.Errorf("%q: expected invalid port, got %v", data, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected error containing %q, got %v", data, want, err)
+		}
+	}
+}
+
+func TestInventoryExecutor(t *testing.T) {
+	a := newGoMaster(t)
+	defer a.Shutdown()
+	b := newGoMaster(t)
+	defer b.Shutdown()
+
+	inv, err := ParseInventory(strings.NewReader(
+		"[ok]\na control_path=" + a.ctrlSock + "\nb control_path=" + b.ctrlSock +
+			"\n[broken]\nc control_path=" + a.ctrlSock + ".missing timeout=1m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := inv.Executor("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.HostTimeouts["c"] != time.Minute || len(e.HostTimeouts) != 1 {
+		t.Fatalf("expected a timeout for c only, got %v", e.HostTimeouts)
+	}
+	e.Concurrency = 1
+	res := e.Run("true")
+	if len(res) != 3 || res[0].Err != nil || res[1].Err != nil {
+		t.Fatalf("expected a and b to succeed, got %+v", res)
+	}
+	if !errors.Is(res[2].Err, os.ErrNotExist) {
+		t.Fatalf("expected a dial error for c, got %v", res[2].Err)
+	}
+
+	e, _ = inv.Executor("ok")
+	if res := e.Run("false"); len(res) != 2 || res[0].ExitStatus != 1 || res[1].ExitStatus != 1 {
+		t.Fatalf("expected exit status 1 on both hosts, got %+v", res)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// JSONError reports remote command output that could not be decoded,
+// e.g. because the command died halfway through.
+type JSONError struct {
+	Cmd    string
+	Offset int64 // offset in the output where decoding failed
+	Err    error
+}
+
+func (e *JSONError) Error() string {
+	return fmt.Sprintf("sshctl: decoding output of %q at offset %d: %v", e.Cmd, e.Offset, e.Err)
+}
+
+func (e *JSONError) Unwrap() error {
+	return e.Err
+}
+
+// RunJSON runs cmd on the remote host and decodes its standard
+// output, a single JSON value, into v. If the command fails, its
+// error is returned even if the output could be decoded, since many
+// tools report failures as JSON; otherwise undecodable output is
+// reported as a *JSONError.
+func (s *Session) RunJSON(cmd string, v interface{}) error {
+	out, err := s.Output(cmd)
+	dec := json.NewDecoder(bytes.NewReader(out))
+	derr := dec.Decode(v)
+	if derr == nil {
+		// only whitespace may follow the value
+		if _, err := dec.Token(); err != io.EOF {
+			derr = errors.New("unexpected data after JSON value")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if derr != nil {
+		if derr == io.EOF {
+			derr = io.ErrUnexpectedEOF
+		}
+		return s.labelErr(&JSONError{Cmd: cmd, Offset: dec.InputOffset(), Err: derr})
+	}
+	return nil
+}
+
+// RunNDJSON runs cmd on the remote host and calls fn for each value of
+// its newline delimited JSON output as it arrives. If fn returns an
+// error, the session is closed and the error returned. Output that
+// cannot be decoded is reported as a *JSONError, after the values
+// preceding it were passed to fn; the command's own error takes
+// precedence.
+func RunNDJSON[T any](s *Session, cmd string, fn func(T) error) error {
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(stdout))
+	var derr error
+	for {
+		var v T
+		if derr = dec.Decode(&v); derr != nil {
+			break
+		}
+		if err := fn(v); err != nil {
+			s.Close()
+			s.Wait()
+			return err
+		}
+	}
+	offset := dec.InputOffset()
+	// let the command finish
+	io.Copy(ioutil.Discard, stdout)
+	if err := s.Wait(); err != nil {
+		return err
+	}
+	if derr != io.EOF {
+		return s.labelErr(&JSONError{Cmd: cmd, Offset: offset, Err: derr})
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRunJSON(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	var v struct{ Name string }
+	if err := NewSession(g.ctrlSock).RunJSON(`echo '{"name": "`+TestString+`"}'`, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != TestString {
+		t.Fatalf("expected %q, got %q", TestString, v.Name)
+	}
+
+	var je *JSONError
+	for _, out := range []string{`{"name": "trunc`, `{} {}`, ``} {
+		err := NewSession(g.ctrlSock).RunJSON("printf '%s' '"+out+"'", &v)
+		if !errors.As(err, &je) {
+			t.Fatalf("%q: expected JSONError, got %v", out, err)
+		}
+	}
+
+	var ee *ExitError
+	err := NewSession(g.ctrlSock).RunJSON(`echo '{"name": "err"}'; exit 2`, &v)
+	if !errors.As(err, &ee) || v.Name != "err" {
+		t.Fatalf("expected exit error and decoded value, got %v, %q", err, v.Name)
+	}
+}
+
+func TestRunNDJSON(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	type rec struct{ N int }
+	var got []int
+	collect := func(r rec) error {
+		got = append(got, r.N)
+		return nil
+	}
+	err := RunNDJSON(NewSession(g.ctrlSock), `for i in 1 2 3; do echo "{\"n\": $i}"; done`, collect)
+	if err != nil || len(got) != 3 || got[2] != 3 {
+		t.Fatalf("unexpected result %v, %v", got, err)
+	}
+
+	got = nil
+	var je *JSONError
+	err = RunNDJSON(NewSession(g.ctrlSock), `echo '{"n": 1}'; printf '{"n": 2'`, collect)
+	if !errors.As(err, &je) || len(got) != 1 {
+		t.Fatalf("expected JSONError after one value, got %v, %v", got, err)
+	}
+
+	stop := errors.New("stop")
+	err = RunNDJSON(NewSession(g.ctrlSock), `while :; do echo '{"n": 1}'; done`, func(r rec) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("expected error from fn, got %v", err)
+	}
+}
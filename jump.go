@@ -0,0 +1,209 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpHost is a hop of a ProxyJump chain.
+type JumpHost struct {
+	User string // empty to use the ssh.ClientConfig's user
+	Host string
+	Port int // 0 means 22
+}
+
+// Addr returns the hop as "host:port".
+func (j JumpHost) Addr() string {
+	port := j.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(j.Host, strconv.Itoa(port))
+}
+
+func (j JumpHost) String() string {
+	s := j.Host
+	if j.Port != 0 {
+		s = j.Addr()
+	}
+	if j.User != "" {
+		s = j.User + "@" + s
+	}
+	return s
+}
+
+// ParseProxyJump parses an ssh_config ProxyJump value, a comma
+// separated list of [user@]host[:port]. "none" yields no hops.
+func ParseProxyJump(s string) ([]JumpHost, error) {
+	if s == "" || s == "none" {
+		return nil, nil
+	}
+	var hops []JumpHost
+	for _, hop := range strings.Split(s, ",") {
+		j, err := parseJumpHost(hop)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, j)
+	}
+	return hops, nil
+}
+
+func parseJumpHost(s string) (JumpHost, error) {
+	var j JumpHost
+	s = strings.TrimPrefix(s, "ssh://")
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		j.User, s = s[:i], s[i+1:]
+	}
+	j.Host = s
+	if strings.Count(s, ":") == 1 || strings.HasPrefix(s, "[") {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			if !strings.HasSuffix(s, "]") {
+				return j, fmt.Errorf("sshctl: invalid jump host %q", s)
+			}
+			host = strings.Trim(s, "[]")
+		}
+		j.Host = host
+		if port != "" {
+			if j.Port, err = strconv.Atoi(port); err != nil {
+				return j, fmt.Errorf("sshctl: invalid port in jump host %q", s)
+			}
+		}
+	}
+	if j.Host == "" {
+		return j, fmt.Errorf("sshctl: empty jump host")
+	}
+	return j, nil
+}
+
+// sshConfig returns the ssh_config options in effect for dest, as
+// printed by "ssh -G". Keys are lower case. args are passed to ssh
+// before dest, e.g. "-F", "path/to/config".
+func sshConfig(dest string, args ...string) (map[string]string, error) {
+	args = append(append([]string{"-G"}, args...), dest)
+	out, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("ssh -G %s: %s", dest, bytes.TrimSpace(ee.Stderr))
+		}
+		return nil, fmt.Errorf("ssh -G %s: %v", dest, err)
+	}
+	config := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		kv := strings.SplitN(sc.Text(), " ", 2)
+		if len(kv) == 2 {
+			// repeated options, e.g. sendenv, are joined
+			if v, ok := config[kv[0]]; ok {
+				kv[1] = v + " " + kv[1]
+			}
+			config[kv[0]] = kv[1]
+		}
+	}
+	return config, nil
+}
+
+// resolveJumpHost applies ssh_config to a hop given by alias.
+func resolveJumpHost(j JumpHost, args ...string) (JumpHost, error) {
+	if j.User != "" {
+		args = append(args, "-l", j.User)
+	}
+	if j.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(j.Port))
+	}
+	h, err := LookupHost(j.Host, args...)
+	if err != nil {
+		return j, err
+	}
+	return h.JumpHost(), nil
+}
+
+// ResolveProxyJump looks up dest in ssh_config and returns the hops
+// to reach it: the ProxyJump hops followed by dest itself, each with
+// hostname, user and port resolved. ProxyJump settings of the hops
+// themselves are not followed. args are passed to "ssh -G", e.g.
+// "-F", "path/to/config".
+//
+// A master is typically connected to the first hop; the remaining
+// hops are then passed to Client.DialJump.
+func ResolveProxyJump(dest string, args ...string) ([]JumpHost, error) {
+	h, err := LookupHost(dest, args...)
+	if err != nil {
+		return nil, err
+	}
+	var hops []JumpHost
+	for _, j := range h.ProxyJump {
+		if j, err = resolveJumpHost(j, args...); err != nil {
+			return nil, err
+		}
+		hops = append(hops, j)
+	}
+	return append(hops, h.JumpHost()), nil
+}
+
+// DialJump connects to the last of hops by tunneling through the
+// master to the first hop and through each hop to the next one, like
+// "ssh -J". config is used for all hops; a hop's User overrides
+// config.User. Closing the returned client closes the whole chain.
+func (c *Client) DialJump(hops []JumpHost, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("sshctl: no hops to dial")
+	}
+	var chain []*ssh.Client
+	closeChain := func() {
+		for i := len(chain) - 1; i >= 0; i-- {
+			chain[i].Close()
+		}
+	}
+	for i, j := range hops {
+		var conn net.Conn
+		var err error
+		if i == 0 {
+			conn, err = c.Dial("tcp", j.Addr())
+		} else {
+			conn, err = chain[i-1].Dial("tcp", j.Addr())
+		}
+		if err != nil {
+			closeChain()
+			return nil, fmt.Errorf("sshctl: dial %s: %w", j, err)
+		}
+		cfg := *config
+		if j.User != "" {
+			cfg.User = j.User
+		}
+		sconn, chans, reqs, err := ssh.NewClientConn(conn, j.Addr(), &cfg)
+		if err != nil {
+			conn.Close()
+			closeChain()
+			return nil, fmt.Errorf("sshctl: handshake with %s: %w", j, err)
+		}
+		chain = append(chain, ssh.NewClient(sconn, chans, reqs))
+	}
+	last := chain[len(chain)-1]
+	go func() {
+		last.Wait()
+		closeChain()
+	}()
+	return last, nil
+}
+
+// ProxyCommand returns an ssh_config ProxyCommand that tunnels through
+// the master, for chaining a second ssh(1) master behind this one,
+// e.g. with MuxdHost.Args "-o", "ProxyCommand=" + c.ProxyCommand().
+func (c *Client) ProxyCommand() string {
+	// ssh expands %-tokens in ProxyCommand
+	path := strings.Replace(shellQuote(c.sshctlpath), "%", "%%", -1)
+	return "ssh -S " + path + " -W %h:%p sshctl"
+}
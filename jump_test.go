@@ -0,0 +1,134 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []JumpHost
+	}{
+		{"none", nil},
+		{"bastion", []JumpHost{{Host: "bastion"}}},
+		{"alice@bastion:2200,gw", []JumpHost{{"alice", "bastion", 2200}, {Host: "gw"}}},
+		{"ssh://bob@[::1]:22", []JumpHost{{"bob", "::1", 22}}},
+		{"[fe80::1]", []JumpHost{{Host: "fe80::1"}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseProxyJump(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.in, tt.want, got)
+		}
+	}
+	for _, in := range []string{"bastion:ssh", "alice@", "a,,b"} {
+		if _, err := ParseProxyJump(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestResolveProxyJump(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	cfg := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(cfg, []byte(`Host inner
+  HostName 10.0.0.5
+  User deploy
+  Port 2222
+  ProxyJump alice@bastion:2200,gw
+Host gw
+  HostName gw.example.com
+  User bob
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops, err := ResolveProxyJump("inner", "-F", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JumpHost{
+		{"alice", "bastion", 2200},
+		{"bob", "gw.example.com", 22},
+		{"deploy", "10.0.0.5", 2222},
+	}
+	if !reflect.DeepEqual(hops, want) {
+		t.Fatalf("expected %v, got %v", want, hops)
+	}
+}
+
+func TestClientDial(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	conn, err := NewClient(g.ctrlSock).Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping\n"))
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ping\n" {
+		t.Fatalf("expected echo, got %q, %v", buf, err)
+	}
+}
+
+func TestDialJump(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	gw := listenTestSSHD(t)
+	defer gw.Close()
+	inner := listenTestSSHD(t)
+	defer inner.Close()
+
+	var hops []JumpHost
+	for _, l := range []net.Listener{gw, inner} {
+		port := l.Addr().(*net.TCPAddr).Port
+		hops = append(hops, JumpHost{Host: "127.0.0.1", Port: port})
+	}
+	client, err := NewClient(g.ctrlSock).DialJump(hops, &ssh.ClientConfig{
+		User:            "gopher",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := sess.Output("echo " + strconv.Quote(TestString))
+	if err != nil || string(out) != TestString+"\n" {
+		t.Fatalf("expected %q, got %q, %v", TestString, out, err)
+	}
+}
+
+func TestProxyCommand(t *testing.T) {
+	got := NewClient("/tmp/%r.sock").ProxyCommand()
+	if want := "ssh -S '/tmp/%%r.sock' -W %h:%p sshctl"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
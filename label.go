@@ -0,0 +1,66 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WithLabel tags the session with a label, e.g. "deploy-db01", and
+// returns the session for chaining. The label prefixes trace
+// messages and errors and is part of String.
+//
+// Errors of labeled sessions are wrapped; use errors.As to get at an
+// *ExitError or *ExitMissingError.
+func (s *Session) WithLabel(label string) *Session {
+	s.label = label
+	return s
+}
+
+// Label returns the label set by WithLabel.
+func (s *Session) Label() string {
+	return s.label
+}
+
+// String describes the session for debugging, e.g.
+// `deploy-db01 session 3 on /var/tmp/mux.sock: "uptime"`.
+// The command passes through the session's Redactor.
+func (s *Session) String() string {
+	var b strings.Builder
+	if s.label != "" {
+		b.WriteString(s.label + " ")
+	}
+	b.WriteString("session")
+	if s.started {
+		fmt.Fprintf(&b, " %d", s.ctrlSessid)
+	}
+	fmt.Fprintf(&b, " on %s", s.sshctlpath)
+	if s.started {
+		fmt.Fprintf(&b, ": %q", s.Redactor.Redact(s.cmd))
+	}
+	return b.String()
+}
+
+// LabeledError is returned instead of Err by sessions with a label.
+type LabeledError struct {
+	Label string
+	Err   error
+}
+
+func (e *LabeledError) Error() string {
+	return e.Label + ": " + e.Err.Error()
+}
+
+func (e *LabeledError) Unwrap() error {
+	return e.Err
+}
+
+func (s *Session) labelErr(err error) error {
+	if err == nil || s.label == "" {
+		return err
+	}
+	return &LabeledError{Label: s.label, Err: err}
+}
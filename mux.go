@@ -6,29 +6,58 @@ package sshctl
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/ftrvxmtrx/fd"
+	"github.com/mpfz0r/sshctl/mux"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
 	"net"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
-// ssh mux protocol messages
+// ssh mux protocol messages, see package mux
 // cf: https://github.com/openbsd/src/blob/master/usr.bin/ssh/mux.c
 const (
-	muxVersion    = 4
-	muxMsgHello   = 1
-	muxNewSession = 0x10000002
-	muxAliveCheck = 0x10000004
-
-	muxIsAlive       = 0x80000005
-	muxSessionOpened = 0x80000006
-	muxTtyAllocFail  = 0x80000008
-	muxExitMessage   = 0x80000004
+	muxVersion       = mux.Version
+	muxMsgHello      = mux.MsgHello
+	muxNewSession    = mux.MsgNewSession
+	muxAliveCheck    = mux.MsgAliveCheck
+	muxTerminate     = mux.MsgTerminate
+	muxOpenFwd       = mux.MsgOpenFwd
+	muxCloseFwd      = mux.MsgCloseFwd
+	muxNewStdioFwd   = mux.MsgNewStdioFwd
+	muxStopListening = mux.MsgStopListening
+	muxProxy         = mux.MsgProxy
+
+	muxOk               = mux.MsgOk
+	muxPermissionDenied = mux.MsgPermissionDenied
+	muxFailure          = mux.MsgFailure
+	muxIsAlive          = mux.MsgIsAlive
+	muxSessionOpened    = mux.MsgSessionOpened
+	muxRemotePort       = mux.MsgRemotePort
+	muxTtyAllocFail     = mux.MsgTtyAllocFail
+	muxExitMessage      = mux.MsgExitMessage
+	muxProxyReply       = mux.MsgProxyReply
+
+	// forward types
+	muxFwdLocal   = mux.FwdLocal
+	muxFwdRemote  = mux.FwdRemote
+	muxFwdDynamic = mux.FwdDynamic
+
+	// port number denoting a unix socket forward
+	muxPortStreamLocal = mux.PortStreamLocal
 )
 
+// muxHelloTimeout bounds the wait for the master's hello message.
+// Masters speaking the legacy protocol (OpenSSH < 5.5) expect the
+// client to talk first and would otherwise leave us hanging, as would
+// a stalled master.
+var muxHelloTimeout = 10 * time.Second
+
 type muxNewSessionMsg struct {
 	Request       uint32
 	RequestId     uint32
@@ -42,37 +71,69 @@ type muxNewSessionMsg struct {
 	Command       string
 }
 
+type muxNewStdioFwdMsg struct {
+	Request     uint32
+	RequestId   uint32
+	ReservedStr string
+	ConnectHost string
+	ConnectPort uint32
+}
+
 type muxMsg struct {
 	Request uint32
 	Param   uint32
 }
 
-func (s *Session) readPacket() ([]byte, error) {
-	lenbuf := make([]byte, 4)
-	_, err := io.ReadAtLeast(s.ctrlconn, lenbuf, 4)
+func readPacket(r io.Reader) ([]byte, error) {
+	packet, err := mux.ReadPacket(r)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read from control socket: %v", err)
+		return nil, fmt.Errorf("Unable to read from control socket: %w", err)
 	}
-	len := binary.BigEndian.Uint32(lenbuf)
+	return packet, nil
+}
+
+func writePacket(w io.Writer, req []byte) error {
+	return mux.WritePacket(w, req)
+}
 
-	packet := make([]byte, len)
-	_, err = io.ReadAtLeast(s.ctrlconn, packet, int(len))
+func (s *Session) readPacket() ([]byte, error) {
+	packet, err := mux.ReadPacket(s.ctrlconn)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to read from control socket: %v", err)
+		return nil, &ControlIOError{s.sshctlpath, "read", atomic.LoadInt64(&s.ctrlRead), err}
 	}
+	atomic.AddInt64(&s.ctrlRead, int64(4+len(packet)))
 	return packet, nil
 }
 
-func (s *Session) writePacket(req []byte) (err error) {
-	msg := make([]byte, 4+len(req))
-	binary.BigEndian.PutUint32(msg, uint32(len(req)))
-	copy(msg[4:], req)
-	if _, err = s.ctrlconn.Write(msg); err != nil {
-		return err
+func (s *Session) writePacket(req []byte) error {
+	if err := mux.WritePacket(s.ctrlconn, req); err != nil {
+		return &ControlIOError{s.sshctlpath, "write", atomic.LoadInt64(&s.ctrlWritten), err}
 	}
+	atomic.AddInt64(&s.ctrlWritten, int64(4+len(req)))
 	return nil
 }
 
+// ControlIOError reports a failure reading or writing packets on the
+// control connection to the master.
+type ControlIOError struct {
+	Path string // the control socket
+	Op   string // "read" or "write"
+	N    int64  // bytes read or written on the connection before
+	Err  error
+}
+
+func (e *ControlIOError) Error() string {
+	prep := "from"
+	if e.Op == "write" {
+		prep = "to"
+	}
+	return fmt.Sprintf("Unable to %s %s control socket %s after %d bytes: %v", e.Op, prep, e.Path, e.N, e.Err)
+}
+
+func (e *ControlIOError) Unwrap() error {
+	return e.Err
+}
+
 func packetPopInt(buf *[]byte) (int, error) {
 	if len(*buf) < 4 {
 		return -1, fmt.Errorf("buffer too short")
@@ -82,6 +143,20 @@ func packetPopInt(buf *[]byte) (int, error) {
 	return int(res), nil
 }
 
+func packetPopString(buf *[]byte) (string, error) {
+	var n int
+	var err error
+	if n, err = packetPopInt(buf); err != nil {
+		return "", err
+	}
+	if n < 0 || len(*buf) < n {
+		return "", fmt.Errorf("buffer too short")
+	}
+	res := string((*buf)[:n])
+	*buf = (*buf)[n:]
+	return res, nil
+}
+
 func (s *Session) recvInts(count int) ([]int, error) {
 	var packet []byte
 	var err error
@@ -99,38 +174,130 @@ func (s *Session) recvInts(count int) ([]int, error) {
 	return msgs, nil
 }
 
+// openCtrlConn connects to the master, coalescing the first contact
+// with concurrent sessions, see masterProbes. A failed hello of the
+// shared probe is returned as a *helloError.
 func (s *Session) openCtrlConn() error {
-	var raddr *net.UnixAddr
-	var err error
-	if raddr, err = net.ResolveUnixAddr("unix", s.sshctlpath); err != nil {
+	if s.dial != nil {
+		// nothing to share the first contact with
+		return s.dialCtrlConn()
+	}
+	if s.VerifyPeer {
+		// the probe would say hello to a peer not verified yet
+		return s.dialCtrlConn()
+	}
+	if err := masterProbes.do(s.sshctlpath, probeMaster); err != nil {
 		return err
 	}
-	if s.ctrlconn, err = net.DialUnix("unix", nil, raddr); err != nil {
+	if err := s.dialCtrlConn(); err != nil {
+		masterProbes.forget(s.sshctlpath)
 		return err
 	}
 	return nil
 }
 
-func (s *Session) sshMuxHello() error {
-	var msgs []int
+func (s *Session) dialCtrlConn() error {
+	var err error
+	if s.dial != nil {
+		s.ctrlconn, err = s.dial()
+	} else {
+		var raddr *net.UnixAddr
+		if raddr, err = net.ResolveUnixAddr("unix", s.sshctlpath); err != nil {
+			return err
+		}
+		s.ctrlconn, err = net.DialUnix("unix", nil, raddr)
+	}
+	if err != nil {
+		return err
+	}
+	if s.VerifyPeer {
+		if err = s.verifyPeer(); err != nil {
+			s.ctrlconn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// sshMuxHello exchanges hello messages with the master. The wait for
+// the master's hello ends at deadline, which is restored afterwards,
+// or after muxHelloTimeout if that comes first or deadline is zero.
+func (s *Session) sshMuxHello(deadline time.Time) error {
+	var packet []byte
+	var mtype, version int
 	var err error
 
-	if msgs, err = s.recvInts(2); err != nil {
+	helloDeadline := time.Now().Add(muxHelloTimeout)
+	if !deadline.IsZero() && deadline.Before(helloDeadline) {
+		helloDeadline = deadline
+	}
+	s.ctrlconn.SetReadDeadline(helloDeadline)
+	packet, err = s.readPacket()
+	s.ctrlconn.SetReadDeadline(deadline)
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			// a live master that is stalled, or one speaking the
+			// legacy protocol; which one is not known
+			return fmt.Errorf("no hello from mux master: %w", err)
+		}
+		return err
+	}
+	if mtype, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	if version, err = packetPopInt(&packet); err != nil {
 		return err
 	}
-	if msgs[0] != muxMsgHello || msgs[1] != muxVersion {
+	if mtype != muxMsgHello {
 		return fmt.Errorf("Incompatible Hello packet received")
 	}
+	if version, err = negotiateVersion(version); err != nil {
+		return err
+	}
+	// The rest of the hello packet are extension name/value pairs
+	s.masterExtensions = make(map[string]string)
+	for len(packet) > 0 {
+		var name, value string
+		if name, err = packetPopString(&packet); err != nil {
+			return err
+		}
+		if value, err = packetPopString(&packet); err != nil {
+			return err
+		}
+		s.masterExtensions[name] = value
+	}
+	s.masterVersion = version
+	s.tracef("hello: mux version %d, extensions %v", version, s.masterExtensions)
+	if err = s.consumeExtensions(); err != nil {
+		return err
+	}
 	m := &muxMsg{}
 	m.Request = muxMsgHello
-	m.Param = muxVersion
-	buf := ssh.Marshal(m)
+	m.Param = uint32(version)
+	buf := append(ssh.Marshal(m), marshalExtensions()...)
 	if err = s.writePacket(buf); err != nil {
 		return err
 	}
 	return nil
 }
 
+// negotiateVersion picks the protocol version to speak with a master
+// that announced the given version. Newer masters are answered with
+// our own version: mux.c keeps the message layouts of a revision and
+// adds features as new message types.
+//
+// Degraded operation against older revisions is declined: every
+// OpenSSH since 5.5 speaks version 4, and the ones before it have no
+// hello and a different message layout altogether, so there is no
+// older revision to fall back to.
+func negotiateVersion(master int) (int, error) {
+	if master < muxVersion {
+		return 0, &VersionError{Version: master}
+	}
+	return muxVersion, nil
+}
+
 func (s *Session) sshMuxAliveCheck() error {
 	var msgs []int
 	var err error
@@ -151,7 +318,8 @@ func (s *Session) sshMuxAliveCheck() error {
 	if msgs[1] != s.ctrlReqid {
 		return fmt.Errorf("out of sequence reply: 0x%x", msgs[0])
 	}
-	//sshpid = msgs[2]
+	s.masterPid = msgs[2]
+	s.tracef("master pid %d is alive", s.masterPid)
 	s.ctrlReqid++
 	return nil
 }
@@ -169,13 +337,76 @@ func (s *Session) sshMuxNewSession(cmd string) error {
 		nms.TtyFlags = uint32(1)
 	}
 	nms.Command = cmd
+	s.tracef("new session request %d: term %q, command %q", s.ctrlReqid, nms.Term, cmd)
 	buf := ssh.Marshal(nms)
+	// Environment variables trail the fixed part as "NAME=value"
+	for _, kv := range s.env {
+		s.tracef("new session request %d: env %s", s.ctrlReqid, kv)
+		buf = append(buf, ssh.Marshal(struct{ Env string }{kv})...)
+	}
 	if err := s.writePacket(buf); err != nil {
 		return err
 	}
 	return nil
 }
 
+// stdioFwdError is the master's refusal of a stdio forward.
+type stdioFwdError struct {
+	host   string
+	port   int
+	reason string
+}
+
+func (e *stdioFwdError) Error() string {
+	return fmt.Sprintf("stdio forward to %s:%d: %s", e.host, e.port, e.reason)
+}
+
+// sshMuxNewStdioFwd asks the master to connect to host:port, like
+// "ssh -W", and passes f as both ends of the forward.
+func (s *Session) sshMuxNewStdioFwd(host string, port int, f *os.File) error {
+	m := &muxNewStdioFwdMsg{}
+	m.Request = muxNewStdioFwd
+	m.RequestId = uint32(s.ctrlReqid)
+	m.ConnectHost = host
+	m.ConnectPort = uint32(port)
+	s.tracef("stdio forward request %d: %s:%d", s.ctrlReqid, host, port)
+	if err := s.writePacket(ssh.Marshal(m)); err != nil {
+		return err
+	}
+	if err := fd.Put(s.ctrlconn, f); err != nil {
+		return err
+	}
+	if err := fd.Put(s.ctrlconn, f); err != nil {
+		return err
+	}
+	packet, err := s.readPacket()
+	if err != nil {
+		return err
+	}
+	var mtype, rid int
+	if mtype, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	if rid, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	if rid != s.ctrlReqid {
+		return fmt.Errorf("out of sequence reply: 0x%x", rid)
+	}
+	s.ctrlReqid++
+	switch mtype {
+	case muxSessionOpened:
+		if s.ctrlSessid, err = packetPopInt(&packet); err != nil {
+			return err
+		}
+		return nil
+	case muxPermissionDenied, muxFailure:
+		reason, _ := packetPopString(&packet)
+		return &stdioFwdError{host, port, reason}
+	}
+	return fmt.Errorf("Expected muxSessionOpened, got: 0x%x", mtype)
+}
+
 func (s *Session) sshMuxPassFileDescriptors() error {
 	var msgs []int
 	var err error
@@ -183,26 +414,78 @@ func (s *Session) sshMuxPassFileDescriptors() error {
 	// SSH expects us to pass file descriptors.
 	// If the the user did provide an os.File, use it directly.
 	// Otherwise create a Pipe() and pass one end.
-	if sf, ok := s.Stdin.(*os.File); ok {
+	if s.StdinFile != nil {
+		if s.Stdin != nil || s.lmuxStdin != nil || s.TTYStdin {
+			return errors.New("ssh: Stdin already set")
+		}
+		s.rmuxStdin = s.StdinFile
+		s.stdinpipe = true
+	} else if s.TTYStdin {
+		if s.Stdin != nil || s.lmuxStdin != nil {
+			return errors.New("ssh: Stdin already set")
+		}
+		if s.tty, err = os.OpenFile("/dev/tty", os.O_RDWR, 0); err != nil {
+			return err
+		}
+		s.rmuxStdin = s.tty
+		s.stdinpipe = true
+	} else if sf, ok := s.Stdin.(*os.File); ok {
 		s.rmuxStdin = sf
 		s.stdinpipe = true
+	} else if s.Stdin == nil && s.lmuxStdin == nil && !s.KeepStdinOpen {
+		if s.rmuxStdin, err = s.openDevNull(os.O_RDONLY); err != nil {
+			return err
+		}
+		s.stdinpipe = true
 	} else if s.lmuxStdin == nil {
 		//  r, w, err = os.Pipe
 		if s.rmuxStdin, s.lmuxStdin, err = os.Pipe(); err != nil {
 			return err
 		}
 	}
-	if sf, ok := s.Stdout.(*os.File); ok {
+	if s.term != "" && len(s.TerminalModes) > 0 {
+		if s.restoreModes, err = applyTerminalModes(s.rmuxStdin, s.TerminalModes); err != nil {
+			return err
+		}
+	}
+	if s.term != "" {
+		if err = s.syncWindowSize(); err != nil {
+			return err
+		}
+	}
+	if s.StdoutFile != nil {
+		if s.Stdout != nil || s.lmuxStdout != nil {
+			return errors.New("ssh: Stdout already set")
+		}
+		s.rmuxStdout = s.StdoutFile
+		s.stdoutpipe = true
+	} else if sf, ok := s.Stdout.(*os.File); ok {
 		s.rmuxStdout = sf
 		s.stdoutpipe = true
+	} else if s.Stdout == nil && s.lmuxStdout == nil && s.FirstOutputTimeout <= 0 && s.StdoutEOFTimeout <= 0 {
+		if s.rmuxStdout, err = s.openDevNull(os.O_WRONLY); err != nil {
+			return err
+		}
+		s.stdoutpipe = true
 	} else if s.lmuxStdout == nil {
 		if s.lmuxStdout, s.rmuxStdout, err = os.Pipe(); err != nil {
 			return err
 		}
 	}
-	if sf, ok := s.Stderr.(*os.File); ok {
+	if s.StderrFile != nil {
+		if s.Stderr != nil || s.lmuxStderr != nil {
+			return errors.New("ssh: Stderr already set")
+		}
+		s.rmuxStderr = s.StderrFile
+		s.stderrpipe = true
+	} else if sf, ok := s.Stderr.(*os.File); ok {
 		s.rmuxStderr = sf
 		s.stderrpipe = true
+	} else if s.Stderr == nil && s.lmuxStderr == nil && s.FirstOutputTimeout <= 0 {
+		if s.rmuxStderr, err = s.openDevNull(os.O_WRONLY); err != nil {
+			return err
+		}
+		s.stderrpipe = true
 	} else if s.lmuxStderr == nil {
 		if s.lmuxStderr, s.rmuxStderr, err = os.Pipe(); err != nil {
 			return err
@@ -222,14 +505,43 @@ func (s *Session) sshMuxPassFileDescriptors() error {
 		return fmt.Errorf("out of sequence reply: 0x%x", msgs[0])
 	}
 	s.ctrlSessid = msgs[2]
+	s.tracef("session %d: opened", s.ctrlSessid)
 	s.ctrlReqid++
 	return nil
 }
 
+// syncWindowSize sets the size of the pty to request on the terminal
+// passed as stdin, where the master reads it.
+func (s *Session) syncWindowSize() error {
+	size := s.WindowSize
+	if size == (WindowSize{}) {
+		out, ok := s.Stdout.(*os.File)
+		if s.StdoutFile != nil {
+			out, ok = s.StdoutFile, true
+		}
+		if !ok || s.tty != nil {
+			// the terminal opened for TTYStdin has the right size
+			return nil
+		}
+		var err error
+		if size, err = getWindowSize(out); err != nil {
+			return nil
+		}
+		if cur, err := getWindowSize(s.rmuxStdin); err != nil || cur == size {
+			// no terminal, or the same one
+			return nil
+		}
+	}
+	if err := setWindowSize(s.rmuxStdin, size); err != nil {
+		return fmt.Errorf("ssh: WindowSize needs a terminal as stdin: %w", err)
+	}
+	return nil
+}
+
 func (s *Session) makeRawTerm() error {
 	fd := int(s.rmuxStdin.Fd())
 	st, err := terminal.GetState(fd)
-	// Restore has to be done by the user
+	// Restore has to be done by the user, except for TTYStdin
 	raw, err := terminal.MakeRaw(fd)
 	if err != nil {
 		return fmt.Errorf("MakeRaw err: %v", err)
@@ -237,16 +549,52 @@ func (s *Session) makeRawTerm() error {
 	if *st != *raw {
 		return fmt.Errorf("MakeRaw state was %v expected %v", *raw, *st)
 	}
+	if s.tty != nil {
+		s.ttyState = raw
+	}
 	return nil
 }
 
+// openDevNull opens os.DevNull to pass to the master for a stream
+// nobody reads or writes, which needs neither a pipe nor a goroutine
+// copying it. It is closed once the session is opened.
+func (s *Session) openDevNull(flag int) (*os.File, error) {
+	f, err := os.OpenFile(os.DevNull, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.devNull = append(s.devNull, f)
+	return f, nil
+}
+
 func (s *Session) requestMuxSession(cmd string) error {
 	var err error
 
+	defer func() {
+		// On created pipes, close the remote end from our side,
+		// whether the session was opened or not. This needs to
+		// happen after makeRawTerm()
+		for _, p := range [][2]*os.File{
+			{s.lmuxStdin, s.rmuxStdin},
+			{s.lmuxStdout, s.rmuxStdout},
+			{s.lmuxStderr, s.rmuxStderr},
+		} {
+			if p[0] != nil && p[1] != nil {
+				p[1].Close()
+			}
+		}
+		for _, f := range s.devNull {
+			f.Close()
+		}
+		s.devNull = nil
+	}()
+
 	s.ctrlReqid = 0
-	if err = s.sshMuxHello(); err != nil {
+	if err = s.sshMuxHello(time.Time{}); err != nil {
+		masterProbes.forget(s.sshctlpath)
 		return err
 	}
+	s.setState(StateHelloDone)
 	if err = s.sshMuxAliveCheck(); err != nil {
 		return err
 	}
@@ -256,23 +604,14 @@ func (s *Session) requestMuxSession(cmd string) error {
 	if err = s.sshMuxPassFileDescriptors(); err != nil {
 		return err
 	}
+	s.openTime = time.Now()
+	s.setState(StateOpened)
+	s.emit(SessionOpened, nil)
 	if s.term != "" {
 		if err = s.makeRawTerm(); err != nil {
 			return err
 		}
 	}
-
-	// On created pipes, close the remote end from our side.
-	// This needs to happen after makeRawTerm()
-	if s.lmuxStdin != nil {
-		s.rmuxStdin.Close()
-	}
-	if s.lmuxStdout != nil {
-		s.rmuxStdout.Close()
-	}
-	if s.lmuxStderr != nil {
-		s.rmuxStderr.Close()
-	}
 	return nil
 }
 
@@ -284,9 +623,11 @@ func (s *Session) wait() error {
 
 	exit_seen := false
 	for {
+		var violation string // ignored unless Strict
 		if buf, err = s.readPacket(); err != nil {
 			break
 		}
+		s.heard()
 		if mtype, err = packetPopInt(&buf); err != nil {
 			break
 		}
@@ -297,48 +638,123 @@ func (s *Session) wait() error {
 				break
 			}
 			if sid != s.ctrlSessid {
-				wm.msg = fmt.Sprintf("unknown session id: myid %d theirs %d", s.ctrlSessid, sid)
+				violation = fmt.Sprintf("unknown session id: myid %d theirs %d", s.ctrlSessid, sid)
+				wm.msg = violation
 				break
 			}
+			s.tracef("session %d: tty allocation failed", sid)
+			wm.msg = "pseudo-terminal allocation failed"
+			s.ttyAllocFailed = true
+			if s.PtyFallback {
+				s.ptyFallback()
+			}
 		case muxExitMessage:
 			if sid, err = packetPopInt(&buf); err != nil {
 				break
 			}
 			if sid != s.ctrlSessid {
-				wm.msg = fmt.Sprintf("unknown session id: myid %d theirs %d", s.ctrlSessid, sid)
+				violation = fmt.Sprintf("unknown session id: myid %d theirs %d", s.ctrlSessid, sid)
+				wm.msg = violation
 				break
 			}
 			if exit_seen {
-				wm.msg = "exit seen twice"
+				violation = "exit seen twice"
+				wm.msg = violation
 				break
 			}
 			if wm.status, err = packetPopInt(&buf); err != nil {
 				break
 			}
+			s.tracef("session %d: exit status %d", sid, wm.status)
+			s.setState(StateExited)
 			exit_seen = true
+		case muxPermissionDenied, muxFailure:
+			// request id and reason
+			var rid int
+			if rid, err = packetPopInt(&buf); err != nil {
+				break
+			}
+			if wm.msg, err = packetPopString(&buf); err != nil {
+				break
+			}
+			s.tracef("session %d: master reported: %s", s.ctrlSessid, wm.msg)
+			if rid != s.ctrlReqid-1 {
+				violation = fmt.Sprintf("reply to unknown request id %d", rid)
+			}
 		default:
-			// XXX read error string from packet
-			//checkErr(fmt.Errorf("master returned error: XXX"))
+			violation = "unexpected message from master: " + mux.TypeName(uint32(mtype))
+			wm.msg = violation
+		}
+		if violation != "" && s.Strict {
+			err = &ProtocolError{violation}
 			break
 		}
 	}
+	if pe, ok := err.(*ProtocolError); ok {
+		s.setState(StateExited)
+		s.ctrlconn.Close()
+		return pe
+	}
+	// The master hung up, with or without an exit status
+	s.setState(StateExited)
+	s.exitMsg = wm.msg
 
 	if wm.status == 0 {
 		return nil
 	}
 	if wm.status == -1 {
 		// exit-status was never sent from server
-		return &ExitMissingError{}
+		return &ExitMissingError{Msg: wm.msg}
 	}
 	s.ctrlconn.Close()
 
 	return &ExitError{wm}
 }
 
+// ProtocolError reports a message from the master that violates the
+// mux protocol. It is only returned by sessions in Strict mode.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "sshctl: mux protocol violation: " + e.Msg
+}
+
 // ExitMissingError is returned if a session is torn down cleanly, but
-// the server sends no confirmation of the exit status.
-type ExitMissingError struct{}
+// the server sends no confirmation of the exit status. Msg is the
+// master's message about the session, if any, see Waitmsg.Msg.
+type ExitMissingError struct {
+	Msg string
+}
 
 func (e *ExitMissingError) Error() string {
+	if e.Msg != "" {
+		return "wait: remote command exited without exit status or exit signal. Reason was: " + e.Msg
+	}
 	return "wait: remote command exited without exit status or exit signal"
 }
+
+// VersionError is returned if the master announces a mux protocol
+// version older than 4, the one of OpenSSH 5.5 and later, which is
+// not supported, see negotiateVersion. A master that sends no hello
+// in time gets a timeout error instead, as it may just be stalled.
+type VersionError struct {
+	// Version announced by the master.
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported mux protocol version %d, need at least %d", e.Version, muxVersion)
+}
+
+// ptyFallback continues a session whose pty was refused without one.
+func (s *Session) ptyFallback() {
+	s.tracef("session %d: continuing without a pty", s.ctrlSessid)
+	if s.tty != nil && s.ttyState != nil {
+		terminal.Restore(int(s.tty.Fd()), s.ttyState)
+	}
+	if s.OnPtyFallback != nil {
+		s.OnPtyFallback()
+	}
+}
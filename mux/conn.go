@@ -0,0 +1,117 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// MaxPacketSize bounds the packets accepted by ReadPacket. OpenSSH
+// uses the same limit.
+const MaxPacketSize = 256 * 1024
+
+// PacketConn reads and writes the length-prefixed packets of the
+// protocol. It is not safe for concurrent use.
+type PacketConn struct {
+	rw io.ReadWriter
+}
+
+// NewPacketConn returns a PacketConn on rw, usually a connection to
+// the control socket of a master.
+func NewPacketConn(rw io.ReadWriter) *PacketConn {
+	return &PacketConn{rw: rw}
+}
+
+// ReadPacket reads the next packet and returns its payload.
+func (c *PacketConn) ReadPacket() ([]byte, error) {
+	return ReadPacket(c.rw)
+}
+
+// WritePacket writes payload as a packet.
+func (c *PacketConn) WritePacket(payload []byte) error {
+	return WritePacket(c.rw, payload)
+}
+
+// ReadMessage reads and decodes the next packet.
+func (c *PacketConn) ReadMessage() (Message, error) {
+	p, err := c.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(p)
+}
+
+// WriteMessage encodes and writes m.
+func (c *PacketConn) WriteMessage(m Message) error {
+	return c.WritePacket(Marshal(m))
+}
+
+// ReadPacket reads a packet from r and returns its payload.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(r, lenbuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenbuf[:])
+	if n > MaxPacketSize {
+		return nil, fmt.Errorf("mux: packet of %d bytes too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+// WritePacket writes payload to w as a packet.
+func WritePacket(w io.Writer, payload []byte) error {
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// SendFile passes f over conn, as expected after NewSession and
+// NewStdioFwd.
+func SendFile(conn *net.UnixConn, f *os.File) error {
+	rights := syscall.UnixRights(int(f.Fd()))
+	// OpenSSH reads one byte of data along with the descriptor
+	_, _, err := conn.WriteMsgUnix([]byte{0}, rights, nil)
+	return err
+}
+
+// ReceiveFile receives a file passed with SendFile.
+func ReceiveFile(conn *net.UnixConn) (*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("mux: expected a file descriptor")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, fmt.Errorf("mux: expected one file descriptor, got %d", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), "mux"), nil
+}
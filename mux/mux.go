@@ -0,0 +1,375 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mux implements the wire format of the OpenSSH ControlMaster
+// multiplexing protocol, version 4, as described in PROTOCOL.mux of
+// the OpenSSH sources.
+//
+// It is the low-level layer below package sshctl, for programs that
+// want to speak the protocol directly, e.g. to implement a master or
+// to send requests sshctl does not cover. Most programs should use
+// sshctl.Session and sshctl.Client instead.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Version is the protocol version implemented by this package.
+const Version = 4
+
+// Message types, named after the MUX_C_* requests and MUX_S_*
+// replies of mux.c.
+const (
+	MsgHello         = 0x00000001
+	MsgNewSession    = 0x10000002
+	MsgAliveCheck    = 0x10000004
+	MsgTerminate     = 0x10000005
+	MsgOpenFwd       = 0x10000006
+	MsgCloseFwd      = 0x10000007
+	MsgNewStdioFwd   = 0x10000008
+	MsgStopListening = 0x10000009
+	MsgProxy         = 0x1000000f
+
+	MsgOk               = 0x80000001
+	MsgPermissionDenied = 0x80000002
+	MsgFailure          = 0x80000003
+	MsgExitMessage      = 0x80000004
+	MsgIsAlive          = 0x80000005
+	MsgSessionOpened    = 0x80000006
+	MsgRemotePort       = 0x80000007
+	MsgTtyAllocFail     = 0x80000008
+	MsgProxyReply       = 0x8000000f
+)
+
+var typeNames = map[uint32]string{
+	MsgHello:            "MUX_MSG_HELLO",
+	MsgNewSession:       "MUX_C_NEW_SESSION",
+	MsgAliveCheck:       "MUX_C_ALIVE_CHECK",
+	MsgTerminate:        "MUX_C_TERMINATE",
+	MsgOpenFwd:          "MUX_C_OPEN_FWD",
+	MsgCloseFwd:         "MUX_C_CLOSE_FWD",
+	MsgNewStdioFwd:      "MUX_C_NEW_STDIO_FWD",
+	MsgStopListening:    "MUX_C_STOP_LISTENING",
+	MsgProxy:            "MUX_C_PROXY",
+	MsgOk:               "MUX_S_OK",
+	MsgPermissionDenied: "MUX_S_PERMISSION_DENIED",
+	MsgFailure:          "MUX_S_FAILURE",
+	MsgExitMessage:      "MUX_S_EXIT_MESSAGE",
+	MsgIsAlive:          "MUX_S_ALIVE",
+	MsgSessionOpened:    "MUX_S_SESSION_OPENED",
+	MsgRemotePort:       "MUX_S_REMOTE_PORT",
+	MsgTtyAllocFail:     "MUX_S_TTY_ALLOC_FAIL",
+	MsgProxyReply:       "MUX_S_PROXY",
+}
+
+// TypeName returns the name of a message type as used in mux.c,
+// e.g. "MUX_C_OPEN_FWD", or its hex value if it is unknown.
+func TypeName(t uint32) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", t)
+}
+
+// TypeOf returns the message type of m.
+func TypeOf(m Message) uint32 {
+	return m.msgType()
+}
+
+// Forward types of OpenForward and CloseForward.
+const (
+	FwdLocal   = 1
+	FwdRemote  = 2
+	FwdDynamic = 3
+)
+
+// PortStreamLocal is the port of a forward side that is a unix socket.
+const PortStreamLocal = 0xfffffffe
+
+// A Message is one of the message types of this package. Marshal
+// encodes it and Unmarshal decodes it by its type.
+type Message interface {
+	msgType() uint32
+}
+
+// Extension is a name/value pair of a Hello message.
+type Extension struct {
+	Name, Value string
+}
+
+// Hello is exchanged by both sides when a client connects.
+type Hello struct {
+	Version    uint32
+	Extensions []Extension
+}
+
+// NewSession requests a session. The command's stdin, stdout and
+// stderr are passed as file descriptors right after the message.
+type NewSession struct {
+	RequestID    uint32
+	Reserved     string
+	TtyFlag      uint32
+	ForwardX11   uint32
+	ForwardAgent uint32
+	Subsystem    uint32
+	EscapeChar   uint32 // 0xffffffff disables the escape character
+	Term         string
+	Command      string
+	Env          []string // "NAME=value"
+}
+
+// AliveCheck asks for the master's pid, answered by IsAlive.
+type AliveCheck struct {
+	RequestID uint32
+}
+
+// Terminate asks the master to exit.
+type Terminate struct {
+	RequestID uint32
+}
+
+// OpenForward requests a port forward.
+type OpenForward struct {
+	RequestID   uint32
+	FwdType     uint32
+	ListenHost  string
+	ListenPort  uint32
+	ConnectHost string
+	ConnectPort uint32
+}
+
+// CloseForward cancels a port forward.
+type CloseForward OpenForward
+
+// NewStdioFwd requests a stdio forward, like "ssh -W". The stdin and
+// stdout of the forward are passed as file descriptors right after
+// the message.
+type NewStdioFwd struct {
+	RequestID   uint32
+	Reserved    string
+	ConnectHost string
+	ConnectPort uint32
+}
+
+// StopListening asks the master to close its control socket.
+type StopListening struct {
+	RequestID uint32
+}
+
+// Proxy switches the connection to proxy mode: after ProxyReply,
+// the client exchanges raw SSH channel packets with the master, as
+// "ssh -O proxy" does.
+type Proxy struct {
+	RequestID uint32
+}
+
+// Ok confirms a request.
+type Ok struct {
+	RequestID uint32
+}
+
+// PermissionDenied refuses a request.
+type PermissionDenied struct {
+	RequestID uint32
+	Reason    string
+}
+
+// Failure reports a failed request.
+type Failure struct {
+	RequestID uint32
+	Reason    string
+}
+
+// ExitMessage reports the exit status of a session's command.
+type ExitMessage struct {
+	SessionID  uint32
+	ExitStatus uint32
+}
+
+// IsAlive answers AliveCheck.
+type IsAlive struct {
+	RequestID uint32
+	Pid       uint32
+}
+
+// SessionOpened confirms NewSession and NewStdioFwd.
+type SessionOpened struct {
+	RequestID uint32
+	SessionID uint32
+}
+
+// RemotePort reports the port the server allocated for a remote
+// forward with listen port 0.
+type RemotePort struct {
+	RequestID uint32
+	Port      uint32
+}
+
+// ProxyReply confirms Proxy.
+type ProxyReply struct {
+	RequestID uint32
+}
+
+// TtyAllocFail reports that no pseudo-terminal could be allocated for
+// a session.
+type TtyAllocFail struct {
+	SessionID uint32
+}
+
+func (*Hello) msgType() uint32            { return MsgHello }
+func (*NewSession) msgType() uint32       { return MsgNewSession }
+func (*AliveCheck) msgType() uint32       { return MsgAliveCheck }
+func (*Terminate) msgType() uint32        { return MsgTerminate }
+func (*OpenForward) msgType() uint32      { return MsgOpenFwd }
+func (*CloseForward) msgType() uint32     { return MsgCloseFwd }
+func (*NewStdioFwd) msgType() uint32      { return MsgNewStdioFwd }
+func (*StopListening) msgType() uint32    { return MsgStopListening }
+func (*Proxy) msgType() uint32            { return MsgProxy }
+func (*ProxyReply) msgType() uint32       { return MsgProxyReply }
+func (*Ok) msgType() uint32               { return MsgOk }
+func (*PermissionDenied) msgType() uint32 { return MsgPermissionDenied }
+func (*Failure) msgType() uint32          { return MsgFailure }
+func (*ExitMessage) msgType() uint32      { return MsgExitMessage }
+func (*IsAlive) msgType() uint32          { return MsgIsAlive }
+func (*SessionOpened) msgType() uint32    { return MsgSessionOpened }
+func (*RemotePort) msgType() uint32       { return MsgRemotePort }
+func (*TtyAllocFail) msgType() uint32     { return MsgTtyAllocFail }
+
+var messages = map[uint32]func() Message{
+	MsgHello:            func() Message { return new(Hello) },
+	MsgNewSession:       func() Message { return new(NewSession) },
+	MsgAliveCheck:       func() Message { return new(AliveCheck) },
+	MsgTerminate:        func() Message { return new(Terminate) },
+	MsgOpenFwd:          func() Message { return new(OpenForward) },
+	MsgCloseFwd:         func() Message { return new(CloseForward) },
+	MsgNewStdioFwd:      func() Message { return new(NewStdioFwd) },
+	MsgStopListening:    func() Message { return new(StopListening) },
+	MsgProxy:            func() Message { return new(Proxy) },
+	MsgProxyReply:       func() Message { return new(ProxyReply) },
+	MsgOk:               func() Message { return new(Ok) },
+	MsgPermissionDenied: func() Message { return new(PermissionDenied) },
+	MsgFailure:          func() Message { return new(Failure) },
+	MsgExitMessage:      func() Message { return new(ExitMessage) },
+	MsgIsAlive:          func() Message { return new(IsAlive) },
+	MsgSessionOpened:    func() Message { return new(SessionOpened) },
+	MsgRemotePort:       func() Message { return new(RemotePort) },
+	MsgTtyAllocFail:     func() Message { return new(TtyAllocFail) },
+}
+
+// ErrShortPacket is returned for a packet that ends prematurely.
+var ErrShortPacket = errors.New("mux: packet too short")
+
+// UnknownTypeError is returned by Unmarshal for an unknown message type.
+type UnknownTypeError uint32
+
+func (e UnknownTypeError) Error() string {
+	return fmt.Sprintf("mux: unknown message type 0x%x", uint32(e))
+}
+
+// Marshal encodes m as the payload of a packet.
+func Marshal(m Message) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, m.msgType())
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i).Interface().(type) {
+		case uint32:
+			buf = binary.BigEndian.AppendUint32(buf, f)
+		case string:
+			buf = appendString(buf, f)
+		case []string:
+			for _, s := range f {
+				buf = appendString(buf, s)
+			}
+		case []Extension:
+			for _, e := range f {
+				buf = appendString(appendString(buf, e.Name), e.Value)
+			}
+		}
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// Type returns the message type of a packet payload.
+func Type(packet []byte) (uint32, error) {
+	if len(packet) < 4 {
+		return 0, ErrShortPacket
+	}
+	return binary.BigEndian.Uint32(packet), nil
+}
+
+// Unmarshal decodes a packet payload into the message of its type.
+// Trailing data after the fields of fixed size messages is ignored,
+// as OpenSSH does.
+func Unmarshal(packet []byte) (Message, error) {
+	t, err := Type(packet)
+	if err != nil {
+		return nil, err
+	}
+	newMsg, ok := messages[t]
+	if !ok {
+		return nil, UnknownTypeError(t)
+	}
+	m := newMsg()
+	d := decoder(packet[4:])
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i).Addr().Interface().(type) {
+		case *uint32:
+			*f, err = d.uint32()
+		case *string:
+			*f, err = d.string()
+		case *[]string:
+			for len(d) > 0 && err == nil {
+				var s string
+				s, err = d.string()
+				*f = append(*f, s)
+			}
+		case *[]Extension:
+			for len(d) > 0 && err == nil {
+				var e Extension
+				if e.Name, err = d.string(); err == nil {
+					e.Value, err = d.string()
+				}
+				*f = append(*f, e)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mux: message 0x%x: %w", t, err)
+		}
+	}
+	return m, nil
+}
+
+type decoder []byte
+
+func (d *decoder) uint32() (uint32, error) {
+	if len(*d) < 4 {
+		return 0, ErrShortPacket
+	}
+	v := binary.BigEndian.Uint32(*d)
+	*d = (*d)[4:]
+	return v, nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if uint32(len(*d)) < n {
+		return "", ErrShortPacket
+	}
+	s := string((*d)[:n])
+	*d = (*d)[n:]
+	return s, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestMarshalRoundtrip(t *testing.T) {
+	for _, m := range []Message{
+		&Hello{Version: 4, Extensions: []Extension{{"a@example.com", "1"}, {"b@example.com", ""}}},
+		&Hello{Version: 4},
+		&NewSession{RequestID: 1, TtyFlag: 1, EscapeChar: 0xffffffff, Term: "xterm",
+			Command: "uname -a", Env: []string{"LANG=C", "TZ=UTC"}},
+		&AliveCheck{RequestID: 2},
+		&Terminate{RequestID: 3},
+		&OpenForward{4, FwdLocal, "::1", 8080, "db", 5432},
+		&CloseForward{5, FwdRemote, "", 0, "/run/r.sock", PortStreamLocal},
+		&NewStdioFwd{RequestID: 6, ConnectHost: "db", ConnectPort: 22},
+		&StopListening{RequestID: 7},
+		&Ok{RequestID: 8},
+		&PermissionDenied{9, "denied"},
+		&Failure{10, "failed"},
+		&ExitMessage{1, 255},
+		&IsAlive{11, 4242},
+		&SessionOpened{12, 1},
+		&RemotePort{13, 40000},
+		&TtyAllocFail{1},
+		&Proxy{14},
+		&ProxyReply{14},
+	} {
+		got, err := Unmarshal(Marshal(m))
+		if err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Fatalf("expected %+v, got %+v", m, got)
+		}
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	for typ := range messages {
+		if TypeName(typ) == fmt.Sprintf("0x%x", typ) {
+			t.Errorf("no name for message type 0x%x", typ)
+		}
+	}
+	if got := TypeName(TypeOf(&ProxyReply{})); got != "MUX_S_PROXY" {
+		t.Errorf("expected MUX_S_PROXY, got %s", got)
+	}
+	if got := TypeName(0x7f); got != "0x7f" {
+		t.Errorf("expected 0x7f, got %s", got)
+	}
+}
+
+func TestMarshalWireFormat(t *testing.T) {
+	got := Marshal(&Failure{RequestID: 1, Reason: "no"})
+	want := []byte{0x80, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 2, 'n', 'o'}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected % x, got % x", want, got)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	if _, err := Unmarshal([]byte{0, 0}); err != ErrShortPacket {
+		t.Fatalf("expected ErrShortPacket, got %v", err)
+	}
+	if _, err := Unmarshal([]byte{0x7f, 0, 0, 0}); err != UnknownTypeError(0x7f000000) {
+		t.Fatalf("expected UnknownTypeError, got %v", err)
+	}
+	p := Marshal(&Failure{RequestID: 1, Reason: "truncated"})
+	if _, err := Unmarshal(p[:len(p)-1]); err == nil {
+		t.Fatalf("expected an error for a truncated packet")
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewPacketConn(&buf)
+	if err := c.WriteMessage(&AliveCheck{RequestID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WritePacket(nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.ReadMessage()
+	if err != nil || !reflect.DeepEqual(m, &AliveCheck{RequestID: 1}) {
+		t.Fatalf("unexpected message %+v, %v", m, err)
+	}
+	if p, err := c.ReadPacket(); err != nil || len(p) != 0 {
+		t.Fatalf("expected an empty packet, got %q, %v", p, err)
+	}
+	if _, err := c.ReadPacket(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	buf.Write([]byte{0, 0, 0, 5, 1})
+	if _, err := c.ReadPacket(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	buf.Write([]byte{0xff, 0, 0, 0})
+	if _, err := c.ReadPacket(); err == nil {
+		t.Fatalf("expected an oversized packet to fail")
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c.(*net.UnixConn)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := SendFile(conns[0], w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	got, err := ReceiveFile(conns[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Write([]byte("hello"))
+	got.Close()
+	out, err := io.ReadAll(r)
+	if err != nil || string(out) != "hello" {
+		t.Fatalf("expected hello through the passed file, got %q, %v", out, err)
+	}
+}
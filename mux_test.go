@@ -0,0 +1,355 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, tc := range []struct {
+		master, want int
+		fail         bool
+	}{
+		{master: 2, fail: true},
+		{master: 3, fail: true},
+		{master: 4, want: 4},
+		{master: 5, want: 4},
+	} {
+		got, err := negotiateVersion(tc.master)
+		if tc.fail {
+			if _, ok := err.(*VersionError); !ok {
+				t.Fatalf("version %d: expected *VersionError, got %v", tc.master, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("version %d: expected %d, got %d (%v)", tc.master, tc.want, got, err)
+		}
+	}
+}
+
+func TestMarshalExtensions(t *testing.T) {
+	RegisterExtension(Extension{Name: "b@example.com", Advertise: true, Value: "2"})
+	RegisterExtension(Extension{Name: "a@example.com", Advertise: true, Value: "1"})
+	RegisterExtension(Extension{Name: "c@example.com"})
+	defer func() {
+		extensions.Lock()
+		delete(extensions.m, "a@example.com")
+		delete(extensions.m, "b@example.com")
+		delete(extensions.m, "c@example.com")
+		extensions.Unlock()
+	}()
+
+	buf := marshalExtensions()
+	var got []string
+	for len(buf) > 0 {
+		str, err := packetPopString(&buf)
+		if err != nil {
+			t.Fatalf("Got err: %s", err)
+		}
+		got = append(got, str)
+	}
+	want := "a@example.com 1 b@example.com 2"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("expected \"%s\" but got \"%s\"", want, strings.Join(got, " "))
+	}
+
+	info := &MasterInfo{Extensions: map[string]string{
+		"c@example.com": "",
+		"d@example.com": "4",
+	}}
+	unknown := info.UnknownExtensions()
+	if len(unknown) != 1 || unknown["d@example.com"] != "4" {
+		t.Fatalf("unexpected unknown extensions: %v", unknown)
+	}
+}
+
+// unixPair returns a connected pair of unix sockets.
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "s"), Net: "unix"})
+	if err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	defer l.Close()
+	c, err := net.DialUnix("unix", nil, l.Addr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	s, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	return c, s
+}
+
+func TestHelloTimeout(t *testing.T) {
+	defer func(d time.Duration) { muxHelloTimeout = d }(muxHelloTimeout)
+
+	// a silent master is told as such, not as an old one
+	muxHelloTimeout = 50 * time.Millisecond
+	c, m := unixPair(t)
+	defer m.Close()
+	err := (&Session{ctrlconn: c}).sshMuxHello(time.Time{})
+	c.Close()
+	var ve *VersionError
+	if !errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &ve) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// an earlier deadline of the caller wins
+	muxHelloTimeout = 10 * time.Second
+	c, m = unixPair(t)
+	defer m.Close()
+	start := time.Now()
+	err = (&Session{ctrlconn: c}).sshMuxHello(start.Add(50 * time.Millisecond))
+	c.Close()
+	if !errors.Is(err, os.ErrDeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected a timeout at the deadline, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestWaitMsg(t *testing.T) {
+	failure := ssh.Marshal(&struct {
+		Type, Rid uint32
+		Reason    string
+	}{muxFailure, 3, "channel closed"})
+	for _, tc := range []struct {
+		packets [][]byte
+		status  int // -1 for *ExitMissingError
+		msg     string
+	}{
+		{
+			packets: [][]byte{
+				ssh.Marshal(&muxMsg{muxTtyAllocFail, 7}),
+				ssh.Marshal(&muxReply{muxExitMessage, 7, 1}),
+			},
+			status: 1,
+			msg:    "pseudo-terminal allocation failed",
+		},
+		{
+			packets: [][]byte{failure, ssh.Marshal(&muxReply{muxExitMessage, 7, 255})},
+			status:  255,
+			msg:     "channel closed",
+		},
+		{
+			packets: [][]byte{ssh.Marshal(&muxReply{muxExitMessage, 7, 2})},
+			status:  2,
+		},
+		{
+			packets: [][]byte{failure, ssh.Marshal(&muxReply{muxExitMessage, 7, 0})},
+			msg:     "channel closed",
+		},
+		{
+			packets: [][]byte{failure},
+			status:  -1,
+			msg:     "channel closed",
+		},
+	} {
+		c, m := unixPair(t)
+		for _, p := range tc.packets {
+			if err := writePacket(m, p); err != nil {
+				t.Fatalf("Got err: %s", err)
+			}
+		}
+		m.Close()
+
+		s := &Session{ctrlconn: c, ctrlSessid: 7, ctrlReqid: 4}
+		err := s.wait()
+		c.Close()
+		if s.ExitMsg() != tc.msg {
+			t.Errorf("expected session message %q, got %q", tc.msg, s.ExitMsg())
+		}
+		switch tc.status {
+		case 0:
+			if err != nil {
+				t.Fatalf("expected success, got %v", err)
+			}
+		case -1:
+			em, ok := err.(*ExitMissingError)
+			if !ok {
+				t.Fatalf("expected *ExitMissingError, got %v", err)
+			}
+			if em.Msg != tc.msg || !strings.HasSuffix(em.Error(), "Reason was: "+tc.msg) {
+				t.Errorf("expected message %q, got %q", tc.msg, em.Error())
+			}
+		default:
+			ee, ok := err.(*ExitError)
+			if !ok {
+				t.Fatalf("expected *ExitError, got %v", err)
+			}
+			if ee.ExitStatus() != tc.status || ee.Msg() != tc.msg {
+				t.Errorf("expected status %d message %q, got %d %q",
+					tc.status, tc.msg, ee.ExitStatus(), ee.Msg())
+			}
+			if ee.Lang() != "" {
+				t.Errorf("expected no lang, got %q", ee.Lang())
+			}
+		}
+	}
+}
+
+func TestControlIOError(t *testing.T) {
+	c, m := unixPair(t)
+	hello := ssh.Marshal(&muxMsg{muxMsgHello, muxVersion})
+	if err := writePacket(m, hello); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	m.Close()
+
+	s := &Session{ctrlconn: c, sshctlpath: "/tmp/ctrl.sock"}
+	defer c.Close()
+	if _, err := s.readPacket(); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	_, err := s.readPacket()
+	var ce *ControlIOError
+	if !errors.As(err, &ce) || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected *ControlIOError wrapping EOF, got %v", err)
+	}
+	if ce.Path != s.sshctlpath || ce.Op != "read" || ce.N != int64(4+len(hello)) {
+		t.Fatalf("unexpected %+v", ce)
+	}
+	if !strings.HasPrefix(err.Error(), "Unable to read from control socket /tmp/ctrl.sock after 12 bytes") {
+		t.Fatalf("unexpected message %q", err)
+	}
+}
+
+func TestWaitStrict(t *testing.T) {
+	exit := ssh.Marshal(&muxReply{muxExitMessage, 7, 0})
+	failure := func(rid uint32) []byte {
+		return ssh.Marshal(&struct {
+			Type, Rid uint32
+			Reason    string
+		}{muxFailure, rid, "failed"})
+	}
+	for _, tc := range []struct {
+		packets [][]byte
+		msg     string // of the ProtocolError, "" for none
+	}{
+		{[][]byte{exit}, ""},
+		{[][]byte{failure(3), exit}, ""},
+		{[][]byte{ssh.Marshal(&muxReply{muxExitMessage, 8, 0})}, "unknown session id: myid 7 theirs 8"},
+		{[][]byte{ssh.Marshal(&muxMsg{muxTtyAllocFail, 9})}, "unknown session id: myid 7 theirs 9"},
+		{[][]byte{exit, exit}, "exit seen twice"},
+		{[][]byte{failure(1), exit}, "reply to unknown request id 1"},
+		{[][]byte{ssh.Marshal(&muxMsg{muxRemotePort, 3}), exit}, "unexpected message from master: MUX_S_REMOTE_PORT"},
+	} {
+		for _, strict := range []bool{false, true} {
+			c, m := unixPair(t)
+			for _, p := range tc.packets {
+				if err := writePacket(m, p); err != nil {
+					t.Fatalf("Got err: %s", err)
+				}
+			}
+			m.Close()
+
+			s := &Session{ctrlconn: c, ctrlSessid: 7, ctrlReqid: 4, Strict: strict}
+			err := s.wait()
+			pe, ok := err.(*ProtocolError)
+			if strict && tc.msg != "" {
+				if !ok || pe.Msg != tc.msg {
+					t.Errorf("expected protocol violation %q, got %v", tc.msg, err)
+				}
+			} else if ok {
+				t.Errorf("strict %v: unexpected %v", strict, err)
+			}
+		}
+	}
+}
+
+func TestTTYAllocError(t *testing.T) {
+	for _, tc := range []struct {
+		status uint32
+		want   int // exit status of the wrapped error, 0 for none
+	}{{0, 0}, {3, 3}} {
+		c, m := unixPair(t)
+		writePacket(m, ssh.Marshal(&muxMsg{muxTtyAllocFail, 7}))
+		writePacket(m, ssh.Marshal(&muxReply{muxExitMessage, 7, tc.status}))
+		m.Close()
+
+		s := &Session{ctrlconn: c, ctrlSessid: 7, started: true,
+			exitStatus: make(chan error, 1), aborted: make(chan struct{})}
+		go func() { s.exitStatus <- s.wait() }()
+		err := s.Wait()
+		te, ok := err.(*TTYAllocError)
+		if !ok {
+			t.Fatalf("expected *TTYAllocError, got %v", err)
+		}
+		var ee *ExitError
+		if tc.want == 0 && te.Err != nil || tc.want != 0 && (!errors.As(err, &ee) || ee.ExitStatus() != tc.want) {
+			t.Fatalf("expected exit status %d, got %v", tc.want, te.Err)
+		}
+	}
+}
+
+func TestPtyFallback(t *testing.T) {
+	c, m := unixPair(t)
+	writePacket(m, ssh.Marshal(&muxMsg{muxTtyAllocFail, 7}))
+	writePacket(m, ssh.Marshal(&muxReply{muxExitMessage, 7, 0}))
+	m.Close()
+
+	fellBack := false
+	s := &Session{ctrlconn: c, ctrlSessid: 7, started: true,
+		exitStatus: make(chan error, 1), aborted: make(chan struct{}),
+		PtyFallback: true, OnPtyFallback: func() { fellBack = true }}
+	go func() { s.exitStatus <- s.wait() }()
+	if err := s.Wait(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !fellBack {
+		t.Fatalf("expected OnPtyFallback to be called")
+	}
+}
+
+func TestStdoutEOFTimeout(t *testing.T) {
+	for _, exit := range []bool{false, true} {
+		c, m := unixPair(t)
+		defer m.Close()
+		if exit {
+			writePacket(m, ssh.Marshal(&muxReply{muxExitMessage, 7, 3}))
+			m.Close()
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("Got err: %s", err)
+		}
+		var outb bytes.Buffer
+		s := &Session{ctrlconn: c, ctrlSessid: 7, lmuxStdout: r, Stdout: &outb,
+			stdinpipe: true, stderrpipe: true, StdoutEOFTimeout: 50 * time.Millisecond,
+			exitStatus: make(chan error, 1), aborted: make(chan struct{}), exited: make(chan struct{})}
+		if exit {
+			s.StdoutEOFTimeout = time.Minute
+		}
+		s.start()
+		go func() {
+			err := s.wait()
+			close(s.exited)
+			s.exitStatus <- err
+		}()
+		w.WriteString("out")
+		w.Close()
+
+		err = s.Wait()
+		if exit && ExitCode(err) != 3 {
+			t.Errorf("expected exit status 3, got %v", err)
+		} else if !exit && err != ErrStdoutEOF {
+			t.Errorf("expected ErrStdoutEOF, got %v", err)
+		}
+		if outb.String() != "out" {
+			t.Errorf("expected output, got %q", outb.String())
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MuxdHost describes a master maintained by Muxd.
+type MuxdHost struct {
+	// Name is the ssh(1) destination, e.g. "user@host" or an
+	// alias from ssh_config. It must be unique within a Muxd.
+	Name string
+
+	// ControlPath is the master's control socket. If empty, the
+	// socket is created as Name + ".sock" in the Muxd's directory.
+	ControlPath string
+
+	// Args are additional ssh(1) arguments, e.g. "-p", "2222".
+	Args []string
+}
+
+// MasterStatus reports the state of a master maintained by Muxd.
+type MasterStatus struct {
+	Host        string
+	ControlPath string
+	Up          bool
+	PID         int       // pid of the ssh(1) master process, if up
+	Since       time.Time // time of the last transition between up and down
+	Restarts    int
+	Err         error // why the master went down last, if it did
+}
+
+// Muxd keeps ssh(1) ControlMaster processes running for a set of
+// hosts. Masters are started with "ssh -M -N -S path", checked
+// periodically with a mux alive check and restarted with exponential
+// backoff when they exit or stop answering.
+type Muxd struct {
+	// SSH is the ssh binary to run. If empty, "ssh" is looked
+	// up in $PATH.
+	SSH string
+
+	// CheckInterval is the time between alive checks of a running
+	// master. If zero, 30 seconds are used.
+	CheckInterval time.Duration
+
+	// StartTimeout bounds the wait for a new master's control
+	// socket. If zero, 30 seconds are used.
+	StartTimeout time.Duration
+
+	// MinRestartDelay and MaxRestartDelay bound the backoff between
+	// restarts. If zero, 1 second and 1 minute are used.
+	MinRestartDelay time.Duration
+	MaxRestartDelay time.Duration
+
+	hosts []MuxdHost
+
+	mu     sync.Mutex
+	status map[string]*MasterStatus
+}
+
+// NewMuxd returns a Muxd for the given hosts. Control sockets of
+// hosts without a ControlPath are placed in dir.
+func NewMuxd(dir string, hosts []MuxdHost) *Muxd {
+	d := &Muxd{status: make(map[string]*MasterStatus)}
+	for _, h := range hosts {
+		if h.ControlPath == "" {
+			h.ControlPath = filepath.Join(dir, h.Name+".sock")
+		}
+		d.hosts = append(d.hosts, h)
+		d.status[h.Name] = &MasterStatus{Host: h.Name, ControlPath: h.ControlPath}
+	}
+	return d
+}
+
+// Run starts the masters and keeps them running until ctx is done.
+// The masters are terminated before Run returns ctx.Err().
+func (d *Muxd) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, h := range d.hosts {
+		wg.Add(1)
+		go func(h MuxdHost) {
+			defer wg.Done()
+			d.maintain(ctx, h)
+		}(h)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// ControlPath returns the control socket of the named host.
+func (d *Muxd) ControlPath(name string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st, ok := d.status[name]
+	if !ok {
+		return "", false
+	}
+	return st.ControlPath, true
+}
+
+// Status returns the state of all masters, in the order the hosts
+// were given to NewMuxd.
+func (d *Muxd) Status() []MasterStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := make([]MasterStatus, 0, len(d.hosts))
+	for _, h := range d.hosts {
+		res = append(res, *d.status[h.Name])
+	}
+	return res
+}
+
+func (d *Muxd) setUp(name string, pid int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.status[name]
+	st.Up, st.PID, st.Since, st.Err = true, pid, time.Now(), nil
+}
+
+func (d *Muxd) setDown(name string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.status[name]
+	if st.Up {
+		st.Since = time.Now()
+	}
+	st.Up, st.PID, st.Err = false, 0, err
+}
+
+func (d *Muxd) restarted(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status[name].Restarts++
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func (d *Muxd) maintain(ctx context.Context, h MuxdHost) {
+	minDelay := durationOr(d.MinRestartDelay, time.Second)
+	maxDelay := durationOr(d.MaxRestartDelay, time.Minute)
+	delay := minDelay
+	for {
+		started := time.Now()
+		err := d.runMaster(ctx, h)
+		d.setDown(h.Name, err)
+		if ctx.Err() != nil {
+			return
+		}
+		// A master that was up for a while starts over with a
+		// short delay.
+		if time.Since(started) > maxDelay {
+			delay = minDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+		d.restarted(h.Name)
+	}
+}
+
+// masterStopGrace is how long a master has to exit after SIGTERM
+// before it is killed.
+const masterStopGrace = 5 * time.Second
+
+// stderrTail is the number of bytes of a master's stderr kept for the
+// error reporting its exit.
+const stderrTail = 4096
+
+// tailWriter keeps the last limit bytes written to it.
+type tailWriter struct {
+	limit int
+	b     []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	if len(w.b) > w.limit {
+		w.b = append(w.b[:0], w.b[len(w.b)-w.limit:]...)
+	}
+	return len(p), nil
+}
+
+// runMaster runs one ssh master process for h until it exits, stops
+// answering alive checks or ctx is done.
+func (d *Muxd) runMaster(ctx context.Context, h MuxdHost) error {
+	sshbin := d.SSH
+	if sshbin == "" {
+		sshbin = "ssh"
+	}
+	// A stale socket makes the new master fail, but one that still
+	// answers belongs to a master started elsewhere, e.g. by the
+	// user's own "ssh -M", which must stay reachable.
+	if _, err := NewClient(h.ControlPath).Check(); err == nil {
+		return fmt.Errorf("sshctl: another master is listening on %s", h.ControlPath)
+	}
+	os.Remove(h.ControlPath)
+
+	args := []string{"-M", "-N", "-S", h.ControlPath, "-o", "ControlPersist=no"}
+	args = append(append(args, h.Args...), h.Name)
+	cmd := exec.Command(sshbin, args...)
+	stderr := &tailWriter{limit: stderrTail}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			// a master is not supposed to exit on its own
+			err = errors.New("exit status 0")
+		}
+		if msg := strings.TrimSpace(string(stderr.b)); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		exited <- err
+	}()
+	// SIGTERM lets ssh unlink its control socket, SIGKILL is the
+	// last resort for one that does not exit
+	stop := func(err error) error {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(masterStopGrace):
+			cmd.Process.Kill()
+			<-exited
+		}
+		return err
+	}
+
+	// Wait for the master to answer on its control socket
+	client := NewClient(h.ControlPath)
+	timeout := time.After(durationOr(d.StartTimeout, 30*time.Second))
+	for {
+		pid, err := client.Check()
+		if err == nil {
+			d.setUp(h.Name, pid)
+			break
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("ssh master exited: %w", err)
+		case <-ctx.Done():
+			return stop(ctx.Err())
+		case <-timeout:
+			return stop(fmt.Errorf("ssh master did not come up: %w", err))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	ticker := time.NewTicker(durationOr(d.CheckInterval, 30*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("ssh master exited: %w", err)
+		case <-ctx.Done():
+			return stop(ctx.Err())
+		case <-ticker.C:
+			if _, err := client.Check(); err != nil {
+				return stop(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMuxdHelperProcess stands in for "ssh -M -N -S path host".
+func TestMuxdHelperProcess(t *testing.T) {
+	if os.Getenv("SSHCTL_TEST_MUXD_HELPER") != "1" {
+		return
+	}
+	var path string
+	for i, arg := range os.Args {
+		if arg == "-S" && i+1 < len(os.Args) {
+			path = os.Args[i+1]
+		}
+	}
+	// like ssh, unlink the control socket on SIGTERM
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	g := newGoMasterAt(t, path)
+	select {
+	case <-g.served:
+	case <-term:
+		g.Shutdown()
+		<-g.served
+		os.Remove(path)
+	}
+	os.Exit(0)
+}
+
+func waitStatus(t *testing.T, d *Muxd, cond func(MasterStatus) bool) MasterStatus {
+	for i := 0; i < 500; i++ {
+		if st := d.Status()[0]; cond(st) {
+			return st
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("condition not reached, status: %+v", d.Status()[0])
+	return MasterStatus{}
+}
+
+func TestMuxdRestart(t *testing.T) {
+	dir := t.TempDir()
+	sshbin := filepath.Join(dir, "ssh")
+	script := fmt.Sprintf("#!/bin/sh\nexec %s -test.run=TestMuxdHelperProcess -- \"$@\"\n", os.Args[0])
+	writeFile(sshbin, []byte(script))
+	os.Chmod(sshbin, 0700)
+	os.Setenv("SSHCTL_TEST_MUXD_HELPER", "1")
+	defer os.Unsetenv("SSHCTL_TEST_MUXD_HELPER")
+
+	d := NewMuxd(dir, []MuxdHost{{Name: "dummy"}})
+	d.SSH = sshbin
+	d.CheckInterval = 50 * time.Millisecond
+	d.MinRestartDelay = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+
+	st := waitStatus(t, d, func(st MasterStatus) bool { return st.Up })
+	if path, _ := d.ControlPath("dummy"); path != filepath.Join(dir, "dummy.sock") {
+		t.Fatalf("unexpected control path %s", path)
+	}
+	if _, err := NewClient(st.ControlPath).MasterInfo(); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+
+	syscall.Kill(st.PID, syscall.SIGKILL)
+	st2 := waitStatus(t, d, func(st MasterStatus) bool { return st.Up && st.Restarts == 1 })
+	if st2.PID == st.PID {
+		t.Fatalf("expected a new master, still pid %d", st.PID)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if d.Status()[0].Up {
+		t.Fatalf("master still up after Run returned")
+	}
+	if _, err := os.Stat(st.ControlPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the master to remove its socket, got %v", err)
+	}
+}
+
+func TestMuxdForeignMaster(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	d := NewMuxd(t.TempDir(), []MuxdHost{{Name: "dummy", ControlPath: g.ctrlSock}})
+	d.SSH = "/nonexistent/ssh"
+	d.MinRestartDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+
+	st := waitStatus(t, d, func(st MasterStatus) bool { return st.Err != nil })
+	cancel()
+	<-done
+	if !strings.Contains(st.Err.Error(), "another master") {
+		t.Fatalf("expected the foreign master to be detected, got %v", st.Err)
+	}
+	if _, err := NewClient(g.ctrlSock).Check(); err != nil {
+		t.Fatalf("foreign master unreachable: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// OutputCache memoizes the output of idempotent commands by master
+// and command line, so tools asking a host for e.g. "uname -a" or
+// "dpkg -l" over and over run it only once per TTL. A zero TTL caches
+// outputs for the lifetime of the OutputCache, a negative TTL
+// disables caching. Failed commands are never cached. Concurrent
+// calls for a command that is not cached yet share a single run.
+type OutputCache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[outputKey]*cachedOutput
+}
+
+type outputKey struct {
+	path string // the control path of the Client
+	cmd  string
+}
+
+type cachedOutput struct {
+	done    chan struct{} // closed once out and err are set
+	out     []byte
+	err     error
+	expires time.Time // zero if it never expires
+}
+
+// Output returns the output of cmd run through c, see
+// Session.Output, from the cache if it is there and has not expired.
+// The returned slice is the caller's.
+func (oc *OutputCache) Output(c *Client, cmd string) ([]byte, error) {
+	if oc.TTL < 0 {
+		return c.NewSession().Output(cmd)
+	}
+	key := outputKey{c.sshctlpath, cmd}
+	oc.mu.Lock()
+	e, ok := oc.entries[key]
+	if ok {
+		select {
+		case <-e.done:
+			if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+				ok = false
+			}
+		default:
+			// in flight
+		}
+	}
+	if !ok {
+		e = &cachedOutput{done: make(chan struct{})}
+		if oc.entries == nil {
+			oc.entries = make(map[outputKey]*cachedOutput)
+		}
+		oc.entries[key] = e
+		oc.mu.Unlock()
+
+		e.out, e.err = c.NewSession().Output(cmd)
+		if oc.TTL > 0 {
+			e.expires = time.Now().Add(oc.TTL)
+		}
+		close(e.done)
+		if e.err != nil {
+			oc.mu.Lock()
+			if oc.entries[key] == e {
+				delete(oc.entries, key)
+			}
+			oc.mu.Unlock()
+		}
+		return bytes.Clone(e.out), e.err
+	}
+	oc.mu.Unlock()
+	<-e.done
+	return bytes.Clone(e.out), e.err
+}
+
+// Forget drops the output of cmd on c's master from the cache, e.g.
+// after a change that affects it. A run in flight is not waited for.
+func (oc *OutputCache) Forget(c *Client, cmd string) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	delete(oc.entries, outputKey{c.sshctlpath, cmd})
+}
+
+// ForgetHost drops all outputs of c's master from the cache, e.g.
+// after the host was reconfigured.
+func (oc *OutputCache) ForgetHost(c *Client) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	for key := range oc.entries {
+		if key.path == c.sshctlpath {
+			delete(oc.entries, key)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutputCache(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	// prints the number of runs so far
+	count := shellQuote(filepath.Join(t.TempDir(), "count"))
+	cmd := "echo >> " + count + "; wc -l < " + count
+	runs := func(out []byte, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	oc := &OutputCache{TTL: 200 * time.Millisecond}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if out, err := oc.Output(c, cmd); err != nil || strings.TrimSpace(string(out)) != "1" {
+				t.Errorf("expected output of the first run, got %q, %v", out, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := runs(oc.Output(c, cmd)); n != "1" {
+		t.Fatalf("expected cached output, got %s runs", n)
+	}
+	oc.Forget(c, cmd)
+	if n := runs(oc.Output(c, cmd)); n != "2" {
+		t.Fatalf("expected a run after Forget, got %s runs", n)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if n := runs(oc.Output(c, cmd)); n != "3" {
+		t.Fatalf("expected a run after the TTL, got %s runs", n)
+	}
+	oc.ForgetHost(c)
+	if n := runs(oc.Output(c, cmd)); n != "4" {
+		t.Fatalf("expected a run after ForgetHost, got %s runs", n)
+	}
+
+	if _, err := oc.Output(c, "exit 1"); err == nil {
+		t.Fatalf("expected failing command to fail")
+	}
+	if _, ok := oc.entries[outputKey{c.sshctlpath, "exit 1"}]; ok {
+		t.Fatalf("failed output was cached")
+	}
+
+	oc = &OutputCache{TTL: -1}
+	if n := runs(oc.Output(c, cmd)); n != "5" {
+		t.Fatalf("expected negative TTL not to cache, got %s runs", n)
+	}
+	if n := runs(oc.Output(c, cmd)); n != "6" {
+		t.Fatalf("expected negative TTL not to cache, got %s runs", n)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"fmt"
+	"os"
+)
+
+// PeerError is returned with VerifyPeer if the process behind the
+// control socket runs as another user. PID is zero if the system
+// does not tell.
+type PeerError struct {
+	Path string
+	UID  int
+	PID  int
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("sshctl: master on %s runs as uid %d (pid %d), not as uid %d",
+		e.Path, e.UID, e.PID, os.Geteuid())
+}
+
+// verifyPeer checks the credentials of the master s is connected to.
+func (s *Session) verifyPeer() error {
+	uid, pid, err := peerCred(s.ctrlconn)
+	if err != nil {
+		return fmt.Errorf("sshctl: peer credentials of %s: %w", s.sshctlpath, err)
+	}
+	return checkPeer(s.sshctlpath, uid, pid)
+}
+
+func checkPeer(path string, uid, pid int) error {
+	if uid != os.Geteuid() && uid != 0 {
+		return &PeerError{Path: path, UID: uid, PID: pid}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestVerifyPeer(t *testing.T) {
+	c, s := unixPair(t)
+	defer c.Close()
+	defer s.Close()
+	uid, pid, err := peerCred(c)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != os.Geteuid() || pid != os.Getpid() {
+		t.Fatalf("expected uid %d and pid %d, got %d and %d", os.Geteuid(), os.Getpid(), uid, pid)
+	}
+
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	sess := NewClient(g.ctrlSock).NewSession()
+	sess.VerifyPeer = true
+	if err := sess.Run("true"); err != nil {
+		t.Fatal(err)
+	}
+	// no hello with the master before it was verified
+	masterProbes.mu.Lock()
+	probed := masterProbes.good[g.ctrlSock]
+	masterProbes.mu.Unlock()
+	if probed {
+		t.Fatalf("expected no probe of %s", g.ctrlSock)
+	}
+
+	var pe *PeerError
+	if err := checkPeer(g.ctrlSock, os.Geteuid()+1, 42); !errors.As(err, &pe) || pe.UID != os.Geteuid()+1 || pe.PID != 42 {
+		t.Fatalf("expected *PeerError, got %v", err)
+	}
+	if err := checkPeer(g.ctrlSock, 0, 1); err != nil {
+		t.Fatalf("expected a master running as root to pass, got %v", err)
+	}
+}
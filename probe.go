@@ -0,0 +1,137 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// masterProbes coalesces the first contact with each master: when
+// many goroutines start sessions on a path not known to work, a
+// single hello handshake is done on their behalf and its result is
+// shared, so a slow or broken master is not hit by a burst of
+// connections. Once a handshake succeeded, sessions connect directly
+// until one fails to reach the master again.
+var masterProbes probeGroup
+
+type probeGroup struct {
+	mu    sync.Mutex
+	calls map[string]*probeCall // in flight, by control path
+	good  map[string]bool       // known to answer
+}
+
+type probeCall struct {
+	done chan struct{}
+	err  error
+}
+
+// do runs probe for path unless path is known to work or a probe of
+// it is in flight, in which case it waits for that one's result.
+func (g *probeGroup) do(path string, probe func(string) error) error {
+	g.mu.Lock()
+	if g.good[path] {
+		g.mu.Unlock()
+		return nil
+	}
+	if c, ok := g.calls[path]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*probeCall)
+		g.good = make(map[string]bool)
+	}
+	c := &probeCall{done: make(chan struct{})}
+	g.calls[path] = c
+	g.mu.Unlock()
+
+	c.err = probe(path)
+
+	g.mu.Lock()
+	delete(g.calls, path)
+	if c.err == nil {
+		g.good[path] = true
+	}
+	g.mu.Unlock()
+	close(c.done)
+	return c.err
+}
+
+// forget makes the next connection to path probe it again.
+func (g *probeGroup) forget(path string) {
+	g.mu.Lock()
+	delete(g.good, path)
+	g.mu.Unlock()
+}
+
+// helloError is a probe failure in the hello exchange, as opposed to
+// one dialing the master.
+type helloError struct {
+	err error
+}
+
+func (e *helloError) Error() string {
+	return e.err.Error()
+}
+
+func (e *helloError) Unwrap() error {
+	return e.err
+}
+
+// probeMaster does a hello handshake with the master at path. A
+// failed hello is returned as a *helloError.
+func probeMaster(path string) error {
+	s := NewSession(path)
+	if err := s.dialCtrlConn(); err != nil {
+		return err
+	}
+	defer s.ctrlconn.Close()
+	if err := s.sshMuxHello(time.Time{}); err != nil {
+		return &helloError{err}
+	}
+	return nil
+}
+
+// SocketProbe is what ProbeSocket learned about a control socket.
+type SocketProbe struct {
+	// Compatible is set if the peer is a mux master sshctl can
+	// talk to. Otherwise Err tells why not.
+	Compatible bool
+	Err        error
+
+	// Version is the negotiated mux protocol version or, for an
+	// incompatible master, the one it announced. It is zero if the
+	// peer did not send a hello.
+	Version    int
+	Extensions map[string]string
+}
+
+// ProbeSocket tells whether a compatible mux master listens at path.
+// Unlike Check it only exchanges hello messages, and it neither
+// opens a session nor uses what earlier connections learned about
+// path. It returns an error, a *MasterError, only if path cannot be
+// dialed.
+func ProbeSocket(path string) (*SocketProbe, error) {
+	s := NewSession(path)
+	if err := s.dialCtrlConn(); err != nil {
+		return nil, &MasterError{path, "dial", err}
+	}
+	defer s.ctrlconn.Close()
+	p := &SocketProbe{}
+	if err := s.sshMuxHello(time.Time{}); err != nil {
+		var ve *VersionError
+		if errors.As(err, &ve) {
+			p.Version = ve.Version
+		}
+		p.Err = err
+		return p, nil
+	}
+	p.Compatible = true
+	p.Version, p.Extensions = s.masterVersion, s.masterExtensions
+	return p, nil
+}
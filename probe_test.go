@@ -0,0 +1,189 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mpfz0r/sshctl/mux"
+)
+
+func TestProbeCoalescing(t *testing.T) {
+	// a master that accepts, but never says hello
+	path := filepath.Join(t.TempDir(), "hung.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var conns int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				conn.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := NewSession(path).Run("true"); err == nil {
+				t.Errorf("expected the session to fail")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected 1 connection to the master, got %d", n)
+	}
+}
+
+func TestProbeGood(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := NewSession(g.ctrlSock).Run("true"); err != nil {
+				t.Errorf("Got err: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a master that went away is probed again
+	g.Shutdown()
+	if err := NewSession(g.ctrlSock).Run("true"); err == nil {
+		t.Fatalf("expected the session to fail")
+	}
+	masterProbes.mu.Lock()
+	good := masterProbes.good[g.ctrlSock]
+	masterProbes.mu.Unlock()
+	if good {
+		t.Fatalf("expected %s to be forgotten", g.ctrlSock)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := NewClient(g.ctrlSock).Connect(ctx); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	var me *MasterError
+	if err := NewClient(missing).Connect(ctx); !errors.As(err, &me) || me.Op != "connect" {
+		t.Fatalf("expected a *MasterError, got %v", err)
+	}
+
+	// a hung master is given up on with ctx
+	path := filepath.Join(t.TempDir(), "hung.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := NewClient(path).Connect(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestWaitForMaster(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctrl.sock")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := WaitForMaster(ctx, path); !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "dial") {
+		t.Fatalf("expected a deadline error telling the dial failure, got %v", err)
+	}
+
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	// the master shows up at path later
+	time.AfterFunc(100*time.Millisecond, func() { os.Symlink(g.ctrlSock, path) })
+	pid, err := WaitForMaster(context.Background(), path)
+	if err != nil || pid != os.Getpid() {
+		t.Fatalf("expected pid %d, got %d (%v)", os.Getpid(), pid, err)
+	}
+}
+
+// fakeMaster serves the given packets to each connection at a new
+// socket, then closes it.
+func fakeMaster(t *testing.T, packets ...[]byte) string {
+	path := filepath.Join(t.TempDir(), "fake.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			for _, p := range packets {
+				mux.WritePacket(conn, p)
+			}
+			conn.Close()
+		}
+	}()
+	return path
+}
+
+func TestProbeSocket(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	p, err := ProbeSocket(g.ctrlSock)
+	if err != nil || !p.Compatible || p.Version != muxVersion || p.Err != nil {
+		t.Fatalf("expected a compatible master, got %+v (%v)", p, err)
+	}
+
+	old := fakeMaster(t, mux.Marshal(&mux.Hello{Version: 1}))
+	p, err = ProbeSocket(old)
+	var ve *VersionError
+	if err != nil || p.Compatible || p.Version != 1 || !errors.As(p.Err, &ve) {
+		t.Fatalf("expected an incompatible version 1, got %+v (%v)", p, err)
+	}
+
+	other := fakeMaster(t, []byte("not a mux master"))
+	if p, err = ProbeSocket(other); err != nil || p.Compatible || p.Err == nil || p.Version != 0 {
+		t.Fatalf("expected an incompatible peer, got %+v (%v)", p, err)
+	}
+
+	var me *MasterError
+	if _, err = ProbeSocket(g.ctrlSock + ".missing"); !errors.As(err, &me) || me.Op != "dial" {
+		t.Fatalf("expected *MasterError from dial, got %v", err)
+	}
+}
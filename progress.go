@@ -0,0 +1,110 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ProgressInfo describes the state of a running transfer.
+type ProgressInfo struct {
+	Done  int64         // bytes transferred, including resumed ones
+	Total int64         // size of the file, -1 if unknown
+	Rate  float64       // bytes per second during this transfer
+	ETA   time.Duration // estimated time left, -1 if unknown
+	Final bool          // the transfer is over
+}
+
+// Progress receives updates of running transfers, e.g. to render a
+// progress bar. Updates are rate limited; the last one has Final set.
+type Progress interface {
+	Progress(info ProgressInfo)
+}
+
+// ProgressFunc adapts a function to the Progress interface.
+type ProgressFunc func(info ProgressInfo)
+
+// Progress implements Progress.
+func (f ProgressFunc) Progress(info ProgressInfo) {
+	f(info)
+}
+
+// progressInterval is the minimum time between two updates.
+var progressInterval = 100 * time.Millisecond
+
+// progressCounter counts bytes and reports them to a Progress.
+type progressCounter struct {
+	p      Progress
+	total  int64
+	offset int64 // bytes done before this transfer
+	start  time.Time
+
+	mu   sync.Mutex
+	done int64
+	last time.Time
+}
+
+func newProgressCounter(p Progress, offset, total int64) *progressCounter {
+	return &progressCounter{p: p, total: total, offset: offset, done: offset, start: time.Now()}
+}
+
+func (pc *progressCounter) add(n int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.done += int64(n)
+	if now := time.Now(); now.Sub(pc.last) >= progressInterval {
+		pc.last = now
+		pc.p.Progress(pc.info(false))
+	}
+}
+
+// finish sends the final update.
+func (pc *progressCounter) finish() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.p.Progress(pc.info(true))
+}
+
+func (pc *progressCounter) info(final bool) ProgressInfo {
+	info := ProgressInfo{Done: pc.done, Total: pc.total, ETA: -1, Final: final}
+	if elapsed := time.Since(pc.start).Seconds(); elapsed > 0 {
+		info.Rate = float64(pc.done-pc.offset) / elapsed
+	}
+	if final {
+		info.ETA = 0
+	} else if pc.total >= 0 && info.Rate > 0 {
+		left := float64(pc.total - pc.done)
+		info.ETA = time.Duration(left / info.Rate * float64(time.Second))
+	}
+	return info
+}
+
+// reader counts what is read from r.
+func (pc *progressCounter) reader(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		pc.add(n)
+		return n, err
+	})
+}
+
+// writer counts what is written to w.
+func (pc *progressCounter) writer(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		n, err := w.Write(p)
+		pc.add(n)
+		return n, err
+	})
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
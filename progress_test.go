@@ -0,0 +1,80 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTransferProgress(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := bytes.Repeat([]byte(TestString), 10000)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var infos []ProgressInfo
+	opts := &TransferOptions{Progress: ProgressFunc(func(info ProgressInfo) {
+		mu.Lock()
+		infos = append(infos, info)
+		mu.Unlock()
+	})}
+	check := func(what string) {
+		t.Helper()
+		if len(infos) == 0 {
+			t.Fatalf("%s: no progress reported", what)
+		}
+		last := infos[len(infos)-1]
+		size := int64(len(data))
+		if !last.Final || last.Done != size || last.Total != size || last.ETA != 0 {
+			t.Fatalf("%s: unexpected final progress %+v", what, last)
+		}
+		for _, info := range infos[:len(infos)-1] {
+			if info.Final || info.Done > size {
+				t.Fatalf("%s: unexpected progress %+v", what, info)
+			}
+		}
+		infos = nil
+	}
+
+	remote := filepath.Join(dir, "remote")
+	if err := c.UploadFile(src, remote, opts); err != nil {
+		t.Fatal(err)
+	}
+	check("upload")
+	if err := c.DownloadFile(remote, filepath.Join(dir, "dst"), opts); err != nil {
+		t.Fatal(err)
+	}
+	check("download")
+}
+
+func TestProgressETA(t *testing.T) {
+	pc := newProgressCounter(ProgressFunc(func(ProgressInfo) {}), 100, 1100)
+	pc.start = pc.start.Add(-2e9)
+	pc.done = 600
+	info := pc.info(false)
+	if info.Rate < 240 || info.Rate > 250 {
+		t.Fatalf("expected a rate of about 250 bytes/s, got %v", info.Rate)
+	}
+	if info.ETA.Seconds() < 1.9 || info.ETA.Seconds() > 2.1 {
+		t.Fatalf("expected an ETA of about 2s, got %v", info.ETA)
+	}
+	pc.total = -1
+	if info := pc.info(false); info.ETA != -1 {
+		t.Fatalf("expected unknown ETA, got %v", info.ETA)
+	}
+}
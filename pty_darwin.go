@@ -0,0 +1,49 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty returns the master and slave side of a new pty, the way
+// posix_openpt(3), grantpt(3) and unlockpt(3) do on macOS. The master
+// is non-blocking, so reads on it honor deadlines.
+func openPty() (*os.File, *os.File, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "open", Path: "/dev/ptmx", Err: err}
+	}
+	var name [128]byte
+	for _, req := range []struct {
+		op  uint
+		arg uintptr
+	}{
+		{unix.TIOCPTYGRANT, 0},
+		{unix.TIOCPTYUNLK, 0},
+		{unix.TIOCPTYGNAME, uintptr(unsafe.Pointer(&name[0]))},
+	} {
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req.op), req.arg); errno != 0 {
+			unix.Close(fd)
+			return nil, nil, errno
+		}
+	}
+	i := bytes.IndexByte(name[:], 0)
+	if i <= 0 {
+		unix.Close(fd)
+		return nil, nil, unix.ENAMETOOLONG
+	}
+	ptm := os.NewFile(uintptr(fd), "/dev/ptmx")
+	pts, err := os.OpenFile(string(name[:i]), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, pts, nil
+}
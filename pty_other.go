@@ -0,0 +1,17 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package sshctl
+
+import (
+	"errors"
+	"os"
+)
+
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.ErrUnsupported
+}
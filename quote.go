@@ -0,0 +1,139 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"strings"
+)
+
+// Quoting selects the quoting rules for command lines built by Cmd,
+// which depend on the shell of the remote host.
+type Quoting int
+
+const (
+	// POSIXQuoting suits sh, bash, zsh and the like.
+	POSIXQuoting Quoting = iota
+
+	// CmdQuoting suits Windows OpenSSH servers running cmd.exe,
+	// their default shell. Arguments are quoted as expected by
+	// CommandLineToArgvW and cmd.exe metacharacters are escaped.
+	CmdQuoting
+
+	// PowerShellQuoting suits Windows OpenSSH servers configured
+	// with PowerShell as DefaultShell.
+	PowerShellQuoting
+)
+
+func (q Quoting) String() string {
+	switch q {
+	case POSIXQuoting:
+		return "posix"
+	case CmdQuoting:
+		return "cmd"
+	case PowerShellQuoting:
+		return "powershell"
+	}
+	return "unknown"
+}
+
+// argv returns the command line running args, args[0] being the
+// program.
+func (q Quoting) argv(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = q.quote(a)
+	}
+	line := strings.Join(quoted, " ")
+	if q == PowerShellQuoting {
+		// a quoted program name needs the call operator
+		line = "& " + line
+	}
+	return line
+}
+
+// quote returns s as a single argument.
+func (q Quoting) quote(s string) string {
+	switch q {
+	case CmdQuoting:
+		return cmdEscape(windowsArg(s))
+	case PowerShellQuoting:
+		return powerShellQuote(s)
+	}
+	return shellQuote(s)
+}
+
+// chdir returns line run in dir. With exec set, the shell may be
+// replaced by the command.
+func (q Quoting) chdir(dir, line string, exec bool) string {
+	switch q {
+	case CmdQuoting:
+		return "cd /d " + cmdEscape(windowsArg(dir)) + " && " + line
+	case PowerShellQuoting:
+		return "Set-Location -LiteralPath " + powerShellQuote(dir) + " -ErrorAction Stop; " + line
+	}
+	if exec {
+		line = "exec " + line
+	}
+	return "cd -- " + shellQuote(dir) + " && " + line
+}
+
+// windowsArg quotes s for CommandLineToArgvW and the MS C runtime:
+// backslashes are literal unless they precede a double quote.
+func windowsArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n\v\"") {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			slashes++
+		case '"':
+			b.WriteString(strings.Repeat(`\`, 2*slashes+1))
+			b.WriteByte(c)
+			slashes = 0
+		default:
+			b.WriteString(strings.Repeat(`\`, slashes))
+			b.WriteByte(c)
+			slashes = 0
+		}
+	}
+	// double trailing backslashes so they do not escape the quote
+	b.WriteString(strings.Repeat(`\`, 2*slashes))
+	b.WriteByte('"')
+	return b.String()
+}
+
+// cmdEscape escapes cmd.exe metacharacters with ^, so cmd.exe passes
+// the string on verbatim, quotes included.
+func cmdEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`()%!^"<>&|`, r) {
+			b.WriteByte('^')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// powerShellQuote returns s as a PowerShell verbatim string. Besides
+// the ASCII apostrophe, PowerShell treats the typographic single
+// quotes as quote characters; all of them are doubled.
+func powerShellQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'', '‘', '’', '‚', '‛':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
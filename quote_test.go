@@ -0,0 +1,51 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"testing"
+)
+
+func TestWindowsArg(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`plain`, `plain`},
+		{``, `""`},
+		{`a b`, `"a b"`},
+		{`C:\dir\`, `C:\dir\`},
+		{`C:\my dir\`, `"C:\my dir\\"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`a\"b`, `"a\\\"b"`},
+	}
+	for _, tt := range tests {
+		if got := windowsArg(tt.in); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestCmdQuoting(t *testing.T) {
+	c := NewClient("")
+	tests := []struct {
+		q    Quoting
+		want string
+	}{
+		{POSIXQuoting, `cd -- 'C:\a b' && exec 'echo' '100%' 'it'\''s' 'a&b'`},
+		{CmdQuoting, `cd /d ^"C:\a b^" && echo 100^% it's a^&b`},
+		{PowerShellQuoting, `Set-Location -LiteralPath 'C:\a b' -ErrorAction Stop; & 'echo' '100%' 'it''s' 'a&b'`},
+	}
+	for _, tt := range tests {
+		c.Quoting = tt.q
+		cmd := c.Command("echo", "100%", "it's", "a&b")
+		cmd.Dir = `C:\a b`
+		if got := cmd.String(); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.q, tt.want, got)
+		}
+	}
+	if got := powerShellQuote("it’s"); got != "'it’’s'" {
+		t.Errorf("typographic quote not doubled: %s", got)
+	}
+}
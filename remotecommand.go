@@ -0,0 +1,149 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// StreamOptions are the streams of a StreamExecutor run. They have
+// the fields of StreamOptions in k8s.io/client-go's remotecommand
+// package.
+type StreamOptions struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Tty runs the command on a pty, with stderr merged into
+	// Stdout, and Stdin passed through unchanged, e.g. with the
+	// user's keystrokes.
+	Tty bool
+
+	// TerminalSizeQueue, if non-nil, resizes the pty of a Tty run.
+	TerminalSizeQueue TerminalSizeQueue
+}
+
+// TerminalSize is the size of a terminal in characters.
+type TerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// TerminalSizeQueue delivers the sizes of a resized terminal, like
+// its remotecommand namesake. Next blocks until the next size and
+// returns nil when there are no more.
+type TerminalSizeQueue interface {
+	Next() *TerminalSize
+}
+
+// StreamExecutor runs a command with streamed stdio, shaped after
+// remotecommand.Executor, so tools can put "kubectl exec" and ssh
+// behind one interface of their own, e.g.
+//
+//	type Executor interface {
+//		StreamWithContext(ctx context.Context, opts Options) error
+//	}
+//
+// with an adapter for each backend copying the options. The command
+// exits with a non-zero status as an *ExitError, see ExitCode.
+type StreamExecutor struct {
+	// Term is the terminal type of Tty runs. If empty, "xterm" is
+	// used.
+	Term string
+
+	client *Client
+	cmd    string
+}
+
+// NewStreamExecutor returns a StreamExecutor running cmd through c.
+func (c *Client) NewStreamExecutor(cmd string) *StreamExecutor {
+	return &StreamExecutor{client: c, cmd: cmd}
+}
+
+// Stream runs the command with the streams of opts and returns once
+// it exited.
+func (e *StreamExecutor) Stream(opts StreamOptions) error {
+	return e.StreamWithContext(context.Background(), opts)
+}
+
+// StreamWithContext is like Stream but closes the session if ctx is
+// done first, in which case ctx.Err() is returned. A goroutine copying
+// Stdin may be left blocked in its Read, as with Session.Stdin.
+func (e *StreamExecutor) StreamWithContext(ctx context.Context, opts StreamOptions) error {
+	sess := e.client.NewSession()
+	if !opts.Tty {
+		sess.Stdin, sess.Stdout, sess.Stderr = opts.Stdin, opts.Stdout, opts.Stderr
+		return sess.RunContext(ctx, e.cmd)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the master takes the slave as the terminal of the command
+	// and reads its size, as from the terminal of ssh(1)
+	ptm, pts, err := openPty()
+	if err != nil {
+		return fmt.Errorf("sshctl: tty stream: %w", err)
+	}
+	defer ptm.Close()
+	defer pts.Close()
+	term := e.Term
+	if term == "" {
+		term = "xterm"
+	}
+	sess.RequestPty(term)
+	sess.StdinFile, sess.StdoutFile, sess.StderrFile = pts, pts, pts
+
+	if opts.Stdin != nil {
+		go io.Copy(ptm, opts.Stdin)
+	}
+	out := opts.Stdout
+	if out == nil {
+		out = ioutil.Discard
+	}
+	output := make(chan struct{})
+	go func() {
+		// ends with EIO once nobody holds the slave anymore, or
+		// with the read deadline
+		io.Copy(out, ptm)
+		close(output)
+	}()
+
+	if err = sess.Start(e.cmd); err == nil {
+		if q := opts.TerminalSizeQueue; q != nil {
+			go resizePty(pts, sess.masterPid, q)
+		}
+		err = sess.waitContext(ctx)
+	}
+	// an OpenSSH master lets go of the slave with the exit, others
+	// may hold it until their stdin copying ends
+	pts.Close()
+	ptm.SetReadDeadline(time.Now().Add(ptyDrainTimeout))
+	<-output
+	return err
+}
+
+// ptyDrainTimeout bounds reading what is left on the pty of a Tty
+// run after the exit.
+var ptyDrainTimeout = 250 * time.Millisecond
+
+// resizePty applies the sizes from q to pts and tells the master to
+// pass them on, as ssh(1) relays SIGWINCH to it.
+func resizePty(pts *os.File, masterPid int, q TerminalSizeQueue) {
+	for size := q.Next(); size != nil; size = q.Next() {
+		if setWindowSize(pts, WindowSize{Rows: int(size.Height), Cols: int(size.Width)}) != nil {
+			return
+		}
+		if masterPid > 0 {
+			syscall.Kill(masterPid, syscall.SIGWINCH)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testPty returns the master and slave side of a new pty.
+func testPty(t *testing.T) (*os.File, *os.File) {
+	ptm, pts, err := openPty()
+	if err != nil {
+		t.Skip("no ptys:", err)
+	}
+	return ptm, pts
+}
+
+type sizeQueue []TerminalSize
+
+func (q *sizeQueue) Next() *TerminalSize {
+	if len(*q) == 0 {
+		return nil
+	}
+	size := (*q)[0]
+	*q = (*q)[1:]
+	return &size
+}
+
+func TestStreamExecutor(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	var stdout, stderr bytes.Buffer
+	err := c.NewStreamExecutor("cat; echo oops >&2; exit 3").Stream(StreamOptions{
+		Stdin:  strings.NewReader(TestString),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if ExitCode(err) != 3 || stdout.String() != TestString || stderr.String() != "oops\n" {
+		t.Fatalf("unexpected result %v, %q, %q", err, stdout.String(), stderr.String())
+	}
+
+	ptm, pts := testPty(t)
+	ptm.Close()
+	pts.Close()
+	stdout.Reset()
+	err = c.NewStreamExecutor("head -n 1; echo oops >&2").Stream(StreamOptions{
+		Stdin:  strings.NewReader(TestString + "\n"),
+		Stdout: &stdout,
+		Tty:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := stdout.String(); !strings.Contains(out, TestString) || !strings.Contains(out, "oops") {
+		t.Fatalf("expected output and errors on the pty, got %q", out)
+	}
+}
+
+func TestResizePty(t *testing.T) {
+	ptm, pts := testPty(t)
+	defer ptm.Close()
+	defer pts.Close()
+	resizePty(pts, 0, &sizeQueue{{80, 24}, {132, 43}})
+	if size, err := getWindowSize(pts); err != nil || size != (WindowSize{Rows: 43, Cols: 132}) {
+		t.Fatalf("expected 132x43, got %v (%v)", size, err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a writer for capturing session output to a file
+// that is rotated by size: once a write would take it past MaxSize,
+// the file is renamed to Path.1, an existing Path.1 to Path.2 and so
+// on, and a new file is started. Only Keep rotated files are kept.
+// A single write larger than MaxSize is not split.
+//
+// It is safe to use one RotatingFile for both Stdout and Stderr.
+type RotatingFile struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens, or creates, the file at path for appending.
+func NewRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	if maxSize <= 0 || keep < 0 {
+		return nil, errors.New("sshctl: invalid rotation limits")
+	}
+	w := &RotatingFile{Path: path, MaxSize: maxSize, Keep: keep}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingFile) open() error {
+	f, err := os.OpenFile(w.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *RotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.size > 0 && w.size+int64(len(p)) > w.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate starts a new file regardless of the size of the current one.
+func (w *RotatingFile) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	return w.rotate()
+}
+
+func (w *RotatingFile) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+	name := func(i int) string {
+		if i == 0 {
+			return w.Path
+		}
+		return fmt.Sprintf("%s.%d", w.Path, i)
+	}
+	if err := os.Remove(name(w.Keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := w.Keep - 1; i >= 0; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return w.open()
+}
+
+// Close closes the current file.
+func (w *RotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if _, err := fmt.Fprintf(w, "line%d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"out.log":   "line4\n",
+		"out.log.1": "line3\n",
+		"out.log.2": "line2\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s: expected %q, got %q (%v)", name, want, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files, got %v", err)
+	}
+	if _, err := w.Write([]byte("x")); err != os.ErrClosed {
+		t.Errorf("expected os.ErrClosed, got %v", err)
+	}
+}
+
+func TestRotatingFileSession(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	path := filepath.Join(t.TempDir(), "out.log")
+	w, err := NewRotatingFile(path, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSession(g.ctrlSock)
+	s.Stdout, s.Stderr = w, w
+	if err := s.Run("for i in 1 2 3 4 5 6 7 8; do echo line$i; done"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// however the output was split into writes, no line is lost
+	var all []byte
+	for i := 100; i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		data, err := os.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, data...)
+	}
+	if want := "line1\nline2\nline3\nline4\nline5\nline6\nline7\nline8\n"; string(all) != want {
+		t.Fatalf("expected %q, got %q", want, all)
+	}
+}
+
+func TestRotatingFileLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	w, err := NewRotatingFile(path, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// oversized writes are kept whole
+	for _, s := range []string{"abcdefgh", "ij", "kl"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != "ijkl" {
+		t.Fatalf("expected ijkl, got %q", data)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("expected no rotated files with Keep 0, got %v", err)
+	}
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Fatalf("expected an empty file after Rotate, got %v", err)
+	}
+	if _, err := NewRotatingFile(path, 0, 1); err == nil {
+		t.Fatal("expected an error for MaxSize 0")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrSecretNotFound is returned by a SecretProvider that does not
+// know the requested key.
+var ErrSecretNotFound = errors.New("sshctl: secret not found")
+
+// A SecretProvider looks up secrets, such as sudo passwords or API
+// tokens, by key. Implementations for Vault, SOPS and the like live
+// outside this package.
+type SecretProvider interface {
+	Secret(key string) (string, error)
+}
+
+// EnvSecrets is a SecretProvider reading secrets from environment
+// variables named Prefix + key.
+type EnvSecrets struct {
+	Prefix string
+}
+
+// Secret implements SecretProvider.
+func (e EnvSecrets) Secret(key string) (string, error) {
+	v, ok := os.LookupEnv(e.Prefix + key)
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return v, nil
+}
+
+// CachedSecrets wraps a SecretProvider and remembers successful
+// lookups for TTL. A zero TTL caches secrets for the lifetime of the
+// CachedSecrets, a negative TTL disables caching. Errors are never
+// cached.
+type CachedSecrets struct {
+	Provider SecretProvider
+	TTL      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time // zero if it never expires
+}
+
+// Secret implements SecretProvider.
+func (c *CachedSecrets) Secret(key string) (string, error) {
+	if c.TTL < 0 {
+		return c.Provider.Secret(key)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cs, ok := c.cache[key]; ok {
+		if cs.expires.IsZero() || time.Now().Before(cs.expires) {
+			return cs.value, nil
+		}
+		delete(c.cache, key)
+	}
+	v, err := c.Provider.Secret(key)
+	if err != nil {
+		return "", err
+	}
+	if c.cache == nil {
+		c.cache = make(map[string]cachedSecret)
+	}
+	cs := cachedSecret{value: v}
+	if c.TTL > 0 {
+		cs.expires = time.Now().Add(c.TTL)
+	}
+	c.cache[key] = cs
+	return v, nil
+}
+
+// Forget drops key from the cache, e.g. after the secret was rotated.
+func (c *CachedSecrets) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cache, key)
+}
+
+// addSecret makes sure a looked up secret never shows up in traces.
+func (s *Session) addSecret(secret string) {
+	if s.Redactor == nil {
+		s.Redactor = &Redactor{}
+	}
+	s.Redactor.AddSecret(secret)
+}
+
+// SetenvSecret sets the environment variable name to the secret
+// stored under key in p. The value is registered with the session's
+// Redactor. See Setenv for which variables reach the remote command.
+func (s *Session) SetenvSecret(name string, p SecretProvider, key string) error {
+	value, err := p.Secret(key)
+	if err != nil {
+		return err
+	}
+	if err := s.Setenv(name, value); err != nil {
+		return err
+	}
+	s.addSecret(value)
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type countingSecrets struct {
+	n int
+}
+
+func (c *countingSecrets) Secret(key string) (string, error) {
+	c.n++
+	return key + "-value", nil
+}
+
+func TestCachedSecrets(t *testing.T) {
+	p := &countingSecrets{}
+	c := &CachedSecrets{Provider: p, TTL: 50 * time.Millisecond}
+	for i := 0; i < 3; i++ {
+		if v, err := c.Secret("db"); err != nil || v != "db-value" {
+			t.Fatalf("unexpected secret %q (%v)", v, err)
+		}
+	}
+	if p.n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", p.n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	c.Secret("db")
+	c.Forget("db")
+	c.Secret("db")
+	if p.n != 3 {
+		t.Fatalf("expected 3 lookups, got %d", p.n)
+	}
+}
+
+func TestSetenvSecret(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	os.Setenv("SSHCTL_TEST_TOKEN", TestString)
+	defer os.Unsetenv("SSHCTL_TEST_TOKEN")
+	if _, err := (EnvSecrets{Prefix: "SSHCTL_TEST_"}).Secret("MISSING"); err != ErrSecretNotFound {
+		t.Fatalf("expected ErrSecretNotFound, got %v", err)
+	}
+
+	var traced []string
+	sess := NewSession(g.ctrlSock)
+	sess.Trace = func(msg string) { traced = append(traced, msg) }
+	if err := sess.SetenvSecret("TOKEN", EnvSecrets{Prefix: "SSHCTL_TEST_"}, "TOKEN"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	out, err := sess.Output("echo -n $TOKEN")
+	if err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if string(out) != TestString {
+		t.Fatalf("expected response \"%s\" but got \"%s\"", TestString, out)
+	}
+	for _, msg := range traced {
+		if sess.Redactor.Redact(msg) != msg || msg == "" {
+			t.Fatalf("secret leaked into trace: %s", msg)
+		}
+	}
+}
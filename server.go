@@ -0,0 +1,713 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ftrvxmtrx/fd"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// ErrMasterServerClosed is returned by MasterServer.Serve after
+// Close was called or a client requested termination.
+var ErrMasterServerClosed = errors.New("sshctl: master server closed")
+
+// MasterServer implements the master side of the ssh mux protocol.
+// It accepts mux clients on a ControlPath socket, including sshctl
+// Sessions and the stock "ssh -S path" client, and services their
+// sessions and forwards over an established *ssh.Client.
+//
+// Supported requests are alive checks, sessions, stdio forwards,
+// local and remote port forwards, stop listening and terminate.
+// Dynamic (SOCKS) forwards are refused.
+type MasterServer struct {
+	client *ssh.Client
+
+	mu       sync.Mutex
+	listener *net.UnixListener
+	conns    map[*masterConn]bool
+	forwards map[string]io.Closer
+	nextSid  int
+	closed   bool
+}
+
+// NewMasterServer returns a MasterServer servicing mux clients over
+// the given client. The ssh connection is not closed by the server.
+func NewMasterServer(client *ssh.Client) *MasterServer {
+	return &MasterServer{
+		client:   client,
+		conns:    make(map[*masterConn]bool),
+		forwards: make(map[string]io.Closer),
+	}
+}
+
+// ListenAndServe listens on the unix socket path and then calls Serve.
+func (m *MasterServer) ListenAndServe(path string) error {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	return m.Serve(l)
+}
+
+// ServeActivated serves the control socket passed by systemd socket
+// activation, see ActivationListener.
+func (m *MasterServer) ServeActivated() error {
+	l, err := ActivationListener()
+	if err != nil {
+		return err
+	}
+	return m.Serve(l)
+}
+
+// Serve accepts mux clients on l until the server is closed.
+// It always returns a non-nil error; after Close or a terminate
+// request it is ErrMasterServerClosed.
+func (m *MasterServer) Serve(l *net.UnixListener) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		l.Close()
+		return ErrMasterServerClosed
+	}
+	m.listener = l
+	m.mu.Unlock()
+
+	// ssh(1) mux clients relay SIGWINCH to the master's pid
+	// signal.Stop does not close winch, so done ends the relay
+	winch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer func() {
+		signal.Stop(winch)
+		close(done)
+	}()
+	go func() {
+		for {
+			select {
+			case <-winch:
+				m.windowChanged()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			m.mu.Lock()
+			stopped := m.listener != l
+			m.mu.Unlock()
+			if stopped {
+				return ErrMasterServerClosed
+			}
+			return err
+		}
+		c := &masterConn{srv: m, conn: conn}
+		if !m.track(c) {
+			conn.Close()
+			return ErrMasterServerClosed
+		}
+		go c.serve()
+	}
+}
+
+// Close stops listening, cancels all forwards and closes all mux
+// client connections together with their sessions.
+func (m *MasterServer) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	var err error
+	if m.listener != nil {
+		err = m.listener.Close()
+		m.listener = nil
+	}
+	conns := m.conns
+	m.conns = make(map[*masterConn]bool)
+	forwards := m.forwards
+	m.forwards = make(map[string]io.Closer)
+	m.mu.Unlock()
+
+	for _, l := range forwards {
+		l.Close()
+	}
+	for c := range conns {
+		c.close()
+	}
+	return err
+}
+
+// stopListening stops accepting new mux clients, like "ssh -O stop".
+func (m *MasterServer) stopListening() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listener != nil {
+		m.listener.Close()
+		m.listener = nil
+	}
+}
+
+func (m *MasterServer) track(c *masterConn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	m.conns[c] = true
+	return true
+}
+
+func (m *MasterServer) untrack(c *masterConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns, c)
+}
+
+func (m *MasterServer) newSid() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextSid++
+	return m.nextSid
+}
+
+func (m *MasterServer) windowChanged() {
+	m.mu.Lock()
+	conns := make([]*masterConn, 0, len(m.conns))
+	for c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.mu.Unlock()
+	for _, c := range conns {
+		c.windowChanged()
+	}
+}
+
+type muxReply struct {
+	Request   uint32
+	RequestId uint32
+	Value     uint32
+}
+
+type muxFailureReply struct {
+	Request   uint32
+	RequestId uint32
+	Reason    string
+}
+
+// masterConn is a single mux client connection.
+type masterConn struct {
+	srv  *MasterServer
+	conn *net.UnixConn
+
+	wmu sync.Mutex // serializes writes to conn
+
+	mu      sync.Mutex
+	closers []io.Closer               // sessions and stdio forwards on conn
+	ttys    map[*os.File]*ssh.Session // pty sessions by their stdin
+}
+
+func (c *masterConn) serve() {
+	defer c.close()
+	if err := c.hello(); err != nil {
+		return
+	}
+	for {
+		packet, err := readPacket(c.conn)
+		if err != nil {
+			return
+		}
+		if err = c.handle(packet); err != nil {
+			return
+		}
+	}
+}
+
+func (c *masterConn) close() {
+	c.srv.untrack(c)
+	c.conn.Close()
+	c.mu.Lock()
+	closers := c.closers
+	c.closers = nil
+	c.mu.Unlock()
+	for _, cl := range closers {
+		cl.Close()
+	}
+}
+
+func (c *masterConn) addCloser(cl io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closers = append(c.closers, cl)
+}
+
+func (c *masterConn) reply(msg interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writePacket(c.conn, ssh.Marshal(msg))
+}
+
+func (c *masterConn) fail(rid int, format string, a ...interface{}) error {
+	return c.reply(&muxFailureReply{muxFailure, uint32(rid), fmt.Sprintf(format, a...)})
+}
+
+func (c *masterConn) hello() error {
+	m := &muxMsg{Request: muxMsgHello, Param: muxVersion}
+	if err := c.reply(m); err != nil {
+		return err
+	}
+	packet, err := readPacket(c.conn)
+	if err != nil {
+		return err
+	}
+	var mtype, version int
+	if mtype, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	if version, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	if mtype != muxMsgHello || version != muxVersion {
+		return fmt.Errorf("Incompatible Hello packet received")
+	}
+	return nil
+}
+
+func (c *masterConn) handle(packet []byte) error {
+	var mtype, rid int
+	var err error
+
+	if mtype, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	if rid, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	switch mtype {
+	case muxAliveCheck:
+		return c.reply(&muxReply{muxIsAlive, uint32(rid), uint32(os.Getpid())})
+	case muxTerminate:
+		err = c.reply(&muxMsg{muxOk, uint32(rid)})
+		go c.srv.Close()
+		return err
+	case muxStopListening:
+		c.srv.stopListening()
+		return c.reply(&muxMsg{muxOk, uint32(rid)})
+	case muxNewSession:
+		return c.newSession(rid, packet)
+	case muxNewStdioFwd:
+		return c.newStdioFwd(rid, packet)
+	case muxOpenFwd:
+		return c.openForward(rid, packet)
+	case muxCloseFwd:
+		return c.closeForward(rid, packet)
+	default:
+		return c.fail(rid, "unsupported request 0x%x", mtype)
+	}
+}
+
+// recvFiles receives n file descriptors, one per message as sent by
+// ssh(1) and Session.
+func (c *masterConn) recvFiles(n int) ([]*os.File, error) {
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		f, err := fd.Get(c.conn, 1, nil)
+		if err != nil || len(f) != 1 {
+			closeFiles(files...)
+			closeFiles(f...)
+			if err == nil {
+				err = errors.New("expected a file descriptor")
+			}
+			return nil, err
+		}
+		files = append(files, f[0])
+	}
+	return files, nil
+}
+
+func closeFiles(files ...*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+func (c *masterConn) newSession(rid int, packet []byte) error {
+	var wantTty, subsystem int
+	var term, cmd string
+	var env []string
+	var err error
+
+	if _, err = packetPopString(&packet); err != nil { // reserved
+		return err
+	}
+	if wantTty, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	// X11 forwarding, agent forwarding
+	for i := 0; i < 2; i++ {
+		if _, err = packetPopInt(&packet); err != nil {
+			return err
+		}
+	}
+	if subsystem, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	if _, err = packetPopInt(&packet); err != nil { // escape char
+		return err
+	}
+	if term, err = packetPopString(&packet); err != nil {
+		return err
+	}
+	if cmd, err = packetPopString(&packet); err != nil {
+		return err
+	}
+	for len(packet) > 0 {
+		var kv string
+		if kv, err = packetPopString(&packet); err != nil {
+			return err
+		}
+		env = append(env, kv)
+	}
+
+	files, err := c.recvFiles(3)
+	if err != nil {
+		return err
+	}
+	sess, err := c.srv.client.NewSession()
+	if err != nil {
+		closeFiles(files...)
+		return c.fail(rid, "session open failed: %v", err)
+	}
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			// Servers commonly refuse env requests, so does ssh(1)
+			sess.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+	sess.Stdin, sess.Stdout, sess.Stderr = files[0], files[1], files[2]
+
+	var ttyErr error
+	if wantTty != 0 {
+		w, h := 80, 24
+		if tw, th, err := terminal.GetSize(int(files[0].Fd())); err == nil {
+			w, h = tw, th
+		}
+		// like ssh(1), pass on the modes of the client's terminal
+		modes, err := terminalModes(files[0])
+		if err != nil {
+			modes = ssh.TerminalModes{}
+		}
+		ttyErr = sess.RequestPty(term, h, w, modes)
+	}
+	switch {
+	case subsystem != 0:
+		err = sess.RequestSubsystem(cmd)
+	case cmd == "":
+		err = sess.Shell()
+	default:
+		err = sess.Start(cmd)
+	}
+	if err != nil {
+		sess.Close()
+		closeFiles(files...)
+		return c.fail(rid, "session start failed: %v", err)
+	}
+
+	sid := c.srv.newSid()
+	c.addCloser(sess)
+	if err = c.reply(&muxReply{muxSessionOpened, uint32(rid), uint32(sid)}); err != nil {
+		return err
+	}
+	if ttyErr != nil {
+		if err = c.reply(&muxMsg{muxTtyAllocFail, uint32(sid)}); err != nil {
+			return err
+		}
+	} else if wantTty != 0 {
+		c.addTty(files[0], sess)
+	}
+
+	go func() {
+		err := sess.Wait()
+		closeFiles(files...)
+		status := 0
+		switch e := err.(type) {
+		case nil:
+		case *ssh.ExitMissingError:
+			status = -1
+		case *ssh.ExitError:
+			status = e.ExitStatus()
+		default:
+			status = 255
+		}
+		if status != -1 {
+			c.reply(&muxReply{muxExitMessage, uint32(sid), uint32(status)})
+		}
+		// The session ends with the mux client connection
+		c.close()
+	}()
+	return nil
+}
+
+func (c *masterConn) addTty(f *os.File, sess *ssh.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttys == nil {
+		c.ttys = make(map[*os.File]*ssh.Session)
+	}
+	c.ttys[f] = sess
+}
+
+func (c *masterConn) windowChanged() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for f, sess := range c.ttys {
+		if w, h, err := terminal.GetSize(int(f.Fd())); err == nil {
+			sess.WindowChange(h, w)
+		}
+	}
+}
+
+func (c *masterConn) newStdioFwd(rid int, packet []byte) error {
+	var host string
+	var port int
+	var err error
+
+	if _, err = packetPopString(&packet); err != nil { // reserved
+		return err
+	}
+	if host, err = packetPopString(&packet); err != nil {
+		return err
+	}
+	if port, err = packetPopInt(&packet); err != nil {
+		return err
+	}
+	files, err := c.recvFiles(2)
+	if err != nil {
+		return err
+	}
+	network, addr := forwardAddr(host, port)
+	remote, err := c.srv.client.Dial(network, addr)
+	if err != nil {
+		closeFiles(files...)
+		return c.fail(rid, "stdio forward failed: %v", err)
+	}
+	sid := c.srv.newSid()
+	c.addCloser(remote)
+	if err = c.reply(&muxReply{muxSessionOpened, uint32(rid), uint32(sid)}); err != nil {
+		return err
+	}
+	go func() {
+		done := make(chan bool, 2)
+		go func() {
+			io.Copy(remote, files[0])
+			closeWrite(remote)
+			done <- true
+		}()
+		go func() {
+			io.Copy(files[1], remote)
+			closeWrite(files[1])
+			done <- true
+		}()
+		<-done
+		<-done
+		remote.Close()
+		closeFiles(files...)
+		c.close()
+	}()
+	return nil
+}
+
+// forwardAddr returns the network and address for a forward target.
+func forwardAddr(host string, port int) (string, string) {
+	if uint32(port) == muxPortStreamLocal {
+		return "unix", host
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// listenAddr returns the network and address for a forward's listen
+// side, following ssh(1)'s conventions for the bind address.
+func listenAddr(host string, port int) (string, string) {
+	if uint32(port) == muxPortStreamLocal {
+		return "unix", host
+	}
+	switch host {
+	case "":
+		host = "localhost"
+	case "*":
+		host = ""
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+type muxForwardMsg struct {
+	Type        int
+	ListenHost  string
+	ListenPort  int
+	ConnectHost string
+	ConnectPort int
+}
+
+func parseForward(packet []byte) (*muxForwardMsg, error) {
+	var err error
+	f := &muxForwardMsg{}
+	if f.Type, err = packetPopInt(&packet); err != nil {
+		return nil, err
+	}
+	if f.ListenHost, err = packetPopString(&packet); err != nil {
+		return nil, err
+	}
+	if f.ListenPort, err = packetPopInt(&packet); err != nil {
+		return nil, err
+	}
+	if f.ConnectHost, err = packetPopString(&packet); err != nil {
+		return nil, err
+	}
+	if f.ConnectPort, err = packetPopInt(&packet); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *muxForwardMsg) key() string {
+	return fmt.Sprintf("%d:%s:%d:%s:%d", f.Type, f.ListenHost, f.ListenPort, f.ConnectHost, f.ConnectPort)
+}
+
+func (c *masterConn) openForward(rid int, packet []byte) error {
+	f, err := parseForward(packet)
+	if err != nil {
+		return err
+	}
+	m := c.srv
+	m.mu.Lock()
+	_, dup := m.forwards[f.key()]
+	m.mu.Unlock()
+	if dup {
+		return c.reply(&muxMsg{muxOk, uint32(rid)})
+	}
+
+	var l net.Listener
+	var dial func() (net.Conn, error)
+	network, addr := listenAddr(f.ListenHost, f.ListenPort)
+	cnetwork, caddr := forwardAddr(f.ConnectHost, f.ConnectPort)
+	switch f.Type {
+	case muxFwdLocal:
+		l, err = net.Listen(network, addr)
+		dial = func() (net.Conn, error) {
+			return m.client.Dial(cnetwork, caddr)
+		}
+	case muxFwdRemote:
+		if network == "unix" {
+			l, err = m.client.ListenUnix(addr)
+		} else {
+			l, err = m.client.Listen(network, addr)
+		}
+		dial = func() (net.Conn, error) {
+			return net.Dial(cnetwork, caddr)
+		}
+	default:
+		return c.fail(rid, "unsupported forward type %d", f.Type)
+	}
+	if err != nil {
+		return c.fail(rid, "port forwarding failed: %v", err)
+	}
+
+	m.mu.Lock()
+	m.forwards[f.key()] = l
+	m.mu.Unlock()
+	go func() {
+		for {
+			lconn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				rconn, err := dial()
+				if err != nil {
+					lconn.Close()
+					return
+				}
+				proxyConns(lconn, rconn)
+			}()
+		}
+	}()
+
+	if f.Type == muxFwdRemote && f.ListenPort == 0 {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			return c.reply(&muxReply{muxRemotePort, uint32(rid), uint32(addr.Port)})
+		}
+	}
+	return c.reply(&muxMsg{muxOk, uint32(rid)})
+}
+
+func (c *masterConn) closeForward(rid int, packet []byte) error {
+	f, err := parseForward(packet)
+	if err != nil {
+		return err
+	}
+	m := c.srv
+	m.mu.Lock()
+	l, ok := m.forwards[f.key()]
+	delete(m.forwards, f.key())
+	m.mu.Unlock()
+	if !ok {
+		return c.fail(rid, "port not forwarded")
+	}
+	l.Close()
+	return c.reply(&muxMsg{muxOk, uint32(rid)})
+}
+
+// proxyConns copies between a and b until both directions are done,
+// passing on the end of each as a half-close.
+func proxyConns(a, b io.ReadWriteCloser) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(a, b)
+		closeWrite(a)
+		done <- true
+	}()
+	go func() {
+		io.Copy(b, a)
+		closeWrite(b)
+		done <- true
+	}()
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// closeWrite shuts down the writing side of c, so its peer reads EOF
+// while data can still flow the other way. A file that is not a
+// socket, e.g. a pipe, is closed instead.
+func closeWrite(c io.Closer) {
+	switch c := c.(type) {
+	case interface{ CloseWrite() error }:
+		c.CloseWrite()
+		return
+	case *os.File:
+		if rc, err := c.SyscallConn(); err == nil {
+			var serr error
+			err = rc.Control(func(fd uintptr) {
+				serr = syscall.Shutdown(int(fd), syscall.SHUT_WR)
+			})
+			if err == nil && serr == nil {
+				return
+			}
+		}
+	}
+	c.Close()
+}
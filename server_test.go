@@ -0,0 +1,705 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+// in-process test harness: sshd --- ssh.Client --- MasterServer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type goMaster struct {
+	t        *testing.T
+	sshd     net.Listener
+	client   *ssh.Client
+	master   *MasterServer
+	ctrlSock string
+	served   chan error
+}
+
+// newGoMaster starts an in-process sshd and a MasterServer on top of
+// a client connection to it.
+func newGoMaster(t *testing.T) *goMaster {
+	return newGoMasterAt(t, filepath.Join(t.TempDir(), "ctrl.sock"))
+}
+
+func newGoMasterAt(t *testing.T, ctrlSock string) *goMaster {
+	l := listenTestSSHD(t)
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "gopher",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+
+	g := &goMaster{
+		t:        t,
+		sshd:     l,
+		client:   client,
+		master:   NewMasterServer(client),
+		ctrlSock: ctrlSock,
+		served:   make(chan error, 1),
+	}
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: g.ctrlSock, Net: "unix"})
+	if err != nil {
+		g.Shutdown()
+		t.Fatal(err)
+	}
+	go func() {
+		g.served <- g.master.Serve(ul)
+	}()
+	return g
+}
+
+func (g *goMaster) Shutdown() {
+	g.master.Close()
+	g.client.Close()
+	g.sshd.Close()
+}
+
+// listenTestSSHD starts an in-process sshd on a local port.
+func listenTestSSHD(t *testing.T) net.Listener {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigners["rsa"])
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSH(conn, config)
+		}
+	}()
+	return l
+}
+
+func serveTestSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	// commands left running die with the connection, so they do not
+	// hold on to files after their test
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go serveTestSession(ctx, ch, reqs)
+		case "direct-tcpip":
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			network, addr := forwardAddr(target.Host, int(target.Port))
+			rconn, err := net.Dial(network, addr)
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				rconn.Close()
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				proxyConns(rconn, ch)
+			}()
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func serveTestSession(ctx context.Context, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	var env []string
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			ssh.Unmarshal(req.Payload, &kv)
+			env = append(env, kv.Name+"="+kv.Value)
+			req.Reply(true, nil)
+		case "pty-req":
+			var pty struct {
+				Term                      string
+				Cols, Rows, Width, Height uint32
+				Modes                     string
+			}
+			ssh.Unmarshal(req.Payload, &pty)
+			// expose the size and the ECHO mode to the command
+			env = append(env, fmt.Sprintf("TEST_PTY_SIZE=%dx%d", pty.Cols, pty.Rows))
+			for m := pty.Modes; len(m) >= 5 && m[0] != 0; m = m[5:] {
+				if m[0] == ssh.ECHO {
+					env = append(env, fmt.Sprintf("TEST_PTY_ECHO=%d", binary.BigEndian.Uint32([]byte(m[1:5]))))
+				}
+			}
+			req.Reply(true, nil)
+		case "exec", "shell":
+			var cmd struct{ Command string }
+			if req.Type == "exec" {
+				ssh.Unmarshal(req.Payload, &cmd)
+			}
+			req.Reply(true, nil)
+			go runTestCommand(ctx, ch, cmd.Command, env)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func runTestCommand(ctx context.Context, ch ssh.Channel, command string, env []string) {
+	defer ch.Close()
+	args := []string{}
+	if command != "" {
+		args = append(args, "-c", command)
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	status := 0
+	if err := cmd.Run(); err != nil {
+		status = 255
+		if ee, ok := err.(*exec.ExitError); ok {
+			status = ee.ExitCode()
+		}
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+func TestMasterServerRun(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock)
+	inb := bytes.NewBufferString(TestString)
+	var outb bytes.Buffer
+	sess.Stdin = inb
+	sess.Stdout = &outb
+	if err := sess.Run("cat"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if outb.String() != TestString {
+		t.Fatalf("expected response \"%s\" but got \"%s\"", TestString, outb.String())
+	}
+
+	sess = NewSession(g.ctrlSock)
+	err := sess.Run("exit 3")
+	if ee, ok := err.(*ExitError); !ok || ee.ExitStatus() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+}
+
+func TestMasterServerInfo(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	info, err := NewClient(g.ctrlSock).MasterInfo()
+	if err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if info.PID != os.Getpid() {
+		t.Fatalf("expected master pid %d but got %d", os.Getpid(), info.PID)
+	}
+}
+
+func TestMasterServerOpenSSHClient(t *testing.T) {
+	sshbin, err := exec.LookPath("ssh")
+	if err != nil {
+		t.Skipf("skipping test: %v", err)
+	}
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	out, err := exec.Command(sshbin, "-S", g.ctrlSock, "dummy", "echo -n "+TestString).Output()
+	if err != nil || string(out) != TestString {
+		t.Fatalf("expected response \"%s\" but got \"%s\" (%v)", TestString, out, err)
+	}
+	for _, op := range []string{"check", "exit"} {
+		out, err := exec.Command(sshbin, "-S", g.ctrlSock, "-O", op, "dummy").CombinedOutput()
+		if err != nil {
+			t.Fatalf("ssh -O %s: %v: %s", op, err, out)
+		}
+	}
+	if err := <-g.served; err != ErrMasterServerClosed {
+		t.Fatalf("expected ErrMasterServerClosed, got %v", err)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	sess := NewSession(g.ctrlSock)
+	if err := sess.Start("sleep 0.2; echo -n " + TestString + " >" + marker); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if err := sess.Detach(); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if err := sess.Wait(); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if b, err := os.ReadFile(marker); err == nil && string(b) == TestString {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("detached command did not complete")
+}
+
+type blockingWriter struct {
+	unblock chan bool
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func TestDrainTimeout(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	w := &blockingWriter{unblock: make(chan bool)}
+	defer close(w.unblock)
+	sess := NewSession(g.ctrlSock)
+	sess.Stdout = w
+	sess.DrainTimeout = 100 * time.Millisecond
+	err := sess.Run("echo " + TestString + "; exit 2")
+	var ee *ExitError
+	if !errors.Is(err, ErrDrainTimeout) || !errors.As(err, &ee) || ee.ExitStatus() != 2 {
+		t.Fatalf("expected exit status 2 and ErrDrainTimeout, got %v", err)
+	}
+}
+
+// chunkWriter records the largest write.
+type chunkWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		w.max = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestBufferSizes(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock)
+	sess.ReadBufferSize = 16
+	sess.WriteBufferSize = 8
+	data := bytes.Repeat([]byte(TestString), 100)
+	sess.Stdin = bytes.NewReader(data)
+	var out chunkWriter
+	sess.Stdout = &out
+	if err := sess.Run("cat"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("output differs from input")
+	}
+	if out.max > 16 {
+		t.Fatalf("expected writes of at most 16 bytes, got %d", out.max)
+	}
+}
+
+// flushRecorder is a buffered writer recording whether its content
+// was flushed before the session ended.
+type flushRecorder struct {
+	pending, flushed bytes.Buffer
+}
+
+func (w *flushRecorder) Write(p []byte) (int, error) {
+	return w.pending.Write(p)
+}
+
+func (w *flushRecorder) Flush() error {
+	w.pending.WriteTo(&w.flushed)
+	return nil
+}
+
+func TestLowLatency(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	for _, lowLatency := range []bool{false, true} {
+		sess := NewSession(g.ctrlSock)
+		sess.LowLatency = lowLatency
+		var out flushRecorder
+		sess.Stdout = &out
+		if err := sess.Run("printf " + TestString); err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if lowLatency {
+			want = TestString
+		}
+		if got := out.flushed.String(); got != want {
+			t.Fatalf("LowLatency %v: expected %q flushed, got %q", lowLatency, want, got)
+		}
+	}
+}
+
+func TestSpoolOutput(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	for _, limit := range []int{1 << 20, 100} {
+		rc, err := NewSession(g.ctrlSock).SpoolOutput("i=0; while [ $i -lt 1000 ]; do echo "+TestString+"; i=$((i+1)); done", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, spooled := rc.(*spoolFile)
+		if spooled != (limit == 100) {
+			t.Fatalf("limit %d: unexpected spooling %v", limit, spooled)
+		}
+		out, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := bytes.Repeat([]byte(TestString+"\n"), 1000); !bytes.Equal(out, want) {
+			t.Fatalf("limit %d: output differs", limit)
+		}
+		if _, err := rc.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if err := rc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := rc.(*spoolFile); ok {
+			if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+				t.Fatalf("spool file %s not removed", f.Name())
+			}
+		}
+	}
+}
+
+func TestOutputContext(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	out, err := NewSession(g.ctrlSock).CombinedOutputContext(ctx, "echo "+TestString+"; echo err >&2; sleep 10")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("session not aborted on time")
+	}
+	if !bytes.Contains(out, []byte(TestString)) || !bytes.Contains(out, []byte("err")) {
+		t.Fatalf("expected partial output, got %q", out)
+	}
+
+	out, err = NewSession(g.ctrlSock).OutputContext(context.Background(), "echo "+TestString)
+	if err != nil || string(out) != TestString+"\n" {
+		t.Fatalf("unexpected result %q, %v", out, err)
+	}
+}
+
+func TestOutputAll(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	stdout, stderr, err := NewSession(g.ctrlSock).OutputAll("echo out; echo err >&2; exit 1")
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.ExitStatus() != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+	if string(stdout) != "out\n" || string(stderr) != "err\n" {
+		t.Fatalf("unexpected output %q, %q", stdout, stderr)
+	}
+}
+
+func TestFirstOutputTimeout(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	tests := []struct {
+		cmd  string
+		want error
+	}{
+		{"sleep 10", ErrNoOutput},
+		{"echo prompt >&2; sleep 0.5", nil},
+		{"true", nil},
+	}
+	for _, tt := range tests {
+		sess := NewSession(g.ctrlSock)
+		sess.FirstOutputTimeout = 200 * time.Millisecond
+		start := time.Now()
+		if err := sess.Run(tt.cmd); err != tt.want {
+			t.Fatalf("%q: expected %v, got %v", tt.cmd, tt.want, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%q: watchdog did not fire in time", tt.cmd)
+		}
+	}
+}
+
+func TestControlTimeout(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock)
+	sess.ControlTimeout = 300 * time.Millisecond
+	if err := sess.Run("sleep 0.5"); err != nil {
+		t.Fatalf("expected healthy master to pass, got %v", err)
+	}
+
+	sess = NewSession(g.ctrlSock)
+	sess.ControlTimeout = 300 * time.Millisecond
+	if err := sess.Start("sleep 10"); err != nil {
+		t.Fatal(err)
+	}
+	// the running session survives, but alive checks fail
+	g.master.stopListening()
+	start := time.Now()
+	err := sess.Wait()
+	var cte *ControlTimeoutError
+	if !errors.As(err, &cte) {
+		t.Fatalf("expected ControlTimeoutError, got %v", err)
+	}
+	if cte.Idle < sess.ControlTimeout || time.Since(start) > 5*time.Second {
+		t.Fatalf("unexpected timing: idle %v after %v", cte.Idle, time.Since(start))
+	}
+}
+
+func TestStats(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock)
+	if sess.Stats() != nil {
+		t.Fatalf("expected no stats before Wait")
+	}
+	sess.Stdin = bytes.NewBufferString(TestString)
+	var outb, errb bytes.Buffer
+	sess.Stdout = &outb
+	sess.Stderr = &errb
+	err := sess.Run("cat; echo err >&2; exit 3")
+	if err == nil {
+		t.Fatalf("expected exit status 3")
+	}
+	st := sess.Stats()
+	if st == nil {
+		t.Fatalf("expected stats after Wait")
+	}
+	want := SessionStats{
+		StdinBytes:  int64(len(TestString)),
+		StdoutBytes: int64(len(TestString)),
+		StderrBytes: 4,
+		ExitStatus:  3,
+	}
+	got := *st
+	got.Duration, got.OpenTime = 0, 0
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if st.OpenTime <= 0 || st.Duration < st.OpenTime {
+		t.Fatalf("unexpected timing %+v", st)
+	}
+}
+
+func TestCloseErrors(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock)
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if err := sess.Start("sleep 10"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	// the caller's end of the pipe is closed twice
+	stdin.Close()
+	if err := sess.Close(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := sess.Wait(); err != ErrAborted {
+		t.Fatalf("expected ErrAborted, got %v", err)
+	}
+
+	if err := ignoreClosed(os.ErrPermission); err != os.ErrPermission {
+		t.Fatalf("expected %v, got %v", os.ErrPermission, err)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	client := NewClient(g.ctrlSock)
+	f := Forward{LocalForward, "127.0.0.1", freePort(t), "127.0.0.1", 22}
+	if _, err := client.OpenForward(f); err != nil {
+		t.Fatal(err)
+	}
+	var outb bytes.Buffer
+	sess := client.NewSession()
+	sess.Stdout = &outb
+	if err := sess.Start("sleep 0.3; echo -n " + TestString); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if err := <-done; err != nil || outb.String() != TestString {
+		t.Fatalf("expected the session to finish, got %q, %v", outb.String(), err)
+	}
+	if got := client.Forwards(); len(got) != 0 {
+		t.Fatalf("expected no forwards, got %+v", got)
+	}
+	if err := client.CloseForward(f); err == nil {
+		t.Fatalf("expected %s to be cancelled", f)
+	}
+	if err := client.NewSession().Run("true"); err != ErrClientShutdown {
+		t.Fatalf("expected ErrClientShutdown, got %v", err)
+	}
+}
+
+func TestClientShutdownTimeout(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	client := NewClient(g.ctrlSock)
+	sess := client.NewSession()
+	if err := sess.Start("sleep 10"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := sess.Wait(); err != ErrAborted {
+		t.Fatalf("expected ErrAborted, got %v", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := NewClientContext(ctx, g.ctrlSock)
+	f := Forward{LocalForward, "127.0.0.1", freePort(t), "127.0.0.1", 22}
+	if _, err := client.OpenForward(f); err != nil {
+		t.Fatal(err)
+	}
+	sess := client.NewSession()
+	if err := sess.Start("sleep 10"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	cancel()
+	if err := sess.Wait(); err != ErrAborted {
+		t.Fatalf("expected ErrAborted, got %v", err)
+	}
+	// cancelling the forward races with Wait
+	deadline := time.Now().Add(2 * time.Second)
+	for len(client.Forwards()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := client.Forwards(); len(got) != 0 {
+		t.Fatalf("expected no forwards, got %+v", got)
+	}
+	if err := client.NewSession().Run("true"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := client.OpenForward(f); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := client.OpenForwards([]Forward{f}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if got := client.Forwards(); len(got) != 0 {
+		t.Fatalf("expected no forwards, got %+v", got)
+	}
+
+	// Shutdown unbinds a Client whose context is never done
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	client = NewClientContext(ctx, g.ctrlSock)
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if client.stopCtx() {
+		t.Fatal("expected the cleanup of the context to be unregistered")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock)
+	sess.Strict = true
+	err := sess.Run("exit 3")
+	if ee, ok := err.(*ExitError); !ok || ee.ExitStatus() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+}
+
@@ -0,0 +1,159 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// ErrWorkerClosed is returned by ShellWorker.Run once the worker's
+// shell is gone.
+var ErrWorkerClosed = errors.New("sshctl: shell worker closed")
+
+// ShellWorker runs commands one after the other in a single remote
+// sh(1), which saves setting up a session per command. After each
+// command the shell writes a line with a random marker and the exit
+// status to both output streams, which tells where the command's
+// output ends.
+//
+// Every command runs in a subshell with standard input from
+// /dev/null, so exit, cd or syntax errors do not affect later
+// commands, and neither does anything else changing the shell's
+// state.
+type ShellWorker struct {
+	s      *Session
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *bufio.Reader
+	marker []byte
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewShellWorker starts a ShellWorker in s, which must not be started
+// and must not have its Stdin, Stdout or Stderr set. The remote host
+// needs a POSIX shell.
+func NewShellWorker(s *Session) (*ShellWorker, error) {
+	var token [12]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+	w := &ShellWorker{s: s, marker: []byte("sshctl-" + hex.EncodeToString(token[:]))}
+	var err error
+	if w.stdin, err = s.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := s.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.stdout, w.stderr = bufio.NewReader(stdout), bufio.NewReader(stderr)
+	if err := s.Start("exec sh"); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// NewShellWorker starts a ShellWorker on the client's master.
+func (c *Client) NewShellWorker() (*ShellWorker, error) {
+	return NewShellWorker(c.NewSession())
+}
+
+// Run runs cmd and returns its standard output and error. A non-zero
+// exit status is reported as an *ExitError. If the shell went away,
+// the worker is closed and the error is ErrWorkerClosed, joined with
+// the session's error if there was one.
+func (w *ShellWorker) Run(cmd string) (stdout, stderr []byte, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, nil, ErrWorkerClosed
+	}
+	// the newline printed first puts the marker on a line of its own
+	script := fmt.Sprintf("(eval %s) </dev/null; st=$?; printf '\\n%s %%d\\n' $st >&2; printf '\\n%s %%d\\n' $st\n",
+		shellQuote(cmd), w.marker, w.marker)
+	if _, err := io.WriteString(w.stdin, script); err != nil {
+		return nil, nil, w.fail()
+	}
+	var status int
+	var errOut []byte
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		errOut, _, err = w.read(w.stderr)
+		done <- err
+	}()
+	stdout, status, err = w.read(w.stdout)
+	if err1 := <-done; err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, nil, w.fail()
+	}
+	if status != 0 {
+		return stdout, errOut, &ExitError{Waitmsg{status: status}}
+	}
+	return stdout, errOut, nil
+}
+
+// read returns the output up to the next marker line and the status
+// it carries.
+func (w *ShellWorker) read(r *bufio.Reader) ([]byte, int, error) {
+	var out []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, 0, err
+		}
+		if bytes.HasPrefix(line, w.marker) {
+			status, err := strconv.Atoi(string(bytes.TrimSpace(line[len(w.marker):])))
+			if err != nil || len(out) == 0 {
+				return nil, 0, fmt.Errorf("sshctl: shell worker: malformed marker line %q", line)
+			}
+			// drop the newline printed before the marker
+			return out[:len(out)-1], status, nil
+		}
+		out = append(out, line...)
+	}
+}
+
+// fail closes the worker after its shell went away.
+func (w *ShellWorker) fail() error {
+	if err := w.shutdown(); err != nil {
+		return errors.Join(ErrWorkerClosed, err)
+	}
+	return ErrWorkerClosed
+}
+
+// Close ends the shell and waits for the session to finish.
+func (w *ShellWorker) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	return w.shutdown()
+}
+
+func (w *ShellWorker) shutdown() error {
+	w.closed = true
+	w.stdin.Close()
+	go io.Copy(io.Discard, w.stdout)
+	go io.Copy(io.Discard, w.stderr)
+	return w.s.Wait()
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestShellWorker(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	w, err := NewClient(g.ctrlSock).NewShellWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, tc := range []struct {
+		cmd            string
+		stdout, stderr string
+		status         int
+	}{
+		{"echo hello", "hello\n", "", 0},
+		{"printf abc; printf err >&2", "abc", "err", 0},
+		{"echo out; echo err >&2; exit 3", "out\n", "err\n", 3},
+		{"cd /; export FOO=bar; pwd", "/\n", "", 0},
+		{"pwd | grep -qx /; echo \"$?${FOO:-unset}\"", "1unset\n", "", 0},
+		{"cat", "", "", 0}, // does not read the worker's input
+		{"printf '\\n\\n'", "\n\n", "", 0},
+	} {
+		stdout, stderr, err := w.Run(tc.cmd)
+		if string(stdout) != tc.stdout || string(stderr) != tc.stderr || ExitCode(err) != tc.status {
+			t.Errorf("%s: expected %q, %q, %d, got %q, %q, %v", tc.cmd, tc.stdout, tc.stderr, tc.status, stdout, stderr, err)
+		}
+	}
+
+	if _, stderr, err := w.Run("if then"); ExitCode(err) == 0 || len(stderr) == 0 {
+		t.Fatalf("expected a syntax error, got %q (%v)", stderr, err)
+	}
+	if out, _, err := w.Run("echo still here"); err != nil || string(out) != "still here\n" {
+		t.Fatalf("worker broken after syntax error: %q (%v)", out, err)
+	}
+
+	if _, _, err := w.Run("kill -KILL $$"); !errors.Is(err, ErrWorkerClosed) {
+		t.Fatalf("expected ErrWorkerClosed, got %v", err)
+	}
+	if _, _, err := w.Run("true"); err != ErrWorkerClosed {
+		t.Fatalf("expected ErrWorkerClosed, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected Close of a failed worker to succeed, got %v", err)
+	}
+}
+
+func TestShellWorkerClose(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	w, err := NewShellWorker(NewSession(g.ctrlSock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := w.Run("true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, _, err := w.Run("true"); err != ErrWorkerClosed {
+		t.Fatalf("expected ErrWorkerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SpoolOutput runs cmd on the remote host and returns its standard
+// output like Output, but keeps only up to limit bytes in memory;
+// larger output is spooled to a temporary file, which is removed by
+// Close. As with Output, the output is returned along with a non-nil
+// error, if any, and must be closed in any case.
+func (s *Session) SpoolOutput(cmd string, limit int) (io.ReadSeekCloser, error) {
+	if s.Stdout != nil {
+		return nil, errors.New("ssh: Stdout already set")
+	}
+	w := &spoolWriter{limit: limit}
+	s.Stdout = w
+	err := s.Run(cmd)
+	rc, err1 := w.result()
+	if err1 != nil {
+		w.discard()
+		return nil, err1
+	}
+	return rc, err
+}
+
+// spoolWriter buffers up to limit bytes and moves everything to a
+// temporary file once more is written.
+type spoolWriter struct {
+	limit int
+	buf   bytes.Buffer
+	f     *os.File
+	err   error // first error writing the file
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.f == nil && w.buf.Len()+len(p) <= w.limit {
+		return w.buf.Write(p)
+	}
+	if w.f == nil {
+		if w.f, w.err = ioutil.TempFile("", "sshctl-spool-"); w.err != nil {
+			return 0, w.err
+		}
+		if _, w.err = w.buf.WriteTo(w.f); w.err != nil {
+			return 0, w.err
+		}
+	}
+	var n int
+	n, w.err = w.f.Write(p)
+	return n, w.err
+}
+
+func (w *spoolWriter) result() (io.ReadSeekCloser, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if w.f == nil {
+		return nopSeekCloser{bytes.NewReader(w.buf.Bytes())}, nil
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &spoolFile{w.f}, nil
+}
+
+func (w *spoolWriter) discard() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+	}
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// spoolFile is a temporary file removed on Close.
+type spoolFile struct {
+	*os.File
+}
+
+func (f *spoolFile) Close() error {
+	err := f.File.Close()
+	if err1 := os.Remove(f.Name()); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -7,43 +7,212 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package sshctl is a client for the control socket of an ssh(1)
+// ControlMaster, which runs sessions and forwards over the master's
+// connection.
+//
+// Programs working on many hosts can share a Config file describing
+// hosts, control paths, environment, timeouts and concurrency. It is
+// JSON rather than YAML or TOML: the standard library reads JSON,
+// while a YAML or TOML parser would be one more third-party package
+// for every user to fetch into their GOPATH, just for a config file.
+// The Config hands out Clients, Sessions and Executors; there is no
+// connection pool in the package to consume it.
 package sshctl
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"runtime/pprof"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // NewSession prepares a new Session on top of an ssh(1) "ControlMaster" process.
-// The given path points towards the ssh "ControlPath"
+// The given path points towards the ssh "ControlPath". If it is empty,
+// the path is taken from the SSHCTL_CONTROL_PATH environment variable.
 func NewSession(path string) *Session {
-	s := &Session{sshctlpath: path}
+	s := &Session{sshctlpath: defaultControlPath(path)}
 	return s
 }
 
 type Session struct {
 	// Stdin specifies the remote process's standard input.
-	// If Stdin is nil, the remote process reads from an empty
-	// bytes.Buffer.
+	// If Stdin is nil, the remote process reads from os.DevNull.
+	// Other than an *os.File, Stdin is read by a goroutine that only
+	// ends when a Read returns, so a reader blocking forever keeps
+	// it around even after Wait or Close.
 	Stdin io.Reader
 
 	// Stdout and Stderr specify the remote process's standard
 	// output and error.
 	//
 	// If either is nil, Run connects the corresponding file
-	// descriptor to an instance of ioutil.Discard. There is a
-	// fixed amount of buffering that is shared for the two streams.
-	// If either blocks it may eventually cause the remote
-	// command to block.
+	// descriptor to os.DevNull, which is passed to the master
+	// directly rather than through a pipe. With FirstOutputTimeout
+	// or StdoutEOFTimeout set, the output is instead read and
+	// discarded, so that the watchdog sees it. There is a fixed
+	// amount of buffering that is shared for the two streams. If
+	// either blocks it may eventually cause the remote command to
+	// block.
 	Stdout io.Writer
 	Stderr io.Writer
 
+	// TTYStdin connects the remote process's standard input to the
+	// controlling terminal (/dev/tty) instead of Stdin, which must be
+	// nil. This lets a program whose own stdin is a pipe still answer
+	// an occasional remote prompt. If a pty is requested, the
+	// terminal is put into raw mode and restored by Wait.
+	TTYStdin bool
+
+	// StdinFile, StdoutFile and StderrFile, if non-nil, are passed to
+	// the master as the remote process's standard input, output and
+	// error, without copying, in place of Stdin, Stdout and Stderr,
+	// which must then be nil. Any file works, including a socket
+	// from the File method of a net.Conn. Unlike an *os.File given
+	// as Stdin, Stdout or Stderr, which is passed the same way, the
+	// choice is explicit and does not depend on the dynamic type.
+	//
+	// The files remain owned by the caller: the session never closes
+	// them. The master holds a duplicate from Start on, so the caller
+	// may close its copy as soon as Start returns; the remote process
+	// sees EOF on its input only once all copies are closed.
+	StdinFile  *os.File
+	StdoutFile *os.File
+	StderrFile *os.File
+
+	// KeepStdinOpen keeps the remote process's standard input open
+	// after Stdin reached EOF, for commands that take EOF as a
+	// request to shut down. It is closed when the command has
+	// exited or the session is closed. With Stdin nil, the remote
+	// process gets no input instead of reading from os.DevNull.
+	// Files passed to the master, such as an *os.File Stdin or
+	// StdinFile, and StdinPipe are not affected.
+	KeepStdinOpen bool
+
+	// DrainTimeout bounds how long Wait waits for Stdin, Stdout and
+	// Stderr copying to finish once the remote command has exited.
+	// If it expires, Wait returns ErrDrainTimeout joined with the
+	// exit error, if any. Zero means wait indefinitely.
+	DrainTimeout time.Duration
+
+	// ReadBufferSize and WriteBufferSize are the chunk sizes in
+	// which the remote command's output is read and Stdin is written
+	// to it. Small chunks hand data on sooner, large ones need fewer
+	// system calls. If zero, 32 KiB are used.
+	//
+	// Output is copied to Stdout and Stderr synchronously: while a
+	// writer blocks, nothing is read from the master, and once the
+	// pipe between master and session is full, the remote command
+	// blocks as well. Likewise Stdin is read only as fast as the
+	// remote command consumes it.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// LowLatency favors latency over throughput, e.g. so keystroke
+	// echo in interactive sessions is not held up: buffer sizes left
+	// at zero default to 512 bytes, and Stdout and Stderr are flushed
+	// after every write if they have a Flush method, such as a
+	// bufio.Writer.
+	LowLatency bool
+
+	// FirstOutputTimeout, if non-zero, closes the session if the
+	// remote command neither writes output nor exits within this
+	// time after Start, e.g. because it waits at an unexpected
+	// prompt. Wait then returns ErrNoOutput. Output going to an
+	// *os.File or through StdoutPipe or StderrPipe is not seen by
+	// the watchdog; do not combine them.
+	FirstOutputTimeout time.Duration
+
+	// StdoutEOFTimeout, if non-zero, takes EOF on the remote
+	// command's standard output as the end of the session, for
+	// masters or commands that never deliver an exit status: if none
+	// arrives within this time after EOF, the session is closed and
+	// Wait returns ErrStdoutEOF. Like FirstOutputTimeout, it only
+	// watches output copied to Stdout, not an *os.File, StdoutFile
+	// or StdoutPipe.
+	StdoutEOFTimeout time.Duration
+
+	// ControlTimeout, if non-zero, watches the master while the
+	// command runs: if the control connection delivers no packets
+	// and alive checks on separate connections go unanswered for
+	// this long, the session is closed and Wait returns a
+	// *ControlTimeoutError.
+	ControlTimeout time.Duration
+
+	// Strict rejects messages from the master that violate the mux
+	// protocol instead of tolerating them as ssh(1) does: replies
+	// and notifications for another request or session, a second
+	// exit message, and unknown message types. Wait then returns a
+	// *ProtocolError.
+	Strict bool
+
+	// VerifyPeer checks, before talking to the master, that the
+	// process listening on the control socket runs as the current
+	// user or as root, like the master checks its clients. Start
+	// then fails with a *PeerError otherwise. It is supported on
+	// Linux and macOS.
+	VerifyPeer bool
+
+	// TerminalModes adjusts the modes of the pty requested with
+	// RequestPty, e.g. ssh.ECHO: 0 for a session that reads a
+	// password. Only flags are supported, not special characters
+	// or speeds. The master copies the modes from the terminal
+	// passed as stdin, so they are set on it before the session
+	// starts, and Stdin must be a terminal, see TTYStdin. Only
+	// the terminal opened for TTYStdin is restored by Wait.
+	TerminalModes ssh.TerminalModes
+
+	// WindowSize overrides the size of the pty requested with
+	// RequestPty. If zero and Stdout is a terminal, its size is
+	// used. Like the modes, the master reads the size from the
+	// terminal passed as stdin, which is resized accordingly.
+	WindowSize WindowSize
+
+	// PtyFallback makes a pty refused by the server non-fatal: the
+	// session carries on without one, as ssh(1) does, and Wait
+	// returns the command's result instead of a *TTYAllocError.
+	// A terminal opened for TTYStdin leaves raw mode.
+	// OnPtyFallback, if non-nil, is called when this happens, from
+	// a goroutine other than the caller's.
+	PtyFallback   bool
+	OnPtyFallback func()
+
+	// Trace, if non-nil, receives human-readable messages about the
+	// session's progress, e.g. the command sent to the master and
+	// its exit status. Messages pass through Redactor first.
+	// Trace may be called from a goroutine other than the caller's.
+	Trace func(msg string)
+
+	// OnStateChange, if non-nil, is called on every state transition
+	// of the session. It may be called from a goroutine other than
+	// the caller's and must not block.
+	OnStateChange func(old, new SessionState)
+
+	// Events, if non-nil, receives progress updates for dashboards
+	// and TUIs: SessionOpened and SessionStarted while the session
+	// starts, SessionBytes as stdio is copied, at most every 100ms,
+	// and SessionExited at the end. These lifecycle events are
+	// always delivered, so the channel must be drained, but
+	// SessionBytes events are dropped while it is full.
+	// Client.Events sets it for all sessions of a Client.
+	Events chan<- SessionEvent
+
+	// Redactor removes secrets from trace messages. If nil, messages
+	// are passed on unchanged.
+	Redactor *Redactor
+
 	// Local files of a mux session
 	lmuxStdin  *os.File
 	lmuxStdout *os.File
@@ -55,100 +224,307 @@ type Session struct {
 	rmuxStdout *os.File
 	rmuxStderr *os.File
 
+	// os.DevNull opened for streams left nil, see openDevNull
+	devNull []*os.File
+
 	copyFuncs []func() error
 	errors    chan error // one send per copyFunc
 
+	label      string // set by WithLabel
+	cmd        string // the command passed to Start
 	sshctlpath string // the ssh control unix socket path
 	ctrlconn   *net.UnixConn
 	ctrlReqid  int
 	ctrlSessid int
 	term       string
-	started    bool // true once Start, Run or Shell is invoked.
+	env        []string // "NAME=value" pairs set with Setenv
+	started    bool     // true once Start, Run or Shell is invoked.
+
+	// dials instead of sshctlpath, see NewClientDialer
+	dial func() (*net.UnixConn, error)
+
+	// Master details learned during the mux handshake
+	masterVersion    int
+	masterExtensions map[string]string
+	masterPid        int
 
 	// true if pipe method is active
 	stdinpipe, stdoutpipe, stderrpipe bool
 
+	// set by wait if the master reported MUX_S_TTY_ALLOC_FAIL
+	ttyAllocFailed bool
+
+	// the master's message about the session, set by wait
+	exitMsg string
+
+	// the terminal opened for TTYStdin and its state before MakeRaw
+	// and TerminalModes
+	tty          *os.File
+	ttyState     *terminal.State
+	restoreModes func() error
+
 	// stdinPipeWriter is non-nil if StdinPipe has not been called
 	// and Stdin was specified by the user; it is the write end of
 	// a pipe connecting Session.Stdin to the stdin channel.
 	stdinPipeWriter io.WriteCloser
 
+	// the FirstOutputTimeout watchdog
+	watchdog  *time.Timer
+	sawOutput int32 // set atomically on the first output
+
+	// closed once the master reported the exit or the control
+	// connection broke, when the wait loop is done
+	exited chan struct{}
+
+	// closed when reportBytes returned, if Events is set
+	bytesReported chan struct{}
+
+	// the ControlTimeout watchdog
+	lastHeard int64 // UnixNano, accessed atomically
+
+	// bytes exchanged on the control connection, for
+	// ControlIOError, accessed atomically
+	ctrlRead, ctrlWritten int64
+
+	// the Client that created the session, if any
+	client *Client
+
+	// statistics, see Stats
+	startTime, openTime                  time.Time
+	stdinBytes, stdoutBytes, stderrBytes int64 // counted as copied, accessed atomically
+	stats                                *SessionStats
+
+	state      int32 // SessionState, accessed atomically
 	exitStatus chan error
-	aborted    chan bool
+
+	// teardown, see shutdown
+	closeOnce sync.Once
+	closeErr  error         // of closing the files and connection
+	abortErr  error         // what Wait returns after shutdown
+	aborted   chan struct{} // closed by shutdown
 }
 
 // Start runs cmd on the remote host. Typically, the remote
 // server passes cmd to the shell for interpretation.
 // A Session only accepts one call to Run, Start or Shell.
 func (s *Session) Start(cmd string) error {
+	return s.labelErr(s.startSession(cmd))
+}
+
+func (s *Session) startSession(cmd string) (err error) {
 	if s.started {
 		return errors.New("ssh: session already started")
 	}
+	defer func() {
+		if err != nil {
+			s.emit(SessionExited, err)
+		}
+	}()
 
+	s.cmd = cmd
+	s.startTime = time.Now()
+	s.exitStatus = make(chan error, 1)
+	s.aborted = make(chan struct{})
+	s.exited = make(chan struct{})
+	s.setState(StateDialing)
+	// on failure, Close releases the control connection and the
+	// pipes, including those of StdinPipe, StdoutPipe and StderrPipe
 	if err := s.openCtrlConn(); err != nil {
+		s.Close()
+		return err
+	}
+	// once registered, a Close from the client aborts the handshake
+	if err := s.client.acquire(s); err != nil {
+		s.Close()
 		return err
 	}
 	if err := s.requestMuxSession(cmd); err != nil {
+		s.Close()
 		return err
 	}
 
-	s.exitStatus = make(chan error, 1)
-	s.aborted = make(chan bool, 1)
-	go func() {
-		s.exitStatus <- s.wait()
-	}()
-
-	return s.start()
+	err = s.start()
+	go s.withLabels("wait", func() {
+		err := s.wait()
+		close(s.exited)
+		s.exitStatus <- err
+	})
+	return err
 }
+
+// Close aborts the session and closes the control connection and
+// the local ends of the stdio pipes. It returns the errors of closing
+// them, joined with errors.Join; files that are already closed are
+// not reported. Close does not wait for the session's goroutines,
+// Wait does.
 func (s *Session) Close() error {
-	/*
-		XXX?
-			s.lmuxStdin.Close()
-			s.lmuxStdout.Close()
-			s.lmuxStderr.Close()
-
-			s.rmuxStdin.Close()
-			s.rmuxStdout.Close()
-			s.rmuxStderr.Close()
-	*/
-	if s.ctrlconn != nil {
-		s.ctrlconn.Close()
-	}
-	if s.lmuxStderr != nil {
-		s.lmuxStderr.Close()
-	}
-	if s.lmuxStdout != nil {
-		s.lmuxStdout.Close()
-	}
-	s.aborted <- true
+	s.tracef("session %d: closed", s.ctrlSessid)
+	return s.shutdown(StateAborted, ErrAborted)
+}
+
+// shutdown tears the session down, once, in a fixed order: Wait is
+// told, the stdin copier is stopped, the local ends of the stdio
+// pipes are closed, so the copy funcs finish, and then the control
+// connection, which ends the wait loop. reason is what a pending or
+// later Wait returns; the first shutdown decides it, e.g. ErrNoOutput
+// from the watchdog over a Close that came later.
+func (s *Session) shutdown(st SessionState, reason error) error {
+	// OnStateChange may call Close, so not inside the Once
+	s.setState(st)
+	s.closeOnce.Do(func() {
+		// before anything is closed, so Wait tells an exit caused
+		// by the teardown from a real one
+		s.abortErr = reason
+		if s.aborted != nil {
+			close(s.aborted)
+		}
+		s.client.release(s)
+		if s.stdinPipeWriter != nil {
+			s.stdinPipeWriter.Close()
+		}
+		var errs []error
+		for _, f := range []*os.File{s.lmuxStdin, s.lmuxStdout, s.lmuxStderr} {
+			if f != nil {
+				errs = append(errs, ignoreClosed(f.Close()))
+			}
+		}
+		if s.ctrlconn != nil {
+			errs = append(errs, ignoreClosed(s.ctrlconn.Close()))
+		}
+		s.closeErr = errors.Join(errs...)
+	})
+	return s.closeErr
+}
+
+// ignoreClosed drops the error of closing something twice.
+func ignoreClosed(err error) error {
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// ErrAborted is returned by Wait after the session was closed.
+var ErrAborted = errors.New("Session aborted")
+
+// ErrDrainTimeout is returned by Wait if copying the session's
+// stdio did not finish within DrainTimeout after the remote command
+// exited.
+var ErrDrainTimeout = errors.New("ssh: timeout draining session stdio")
+
+// ErrNoOutput is returned by Wait if the session was closed because
+// of FirstOutputTimeout.
+var ErrNoOutput = errors.New("ssh: no output from remote command")
+
+// ErrStdoutEOF is returned by Wait if the session was closed because
+// of StdoutEOFTimeout.
+var ErrStdoutEOF = errors.New("ssh: no exit status after EOF on stdout")
+
+// ErrDetached is returned by Wait after the session was detached.
+var ErrDetached = errors.New("ssh: session detached")
+
+// Detach disconnects a started session from the master without
+// waiting for the remote command, e.g. to fire off a long job.
+// The control connection and the local ends of the stdio pipes are
+// closed, and a pending or later Wait returns ErrDetached.
+//
+// What survives: the master keeps running (see ControlPersist in
+// ssh_config(5)) and keeps the remote session open until the command
+// exits, but it closes the command's stdin and discards its output.
+// Depending on the server, the command may also receive SIGHUP,
+// particularly when a pty was requested. Commands meant to outlive
+// the session should therefore detach from their stdio themselves,
+// for example "nohup job >job.log 2>&1 </dev/null &" or via setsid(1).
+func (s *Session) Detach() error {
+	if !s.started {
+		return errors.New("ssh: session not started")
+	}
+	s.tracef("session %d: detached", s.ctrlSessid)
+	s.shutdown(StateDetached, ErrDetached)
 	return nil
 }
 
+// WindowSize is the size of a terminal in characters.
+type WindowSize struct {
+	Rows, Cols int
+}
+
 // RequestPty requests the association of a pty with the session on the remote host.
+// Its modes and size are taken from the local terminal, see
+// TerminalModes and WindowSize.
+// If the server cannot allocate one, Wait returns a *TTYAllocError,
+// unless PtyFallback is set.
 func (s *Session) RequestPty(term string) error {
 	s.term = term
 	return nil
 }
 
-// Shell starts a login shell on the remote host. A Session only
-// accepts one call to Run, Start, Shell, Output, or CombinedOutput.
-func (s *Session) Shell() error {
+// Setenv sets an environment variable that will be applied to any
+// command executed by Shell or Run.
+//
+// An OpenSSH master only forwards variables matching its SendEnv or
+// SetEnv options (see ssh_config(5)), and the server only accepts
+// those matching its AcceptEnv option; others are silently dropped.
+func (s *Session) Setenv(name, value string) error {
 	if s.started {
-		return errors.New("ssh: session already started")
+		return errors.New("ssh: Setenv after process started")
 	}
-	if err := s.openCtrlConn(); err != nil {
-		return err
-	}
-	if err := s.requestMuxSession(""); err != nil {
-		return err
+	if name == "" || strings.Contains(name, "=") {
+		return fmt.Errorf("ssh: invalid environment variable name %q", name)
 	}
+	s.env = append(s.env, name+"="+value)
+	return nil
+}
 
-	s.exitStatus = make(chan error, 1)
-	go func() {
-		s.exitStatus <- s.wait()
-	}()
+// Clone returns a new, unstarted Session with the same configuration
+// as s: control path, label, pty request, environment and the
+// exported fields. The io values are shared, not copied. Pipes
+// requested via StdinPipe, StdoutPipe or StderrPipe are not carried
+// over.
+//
+// Clone may be called on a session in any state, which makes it
+// possible to use an unstarted Session as a template for repeated
+// runs.
+func (s *Session) Clone() *Session {
+	return &Session{
+		Stdin:              s.Stdin,
+		Stdout:             s.Stdout,
+		Stderr:             s.Stderr,
+		TTYStdin:           s.TTYStdin,
+		StdinFile:          s.StdinFile,
+		StdoutFile:         s.StdoutFile,
+		StderrFile:         s.StderrFile,
+		KeepStdinOpen:      s.KeepStdinOpen,
+		DrainTimeout:       s.DrainTimeout,
+		ReadBufferSize:     s.ReadBufferSize,
+		WriteBufferSize:    s.WriteBufferSize,
+		LowLatency:         s.LowLatency,
+		FirstOutputTimeout: s.FirstOutputTimeout,
+		StdoutEOFTimeout:   s.StdoutEOFTimeout,
+		ControlTimeout:     s.ControlTimeout,
+		Strict:             s.Strict,
+		VerifyPeer:         s.VerifyPeer,
+		TerminalModes:      s.TerminalModes,
+		WindowSize:         s.WindowSize,
+		PtyFallback:        s.PtyFallback,
+		OnPtyFallback:      s.OnPtyFallback,
+		Trace:              s.Trace,
+		OnStateChange:      s.OnStateChange,
+		Events:             s.Events,
+		Redactor:           s.Redactor,
+		label:              s.label,
+		client:             s.client,
+		sshctlpath:         s.sshctlpath,
+		dial:               s.dial,
+		term:               s.term,
+		env:                append([]string(nil), s.env...),
+	}
+}
 
-	return s.start()
+// Shell starts a login shell on the remote host. A Session only
+// accepts one call to Run, Start, Shell, Output, or CombinedOutput.
+func (s *Session) Shell() error {
+	return s.labelErr(s.startSession(""))
 }
 
 // Run runs cmd on the remote host. Typically, the remote
@@ -210,6 +586,22 @@ func (s *Session) CombinedOutput(cmd string) ([]byte, error) {
 	return b.b.Bytes(), err
 }
 
+// OutputAll runs cmd on the remote host and returns its standard
+// output and standard error separately.
+func (s *Session) OutputAll(cmd string) (stdout, stderr []byte, err error) {
+	if s.Stdout != nil {
+		return nil, nil, errors.New("ssh: Stdout already set")
+	}
+	if s.Stderr != nil {
+		return nil, nil, errors.New("ssh: Stderr already set")
+	}
+	var outb, errb bytes.Buffer
+	s.Stdout = &outb
+	s.Stderr = &errb
+	err = s.Run(cmd)
+	return outb.Bytes(), errb.Bytes(), err
+}
+
 // Wait waits for the remote command to exit.
 //
 // The returned error is nil if the command runs, has no problems
@@ -219,33 +611,89 @@ func (s *Session) CombinedOutput(cmd string) ([]byte, error) {
 // If the remote server does not send an exit status, an error of type
 // *ExitMissingError is returned. If the command completes
 // unsuccessfully or is interrupted by a signal, the error is of type
-// *ExitError. Other error types may be returned for I/O problems.
-func (s *Session) Wait() error {
+// *ExitError. Problems copying stdin, stdout or stderr are reported
+// as a *StreamError, or several joined with errors.Join, if the
+// command itself succeeded. Other error types may be returned for I/O
+// problems.
+func (s *Session) Wait() (err error) {
 	if !s.started {
-		return errors.New("ssh: session not started")
+		return s.labelErr(errors.New("ssh: session not started"))
 	}
+	defer func() {
+		s.recordStats(err)
+		s.client.release(s)
+		if s.bytesReported != nil {
+			// no SessionBytes after SessionExited
+			<-s.bytesReported
+		}
+		s.emit(SessionExited, err)
+	}()
 	var waitErr error
-	// s.ctrlconn.Close() does not abort a blocking s.ctrlconn.Read()
-	// Selecting on an separate channel as a workaround
 	select {
 	case waitErr = <-s.exitStatus:
 	case <-s.aborted:
-		waitErr = errors.New("Session aborted")
+	}
+	// a shutdown wins even if the exit status came in as well
+	aborted := false
+	select {
+	case <-s.aborted:
+		aborted = true
+		waitErr = s.abortErr
+		// the closed control connection ends the wait loop
+		<-s.exited
+	default:
+	}
+	if s.watchdog != nil {
+		s.watchdog.Stop()
 	}
 
 	if s.stdinPipeWriter != nil {
 		s.stdinPipeWriter.Close()
 	}
-	var copyError error
+	if s.KeepStdinOpen && !s.stdinpipe {
+		s.lmuxStdin.Close()
+	}
+	if s.tty != nil {
+		if s.ttyState != nil {
+			terminal.Restore(int(s.tty.Fd()), s.ttyState)
+		}
+		if s.restoreModes != nil {
+			s.restoreModes()
+		}
+		s.tty.Close()
+	}
+	var copyErrs []error
+	var drained <-chan time.Time
+	if s.DrainTimeout > 0 {
+		timer := time.NewTimer(s.DrainTimeout)
+		defer timer.Stop()
+		drained = timer.C
+	}
 	for _ = range s.copyFuncs {
-		if err := <-s.errors; err != nil && copyError == nil {
-			copyError = err
+		select {
+		case err := <-s.errors:
+			if err != nil {
+				copyErrs = append(copyErrs, err)
+			}
+		case <-drained:
+			// unblock the copying still reading from the master
+			for _, f := range []*os.File{s.lmuxStdin, s.lmuxStdout, s.lmuxStderr} {
+				if f != nil {
+					f.Close()
+				}
+			}
+			return s.labelErr(errors.Join(waitErr, ErrDrainTimeout))
 		}
 	}
-	if waitErr != nil {
-		return waitErr
+	if waitErr == nil && len(copyErrs) == 1 {
+		waitErr = copyErrs[0]
+	} else if waitErr == nil {
+		waitErr = errors.Join(copyErrs...)
 	}
-	return copyError
+	if s.ttyAllocFailed && !aborted && !s.PtyFallback {
+		waitErr = &TTYAllocError{waitErr}
+	}
+	return s.labelErr(waitErr)
 }
 
 func (s *Session) start() error {
@@ -256,12 +704,26 @@ func (s *Session) start() error {
 		setupFd(s)
 	}
 
+	if s.FirstOutputTimeout > 0 {
+		s.watchdog = time.AfterFunc(s.FirstOutputTimeout, s.firstOutputExpired)
+	}
+	if s.ControlTimeout > 0 {
+		s.heard()
+		go s.withLabels("control", s.watchControl)
+	}
+
 	s.errors = make(chan error, len(s.copyFuncs))
 	for _, fn := range s.copyFuncs {
 		go func(fn func() error) {
 			s.errors <- fn()
 		}(fn)
 	}
+	s.setState(StateRunning)
+	s.emit(SessionStarted, nil)
+	if s.Events != nil {
+		s.bytesReported = make(chan struct{})
+		go s.withLabels("events", s.reportBytes)
+	}
 	return nil
 }
 
@@ -274,18 +736,22 @@ func (s *Session) stdin() {
 		stdin = new(bytes.Buffer)
 	} else {
 		r, w := io.Pipe()
-		go func() {
+		go s.withLabels("stdin", func() {
 			_, err := io.Copy(w, s.Stdin)
 			w.CloseWithError(err)
-		}()
+		})
 		stdin, s.stdinPipeWriter = r, w
 	}
-	s.copyFuncs = append(s.copyFuncs, func() error {
-		_, err := io.Copy(s.lmuxStdin, stdin)
+	s.addCopy("stdin", func() (int64, error) {
+		n, err := copyChunked(counted(s.lmuxStdin, &s.stdinBytes), stdin, s.bufferSize(s.WriteBufferSize))
+		if s.KeepStdinOpen {
+			// closed by Wait, possibly while still writing
+			return n, ignoreClosed(err)
+		}
 		if err1 := s.lmuxStdin.Close(); err == nil && err1 != io.EOF {
 			err = err1
 		}
-		return err
+		return n, err
 	})
 }
 
@@ -296,9 +762,12 @@ func (s *Session) stdout() {
 	if s.Stdout == nil {
 		s.Stdout = ioutil.Discard
 	}
-	s.copyFuncs = append(s.copyFuncs, func() error {
-		_, err := io.Copy(s.Stdout, s.lmuxStdout)
-		return err
+	s.addCopy("stdout", func() (int64, error) {
+		n, err := copyChunked(counted(s.watched(s.flushed(s.Stdout)), &s.stdoutBytes), s.lmuxStdout, s.bufferSize(s.ReadBufferSize))
+		if err == nil && s.StdoutEOFTimeout > 0 {
+			s.awaitExit()
+		}
+		return n, err
 	})
 }
 func (s *Session) stderr() {
@@ -308,16 +777,133 @@ func (s *Session) stderr() {
 	if s.Stderr == nil {
 		s.Stderr = ioutil.Discard
 	}
-	s.copyFuncs = append(s.copyFuncs, func() error {
-		_, err := io.Copy(s.Stderr, s.lmuxStderr)
+	s.addCopy("stderr", func() (int64, error) {
+		return copyChunked(counted(s.watched(s.flushed(s.Stderr)), &s.stderrBytes), s.lmuxStderr, s.bufferSize(s.ReadBufferSize))
+	})
+}
+
+// addCopy registers fn, copying the stream named task, to run in a
+// goroutine of its own once the session is started; Wait collects
+// its error as a *StreamError.
+func (s *Session) addCopy(task string, fn func() (int64, error)) {
+	s.copyFuncs = append(s.copyFuncs, func() (err error) {
+		var n int64
+		s.withLabels(task, func() { n, err = fn() })
+		if err != nil {
+			dir := "from"
+			if task == "stdin" {
+				dir = "to"
+			}
+			err = &StreamError{Stream: task, Dir: dir, Path: s.sshctlpath, N: n, Err: err}
+		}
 		return err
 	})
 }
 
+// withLabels runs fn with pprof labels attributing its work to the
+// session: "sshctl.control_path", "sshctl.label", if set, and
+// "sshctl.task", e.g. "stdout" or "wait". The labels show up in CPU
+// and goroutine profiles, and goroutines started by fn inherit them.
+func (s *Session) withLabels(task string, fn func()) {
+	labels := []string{"sshctl.control_path", s.sshctlpath, "sshctl.task", task}
+	if s.label != "" {
+		labels = append(labels, "sshctl.label", s.label)
+	}
+	pprof.Do(context.Background(), pprof.Labels(labels...), func(context.Context) { fn() })
+}
+
+// copyChunked is io.Copy moving at most size bytes per Read and
+// Write. A size of zero uses io.Copy's defaults.
+func copyChunked(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	// hide ReaderFrom and WriterTo, which bring their own buffers
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
+}
+
+// lowLatencyBufferSize is the default buffer size in LowLatency mode.
+const lowLatencyBufferSize = 512
+
+func (s *Session) bufferSize(size int) int {
+	if size == 0 && s.LowLatency {
+		return lowLatencyBufferSize
+	}
+	return size
+}
+
+// flushed returns w, wrapped to be flushed after every write in
+// LowLatency mode.
+func (s *Session) flushed(w io.Writer) io.Writer {
+	if f, ok := w.(interface{ Flush() error }); ok && s.LowLatency {
+		return &flushWriter{w, f}
+	}
+	return w
+}
+
+type flushWriter struct {
+	io.Writer
+	f interface{ Flush() error }
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil {
+		err = w.f.Flush()
+	}
+	return n, err
+}
+
+// counted returns w, wrapped to add the bytes written to *n as they
+// go, so they can be watched while the session runs.
+func counted(w io.Writer, n *int64) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		m, err := w.Write(p)
+		atomic.AddInt64(n, int64(m))
+		return m, err
+	})
+}
+
+// watched returns w, wrapped to report output to the
+// FirstOutputTimeout watchdog.
+func (s *Session) watched(w io.Writer) io.Writer {
+	if s.FirstOutputTimeout <= 0 {
+		return w
+	}
+	return writerFunc(func(p []byte) (int, error) {
+		atomic.StoreInt32(&s.sawOutput, 1)
+		return w.Write(p)
+	})
+}
+
+func (s *Session) firstOutputExpired() {
+	if atomic.LoadInt32(&s.sawOutput) != 0 || s.State().final() {
+		return
+	}
+	s.tracef("session %d: no output after %v", s.ctrlSessid, s.FirstOutputTimeout)
+	s.shutdown(StateAborted, ErrNoOutput)
+}
+
+// awaitExit closes the session unless the master reports the exit
+// within StdoutEOFTimeout.
+func (s *Session) awaitExit() {
+	timer := time.NewTimer(s.StdoutEOFTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.exited:
+	case <-timer.C:
+		if s.State().final() {
+			return
+		}
+		s.tracef("session %d: no exit status %v after EOF on stdout", s.ctrlSessid, s.StdoutEOFTimeout)
+		s.shutdown(StateAborted, ErrStdoutEOF)
+	}
+}
+
 // StdinPipe returns a pipe that will be connected to the
 // remote command's standard input when the command starts.
 func (s *Session) StdinPipe() (io.WriteCloser, error) {
-	if s.Stdin != nil {
+	if s.Stdin != nil || s.StdinFile != nil {
 		return nil, errors.New("ssh: Stdin already set")
 	}
 	if s.started {
@@ -335,7 +921,7 @@ func (s *Session) StdinPipe() (io.WriteCloser, error) {
 // not serviced fast enough it may eventually cause the
 // remote command to block.
 func (s *Session) StdoutPipe() (io.Reader, error) {
-	if s.Stdout != nil {
+	if s.Stdout != nil || s.StdoutFile != nil {
 		return nil, errors.New("ssh: Stdout already set")
 	}
 	if s.started {
@@ -353,7 +939,7 @@ func (s *Session) StdoutPipe() (io.Reader, error) {
 // not serviced fast enough it may eventually cause the
 // remote command to block.
 func (s *Session) StderrPipe() (io.Reader, error) {
-	if s.Stderr != nil {
+	if s.Stderr != nil || s.StderrFile != nil {
 		return nil, errors.New("ssh: Stderr already set")
 	}
 	if s.started {
@@ -373,6 +959,44 @@ func (e *ExitError) Error() string {
 	return e.Waitmsg.String()
 }
 
+// StreamError reports a failure copying one of the session's streams,
+// e.g. a Stdout whose Write failed.
+type StreamError struct {
+	Stream string // "stdin", "stdout" or "stderr"
+	Dir    string // "to" the master for stdin, "from" it otherwise
+	Path   string // the control socket
+	N      int64  // bytes copied before the failure
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("ssh: copying %s %s master %s failed after %d bytes: %v",
+		e.Stream, e.Dir, e.Path, e.N, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// TTYAllocError is returned by Wait and Run if a pty was requested
+// with RequestPty but the server could not allocate one. Like ssh(1),
+// the session carries on without a pty; Err is what Wait would have
+// returned otherwise, nil or e.g. an *ExitError.
+type TTYAllocError struct {
+	Err error
+}
+
+func (e *TTYAllocError) Error() string {
+	if e.Err == nil {
+		return "ssh: pseudo-terminal allocation failed"
+	}
+	return "ssh: pseudo-terminal allocation failed: " + e.Err.Error()
+}
+
+func (e *TTYAllocError) Unwrap() error {
+	return e.Err
+}
+
 // Waitmsg stores the information about an exited remote command
 // as reported by Wait.
 type Waitmsg struct {
@@ -393,12 +1017,24 @@ func (w Waitmsg) Signal() string {
 	return w.signal
 }
 
-// Msg returns the exit message given by the remote command
+// Msg returns a message from the master about the session, e.g. a
+// failed pseudo-terminal allocation or the reason of a failure reply.
+// The mux protocol has no way to pass on the remote command's own
+// exit message.
 func (w Waitmsg) Msg() string {
 	return w.msg
 }
 
-// Lang returns the language tag. See RFC 3066
+// ExitMsg returns the message of the master about the session, see
+// Waitmsg.Msg, also if the command succeeded and Wait returned nil.
+// It is valid once Wait has returned.
+func (s *Session) ExitMsg() string {
+	return s.exitMsg
+}
+
+// Lang returns the language tag of Msg. The mux protocol carries
+// none, so it is always empty; it is there to match the Waitmsg of
+// golang.org/x/crypto/ssh.
 func (w Waitmsg) Lang() string {
 	return w.lang
 }
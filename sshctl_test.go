@@ -8,9 +8,21 @@ package sshctl
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime/pprof"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/mpfz0r/sshctl/sshctltest"
 )
 
 const TestString = "AABBCCDDEEFFGG"
@@ -104,6 +116,81 @@ func TestSessionClose(t *testing.T) {
 	}
 }
 
+func TestConcurrentTeardown(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewClient(g.ctrlSock).NewSession()
+	sess.Stdout = ioutil.Discard
+	sess.FirstOutputTimeout = 50 * time.Millisecond
+	if err := sess.Start("sleep 10"); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan error)
+	go func() { ch <- sess.Wait() }()
+	// the watchdog tears the session down first, Close and Detach
+	// racing it afterwards must neither panic nor change the outcome
+	time.Sleep(200 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); sess.Close() }()
+		go func() { defer wg.Done(); sess.Detach() }()
+	}
+	wg.Wait()
+	select {
+	case err := <-ch:
+		if err != ErrNoOutput {
+			t.Fatalf("expected ErrNoOutput, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return")
+	}
+}
+
+// limitedWriter takes n bytes and then fails with err.
+type limitedWriter struct {
+	n   int
+	err error
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, w.err
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestStreamError(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	full := errors.New("disk full")
+	sess := NewSession(g.ctrlSock)
+	sess.Stdout = &limitedWriter{3, full}
+	sess.Stderr = &limitedWriter{0, full}
+	err := sess.Run("echo -n hello; echo -n oops >&2")
+	var se *StreamError
+	if !errors.As(err, &se) || !errors.Is(err, full) {
+		t.Fatalf("expected a *StreamError, got %v", err)
+	}
+	got := map[string]int64{}
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		if errors.As(e, &se) {
+			got[se.Stream] = se.N
+			if se.Dir != "from" || se.Path != g.ctrlSock {
+				t.Fatalf("expected the stream from %s, got %+v", g.ctrlSock, se)
+			}
+		}
+	}
+	if want := map[string]int64{"stdout": 3, "stderr": 0}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v (%v)", want, got, err)
+	}
+}
+
 func TestCombinedOutput(t *testing.T) {
 	server := newServer(t)
 	defer server.Shutdown()
@@ -119,3 +206,211 @@ func TestCombinedOutput(t *testing.T) {
 	}
 
 }
+
+func TestClone(t *testing.T) {
+	server := newServer(t)
+	defer server.Shutdown()
+	sshmux := server.Run()
+
+	var outb bytes.Buffer
+	tmpl := NewSession(sshmux)
+	tmpl.Stdout = &outb
+	for i := 0; i < 3; i++ {
+		sess := tmpl.Clone()
+		if err := sess.Run("echo -n " + TestString); err != nil {
+			t.Fatalf("Got err: %s", err)
+		}
+	}
+	if outb.String() != TestString+TestString+TestString {
+		t.Fatalf("expected response \"%s\" but got \"%s\"", TestString+TestString+TestString, outb.String())
+	}
+}
+
+func TestStdioFiles(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	local, remote := unixPair(t)
+	defer local.Close()
+	in, err := remote.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	sess := NewSession(g.ctrlSock)
+	sess.StdinFile, sess.StdoutFile = in, out
+	if err := sess.Start("cat"); err != nil {
+		t.Fatal(err)
+	}
+	// the master holds its own copies now
+	in.Close()
+	local.Write([]byte(TestString))
+	local.CloseWrite()
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if _, err := out.Write(nil); err != nil {
+		t.Fatalf("StdoutFile was closed: %v", err)
+	}
+	if data, _ := os.ReadFile(out.Name()); string(data) != TestString {
+		t.Fatalf("expected response \"%s\" but got \"%s\"", TestString, data)
+	}
+
+	sess = NewSession(g.ctrlSock)
+	sess.Stdout, sess.StdoutFile = new(bytes.Buffer), out
+	if err := sess.Run("true"); err == nil || !strings.Contains(err.Error(), "Stdout already set") {
+		t.Fatalf("expected Stdout already set, got %v", err)
+	}
+	sess = NewSession(g.ctrlSock)
+	sess.StderrFile = out
+	if _, err := sess.StderrPipe(); err == nil {
+		t.Fatal("expected StderrPipe to fail with StderrFile set")
+	}
+}
+
+func TestDevNullStdio(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock)
+	if err := sess.Start("cat; echo out; echo err >&2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sess.copyFuncs); n != 0 {
+		t.Errorf("expected no copying for unused streams, got %d copy funcs", n)
+	}
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+
+	// the watchdog needs to see the output
+	sess = NewSession(g.ctrlSock)
+	sess.FirstOutputTimeout = time.Minute
+	if err := sess.Start("echo out"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sess.copyFuncs); n != 2 {
+		t.Errorf("expected stdout and stderr copied, got %d copy funcs", n)
+	}
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+}
+
+func TestKeepStdinOpen(t *testing.T) {
+	if _, err := exec.LookPath("timeout"); err != nil {
+		t.Skip("timeout(1) not found")
+	}
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	for _, keep := range []bool{false, true} {
+		for _, stdin := range []io.Reader{strings.NewReader(TestString), nil} {
+			sess := NewSession(g.ctrlSock)
+			sess.Stdin, sess.KeepStdinOpen = stdin, keep
+			// cat only times out if stdin stays open
+			out, err := sess.Output("timeout 1 cat; echo $?")
+			if err != nil {
+				t.Fatalf("Got err: %s", err)
+			}
+			want := "0\n"
+			if keep {
+				want = "124\n"
+			}
+			if stdin != nil {
+				want = TestString + want
+			}
+			if string(out) != want {
+				t.Errorf("keep %v, stdin %v: expected %q, got %q", keep, stdin != nil, want, out)
+			}
+		}
+	}
+}
+
+func TestPprofLabels(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	r, w := io.Pipe()
+	defer w.Close()
+	sess := NewSession(g.ctrlSock).WithLabel("job")
+	sess.Stdin, sess.Stdout = r, ioutil.Discard
+	if err := sess.Start("cat"); err != nil {
+		t.Fatal(err)
+	}
+	// the goroutines may not have run yet
+	for _, task := range []string{"stdin", "stdout", "wait"} {
+		want := fmt.Sprintf(`"sshctl.control_path":%q, "sshctl.label":"job", "sshctl.task":%q`, g.ctrlSock, task)
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			var b bytes.Buffer
+			pprof.Lookup("goroutine").WriteTo(&b, 1)
+			if strings.Contains(b.String(), want) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected labels %s in goroutine profile", want)
+			}
+		}
+	}
+	w.Close()
+	if err := sess.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoLeaks(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	sshctltest.VerifyNoLeaks(t)
+
+	// Start failing after the file descriptors were passed
+	fds := openFds(t)
+	sess := NewSession(g.ctrlSock)
+	sess.Stdin = new(bytes.Buffer)
+	sess.RequestPty("xterm")
+	stdout, _ := sess.StdoutPipe()
+	if err := sess.Start("true"); err == nil {
+		t.Fatal("expected MakeRaw to fail without a terminal")
+	}
+	if _, err := stdout.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected StdoutPipe to be closed")
+	}
+	// the in-process master lets go of its copies asynchronously
+	for deadline := time.Now().Add(5 * time.Second); openFds(t) != fds; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d open files after failed Start, got %d", fds, openFds(t))
+		}
+	}
+
+	// closed without Wait
+	r, w := io.Pipe()
+	defer w.Close()
+	sess = NewSession(g.ctrlSock)
+	sess.Stdin, sess.Stdout = r, new(bytes.Buffer)
+	if err := sess.Start("sleep 10"); err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	// abandoned, ends with the command
+	sess = NewSession(g.ctrlSock)
+	sess.Stdout = new(bytes.Buffer)
+	if err := sess.Start("echo " + TestString); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openFds returns the number of open file descriptors.
+func openFds(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd")
+	}
+	return len(fds)
+}
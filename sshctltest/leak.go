@@ -0,0 +1,97 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sshctltest provides helpers for testing programs that use
+// package sshctl.
+package sshctltest
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leakTimeout is how long VerifyNoLeaks waits for goroutines to end,
+// since they finish shortly after Wait or Close returned.
+const leakTimeout = 2 * time.Second
+
+// VerifyNoLeaks fails t if goroutines of sshctl sessions started
+// after the call are still running when the test and its cleanups
+// registered before have finished. Call it first thing in a test:
+//
+//	func TestDeploy(t *testing.T) {
+//		sshctltest.VerifyNoLeaks(t)
+//		...
+//	}
+//
+// A session's goroutines end once it was waited for, closed or
+// detached; a session that was just abandoned keeps them until the
+// remote command exits. A goroutine reading a Stdin that never
+// returns from Read is reported as well.
+//
+// Session goroutines are told apart by their pprof labels, see
+// Session.WithLabel, so tests running sessions in parallel with t
+// may be blamed for each other's leaks.
+func VerifyNoLeaks(t testing.TB) {
+	t.Helper()
+	before := sessionGoroutines()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(leakTimeout)
+		for {
+			leaked := leakedGoroutines(before, sessionGoroutines())
+			if len(leaked) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("sshctltest: leaked session goroutines:\n\n%s", strings.Join(leaked, "\n\n"))
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// sessionGoroutines returns the number of goroutines by stack, from
+// the records of the goroutine profile labeled by package sshctl.
+func sessionGoroutines() map[string]int {
+	var b bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&b, 1)
+	// skip the header, "goroutine profile: total 42"
+	_, profile, _ := strings.Cut(b.String(), "\n")
+	counts := make(map[string]int)
+	for _, r := range strings.Split(profile, "\n\n") {
+		if !strings.Contains(r, `"sshctl.task":`) {
+			continue
+		}
+		// e.g. "2 @ 0x49262a 0x41e90e ..."
+		i := strings.Index(r, " @ ")
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(r[:i])
+		if err != nil {
+			continue
+		}
+		counts[strings.TrimSpace(r[i+1:])] += n
+	}
+	return counts
+}
+
+// leakedGoroutines describes the goroutines in after that are not in
+// before.
+func leakedGoroutines(before, after map[string]int) []string {
+	var leaked []string
+	for stack, n := range after {
+		if n -= before[stack]; n > 0 {
+			leaked = append(leaked, fmt.Sprintf("%d %s", n, stack))
+		}
+	}
+	sort.Strings(leaked)
+	return leaked
+}
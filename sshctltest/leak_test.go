@@ -0,0 +1,72 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctltest
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"strings"
+	"testing"
+)
+
+// recorder is a testing.TB collecting errors and cleanups.
+type recorder struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (r *recorder) Helper()          {}
+func (r *recorder) Cleanup(f func()) { r.cleanups = append(r.cleanups, f) }
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+// fakeSession starts a goroutine labeled like those of a session,
+// running until the returned func is called.
+func fakeSession(task string) func() {
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	labels := pprof.Labels("sshctl.control_path", "/tmp/ctrl.sock", "sshctl.task", task)
+	go pprof.Do(context.Background(), labels, func(context.Context) {
+		close(started)
+		<-stop
+	})
+	<-started
+	return func() { close(stop) }
+}
+
+func TestVerifyNoLeaks(t *testing.T) {
+	// running before the check started
+	stopOld := fakeSession("wait")
+	defer stopOld()
+
+	r := &recorder{TB: t}
+	VerifyNoLeaks(r)
+	stop := fakeSession("stdout")
+	stop()
+	r.finish()
+	if len(r.errors) != 0 {
+		t.Fatalf("expected no leaks, got %q", r.errors)
+	}
+
+	r = &recorder{TB: t}
+	VerifyNoLeaks(r)
+	stop = fakeSession("stdin")
+	defer stop()
+	r.finish()
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], `"sshctl.task":"stdin"`) ||
+		strings.Contains(r.errors[0], `"sshctl.task":"wait"`) {
+		t.Fatalf("expected the stdin goroutine to be reported, got %q", r.errors)
+	}
+}
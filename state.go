@@ -0,0 +1,68 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"sync/atomic"
+)
+
+// SessionState is the lifecycle state of a Session.
+type SessionState int32
+
+const (
+	StateNew       SessionState = iota // not started yet
+	StateDialing                       // connecting to the control socket
+	StateHelloDone                     // mux handshake completed
+	StateOpened                        // master confirmed the new session
+	StateRunning                       // stdio copying in progress
+	StateExited                        // remote command exited or master hung up
+	StateAborted                       // Start failed or Close was called
+	StateDetached                      // Detach was called
+)
+
+var stateNames = []string{
+	StateNew:       "new",
+	StateDialing:   "dialing",
+	StateHelloDone: "hello done",
+	StateOpened:    "opened",
+	StateRunning:   "running",
+	StateExited:    "exited",
+	StateAborted:   "aborted",
+	StateDetached:  "detached",
+}
+
+func (st SessionState) String() string {
+	if st < 0 || int(st) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[st]
+}
+
+func (st SessionState) final() bool {
+	return st >= StateExited
+}
+
+// State returns the current state of the session. It is safe to call
+// from any goroutine, e.g. a supervisor reporting stuck sessions.
+func (s *Session) State() SessionState {
+	return SessionState(atomic.LoadInt32(&s.state))
+}
+
+// setState moves the session to st. Final states are never left.
+func (s *Session) setState(st SessionState) {
+	for {
+		old := SessionState(atomic.LoadInt32(&s.state))
+		if old == st || old.final() {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&s.state, int32(old), int32(st)) {
+			s.tracef("state %s -> %s", old, st)
+			if s.OnStateChange != nil {
+				s.OnStateChange(old, st)
+			}
+			return
+		}
+	}
+}
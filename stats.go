@@ -0,0 +1,60 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats describes a completed session, in the spirit of
+// os.ProcessState.
+type SessionStats struct {
+	Duration time.Duration // from Start until Wait returned
+	OpenTime time.Duration // from Start until the master opened the session
+
+	// Bytes copied from Stdin and to Stdout and Stderr. Data passed
+	// through an *os.File or the pipes of StdinPipe, StdoutPipe and
+	// StderrPipe bypasses the session and is not counted.
+	StdinBytes  int64
+	StdoutBytes int64
+	StderrBytes int64
+
+	// ExitStatus is the remote command's exit status, or -1 if it
+	// is unknown, e.g. because it was killed by a signal or the
+	// session was closed.
+	ExitStatus int
+}
+
+// Stats returns statistics about the session once Wait returned,
+// and nil before.
+func (s *Session) Stats() *SessionStats {
+	return s.stats
+}
+
+func (s *Session) recordStats(err error) {
+	st := &SessionStats{
+		Duration:    time.Since(s.startTime),
+		StdinBytes:  atomic.LoadInt64(&s.stdinBytes),
+		StdoutBytes: atomic.LoadInt64(&s.stdoutBytes),
+		StderrBytes: atomic.LoadInt64(&s.stderrBytes),
+		ExitStatus:  -1,
+	}
+	if !s.openTime.IsZero() {
+		st.OpenTime = s.openTime.Sub(s.startTime)
+	}
+	var te *TTYAllocError
+	if errors.As(err, &te) {
+		err = te.Err
+	}
+	var ee *ExitError
+	if err == nil {
+		st.ExitStatus = 0
+	} else if errors.As(err, &ee) && ee.Signal() == "" {
+		st.ExitStatus = ee.ExitStatus()
+	}
+	s.stats = st
+}
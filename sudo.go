@@ -0,0 +1,41 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// RunSudo runs cmd through "sudo -S" on the remote host, feeding the
+// password stored under key in p to sudo's prompt. Session.Stdin, if
+// set, follows the password line. The password is registered with
+// the session's Redactor.
+//
+// Cached sudo credentials are ignored (-k), so sudo always consumes
+// the password line. Do not use RunSudo with NOPASSWD rules: sudo
+// would not prompt and the password would reach cmd's stdin instead.
+func (s *Session) RunSudo(cmd string, p SecretProvider, key string) error {
+	password, err := p.Secret(key)
+	if err != nil {
+		return err
+	}
+	s.addSecret(password)
+	stdin := s.Stdin
+	if stdin == nil {
+		stdin = new(bytes.Buffer)
+	}
+	s.Stdin = io.MultiReader(strings.NewReader(password+"\n"), stdin)
+	return s.Run("sudo -S -k -p '' -- sh -c " + shellQuote(cmd))
+}
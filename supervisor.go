@@ -0,0 +1,190 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RestartPolicy decides whether a Supervisor restarts its command.
+type RestartPolicy int
+
+const (
+	RestartAlways    RestartPolicy = iota // restart after every exit
+	RestartOnFailure                      // restart unless the command exited with status 0
+	RestartNever                          // run the command once
+)
+
+// SupervisorEventType tells what happened to a supervised command.
+type SupervisorEventType int
+
+const (
+	EventStarted    SupervisorEventType = iota // the command was started
+	EventExited                                // the command exited, Err tells how
+	EventRestarting                            // a restart is scheduled after Delay
+	EventStopped                               // the supervisor gave up or was cancelled
+)
+
+var supervisorEventNames = []string{
+	EventStarted:    "started",
+	EventExited:     "exited",
+	EventRestarting: "restarting",
+	EventStopped:    "stopped",
+}
+
+func (t SupervisorEventType) String() string {
+	if t < 0 || int(t) >= len(supervisorEventNames) {
+		return "unknown"
+	}
+	return supervisorEventNames[t]
+}
+
+// SupervisorEvent reports a state change of a supervised command.
+type SupervisorEvent struct {
+	Type     SupervisorEventType
+	Time     time.Time
+	Restarts int
+	Delay    time.Duration // for EventRestarting
+	Err      error         // for EventExited and EventStopped
+}
+
+// SupervisorStatus is a snapshot of a Supervisor.
+type SupervisorStatus struct {
+	Running   bool
+	Restarts  int
+	LastStart time.Time
+	LastErr   error // result of the last run
+}
+
+// Supervisor keeps a long-lived remote command, e.g. an agent,
+// running over a master. Each run uses a fresh Clone of a template
+// session; exits are handled according to Policy with exponential
+// backoff between restarts.
+type Supervisor struct {
+	Policy RestartPolicy
+
+	// MaxRestarts limits the number of restarts. Zero means no limit.
+	MaxRestarts int
+
+	// MinBackoff and MaxBackoff bound the delay between restarts.
+	// If zero, 1 second and 1 minute are used. A run that lasted
+	// longer than MaxBackoff resets the delay to MinBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Events, if non-nil, receives an event for every state change.
+	// Events are dropped if the channel is not ready.
+	Events chan<- SupervisorEvent
+
+	tmpl *Session
+	cmd  string
+
+	mu     sync.Mutex
+	status SupervisorStatus
+}
+
+// NewSupervisor returns a Supervisor running cmd in clones of tmpl.
+func NewSupervisor(tmpl *Session, cmd string) *Supervisor {
+	return &Supervisor{tmpl: tmpl, cmd: cmd}
+}
+
+// Status returns the current state of the supervised command.
+func (sv *Supervisor) Status() SupervisorStatus {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.status
+}
+
+func (sv *Supervisor) emit(ev SupervisorEvent) {
+	if sv.Events == nil {
+		return
+	}
+	ev.Time = time.Now()
+	select {
+	case sv.Events <- ev:
+	default:
+	}
+}
+
+// Run supervises the command until the restart policy gives up or
+// ctx is done, in which case the running session is closed. It
+// returns the result of the last run, or ctx.Err().
+func (sv *Supervisor) Run(ctx context.Context) error {
+	minDelay := durationOr(sv.MinBackoff, time.Second)
+	maxDelay := durationOr(sv.MaxBackoff, time.Minute)
+	delay := minDelay
+	for {
+		started := time.Now()
+		err := sv.runOnce(ctx)
+		if ctx.Err() != nil {
+			sv.emit(SupervisorEvent{Type: EventStopped, Restarts: sv.Status().Restarts, Err: ctx.Err()})
+			return ctx.Err()
+		}
+
+		st := sv.Status()
+		if sv.Policy == RestartNever ||
+			(sv.Policy == RestartOnFailure && err == nil) ||
+			(sv.MaxRestarts > 0 && st.Restarts >= sv.MaxRestarts) {
+			sv.emit(SupervisorEvent{Type: EventStopped, Restarts: st.Restarts, Err: err})
+			return err
+		}
+
+		if time.Since(started) > maxDelay {
+			delay = minDelay
+		}
+		sv.emit(SupervisorEvent{Type: EventRestarting, Restarts: st.Restarts, Delay: delay})
+		select {
+		case <-ctx.Done():
+			sv.emit(SupervisorEvent{Type: EventStopped, Restarts: st.Restarts, Err: ctx.Err()})
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+		sv.mu.Lock()
+		sv.status.Restarts++
+		sv.mu.Unlock()
+	}
+}
+
+func (sv *Supervisor) runOnce(ctx context.Context) error {
+	sess := sv.tmpl.Clone()
+	if err := sess.Start(sv.cmd); err != nil {
+		sv.exited(err)
+		return err
+	}
+	sv.mu.Lock()
+	sv.status.Running = true
+	sv.status.LastStart = time.Now()
+	restarts := sv.status.Restarts
+	sv.mu.Unlock()
+	sv.emit(SupervisorEvent{Type: EventStarted, Restarts: restarts})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		sess.Close()
+		err = <-done
+	}
+	sv.exited(err)
+	return err
+}
+
+func (sv *Supervisor) exited(err error) {
+	sv.mu.Lock()
+	sv.status.Running = false
+	sv.status.LastErr = err
+	restarts := sv.status.Restarts
+	sv.mu.Unlock()
+	sv.emit(SupervisorEvent{Type: EventExited, Restarts: restarts, Err: err})
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSupervisorRestart(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	events := make(chan SupervisorEvent, 100)
+	sv := NewSupervisor(NewSession(g.ctrlSock), "exit 1")
+	sv.Policy = RestartOnFailure
+	sv.MaxRestarts = 2
+	sv.MinBackoff = time.Millisecond
+	sv.Events = events
+	err := sv.Run(context.Background())
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.ExitStatus() != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+	if st := sv.Status(); st.Restarts != 2 || st.Running {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	close(events)
+	var started int
+	var last SupervisorEvent
+	for ev := range events {
+		if ev.Type == EventStarted {
+			started++
+		}
+		last = ev
+	}
+	if started != 3 || last.Type != EventStopped {
+		t.Fatalf("expected 3 starts and a stop event, got %d starts, last %s", started, last.Type)
+	}
+}
+
+func TestSupervisorCancel(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sv := NewSupervisor(NewSession(g.ctrlSock), "sleep 10")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sv.Run(ctx) }()
+	for i := 0; i < 100 && !sv.Status().Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("cancel did not stop the supervisor")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyncOptions control SyncDir. The zero value compares files by size
+// and modification time and keeps extraneous remote files.
+type SyncOptions struct {
+	// Checksum compares files of equal size by their sha256
+	// checksums instead of their modification times.
+	Checksum bool
+
+	// Delete removes remote files that do not exist locally.
+	// Directories left empty are kept.
+	Delete bool
+
+	// DryRun only reports what would be transferred and deleted.
+	DryRun bool
+
+	// Workers is the number of files uploaded at once, see
+	// BatchOptions.
+	Workers int
+}
+
+// SyncResult reports what SyncDir did. Paths are relative to the
+// synchronized directories, with slashes as separators.
+type SyncResult struct {
+	Uploaded  []string
+	Deleted   []string
+	Unchanged int
+}
+
+// syncFile is a regular file of a synchronized tree.
+type syncFile struct {
+	size  int64
+	mtime int64  // in seconds
+	sum   string // sha256, for the Checksum option
+}
+
+// SyncDir makes remoteDir a copy of the regular files below
+// localDir, like "rsync -r --times", transferring only files that
+// are missing or differ on the remote host. The remote directory and
+// its subdirectories are created as needed, and uploaded files get
+// the local mode and modification time, so an unchanged file is
+// recognized by the next run. Symlinks and other special files are
+// skipped, as are file names containing newlines. opts may be nil.
+//
+// Files that fail to upload are reported in the returned error; the
+// result lists the ones that succeeded.
+func (c *Client) SyncDir(localDir, remoteDir string, opts *SyncOptions) (*SyncResult, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	local, err := localTree(localDir, opts.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := c.remoteTree(remoteDir, opts.Checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SyncResult{}
+	var upload []string
+	for name, l := range local {
+		r, ok := remote[name]
+		switch {
+		case !ok, r.size != l.size:
+		case opts.Checksum && r.sum == l.sum, !opts.Checksum && r.mtime == l.mtime:
+			res.Unchanged++
+			continue
+		}
+		upload = append(upload, name)
+	}
+	var remove []string
+	if opts.Delete {
+		for name := range remote {
+			if _, ok := local[name]; !ok {
+				remove = append(remove, name)
+			}
+		}
+	}
+	sort.Strings(upload)
+	sort.Strings(remove)
+	if opts.DryRun {
+		res.Uploaded, res.Deleted = upload, remove
+		return res, nil
+	}
+
+	var errs []error
+	if len(upload) > 0 {
+		if err := c.remoteMkdirs(remoteDir, upload); err != nil {
+			return res, err
+		}
+		transfers := make([]FileTransfer, len(upload))
+		for i, name := range upload {
+			transfers[i] = FileTransfer{
+				Local:  filepath.Join(localDir, filepath.FromSlash(name)),
+				Remote: path.Join(remoteDir, name),
+			}
+		}
+		results := c.TransferBatch(context.Background(), transfers, &BatchOptions{Workers: opts.Workers})
+		for i, r := range results {
+			if r.Err != nil {
+				errs = append(errs, fmt.Errorf("sshctl: sync %s: %w", upload[i], r.Err))
+				continue
+			}
+			res.Uploaded = append(res.Uploaded, upload[i])
+		}
+		if err := c.remoteTouch(remoteDir, res.Uploaded, local); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(remove) > 0 {
+		if err := c.remoteRemove(remoteDir, remove); err != nil {
+			errs = append(errs, err)
+		} else {
+			res.Deleted = remove
+		}
+	}
+	return res, errors.Join(errs...)
+}
+
+// localTree returns the regular files below dir by their slash
+// separated relative path.
+func localTree(dir string, checksum bool) (map[string]*syncFile, error) {
+	files := make(map[string]*syncFile)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.Contains(name, "\n") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := &syncFile{size: fi.Size(), mtime: fi.ModTime().Unix()}
+		if checksum {
+			if f.sum, err = fileSHA256(p); err != nil {
+				return err
+			}
+		}
+		files[name] = f
+		return nil
+	})
+	return files, err
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteTreeCmd lists size, modification time and path of the
+// regular files below the current directory, with the stat of GNU
+// and busybox or of the BSDs and macOS.
+const remoteTreeCmd = `find . -type f -exec sh -c 'stat -c "%s %Y %n" -- "$@" 2>/dev/null || stat -f "%z %m %N" -- "$@"' sh {} +`
+
+// remoteSumCmd lists the sha256 checksums of the regular files below
+// the current directory.
+const remoteSumCmd = `find . -type f -exec sh -c 'sha256sum -- "$@" 2>/dev/null || shasum -a 256 -- "$@"' sh {} +`
+
+// remoteTree is localTree for the remote dir. A missing dir is
+// empty.
+func (c *Client) remoteTree(dir string, checksum bool) (map[string]*syncFile, error) {
+	cd := "cd " + shellQuote(dir) + " 2>/dev/null || exit 0; "
+	out, err := c.NewSession().Output(cd + remoteTreeCmd)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*syncFile)
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		f := strings.SplitN(line, " ", 3)
+		if len(f) != 3 || !strings.HasPrefix(f[2], "./") {
+			return nil, fmt.Errorf("sshctl: unexpected stat output %q", line)
+		}
+		size, err1 := strconv.ParseInt(f[0], 10, 64)
+		mtime, err2 := strconv.ParseInt(f[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("sshctl: unexpected stat output %q", line)
+		}
+		files[f[2][2:]] = &syncFile{size: size, mtime: mtime}
+	}
+	if !checksum || len(files) == 0 {
+		return files, nil
+	}
+
+	out, err = c.NewSession().Output(cd + remoteSumCmd)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		// "<sum>  ./<path>"; a name escaped by sha256sum stays
+		// without sum and is uploaded
+		if len(line) < 68 || line[64:68] != "  ./" {
+			continue
+		}
+		if f, ok := files[line[68:]]; ok {
+			f.sum = line[:64]
+		}
+	}
+	return files, nil
+}
+
+// The file names of the commands below are passed on stdin rather
+// than in the command line, which sshd hands to "sh -c" as a single
+// argument of at most 128 KiB on Linux.
+
+// runWithInput runs cmd through c with stdin read from input.
+func (c *Client) runWithInput(cmd, input string) error {
+	s := c.NewSession()
+	s.Stdin = strings.NewReader(input)
+	return s.Run(cmd)
+}
+
+// nulList joins names with NUL terminators, for xargs -0.
+func nulList(names []string) string {
+	return strings.Join(names, "\x00") + "\x00"
+}
+
+// remoteMkdirs creates the directories of names below dir.
+func (c *Client) remoteMkdirs(dir string, names []string) error {
+	dirs := map[string]bool{dir: true}
+	for _, name := range names {
+		dirs[path.Join(dir, path.Dir(name))] = true
+	}
+	list := make([]string, 0, len(dirs))
+	for d := range dirs {
+		list = append(list, d)
+	}
+	sort.Strings(list)
+	return c.runWithInput("xargs -0 mkdir -p --", nulList(list))
+}
+
+// remoteTouch gives the files names below dir the modification time
+// of their local counterparts. touch -t takes the time in the
+// remote time zone, which is set to UTC. Each file is a line with
+// the time and the name, which has no newline, see localTree.
+func (c *Client) remoteTouch(dir string, names []string, local map[string]*syncFile) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, name := range names {
+		t := time.Unix(local[name].mtime, 0).UTC()
+		fmt.Fprintf(&b, "%s %s\n", t.Format("200601021504.05"), name)
+	}
+	return c.runWithInput("TZ=UTC0; export TZ; cd "+shellQuote(dir)+" || exit; r=0; "+
+		`while IFS= read -r l; do touch -t "${l%% *}" -- "${l#* }" || r=1; done; exit $r`, b.String())
+}
+
+// remoteRemove removes the files names below dir.
+func (c *Client) remoteRemove(dir string, names []string) error {
+	return c.runWithInput("cd "+shellQuote(dir)+" && xargs -0 rm -f --", nulList(names))
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncDir(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "dst")
+	write := func(name, data string) {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", "one")
+	write("sub/dir/b c", TestString)
+	sync := func(opts *SyncOptions, uploaded, deleted []string, unchanged int) {
+		t.Helper()
+		res, err := c.SyncDir(src, dst, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Uploaded, uploaded) || !reflect.DeepEqual(res.Deleted, deleted) || res.Unchanged != unchanged {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	}
+
+	sync(&SyncOptions{DryRun: true}, []string{"a", "sub/dir/b c"}, nil, 0)
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("dry run created %s", dst)
+	}
+	sync(nil, []string{"a", "sub/dir/b c"}, nil, 0)
+	got, err := os.ReadFile(filepath.Join(dst, "sub/dir/b c"))
+	if err != nil || string(got) != TestString {
+		t.Fatalf("unexpected content %q, %v", got, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "a")); err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected mode %v, %v", fi.Mode(), err)
+	}
+	sync(nil, nil, nil, 2)
+
+	// same size, later mtime
+	write("a", "two")
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(src, "a"), later, later)
+	sync(&SyncOptions{Checksum: true}, []string{"a"}, nil, 1)
+	if got, _ := os.ReadFile(filepath.Join(dst, "a")); string(got) != "two" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	sync(nil, nil, nil, 2)
+
+	// only the mtime changed
+	os.Chtimes(filepath.Join(src, "a"), later.Add(time.Hour), later.Add(time.Hour))
+	sync(&SyncOptions{Checksum: true}, nil, nil, 2)
+	sync(nil, []string{"a"}, nil, 1)
+
+	if err := os.WriteFile(filepath.Join(dst, "extra"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sync(nil, nil, nil, 2)
+	sync(&SyncOptions{Delete: true}, nil, []string{"extra"}, 2)
+	if _, err := os.Stat(filepath.Join(dst, "extra")); !os.IsNotExist(err) {
+		t.Fatalf("extraneous file not deleted, %v", err)
+	}
+}
+
+func TestSyncDirManyFiles(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	// more names than fit into a single argument of 128 KiB
+	dir := t.TempDir()
+	local := make(map[string]*syncFile)
+	var names []string
+	mtime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	for i := 0; i < 1500; i++ {
+		name := fmt.Sprintf("d%d/%s %d", i%10, strings.Repeat("x", 100), i)
+		names = append(names, name)
+		local[name] = &syncFile{mtime: mtime}
+	}
+	if err := c.remoteMkdirs(dir, names); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.remoteTouch(dir, names, local); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, names[len(names)-1]))
+	if err != nil || fi.ModTime().Unix() != mtime {
+		t.Fatalf("unexpected mtime %v, %v", fi.ModTime(), err)
+	}
+	if err := c.remoteRemove(dir, names); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*", "*")); len(files) != 0 {
+		t.Fatalf("expected all files to be removed, %d left", len(files))
+	}
+}
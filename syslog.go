@@ -0,0 +1,108 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package sshctl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// SyslogWriter sends the lines written to it to syslog, one message
+// each, tagged with the host and command they came from:
+//
+//	host=web1 cmd="uptime" stream=stdout 10:01:02 up 12 days
+//
+// A final line without newline is sent by Close.
+type SyslogWriter struct {
+	w        *syslog.Writer
+	priority syslog.Priority
+	prefix   string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewSyslogWriter returns a SyslogWriter logging to w with the given
+// severity; stream names the output, e.g. "stdout", in the messages.
+func NewSyslogWriter(w *syslog.Writer, severity syslog.Priority, host, cmd, stream string) *SyslogWriter {
+	return &SyslogWriter{
+		w:        w,
+		priority: severity,
+		prefix:   fmt.Sprintf("host=%s cmd=%q stream=%s ", host, cmd, stream),
+	}
+}
+
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := strings.TrimSuffix(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if err := w.send(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Close sends a pending partial line. It does not close the
+// underlying syslog.Writer.
+func (w *SyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := string(w.buf)
+	w.buf = nil
+	return w.send(line)
+}
+
+func (w *SyslogWriter) send(line string) error {
+	msg := w.prefix + line
+	switch w.priority & 7 {
+	case syslog.LOG_EMERG:
+		return w.w.Emerg(msg)
+	case syslog.LOG_ALERT:
+		return w.w.Alert(msg)
+	case syslog.LOG_CRIT:
+		return w.w.Crit(msg)
+	case syslog.LOG_ERR:
+		return w.w.Err(msg)
+	case syslog.LOG_WARNING:
+		return w.w.Warning(msg)
+	case syslog.LOG_NOTICE:
+		return w.w.Notice(msg)
+	case syslog.LOG_INFO:
+		return w.w.Info(msg)
+	}
+	return w.w.Debug(msg)
+}
+
+// RunSyslog runs cmd and logs its output to w, standard output at
+// LOG_INFO and standard error at LOG_ERR, tagged with host and cmd.
+func (s *Session) RunSyslog(w *syslog.Writer, host, cmd string) error {
+	if s.Stdout != nil || s.Stderr != nil {
+		return errors.New("ssh: Stdout or Stderr already set")
+	}
+	stdout := NewSyslogWriter(w, syslog.LOG_INFO, host, cmd, "stdout")
+	stderr := NewSyslogWriter(w, syslog.LOG_ERR, host, cmd, "stderr")
+	s.Stdout, s.Stderr = stdout, stderr
+	err := s.Run(cmd)
+	stdout.Close()
+	stderr.Close()
+	return err
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"log/syslog"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSyslog(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	path := filepath.Join(t.TempDir(), "log")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	w, err := syslog.Dial("unixgram", path, syslog.LOG_DAEMON, "sshctl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := NewSession(g.ctrlSock).RunSyslog(w, "web1", "echo a; echo b >&2; printf c"); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []string
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(msgs) < 3 {
+		n, err := l.Read(buf)
+		if err != nil {
+			t.Fatalf("got %q, then %v", msgs, err)
+		}
+		// drop the timestamp and tag
+		msg := string(buf[:n])
+		msgs = append(msgs, msg[:strings.IndexByte(msg, '>')+1]+msg[strings.Index(msg, "]: ")+3:])
+	}
+	sort.Strings(msgs)
+	cmd := `cmd="echo a; echo b >&2; printf c"`
+	want := []string{
+		"<27>host=web1 " + cmd + " stream=stderr b\n",
+		"<30>host=web1 " + cmd + " stream=stdout a\n",
+		"<30>host=web1 " + cmd + " stream=stdout c\n",
+	}
+	for i := range want {
+		if msgs[i] != want[i] {
+			t.Errorf("expected %q, got %q", want[i], msgs[i])
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLine is a line of output from one of the hosts run by Tail.
+type LogLine struct {
+	Host   string // the host's alias
+	Line   string // without the trailing newline
+	Time   time.Time
+	Stderr bool // the line was written to standard error
+
+	// Err is set on the last record of a host, if its command
+	// failed. Line is empty then.
+	Err error
+}
+
+// TailCommand returns a command following the given remote files,
+// starting at their end and surviving log rotation.
+func TailCommand(paths ...string) string {
+	quoted := make([]string, len(paths))
+	for i, p := range paths {
+		quoted[i] = shellQuote(p)
+	}
+	return "tail -n 0 -F -- " + strings.Join(quoted, " ")
+}
+
+// Tail runs cmd, e.g. TailCommand("/var/log/syslog") or
+// "journalctl -f -n 0", on all hosts and merges their output into
+// the returned channel, which buffers up to buffer lines. If the
+// consumer falls behind, reading from the hosts stalls. The channel
+// is closed once all commands have exited; cancelling ctx closes
+// the sessions.
+func Tail(ctx context.Context, hosts []Host, cmd string, buffer int) <-chan LogLine {
+	out := make(chan LogLine, buffer)
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h Host) {
+			defer wg.Done()
+			if err := tailHost(ctx, h, cmd, out); err != nil && ctx.Err() == nil {
+				select {
+				case out <- LogLine{Host: h.Alias, Time: time.Now(), Err: err}:
+				case <-ctx.Done():
+				}
+			}
+		}(h)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func tailHost(ctx context.Context, h Host, cmd string, out chan<- LogLine) error {
+	c, err := h.Client()
+	if err != nil {
+		return err
+	}
+	return tailClient(ctx, c, h.Alias, cmd, out)
+}
+
+// tailClient runs cmd through c and sends its output lines to out,
+// with host as their Host.
+func tailClient(ctx context.Context, c *Client, host, cmd string, out chan<- LogLine) error {
+	stdout := &lineWriter{ctx: ctx, host: host, out: out}
+	stderr := &lineWriter{ctx: ctx, host: host, out: out, stderr: true}
+	s := c.NewSession()
+	if host != "" {
+		s = s.WithLabel(host)
+	}
+	s.Stdout, s.Stderr = stdout, stderr
+	if err := s.Start(cmd); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+	err := s.Wait()
+	stdout.flush()
+	stderr.flush()
+	return err
+}
+
+// tailFileInterval is how often the loop of TailFile checks the
+// file.
+var tailFileInterval = time.Second
+
+// tailFileScript follows the file %[1]s from its end, polling it
+// every %[2]g seconds. A changed inode or a shrunk size means the
+// file was rotated or truncated, and it is read from the start.
+const tailFileScript = `f=%[1]s; ino=; off=
+while :; do
+	if [ -r "$f" ]; then
+		set -- $(ls -Lid "$f"); i=$1
+		s=$(wc -c < "$f"); s=$((s))
+		if [ -z "$off" ]; then
+			off=$s
+		elif [ "$i" != "$ino" ] || [ "$s" -lt "$off" ]; then
+			off=0
+		fi
+		ino=$i
+		if [ "$s" -gt "$off" ]; then
+			tail -c +$((off + 1)) "$f" | head -c $((s - off))
+			off=$s
+		fi
+	fi
+	: ${off:=0}
+	sleep %[2]g
+done`
+
+// TailFile follows the remote file at path from its end, like
+// "tail -F", and sends its lines to the returned channel, which
+// buffers up to buffer lines. Instead of relying on the remote tail
+// supporting -F, a shell loop re-checks the file's inode and size,
+// so a file that was rotated, truncated or recreated is read again
+// from its start. Lines written to the old file just before a
+// rotation may be missed.
+//
+// Like with Tail, the channel is closed once the loop ended; if it
+// failed, the last record carries the error. Cancelling ctx closes
+// the session.
+func (c *Client) TailFile(ctx context.Context, path string, buffer int) <-chan LogLine {
+	out := make(chan LogLine, buffer)
+	cmd := fmt.Sprintf(tailFileScript, shellQuote(path), tailFileInterval.Seconds())
+	go func() {
+		defer close(out)
+		if err := tailClient(ctx, c, "", cmd, out); err != nil && ctx.Err() == nil {
+			select {
+			case out <- LogLine{Time: time.Now(), Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out
+}
+
+// lineWriter sends complete lines written to it as LogLines.
+type lineWriter struct {
+	ctx    context.Context
+	host   string
+	stderr bool
+	out    chan<- LogLine
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if err := w.send(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// flush sends a trailing line without newline.
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.send(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) send(line string) error {
+	select {
+	case w.out <- LogLine{Host: w.host, Line: line, Time: time.Now(), Stderr: w.stderr}:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTail(t *testing.T) {
+	var hosts []Host
+	for _, name := range []string{"a", "b"} {
+		g := newGoMaster(t)
+		defer g.Shutdown()
+		hosts = append(hosts, Host{Alias: name, ControlPath: g.ctrlSock})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lines := make(map[string][]string)
+	var failed error
+	for l := range Tail(ctx, hosts, "echo one; echo two >&2; printf three; exit 3", 1) {
+		if l.Err != nil {
+			failed = l.Err
+			continue
+		}
+		lines[l.Host] = append(lines[l.Host], l.Line)
+	}
+	for _, h := range hosts {
+		if len(lines[h.Alias]) != 3 {
+			t.Fatalf("%s: expected 3 lines, got %q", h.Alias, lines[h.Alias])
+		}
+	}
+	var ee *ExitError
+	if !errors.As(failed, &ee) || ee.ExitStatus() != 3 {
+		t.Fatalf("expected exit status 3, got %v", failed)
+	}
+}
+
+func TestTailCancel(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	log := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(log, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hosts := []Host{{Alias: "a", ControlPath: g.ctrlSock}}
+	lines := Tail(ctx, hosts, TailCommand(log), 10)
+	deadline := time.After(5 * time.Second)
+	for {
+		f, err := os.OpenFile(log, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(TestString + "\n")
+		f.Close()
+		select {
+		case l := <-lines:
+			if l.Host != "a" || l.Line != TestString {
+				t.Fatalf("unexpected line %+v", l)
+			}
+			cancel()
+			for range lines {
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("timeout waiting for tail")
+		}
+	}
+}
+
+func TestTailFile(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	defer func(d time.Duration) { tailFileInterval = d }(tailFileInterval)
+	tailFileInterval = 50 * time.Millisecond
+	log := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(log, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lines := NewClient(g.ctrlSock).TailFile(ctx, log, 10)
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case l := <-lines:
+			if l.Err != nil || l.Line != want {
+				t.Fatalf("expected %q, got %+v", want, l)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	f, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("appended\n")
+	f.Close()
+	expect("appended")
+
+	if err := os.WriteFile(log, []byte("trunc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect("trunc")
+
+	if err := os.Rename(log, log+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(log, []byte("rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect("rotated")
+
+	cancel()
+	for l := range lines {
+		t.Fatalf("unexpected line after cancel: %+v", l)
+	}
+}
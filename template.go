@@ -0,0 +1,87 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what command templates of an Executor are executed
+// with, e.g. "{{.Host.HostName}}" or "{{.Vars.role}}". Using an unset
+// variable is an error.
+//
+// Templates can quote values for the host's shell with the quote
+// function, as in "rm -rf {{quote .Vars.dir}}", according to the
+// host's Quoting.
+type TemplateData struct {
+	Host Host
+	Vars map[string]string // the host's entry of the Executor's Vars
+}
+
+// TemplateError reports a command template that could not be
+// executed for a host, which is then not run.
+type TemplateError struct {
+	Host string // the host's Alias
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("sshctl: command template for %s: %v", e.Host, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// RunTemplate is like Run but executes the text/template text for
+// each host, with TemplateData, to get the host's command. Commands
+// are rendered for all hosts before any is run; hosts whose template
+// fails get a *TemplateError as result and are skipped. An error is
+// returned only if text does not parse.
+func (e *Executor) RunTemplate(text string) ([]HostResult, error) {
+	return e.RunTemplateContext(context.Background(), text)
+}
+
+// RunTemplateContext is RunTemplate with the cancellation of
+// RunContext.
+func (e *Executor) RunTemplateContext(ctx context.Context, text string) ([]HostResult, error) {
+	results, err := e.render(text)
+	if err != nil {
+		if e.Events != nil {
+			close(e.Events)
+		}
+		return nil, err
+	}
+	return e.runAll(ctx, results), nil
+}
+
+// render returns results with the commands of all hosts.
+func (e *Executor) render(text string) ([]HostResult, error) {
+	tmpl, err := template.New("cmd").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"quote": POSIXQuoting.quote}).
+		Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]HostResult, len(e.Hosts))
+	for i, h := range e.Hosts {
+		results[i].Host = h
+		t, _ := tmpl.Clone()
+		var b strings.Builder
+		err := t.Funcs(template.FuncMap{"quote": h.Quoting.quote}).
+			Execute(&b, TemplateData{Host: h, Vars: e.Vars[h.Alias]})
+		if err != nil {
+			results[i].Err = &TemplateError{Host: h.Alias, Err: err}
+			results[i].ExitStatus = ExitCode(results[i].Err)
+			continue
+		}
+		results[i].Cmd = b.String()
+	}
+	return results, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRunTemplate(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	inv, err := ParseInventory(strings.NewReader(
+		"[web]\na control_path=" + g.ctrlSock + " dir=\"/srv/a b\"\nb control_path=" + g.ctrlSock + " dir=/srv/b\n" +
+			"c control_path=" + g.ctrlSock + "\n[web:vars]\nrole=front\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := inv.Executor("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan ExecEvent, 16)
+	e.Events = events
+	res, err := e.RunTemplate("echo {{.Host.Alias}} {{.Vars.role}} {{quote .Vars.dir}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"a front /srv/a b\n", "b front /srv/b\n"} {
+		if res[i].Err != nil || string(res[i].Stdout) != want {
+			t.Errorf("%s: expected %q, got %q (%v)", res[i].Host.Alias, want, res[i].Stdout, res[i].Err)
+		}
+	}
+	if res[0].Cmd != "echo a front '/srv/a b'" {
+		t.Errorf("unexpected command %q", res[0].Cmd)
+	}
+	var te *TemplateError
+	if !errors.As(res[2].Err, &te) || te.Host != "c" || res[2].Attempts != 0 || res[2].Cmd != "" {
+		t.Fatalf("expected a *TemplateError for c, got %+v", res[2])
+	}
+	var started []string
+	for ev := range events {
+		if ev.Type == ExecStarted {
+			started = append(started, ev.Host.Alias)
+		}
+	}
+	if len(started) != 2 {
+		t.Fatalf("expected a and b to start, got %q", started)
+	}
+
+	events = make(chan ExecEvent)
+	e.Events = events
+	if _, err := e.RunTemplate("echo {{.Vars.role"); err == nil {
+		t.Fatal("expected a parse error")
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expected Events to be closed after a parse error")
+	}
+}
+
+func TestTemplateQuoting(t *testing.T) {
+	e := NewExecutor([]Host{{Alias: "nix"}, {Alias: "win", Quoting: PowerShellQuoting}})
+	e.Vars = map[string]map[string]string{"nix": {"f": "it's"}, "win": {"f": "it's"}}
+	res, err := e.render("rm {{quote .Vars.f}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Cmd != `rm 'it'\''s'` || res[1].Cmd != `rm 'it''s'` {
+		t.Fatalf("unexpected commands %q and %q", res[0].Cmd, res[1].Cmd)
+	}
+}
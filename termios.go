@@ -0,0 +1,132 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package sshctl
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// termiosFlag maps a terminal mode opcode of RFC 4254 to a termios flag.
+type termiosFlag struct {
+	field byte // 'i', 'o' or 'l' for Iflag, Oflag or Lflag
+	bit   uint64
+}
+
+var termiosFlags = map[uint8]termiosFlag{
+	ssh.IGNPAR:  {'i', unix.IGNPAR},
+	ssh.PARMRK:  {'i', unix.PARMRK},
+	ssh.INPCK:   {'i', unix.INPCK},
+	ssh.ISTRIP:  {'i', unix.ISTRIP},
+	ssh.INLCR:   {'i', unix.INLCR},
+	ssh.IGNCR:   {'i', unix.IGNCR},
+	ssh.ICRNL:   {'i', unix.ICRNL},
+	ssh.IXON:    {'i', unix.IXON},
+	ssh.IXANY:   {'i', unix.IXANY},
+	ssh.IXOFF:   {'i', unix.IXOFF},
+	ssh.IMAXBEL: {'i', unix.IMAXBEL},
+	ssh.ISIG:    {'l', unix.ISIG},
+	ssh.ICANON:  {'l', unix.ICANON},
+	ssh.ECHO:    {'l', unix.ECHO},
+	ssh.ECHOE:   {'l', unix.ECHOE},
+	ssh.ECHOK:   {'l', unix.ECHOK},
+	ssh.ECHONL:  {'l', unix.ECHONL},
+	ssh.NOFLSH:  {'l', unix.NOFLSH},
+	ssh.TOSTOP:  {'l', unix.TOSTOP},
+	ssh.IEXTEN:  {'l', unix.IEXTEN},
+	ssh.ECHOCTL: {'l', unix.ECHOCTL},
+	ssh.ECHOKE:  {'l', unix.ECHOKE},
+	ssh.OPOST:   {'o', unix.OPOST},
+	ssh.ONLCR:   {'o', unix.ONLCR},
+}
+
+func setBit[T uint32 | uint64](v T, bit uint64, on bool) T {
+	if on {
+		return v | T(bit)
+	}
+	return v &^ T(bit)
+}
+
+func (f termiosFlag) set(t *unix.Termios, on bool) {
+	switch f.field {
+	case 'i':
+		t.Iflag = setBit(t.Iflag, f.bit, on)
+	case 'o':
+		t.Oflag = setBit(t.Oflag, f.bit, on)
+	case 'l':
+		t.Lflag = setBit(t.Lflag, f.bit, on)
+	}
+}
+
+func (f termiosFlag) get(t *unix.Termios) bool {
+	switch f.field {
+	case 'i':
+		return uint64(t.Iflag)&f.bit != 0
+	case 'o':
+		return uint64(t.Oflag)&f.bit != 0
+	}
+	return uint64(t.Lflag)&f.bit != 0
+}
+
+// applyTerminalModes sets the flags of modes on the terminal f and
+// returns a function restoring its previous state. Modes other than
+// flags, such as special characters and speeds, are not supported.
+func applyTerminalModes(f *os.File, modes ssh.TerminalModes) (func() error, error) {
+	old, err := unix.IoctlGetTermios(int(f.Fd()), ioctlGetTermios)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: terminal modes need a terminal as stdin: %w", err)
+	}
+	t := *old
+	for op, v := range modes {
+		flag, ok := termiosFlags[op]
+		if !ok {
+			return nil, fmt.Errorf("ssh: unsupported terminal mode %d", op)
+		}
+		flag.set(&t, v != 0)
+	}
+	if err := unix.IoctlSetTermios(int(f.Fd()), ioctlSetTermios, &t); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return unix.IoctlSetTermios(int(f.Fd()), ioctlSetTermios, old)
+	}, nil
+}
+
+func getWindowSize(f *os.File) (WindowSize, error) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return WindowSize{}, err
+	}
+	return WindowSize{Rows: int(ws.Row), Cols: int(ws.Col)}, nil
+}
+
+func setWindowSize(f *os.File, size WindowSize) error {
+	ws := &unix.Winsize{Row: uint16(size.Rows), Col: uint16(size.Cols)}
+	return unix.IoctlSetWinsize(int(f.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// terminalModes returns the flags of the terminal f as terminal modes,
+// as ssh(1) does for a pty request.
+func terminalModes(f *os.File) (ssh.TerminalModes, error) {
+	t, err := unix.IoctlGetTermios(int(f.Fd()), ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	modes := make(ssh.TerminalModes, len(termiosFlags))
+	for op, flag := range termiosFlags {
+		if flag.get(t) {
+			modes[op] = 1
+		} else {
+			modes[op] = 0
+		}
+	}
+	return modes, nil
+}
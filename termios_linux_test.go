@@ -0,0 +1,126 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTerminalModes(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	for _, tc := range []struct {
+		modes ssh.TerminalModes
+		want  string
+	}{
+		{nil, "1"},
+		{ssh.TerminalModes{ssh.ECHO: 0}, "0"},
+	} {
+		ptm, pts := testPty(t)
+		var outb bytes.Buffer
+		sess := NewSession(g.ctrlSock)
+		sess.Stdin = pts
+		sess.Stdout = &outb
+		sess.RequestPty("xterm")
+		sess.TerminalModes = tc.modes
+		if err := sess.Run("echo -n $TEST_PTY_ECHO"); err != nil {
+			t.Fatalf("Got err: %s", err)
+		}
+		if outb.String() != tc.want {
+			t.Errorf("modes %v: expected ECHO %s, got %q", tc.modes, tc.want, outb.String())
+		}
+		pts.Close()
+		ptm.Close()
+	}
+
+	sess := NewSession(g.ctrlSock)
+	sess.RequestPty("xterm")
+	sess.TerminalModes = ssh.TerminalModes{ssh.ECHO: 0}
+	if err := sess.Run("true"); err == nil {
+		t.Fatalf("expected terminal modes without a terminal to fail")
+	}
+}
+
+func TestApplyTerminalModes(t *testing.T) {
+	ptm, pts := testPty(t)
+	defer ptm.Close()
+	defer pts.Close()
+
+	restore, err := applyTerminalModes(pts, ssh.TerminalModes{ssh.ECHO: 0, ssh.ICANON: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes, err := terminalModes(pts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modes[ssh.ECHO] != 0 || modes[ssh.ICANON] != 0 || modes[ssh.ISIG] != 1 {
+		t.Fatalf("unexpected modes %v", modes)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if modes, _ := terminalModes(pts); modes[ssh.ECHO] != 1 || modes[ssh.ICANON] != 1 {
+		t.Fatalf("expected the modes to be restored, got %v", modes)
+	}
+	if _, err := applyTerminalModes(pts, ssh.TerminalModes{ssh.VINTR: 3}); err == nil {
+		t.Fatalf("expected special characters to be unsupported")
+	}
+}
+
+func TestWindowSize(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	// an explicit size
+	ptm, pts := testPty(t)
+	defer ptm.Close()
+	defer pts.Close()
+	var outb bytes.Buffer
+	sess := NewSession(g.ctrlSock)
+	sess.Stdin = pts
+	sess.Stdout = &outb
+	sess.RequestPty("xterm")
+	sess.WindowSize = WindowSize{Rows: 50, Cols: 132}
+	if err := sess.Run("echo -n $TEST_PTY_SIZE"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	if outb.String() != "132x50" {
+		t.Fatalf("expected 132x50, got %q", outb.String())
+	}
+
+	// the size of the terminal on stdout
+	outm, outs := testPty(t)
+	defer outm.Close()
+	defer outs.Close()
+	if err := setWindowSize(outs, WindowSize{Rows: 40, Cols: 100}); err != nil {
+		t.Fatal(err)
+	}
+	sess = NewSession(g.ctrlSock)
+	sess.Stdin = pts
+	sess.Stdout = outs
+	sess.RequestPty("xterm")
+	if err := sess.Run("echo -n $TEST_PTY_SIZE"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	buf := make([]byte, 64)
+	outm.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := outm.Read(buf)
+	if err != nil || string(buf[:n]) != "100x40" {
+		t.Fatalf("expected 100x40, got %q, %v", buf[:n], err)
+	}
+
+	sess = NewSession(g.ctrlSock)
+	sess.RequestPty("xterm")
+	sess.WindowSize = WindowSize{Rows: 50, Cols: 132}
+	if err := sess.Run("true"); err == nil {
+		t.Fatalf("expected a window size without a terminal to fail")
+	}
+}
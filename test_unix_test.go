@@ -10,6 +10,7 @@ package sshctl
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
@@ -112,16 +113,12 @@ func (s *server) TryRun() (string, error) {
 	}
 	s.ctrlSock = s.testdir + "/ctrl.sock"
 
-	// Wait for control socket
-	for i := 1; i < 100; i++ {
-		time.Sleep(10 * time.Millisecond)
-		if _, err := os.Stat(s.ctrlSock); err == nil {
-			return s.ctrlSock, nil
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := WaitForMaster(ctx, s.ctrlSock); err != nil {
+		s.t.Fatalf("ssh master did not come up: %v", err)
 	}
-	s.t.Fatalf("ssh did not create control socket %s", s.ctrlSock)
-
-	return "", nil
+	return s.ctrlSock, nil
 }
 
 func (s *server) Run() string {
@@ -0,0 +1,309 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrTmuxExited is returned for commands to a Tmux whose control
+// client is gone.
+var ErrTmuxExited = errors.New("sshctl: tmux control client exited")
+
+// TmuxNotification is an asynchronous message of tmux control mode,
+// such as "%window-add @1" or "%output %1 data".
+type TmuxNotification struct {
+	Name string   // without the %, e.g. "output"
+	Args []string // the blank separated arguments
+
+	// For "output" and "extended-output", the pane and the data
+	// written to it, unescaped. Args then holds the fields before
+	// the data.
+	Pane string
+	Data []byte
+}
+
+// TmuxError reports a tmux command that failed.
+type TmuxError struct {
+	Cmd    string
+	Output []string // what tmux said, e.g. "unknown command: foo"
+}
+
+func (e *TmuxError) Error() string {
+	return "tmux: " + e.Cmd + ": " + strings.Join(e.Output, "; ")
+}
+
+// Tmux is a tmux client in control mode, see "CONTROL MODE" in
+// tmux(1). It runs "tmux -C" rather than "tmux -CC": the latter is
+// meant for terminal emulators and needs a pty. Commands are sent
+// one line each and answered in order; notifications, among them
+// the output of the panes, arrive on the channel given to StartTmux.
+type Tmux struct {
+	s      *Session
+	stdin  io.WriteCloser
+	events chan<- TmuxNotification
+
+	mu      sync.Mutex
+	pending []chan tmuxReply // in the order the commands were sent
+	err     error            // set once tmux is gone
+
+	done chan struct{} // closed when the reader is done
+}
+
+type tmuxReply struct {
+	lines []string
+	ok    bool
+}
+
+// StartTmux starts tmux in control mode in s, which must not be
+// started and must not have its Stdin or Stdout set. args are passed
+// to tmux after -C, e.g. "-L", "sock", "new-session", "-A", "-s",
+// "work" to create or attach the session "work". Without args, tmux
+// creates a new session.
+//
+// If events is non-nil, it receives the notifications. They are not
+// dropped, so the receiver must keep up; tmux waits meanwhile, and
+// so do the commands. events is closed when tmux exits.
+func StartTmux(s *Session, events chan<- TmuxNotification, args ...string) (*Tmux, error) {
+	t := &Tmux{s: s, events: events, done: make(chan struct{})}
+	var err error
+	if t.stdin, err = s.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	// the reply to the command given on the command line
+	first := make(chan tmuxReply, 1)
+	t.pending = append(t.pending, first)
+	if err := s.Start(strings.TrimSpace("exec tmux -C " + strings.Join(quoted, " "))); err != nil {
+		return nil, err
+	}
+	go t.read(bufio.NewReader(stdout))
+	r, ok := <-first
+	if !ok {
+		if err := t.Close(); err != nil {
+			return nil, err
+		}
+		return nil, ErrTmuxExited
+	}
+	if !r.ok {
+		t.Close()
+		return nil, &TmuxError{Cmd: "tmux -C " + strings.Join(args, " "), Output: r.lines}
+	}
+	return t, nil
+}
+
+// read dispatches tmux's output until it exits.
+func (t *Tmux) read(r *bufio.Reader) {
+	defer close(t.done)
+	var block []string
+	var number string
+	inBlock := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if inBlock {
+			// lines in a block may start with % too
+			f := strings.Fields(line)
+			if len(f) >= 3 && (f[0] == "%end" || f[0] == "%error") && f[2] == number {
+				t.reply(tmuxReply{lines: block, ok: f[0] == "%end"})
+				block, inBlock = nil, false
+				continue
+			}
+			block = append(block, line)
+			continue
+		}
+		if f := strings.Fields(line); len(f) >= 3 && f[0] == "%begin" {
+			inBlock, number = true, f[2]
+			continue
+		}
+		if strings.HasPrefix(line, "%") && t.events != nil {
+			t.events <- parseTmuxNotification(line)
+		}
+	}
+	t.mu.Lock()
+	t.err = ErrTmuxExited
+	for _, c := range t.pending {
+		close(c)
+	}
+	t.pending = nil
+	t.mu.Unlock()
+	if t.events != nil {
+		close(t.events)
+	}
+}
+
+func (t *Tmux) reply(r tmuxReply) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		// not ours, e.g. from a hook
+		return
+	}
+	t.pending[0] <- r
+	t.pending = t.pending[1:]
+}
+
+func parseTmuxNotification(line string) TmuxNotification {
+	name, rest, _ := strings.Cut(line[1:], " ")
+	n := TmuxNotification{Name: name}
+	switch name {
+	case "output":
+		// %output %pane data
+		pane, data, _ := strings.Cut(rest, " ")
+		n.Args, n.Pane, n.Data = []string{pane}, pane, unescapeTmux(data)
+	case "extended-output":
+		// %extended-output %pane age ... : data
+		fields, data, _ := strings.Cut(rest, " : ")
+		n.Args = strings.Fields(fields)
+		if len(n.Args) > 0 {
+			n.Pane = n.Args[0]
+		}
+		n.Data = unescapeTmux(data)
+	default:
+		if rest != "" {
+			n.Args = strings.Fields(rest)
+		}
+	}
+	return n
+}
+
+// unescapeTmux decodes the octal escapes tmux uses for backslashes
+// and control characters in pane output.
+func unescapeTmux(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(v))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// tmuxQuote quotes s as a single argument of a tmux command line,
+// which must not contain newlines.
+func tmuxQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\' || c == '$':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Command runs a tmux command, such as "list-windows", and returns
+// its output lines. cmd must be a single line. A failing command is
+// reported as a *TmuxError.
+func (t *Tmux) Command(cmd string) ([]string, error) {
+	if strings.ContainsAny(cmd, "\r\n") {
+		return nil, errors.New("sshctl: tmux command spans lines")
+	}
+	c := make(chan tmuxReply, 1)
+	t.mu.Lock()
+	if t.err != nil {
+		t.mu.Unlock()
+		return nil, t.err
+	}
+	if _, err := io.WriteString(t.stdin, cmd+"\n"); err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
+	t.pending = append(t.pending, c)
+	t.mu.Unlock()
+	r, ok := <-c
+	if !ok {
+		return nil, ErrTmuxExited
+	}
+	if !r.ok {
+		return nil, &TmuxError{Cmd: cmd, Output: r.lines}
+	}
+	return r.lines, nil
+}
+
+// paneCommand runs cmd, which prints a pane id, and returns the id.
+func (t *Tmux) paneCommand(cmd, shellCmd string) (string, error) {
+	cmd += " -P -F '#{pane_id}'"
+	if shellCmd != "" {
+		cmd += " " + tmuxQuote(shellCmd)
+	}
+	out, err := t.Command(cmd)
+	if err != nil {
+		return "", err
+	}
+	if len(out) != 1 {
+		return "", &TmuxError{Cmd: cmd, Output: out}
+	}
+	return out[0], nil
+}
+
+// NewWindow creates a window running shellCmd, or the default shell
+// if empty, and returns the id of its pane, e.g. "%3".
+func (t *Tmux) NewWindow(shellCmd string) (string, error) {
+	return t.paneCommand("new-window", shellCmd)
+}
+
+// SplitWindow splits the pane target, running shellCmd in the new
+// pane, and returns the new pane's id.
+func (t *Tmux) SplitWindow(target, shellCmd string) (string, error) {
+	return t.paneCommand("split-window -t "+tmuxQuote(target), shellCmd)
+}
+
+// SendKeys types text into the pane, literally.
+func (t *Tmux) SendKeys(pane, text string) error {
+	_, err := t.Command("send-keys -t " + tmuxQuote(pane) + " -l " + tmuxQuote(text))
+	return err
+}
+
+// CapturePane returns the visible contents of the pane.
+func (t *Tmux) CapturePane(pane string) (string, error) {
+	out, err := t.Command("capture-pane -p -t " + tmuxQuote(pane))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// KillPane closes the pane and ends its process.
+func (t *Tmux) KillPane(pane string) error {
+	_, err := t.Command("kill-pane -t " + tmuxQuote(pane))
+	return err
+}
+
+// Close detaches the control client, leaving the tmux session and
+// its panes running, and waits for the session to finish.
+func (t *Tmux) Close() error {
+	t.stdin.Close()
+	<-t.done
+	return t.s.Wait()
+}
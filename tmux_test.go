@@ -0,0 +1,111 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTmuxNotification(t *testing.T) {
+	for line, want := range map[string]TmuxNotification{
+		`%window-add @1`:           {Name: "window-add", Args: []string{"@1"}},
+		`%session-changed $1 work`: {Name: "session-changed", Args: []string{"$1", "work"}},
+		`%exit`:                    {Name: "exit"},
+		`%output %2 hi\015\012 a\134b`: {Name: "output", Args: []string{"%2"}, Pane: "%2",
+			Data: []byte("hi\r\n a\\b")},
+		`%extended-output %3 120 : x\012`: {Name: "extended-output", Args: []string{"%3", "120"}, Pane: "%3",
+			Data: []byte("x\n")},
+	} {
+		if n := parseTmuxNotification(line); !reflect.DeepEqual(n, want) {
+			t.Errorf("%s: expected %+v, got %+v", line, want, n)
+		}
+	}
+}
+
+func TestTmuxQuote(t *testing.T) {
+	want := `"a\"b\\c\$HOME\011x\012~ #{pane_id}"`
+	if q := tmuxQuote("a\"b\\c$HOME\tx\n~ #{pane_id}"); q != want {
+		t.Fatalf("expected %s, got %s", want, q)
+	}
+}
+
+func TestTmux(t *testing.T) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux not installed")
+	}
+	t.Setenv("TMUX", "")
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	sock := fmt.Sprintf("sshctl-test-%d", os.Getpid())
+	defer exec.Command("tmux", "-L", sock, "kill-server").Run()
+
+	events := make(chan TmuxNotification, 64)
+	tm, err := StartTmux(NewSession(g.ctrlSock), events, "-L", sock, "new-session", "-s", "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pane, err := tm.NewWindow("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pane, "%") {
+		t.Fatalf("expected a pane id, got %q", pane)
+	}
+	if err := tm.SendKeys(pane, "it's \"quoted\"\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	var output []byte
+	deadline := time.After(5 * time.Second)
+	for !strings.Contains(string(output), "it's \"quoted\"\r\nit's") {
+		select {
+		case n := <-events:
+			if n.Name == "output" && n.Pane == pane {
+				output = append(output, n.Data...)
+			}
+		case <-deadline:
+			t.Fatalf("no echo from the pane, got %q", output)
+		}
+	}
+	screen, err := tm.CapturePane(pane)
+	if err != nil || !strings.Contains(screen, "it's \"quoted\"\nit's \"quoted\"") {
+		t.Fatalf("unexpected pane contents %q (%v)", screen, err)
+	}
+
+	_, err = tm.Command("bogus")
+	var te *TmuxError
+	if !errors.As(err, &te) || !strings.Contains(te.Error(), "unknown command") {
+		t.Fatalf("expected *TmuxError, got %v", err)
+	}
+	if err := tm.KillPane(pane); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for range events {
+		}
+	}()
+	if err := tm.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := tm.Command("list-sessions"); err != ErrTmuxExited {
+		t.Fatalf("expected ErrTmuxExited, got %v", err)
+	}
+
+	// the session survives the control client
+	_, err = StartTmux(NewSession(g.ctrlSock), nil, "-L", sock, "new-session", "-s", "work")
+	if !errors.As(err, &te) || !strings.Contains(te.Error(), "duplicate session") {
+		t.Fatalf("expected a duplicate session error, got %v", err)
+	}
+}
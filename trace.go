@@ -0,0 +1,101 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets in redacted text.
+const Redacted = "[REDACTED]"
+
+// A Redactor removes secrets from text before it leaves the package
+// through trace hooks, labels or logs. It is safe for concurrent use.
+type Redactor struct {
+	mu       sync.RWMutex
+	patterns []*regexp.Regexp
+	secrets  []string
+}
+
+// NewRedactor returns a Redactor for the given regular expressions.
+// If a pattern contains capture groups, only the text of the groups
+// is redacted, so `password=(\S+)` keeps the "password=" prefix.
+// Otherwise the whole match is redacted.
+func NewRedactor(patterns ...string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// AddSecret registers a literal string, e.g. a password fetched at
+// runtime, to be redacted wherever it appears.
+func (r *Redactor) AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = append(r.secrets, secret)
+}
+
+// Redact returns s with all secrets replaced by Redacted.
+// A nil Redactor returns s unchanged.
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.Replace(s, secret, Redacted, -1)
+	}
+	for _, re := range r.patterns {
+		s = redactPattern(re, s)
+	}
+	return s
+}
+
+func redactPattern(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllLiteralString(s, Redacted)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		for g := 2; g < len(m); g += 2 {
+			start, end := m[g], m[g+1]
+			if start < last || start == end {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(Redacted)
+			last = end
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// tracef passes a message through the session's Redactor to its
+// Trace hook, if any.
+func (s *Session) tracef(format string, args ...interface{}) {
+	if s.Trace == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if s.label != "" {
+		msg = s.label + ": " + msg
+	}
+	s.Trace(s.Redactor.Redact(msg))
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r, err := NewRedactor(`password=(\S+)`, `ghp_[A-Za-z0-9]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddSecret("hunter2")
+	for in, want := range map[string]string{
+		"mysql --password=s3cret -e 'select 1'": "mysql --password=[REDACTED] -e 'select 1'",
+		"git clone https://ghp_abc123@example.com": "git clone https://[REDACTED]@example.com",
+		"echo hunter2 | sudo -S true":              "echo [REDACTED] | sudo -S true",
+		"uptime":                                   "uptime",
+	} {
+		if got := r.Redact(in); got != want {
+			t.Errorf("Redact(%q): expected %q but got %q", in, want, got)
+		}
+	}
+	if got := (*Redactor)(nil).Redact("a"); got != "a" {
+		t.Errorf("nil Redactor changed input to %q", got)
+	}
+}
+
+func TestTraceRedacted(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	var mu sync.Mutex
+	var msgs []string
+	sess := NewSession(g.ctrlSock)
+	sess.Redactor, _ = NewRedactor(`TOKEN=(\S+)`)
+	sess.Trace = func(msg string) {
+		mu.Lock()
+		msgs = append(msgs, msg)
+		mu.Unlock()
+	}
+	if err := sess.Run("TOKEN=s3cret true"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	all := strings.Join(msgs, "\n")
+	if strings.Contains(all, "s3cret") || !strings.Contains(all, "TOKEN=[REDACTED]") {
+		t.Fatalf("unexpected trace:\n%s", all)
+	}
+	if !strings.Contains(all, "exit status 0") {
+		t.Fatalf("exit status missing from trace:\n%s", all)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	sess := NewSession(g.ctrlSock).WithLabel("deploy-db01")
+	if s := sess.String(); s != "deploy-db01 session on "+g.ctrlSock {
+		t.Fatalf("unexpected String(): %s", s)
+	}
+	err := sess.Run("exit 1")
+	var ee *ExitError
+	if !errors.As(err, &ee) || ee.ExitStatus() != 1 {
+		t.Fatalf("expected wrapped *ExitError, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "deploy-db01: ") {
+		t.Fatalf("label missing from error: %s", err)
+	}
+	if s := sess.String(); !strings.HasSuffix(s, `: "exit 1"`) {
+		t.Fatalf("unexpected String(): %s", s)
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+
+	var mu sync.Mutex
+	var states []string
+	sess := NewSession(g.ctrlSock)
+	sess.OnStateChange = func(old, new SessionState) {
+		mu.Lock()
+		states = append(states, new.String())
+		mu.Unlock()
+	}
+	if st := sess.State(); st != StateNew {
+		t.Fatalf("expected state new, got %s", st)
+	}
+	if err := sess.Run("true"); err != nil {
+		t.Fatalf("Got err: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	got := strings.Join(states, ",")
+	want := "dialing,hello done,opened,running,exited"
+	if got != want {
+		t.Fatalf("expected transitions %s, got %s", want, got)
+	}
+	sess.Close()
+	if st := sess.State(); st != StateExited {
+		t.Fatalf("expected final state exited, got %s", st)
+	}
+}
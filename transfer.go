@@ -0,0 +1,321 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// TransferOptions control UploadFile and DownloadFile.
+type TransferOptions struct {
+	// Verify compares the sha256 checksums of the local and the
+	// remote file after the transfer. A mismatch is reported as a
+	// *ChecksumError. Uploads are checked before the file is moved
+	// into place, so a mismatch leaves the destination untouched.
+	Verify bool
+
+	// Mode is the permission of the created file. If zero, the mode
+	// of the source is used for uploads and 0644 for downloads.
+	Mode os.FileMode
+
+	// Compression compresses the data in transit. It pays off for
+	// compressible data over slow links.
+	Compression Compression
+
+	// Resume continues an interrupted transfer: data goes to a
+	// partial file next to the destination, which is kept on
+	// failure and appended to by the next try. The checksums are
+	// always verified when resuming; a partial file that turns out
+	// not to match is removed.
+	Resume bool
+
+	// Progress, if non-nil, is updated as data is transferred.
+	Progress Progress
+}
+
+// ChecksumError reports a file that differs after a transfer.
+type ChecksumError struct {
+	Path   string // the remote path
+	Local  string // hex encoded sha256 checksums
+	Remote string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("sshctl: checksum mismatch for %s: local %s, remote %s", e.Path, e.Local, e.Remote)
+}
+
+// Upload copies r to remotePath on the remote host and sets its
+// permissions to mode. The data is written to a temporary file next
+// to remotePath, which is renamed into place once complete. The
+// session's Stdin is replaced by r.
+func (s *Session) Upload(r io.Reader, remotePath string, mode os.FileMode) error {
+	return s.upload(r, remotePath, mode, NoCompression, false, "")
+}
+
+// partialSuffix names the partial file of a resumable transfer.
+const partialSuffix = ".sshctl-partial"
+
+// checksumExit is the exit status of an upload whose checksum does
+// not match.
+const checksumExit = 97
+
+// upload is Upload for data compressed with c. If resume is set, r
+// is appended to the partial file of remotePath, which is kept if the
+// transfer fails. If sum is set, the sha256 checksum of the written
+// file is compared with it before the file is renamed into place; on
+// a mismatch, the file is removed, remotePath is left alone, and a
+// *ChecksumError is returned.
+func (s *Session) upload(r io.Reader, remotePath string, mode os.FileMode, c Compression, resume bool, sum string) error {
+	if s.Stdin != nil {
+		return errors.New("ssh: Stdin already set")
+	}
+	path := shellQuote(remotePath)
+	s.Stdin = r
+	var tmp, cmd string
+	if resume {
+		tmp = shellQuote(remotePath + partialSuffix)
+		cmd = fmt.Sprintf("%s >> %s", c.decompressCmd(), tmp)
+	} else {
+		tmp = shellQuote(remotePath+".sshctl-") + "$$"
+		cmd = fmt.Sprintf("%s > %s", c.decompressCmd(), tmp)
+	}
+	var out *singleWriter
+	if sum != "" {
+		if s.Stdout != nil {
+			return errors.New("ssh: Stdout already set")
+		}
+		out = &singleWriter{}
+		s.Stdout = out
+		// a mismatching partial file is no good for resuming either
+		cmd += fmt.Sprintf(` && { s=$({ sha256sum || shasum -a 256; } < %s 2>/dev/null); s=${s%%%% *}; `+
+			`[ "$s" = %s ] || { rm -f %s; echo "$s"; exit %d; }; }`, tmp, sum, tmp, checksumExit)
+	}
+	cmd += fmt.Sprintf(" && chmod %o %s && mv -f %s %s", mode.Perm(), tmp, tmp, path)
+	if !resume {
+		cmd += fmt.Sprintf(" || { rm -f %s; exit 1; }", tmp)
+	}
+	err := s.Run(cmd)
+	var ee *ExitError
+	if out != nil && errors.As(err, &ee) && ee.ExitStatus() == checksumExit {
+		return s.labelErr(&ChecksumError{Path: remotePath, Local: sum, Remote: strings.TrimSpace(string(out.bytes()))})
+	}
+	return err
+}
+
+// Download copies remotePath on the remote host to w. The session's
+// Stdout is replaced by w.
+func (s *Session) Download(w io.Writer, remotePath string) error {
+	return s.download(w, remotePath, NoCompression, 0)
+}
+
+// download is Download starting at offset, with the data compressed
+// by c in transit.
+func (s *Session) download(w io.Writer, remotePath string, c Compression, offset int64) error {
+	if s.Stdout != nil {
+		return errors.New("ssh: Stdout already set")
+	}
+	s.Stdout = w
+	// a failing redirection makes the shell exit
+	cmd := "exec < " + shellQuote(remotePath) + " && "
+	if offset > 0 {
+		cmd += fmt.Sprintf("tail -c +%d | ", offset+1)
+	}
+	return s.Run(cmd + c.compressCmd())
+}
+
+// UploadFile copies the local file to remotePath. opts may be nil.
+func (c *Client) UploadFile(localPath, remotePath string, opts *TransferOptions) error {
+	return c.uploadFile(localPath, remotePath, opts, "")
+}
+
+// uploadFile is UploadFile with sessions labeled label, see
+// WithLabel.
+func (c *Client) uploadFile(localPath, remotePath string, opts *TransferOptions, label string) error {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = fi.Mode()
+	}
+	// the checksum is checked remotely before the file is renamed
+	// into place, so it is taken up front
+	var sum string
+	if opts.Verify || opts.Resume {
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
+	var offset int64
+	if opts.Resume {
+		if offset, err = c.remoteSize(remotePath + partialSuffix); err != nil {
+			return err
+		}
+		if offset > fi.Size() {
+			// not a prefix of this file
+			offset = 0
+			if err := c.NewSession().WithLabel(label).Run("rm -f " + shellQuote(remotePath+partialSuffix)); err != nil {
+				return err
+			}
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	var r io.Reader = f
+	if opts.Progress != nil {
+		pc := newProgressCounter(opts.Progress, offset, fi.Size())
+		defer pc.finish()
+		r = pc.reader(r)
+	}
+	if opts.Compression != NoCompression {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(r io.Reader) {
+			pw.CloseWithError(opts.Compression.compress(pw, r))
+		}(r)
+		r = pr
+	}
+	return c.NewSession().WithLabel(label).upload(r, remotePath, mode, opts.Compression, opts.Resume, sum)
+}
+
+// DownloadFile copies remotePath to the local file, which is replaced
+// only once the transfer succeeded. opts may be nil.
+func (c *Client) DownloadFile(remotePath, localPath string, opts *TransferOptions) error {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	var f *os.File
+	var err error
+	var offset int64
+	h := sha256.New()
+	if opts.Resume {
+		if f, err = os.OpenFile(localPath+partialSuffix, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+			return err
+		}
+		// the checksum covers the whole file
+		if offset, err = io.Copy(h, f); err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		if f, err = os.CreateTemp(filepath.Dir(localPath), filepath.Base(localPath)+".sshctl-"); err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+	}
+	var w io.Writer = io.MultiWriter(f, h)
+	if opts.Progress != nil {
+		total, err := c.remoteSize(remotePath)
+		if err != nil {
+			total = -1
+		}
+		pc := newProgressCounter(opts.Progress, offset, total)
+		defer pc.finish()
+		w = pc.writer(w)
+	}
+	err = c.download(w, remotePath, opts.Compression, offset)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Verify || opts.Resume {
+		if err := c.verify(remotePath, hex.EncodeToString(h.Sum(nil))); err != nil {
+			if opts.Resume {
+				// the partial file is no good for resuming
+				os.Remove(f.Name())
+			}
+			return err
+		}
+	}
+	if err := os.Chmod(f.Name(), mode.Perm()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), localPath)
+}
+
+func (c *Client) download(w io.Writer, remotePath string, comp Compression, offset int64) error {
+	if comp == NoCompression {
+		return c.NewSession().download(w, remotePath, comp, offset)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := comp.decompress(w, pr)
+		// let the session finish on corrupt data
+		io.Copy(ioutil.Discard, pr)
+		done <- err
+	}()
+	err := c.NewSession().download(pw, remotePath, comp, offset)
+	pw.Close()
+	if err1 := <-done; err == nil {
+		err = err1
+	}
+	return err
+}
+
+// remoteSize returns the size of remotePath, or 0 if it does not exist.
+func (c *Client) remoteSize(remotePath string) (int64, error) {
+	out, err := c.NewSession().Output("wc -c 2>/dev/null < " + shellQuote(remotePath) + " || echo 0")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+func (c *Client) verify(remotePath, sum string) error {
+	remote, err := c.NewSession().remoteSHA256(remotePath)
+	if err != nil {
+		return err
+	}
+	if remote != sum {
+		return &ChecksumError{Path: remotePath, Local: sum, Remote: remote}
+	}
+	return nil
+}
+
+// remoteSHA256 returns the hex encoded sha256 checksum of remotePath,
+// using sha256sum or, e.g. on BSDs and macOS, shasum.
+func (s *Session) remoteSHA256(remotePath string) (string, error) {
+	path := shellQuote(remotePath)
+	out, err := s.Output(fmt.Sprintf("sha256sum -- %s 2>/dev/null || shasum -a 256 -- %s", path, path))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || len(fields[0]) != 64 {
+		return "", fmt.Errorf("sshctl: unexpected checksum output %q", out)
+	}
+	return fields[0], nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package sshctl
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransferFile(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := bytes.Repeat([]byte(TestString), 1000)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	remote := filepath.Join(dir, "remote")
+	opts := &TransferOptions{Verify: true}
+	if err := c.UploadFile(src, remote, opts); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := c.DownloadFile(remote, dst, opts); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("content differs after round trip, %v", err)
+	}
+	if fi, err := os.Stat(dst); err != nil || fi.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected mode %v, %v", fi.Mode(), err)
+	}
+
+	err = c.verify(remote, strings.Repeat("0", 64))
+	var ce *ChecksumError
+	if !errors.As(err, &ce) || ce.Path != remote {
+		t.Fatalf("expected ChecksumError, got %v", err)
+	}
+
+	if err := c.DownloadFile(filepath.Join(dir, "missing"), dst, nil); err == nil {
+		t.Fatalf("expected download of a missing file to fail")
+	}
+	if got, _ := os.ReadFile(dst); !bytes.Equal(got, data) {
+		t.Fatalf("failed download replaced the local file")
+	}
+}
+
+func TestTransferCompression(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := bytes.Repeat([]byte(TestString+"\n"), 10000)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, comp := range []Compression{Gzip, Zstd} {
+		if _, err := exec.LookPath(comp.String()); err != nil {
+			t.Logf("%s not found, skipping", comp)
+			continue
+		}
+		opts := &TransferOptions{Verify: true, Compression: comp}
+		remote := filepath.Join(dir, "remote")
+		if err := c.UploadFile(src, remote, opts); err != nil {
+			t.Fatalf("%s: %v", comp, err)
+		}
+		dst := filepath.Join(dir, "dst")
+		if err := c.DownloadFile(remote, dst, opts); err != nil {
+			t.Fatalf("%s: %v", comp, err)
+		}
+		if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: content differs after round trip, %v", comp, err)
+		}
+	}
+}
+
+func TestTransferResume(t *testing.T) {
+	g := newGoMaster(t)
+	defer g.Shutdown()
+	c := NewClient(g.ctrlSock)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := bytes.Repeat([]byte(TestString+"\n"), 10000)
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	half := data[:len(data)/2]
+
+	for _, comp := range []Compression{NoCompression, Gzip} {
+		opts := &TransferOptions{Resume: true, Compression: comp}
+		remote := filepath.Join(dir, "remote")
+		if err := os.WriteFile(remote+partialSuffix, half, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.UploadFile(src, remote, opts); err != nil {
+			t.Fatalf("%s: %v", comp, err)
+		}
+		if got, err := os.ReadFile(remote); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: content differs after resumed upload, %v", comp, err)
+		}
+
+		dst := filepath.Join(dir, "dst")
+		if err := os.WriteFile(dst+partialSuffix, half, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.DownloadFile(remote, dst, opts); err != nil {
+			t.Fatalf("%s: %v", comp, err)
+		}
+		if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: content differs after resumed download, %v", comp, err)
+		}
+		if _, err := os.Stat(dst + partialSuffix); !os.IsNotExist(err) {
+			t.Fatalf("%s: partial file left behind", comp)
+		}
+	}
+
+	// a partial file that is not a prefix is caught by the checksum
+	remote := filepath.Join(dir, "remote")
+	if err := os.WriteFile(remote+partialSuffix, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var ce *ChecksumError
+	if err := c.UploadFile(src, remote, &TransferOptions{Resume: true}); !errors.As(err, &ce) || len(ce.Remote) != 64 {
+		t.Fatalf("expected ChecksumError, got %v", err)
+	}
+	if got, err := os.ReadFile(remote); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("failed upload replaced the destination, %v", err)
+	}
+	if _, err := os.Stat(remote + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("mismatching partial file left behind")
+	}
+}
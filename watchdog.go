@@ -0,0 +1,78 @@
+// Copyright 2018 Marco Pfatschbacher. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sshctl
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ControlTimeoutError is returned by Wait if the session was closed
+// because the master did not respond for ControlTimeout.
+type ControlTimeoutError struct {
+	Idle time.Duration // time since the master was last heard from
+	Err  error         // why the last alive check failed
+}
+
+func (e *ControlTimeoutError) Error() string {
+	return fmt.Sprintf("ssh: master not responding for %v: %v", e.Idle.Round(time.Millisecond), e.Err)
+}
+
+func (e *ControlTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// heard records activity of the master.
+func (s *Session) heard() {
+	atomic.StoreInt64(&s.lastHeard, time.Now().UnixNano())
+}
+
+// watchControl runs alive checks on separate control connections
+// while the session is running and closes the session once the
+// master was not heard from for ControlTimeout.
+func (s *Session) watchControl() {
+	interval := s.ControlTimeout / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.State().final() {
+			return
+		}
+		err := s.aliveCheck(interval)
+		if err == nil {
+			s.heard()
+			continue
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastHeard)))
+		if idle >= s.ControlTimeout && !s.State().final() {
+			s.tracef("session %d: master not responding: %v", s.ctrlSessid, err)
+			s.shutdown(StateAborted, &ControlTimeoutError{Idle: idle, Err: err})
+			return
+		}
+	}
+}
+
+// aliveCheck checks the master on a new control connection, giving
+// up after timeout. The connection has a deadline rather than being
+// abandoned to a goroutine, so a hung master leaves nothing behind.
+func (s *Session) aliveCheck(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	c := &Session{sshctlpath: s.sshctlpath, dial: s.dial}
+	if err := c.dialCtrlConn(); err != nil {
+		return err
+	}
+	defer c.ctrlconn.Close()
+	c.ctrlconn.SetDeadline(deadline)
+	err := c.sshMuxHello(deadline)
+	if err == nil {
+		err = c.sshMuxAliveCheck()
+	}
+	if err != nil && !time.Now().Before(deadline) {
+		return errors.New("alive check timed out")
+	}
+	return err
+}